@@ -44,4 +44,24 @@ func BenchmarkLimiters(b *testing.B) {
 		})
 		benchmarkLimiter(b, sw)
 	})
+
+	b.Run("Hybrid", func(b *testing.B) {
+		h := limiter.NewHybridLimiter(memStore, limiter.HybridConfig{
+			Config: limiter.Config{
+				Rate:   rate,
+				Window: window,
+			},
+		})
+		defer h.Close()
+		benchmarkLimiter(b, h)
+	})
+
+	b.Run("Leasing", func(b *testing.B) {
+		l := limiter.NewLeasingLimiter(limiter.NewTokenBucketLimiter(memStore, limiter.Config{
+			Rate:   rate,
+			Window: window,
+		}), limiter.LeaseConfig{})
+		defer l.Close()
+		benchmarkLimiter(b, l)
+	})
 }
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 
+	"github.com/sumedhvats/rate-limiter-go/middleware"
 	"github.com/sumedhvats/rate-limiter-go/pkg/limiter"
 	"github.com/sumedhvats/rate-limiter-go/pkg/storage"
 )
@@ -18,38 +21,42 @@ const (
 	TierAdmin   UserTier = "admin"
 )
 
+// tierConfigs holds the limits of every tier that differs from the default.
+var tierConfigs = map[UserTier]limiter.Config{
+	TierPremium: {Rate: 1000},
+}
+
 func main() {
 	store := storage.NewRedisStorage("localhost:6379")
-	limiters := map[UserTier]limiter.Limiter{
-		TierFree: limiter.NewSlidingWindowLimiter(store, limiter.Config{
-			Rate:   100,
-			Window: 1 * time.Hour,
-		}),
-		TierPremium: limiter.NewSlidingWindowLimiter(store, limiter.Config{
-			Rate:   1000,
-			Window: 1 * time.Hour,
-		}),
-		TierAdmin: nil,
-	}
-	tierMiddleware := func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			tier := getUserTier(r)
-			if tier == TierAdmin {
-				next.ServeHTTP(w, r)
-				return
-			}
-			lim := limiters[tier]
-			userID := r.Header.Get("X-User-ID")
 
-			allowed, _ := lim.Allow(userID)
-			if !allowed {
-				http.Error(w, "Rate limit exceeded", 429)
-				return
-			}
+	// Custom contracts live in Redis and can be edited at runtime, e.g.
+	//   HSET ratelimit:overrides premium:acme '{"rate":50000}'
+	contracts := limiter.NewRedisOverrides(store, "")
+
+	// Keys look like "<tier>:<user>". A custom contract wins over the tier.
+	overrides := limiter.OverridesFunc(func(ctx context.Context, key string) (limiter.Config, bool, error) {
+		if cfg, ok, err := contracts.Override(ctx, key); ok || err != nil {
+			return cfg, ok, err
+		}
+		tier, _, _ := strings.Cut(key, ":")
+		cfg, ok := tierConfigs[UserTier(tier)]
+		return cfg, ok, nil
+	})
+
+	// One limiter serves every tier; free users get the default.
+	rateLimiter := limiter.NewSlidingWindowLimiter(store, limiter.Config{
+		Rate:      100,
+		Window:    1 * time.Hour,
+		Overrides: overrides,
+	})
+
+	limited := middleware.RateLimitMiddleware(middleware.Config{
+		Limiter: rateLimiter,
+		KeyFunc: func(r *http.Request) string {
+			return string(getUserTier(r)) + ":" + r.Header.Get("X-User-ID")
+		},
+	})
 
-			next.ServeHTTP(w, r)
-		})
-	}
 	mux := http.NewServeMux()
 	mux.HandleFunc("/api/data", func(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(map[string]string{
@@ -58,12 +65,25 @@ func main() {
 		})
 	})
 
-	handler := tierMiddleware(mux)
+	handler := tierMiddleware(limited(mux), mux)
 	log.Fatal(http.ListenAndServe(":8080", handler))
+}
 
+// tierMiddleware lets admins bypass rate limiting.
+func tierMiddleware(limited, unlimited http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if getUserTier(r) == TierAdmin {
+			unlimited.ServeHTTP(w, r)
+			return
+		}
+		limited.ServeHTTP(w, r)
+	})
 }
 
 // Replace this with JWT or session verification.
 func getUserTier(r *http.Request) UserTier {
-	return UserTier(r.Header.Get("X-User-Tier"))
+	if tier := UserTier(r.Header.Get("X-User-Tier")); tier != "" {
+		return tier
+	}
+	return TierFree
 }
@@ -0,0 +1,98 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sumedhvats/rate-limiter-go/pkg/limiter"
+)
+
+// ConcurrencyConfig holds the configuration for the concurrency limiting middleware.
+type ConcurrencyConfig struct {
+	// Limiter is the concurrency limiter instance to use.
+	Limiter *limiter.ConcurrencyLimiter
+	// KeyFunc extracts a unique client identifier from an HTTP request.
+	KeyFunc func(*http.Request) string
+	// OnLimit is an optional handler to call when a request is denied.
+	OnLimit func(http.ResponseWriter, *http.Request)
+}
+
+// ConcurrencyMiddleware returns a new HTTP middleware that limits how many
+// requests per key are served at once. The lease taken for a request is
+// renewed while the handler runs and released when it returns, even if it
+// panics.
+func ConcurrencyMiddleware(cfg ConcurrencyConfig) func(http.Handler) http.Handler {
+	if cfg.KeyFunc == nil {
+		cfg.KeyFunc = DefaultKeyFunc
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := cfg.KeyFunc(r)
+			if key == "" {
+				http.Error(w, "Unable to determine client IP", http.StatusBadRequest)
+				return
+			}
+			lease, err := cfg.Limiter.Acquire(r.Context(), key)
+			if err != nil {
+				http.Error(w, "Internal Server Error", 500)
+				return
+			}
+
+			w.Header().Set("X-ConcurrencyLimit-Limit", fmt.Sprint(lease.Limit()))
+			w.Header().Set("X-ConcurrencyLimit-InFlight", fmt.Sprint(lease.InFlight()))
+
+			if !lease.OK() {
+				if cfg.OnLimit != nil {
+					cfg.OnLimit(w, r)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusTooManyRequests)
+				json.NewEncoder(w).Encode(map[string]string{
+					"error": "Too many concurrent requests. Try again later.",
+				})
+				return
+			}
+
+			// Release even if the client went away while the handler ran.
+			ctx := context.WithoutCancel(r.Context())
+			stop := keepAlive(ctx, lease)
+			defer func() {
+				stop()
+				lease.Release(ctx)
+			}()
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// keepAlive renews lease whenever half of its TTL has passed, until the
+// returned stop function is called. The interval is measured in real time
+// rather than from Lease.ExpiresAt, which follows the limiter's Clock.
+func keepAlive(ctx context.Context, lease *limiter.Lease) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			timer := time.NewTimer(lease.TTL() / 2)
+			select {
+			case <-timer.C:
+				if err := lease.Renew(ctx); err != nil {
+					return
+				}
+			case <-done:
+				timer.Stop()
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
@@ -0,0 +1,101 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// CostRule assigns a cost to the requests matching Method and Path.
+type CostRule struct {
+	// Method is the HTTP method to match, e.g. "POST". An empty Method or
+	// "*" matches every method.
+	Method string `json:"method"`
+	// Path is a path.Match pattern matched against the request path, e.g.
+	// "/api/export/*". An empty Path matches every path.
+	Path string `json:"path"`
+	// Cost is how many requests a matching request counts as.
+	Cost int `json:"cost"`
+}
+
+// matches reports whether the rule applies to r.
+func (c CostRule) matches(r *http.Request) bool {
+	if c.Method != "" && c.Method != "*" && !strings.EqualFold(c.Method, r.Method) {
+		return false
+	}
+	if c.Path == "" {
+		return true
+	}
+	ok, _ := path.Match(c.Path, r.URL.Path)
+	return ok
+}
+
+// CostTable maps requests to costs declaratively. Its Cost method can be
+// used as Config.CostFunc:
+//
+//	table, err := middleware.LoadCostTable(file)
+//	...
+//	middleware.RateLimitMiddleware(middleware.Config{
+//		Limiter:  rateLimiter,
+//		CostFunc: table.Cost,
+//	})
+type CostTable struct {
+	// Rules are checked in order, and the first matching rule sets the cost.
+	Rules []CostRule `json:"rules"`
+	// Default is the cost of requests that no rule matches. It defaults to 1.
+	Default int `json:"default"`
+}
+
+// LoadCostTable reads a CostTable from JSON such as:
+//
+//	{
+//	  "default": 1,
+//	  "rules": [
+//	    {"method": "GET", "path": "/api/export/*", "cost": 50},
+//	    {"path": "/healthz", "cost": 0}
+//	  ]
+//	}
+//
+// It returns an error for malformed path patterns and negative costs.
+func LoadCostTable(r io.Reader) (*CostTable, error) {
+	var table CostTable
+	if err := json.NewDecoder(r).Decode(&table); err != nil {
+		return nil, fmt.Errorf("cost table: %w", err)
+	}
+	if err := table.Validate(); err != nil {
+		return nil, err
+	}
+	return &table, nil
+}
+
+// Validate reports malformed path patterns and negative costs.
+func (t *CostTable) Validate() error {
+	if t.Default < 0 {
+		return fmt.Errorf("cost table: negative default cost %d", t.Default)
+	}
+	for i, rule := range t.Rules {
+		if _, err := path.Match(rule.Path, ""); err != nil {
+			return fmt.Errorf("cost table: rule %d: path %q: %w", i, rule.Path, err)
+		}
+		if rule.Cost < 0 {
+			return fmt.Errorf("cost table: rule %d: negative cost %d", i, rule.Cost)
+		}
+	}
+	return nil
+}
+
+// Cost returns the cost of r: that of the first matching rule, or Default.
+func (t *CostTable) Cost(r *http.Request) int {
+	for _, rule := range t.Rules {
+		if rule.matches(r) {
+			return rule.Cost
+		}
+	}
+	if t.Default <= 0 {
+		return 1
+	}
+	return t.Default
+}
@@ -1,13 +1,18 @@
 package middleware_test
 
 import (
+	"bufio"
+	"context"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/sumedhvats/rate-limiter-go/middleware"
+	"github.com/sumedhvats/rate-limiter-go/pkg/clock"
 	"github.com/sumedhvats/rate-limiter-go/pkg/limiter"
 	"github.com/sumedhvats/rate-limiter-go/pkg/storage"
 )
@@ -43,6 +48,8 @@ func TestRateLimitMiddleware(t *testing.T) {
 	wrapped.ServeHTTP(rr, req)
 	assert.Equal(t, 429, rr.Code)
 	assert.Contains(t, rr.Body.String(), "Rate limit exceeded")
+	assert.Equal(t, "0", rr.Header().Get("X-RateLimit-Remaining"))
+	assert.NotEmpty(t, rr.Header().Get("Retry-After"))
 }
 
 func TestCustomKeyFunc(t *testing.T) {
@@ -84,3 +91,343 @@ func TestCustomKeyFunc(t *testing.T) {
 	}
 
 }
+
+func TestConcurrencyMiddleware(t *testing.T) {
+	cl := limiter.NewConcurrencyLimiter(storage.NewMemoryStorage(), limiter.ConcurrencyConfig{Limit: 1})
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/panic" {
+			panic("boom")
+		}
+		close(started)
+		<-finish
+		w.WriteHeader(200)
+	})
+	wrapped := middleware.ConcurrencyMiddleware(middleware.ConcurrencyConfig{
+		Limiter: cl,
+	})(handler)
+
+	newRequest := func(path string) *http.Request {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = "192.168.1.1:12345"
+		return req
+	}
+
+	// A handler that panics still releases its slot.
+	assert.Panics(t, func() {
+		wrapped.ServeHTTP(httptest.NewRecorder(), newRequest("/panic"))
+	})
+
+	first := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		wrapped.ServeHTTP(first, newRequest("/report"))
+	}()
+	<-started
+
+	rr := httptest.NewRecorder()
+	wrapped.ServeHTTP(rr, newRequest("/report"))
+	assert.Equal(t, 429, rr.Code)
+	assert.Equal(t, "1", rr.Header().Get("X-ConcurrencyLimit-Limit"))
+	assert.Contains(t, rr.Body.String(), "Too many concurrent requests")
+
+	close(finish)
+	<-done
+	assert.Equal(t, 200, first.Code)
+
+	inFlight, err := cl.InFlight(context.Background(), "192.168.1.1")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, inFlight)
+}
+
+func TestConcurrencyMiddlewareRenewsLease(t *testing.T) {
+	cl := limiter.NewConcurrencyLimiter(storage.NewMemoryStorage(), limiter.ConcurrencyConfig{
+		Limit:    1,
+		LeaseTTL: 50 * time.Millisecond,
+	})
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	wrapped := middleware.ConcurrencyMiddleware(middleware.ConcurrencyConfig{
+		Limiter: cl,
+		KeyFunc: func(*http.Request) string { return "tenant1" },
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-finish
+	}))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		wrapped.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/report", nil))
+	}()
+	<-started
+
+	// The handler outlives several lease TTLs but keeps its slot.
+	time.Sleep(200 * time.Millisecond)
+	inFlight, err := cl.InFlight(context.Background(), "tenant1")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, inFlight)
+
+	close(finish)
+	<-done
+	inFlight, err = cl.InFlight(context.Background(), "tenant1")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, inFlight)
+}
+
+// skewedClock runs offset ahead of real time, like the clock of a pod that
+// has drifted.
+type skewedClock struct {
+	offset time.Duration
+}
+
+func (c skewedClock) Now() time.Time                         { return time.Now().Add(c.offset) }
+func (c skewedClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+func TestConcurrencyMiddlewareRenewsLeaseOnSkewedClock(t *testing.T) {
+	cl := limiter.NewConcurrencyLimiter(storage.NewMemoryStorage(), limiter.ConcurrencyConfig{
+		Limit:    1,
+		LeaseTTL: 50 * time.Millisecond,
+		Clock:    skewedClock{offset: time.Hour},
+	})
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	wrapped := middleware.ConcurrencyMiddleware(middleware.ConcurrencyConfig{
+		Limiter: cl,
+		KeyFunc: func(*http.Request) string { return "tenant1" },
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-finish
+	}))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		wrapped.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/report", nil))
+	}()
+	<-started
+
+	// Renewals follow the lease TTL, not how far ExpiresAt is from the
+	// wall clock.
+	time.Sleep(200 * time.Millisecond)
+	inFlight, err := cl.InFlight(context.Background(), "tenant1")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, inFlight)
+
+	close(finish)
+	<-done
+}
+
+func TestRateLimitMiddlewareFeedback(t *testing.T) {
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	adaptive := limiter.NewAdaptiveLimiter(storage.NewMemoryStorageWithClock(clk), limiter.AdaptiveConfig{
+		Config:       limiter.Config{Rate: 100, Window: time.Second, Clock: clk},
+		MaxErrorRate: 0.5,
+	})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/fail":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "/panic":
+			panic("boom")
+		default:
+			w.Write([]byte("ok"))
+		}
+	})
+	wrapped := middleware.RateLimitMiddleware(middleware.Config{
+		Limiter: adaptive,
+	})(handler)
+	serve := func(path string) {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = "192.168.1.1:12345"
+		wrapped.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	serve("/ok")
+	serve("/fail")
+	assert.Panics(t, func() { serve("/panic") })
+	clk.Advance(time.Second)
+	serve("/ok")
+	assert.Equal(t, 50, adaptive.Rate(), "2 of 3 requests failed")
+
+	serve("/ok")
+	clk.Advance(time.Second)
+	serve("/ok")
+	assert.Equal(t, 55, adaptive.Rate())
+}
+
+func TestRateLimitMiddlewareRefundOnFailure(t *testing.T) {
+	rl := limiter.NewFixedWindowLimiter(storage.NewMemoryStorage(), limiter.Config{Rate: 10, Window: time.Minute})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/fail":
+			w.WriteHeader(http.StatusBadGateway)
+		case "/panic":
+			panic("boom")
+		default:
+			w.Write([]byte("ok"))
+		}
+	})
+	wrapped := middleware.RateLimitMiddleware(middleware.Config{
+		Limiter:         rl,
+		CostFunc:        func(r *http.Request) int { return 2 },
+		RefundOnFailure: true,
+	})(handler)
+	serve := func(path string) {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = "192.168.1.1:12345"
+		wrapped.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	serve("/fail")
+	assert.Panics(t, func() { serve("/panic") })
+	stats, err := rl.GetStats("192.168.1.1")
+	assert.NoError(t, err)
+	assert.Equal(t, 10, stats.Remaining, "failed requests are refunded")
+
+	serve("/ok")
+	stats, err = rl.GetStats("192.168.1.1")
+	assert.NoError(t, err)
+	assert.Equal(t, 8, stats.Remaining)
+}
+
+func TestRateLimitMiddlewareStreams(t *testing.T) {
+	rl := limiter.NewFixedWindowLimiter(storage.NewMemoryStorage(), limiter.Config{Rate: 10, Window: time.Minute})
+	read := make(chan struct{})
+	wrapped := middleware.RateLimitMiddleware(middleware.Config{
+		Limiter:         rl,
+		RefundOnFailure: true,
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/events":
+			flusher, ok := w.(http.Flusher)
+			if !assert.True(t, ok, "the middleware hides http.Flusher") {
+				return
+			}
+			io.WriteString(w, "first\n")
+			flusher.Flush()
+			// The client sees the first event before the second is written.
+			<-read
+			io.WriteString(w, "second\n")
+		case "/upgrade":
+			conn, buf, err := http.NewResponseController(w).Hijack()
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer conn.Close()
+			buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\n")
+			buf.Flush()
+		}
+	}))
+	server := httptest.NewServer(wrapped)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/events")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	body := bufio.NewReader(resp.Body)
+	line, err := body.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "first\n", line)
+	close(read)
+	line, err = body.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "second\n", line)
+
+	req, _ := http.NewRequest("GET", server.URL+"/upgrade", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "test")
+	upgraded, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	upgraded.Body.Close()
+	assert.Equal(t, http.StatusSwitchingProtocols, upgraded.StatusCode)
+}
+
+func TestRateLimitMiddlewarePriority(t *testing.T) {
+	rl := limiter.NewPriorityLimiter(storage.NewMemoryStorage(), limiter.PriorityConfig{
+		Config: limiter.Config{Rate: 10, Window: time.Minute},
+	})
+	wrapped := middleware.RateLimitMiddleware(middleware.Config{
+		Limiter: rl,
+		PriorityFunc: func(r *http.Request) limiter.Priority {
+			if r.URL.Path == "/healthz" {
+				return limiter.PriorityCritical
+			}
+			return limiter.PriorityNormal
+		},
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	serve := func(path string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = "192.168.1.1:12345"
+		rr := httptest.NewRecorder()
+		wrapped.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	for i := 0; i < 8; i++ {
+		assert.Equal(t, http.StatusOK, serve("/"))
+	}
+	assert.Equal(t, http.StatusTooManyRequests, serve("/"), "normal requests leave the headroom alone")
+	assert.Equal(t, http.StatusOK, serve("/healthz"), "critical requests use the headroom")
+}
+
+func TestRateLimitMiddlewareCost(t *testing.T) {
+	table, err := middleware.LoadCostTable(strings.NewReader(`{
+		"rules": [
+			{"method": "GET", "path": "/api/export/*", "cost": 50},
+			{"path": "/healthz", "cost": 0}
+		]
+	}`))
+	assert.NoError(t, err)
+
+	store := storage.NewMemoryStorage()
+	rl := limiter.NewFixedWindowLimiter(store, limiter.Config{Rate: 100, Window: time.Minute})
+	wrapped := middleware.RateLimitMiddleware(middleware.Config{
+		Limiter:  rl,
+		CostFunc: table.Cost,
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.RemoteAddr = "192.168.1.1:12345"
+		rr := httptest.NewRecorder()
+		wrapped.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := serve("GET", "/api/export/123")
+	assert.Equal(t, 200, rr.Code)
+	assert.Equal(t, "50", rr.Header().Get("X-RateLimit-Remaining"))
+
+	// Other methods on the same path cost the default of 1.
+	rr = serve("POST", "/api/export/123")
+	assert.Equal(t, 200, rr.Code)
+	assert.Equal(t, "49", rr.Header().Get("X-RateLimit-Remaining"))
+
+	// Free requests are not counted and not limited.
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, 200, serve("GET", "/healthz").Code)
+	}
+
+	rr = serve("GET", "/api/export/456")
+	assert.Equal(t, 429, rr.Code)
+	assert.Equal(t, 200, serve("GET", "/api/items").Code)
+}
+
+func TestLoadCostTableErrors(t *testing.T) {
+	_, err := middleware.LoadCostTable(strings.NewReader(`{"rules": [{"path": "/api/[", "cost": 1}]}`))
+	assert.Error(t, err)
+	_, err = middleware.LoadCostTable(strings.NewReader(`{"rules": [{"path": "/api", "cost": -1}]}`))
+	assert.Error(t, err)
+	_, err = middleware.LoadCostTable(strings.NewReader(`{"rules": `))
+	assert.Error(t, err)
+}
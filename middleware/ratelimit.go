@@ -2,26 +2,48 @@
 package middleware
 
 import (
+	"bufio"
+	"context"
 	"encoding/json"
 	"strings"
 
 	"fmt"
+	"math"
 	"net"
 	"net/http"
+	"time"
 
 	"github.com/sumedhvats/rate-limiter-go/pkg/limiter"
 )
 
 // Config holds the configuration for the rate limiting middleware.
 type Config struct {
-    // Limiter is the rate limiter instance to use.
-    Limiter limiter.Limiter
-    // KeyFunc extracts a unique client identifier from an HTTP request.
-    KeyFunc func(*http.Request) string
-    // OnLimit is an optional handler to call when a request is denied.
-    OnLimit func(http.ResponseWriter, *http.Request)
+	// Limiter is the rate limiter instance to use.
+	Limiter limiter.Limiter
+	// KeyFunc extracts a unique client identifier from an HTTP request.
+	KeyFunc func(*http.Request) string
+	// OnLimit is an optional handler to call when a request is denied.
+	OnLimit func(http.ResponseWriter, *http.Request)
+	// CostFunc returns how many requests r counts as, e.g. 50 for an
+	// expensive export. It defaults to a cost of 1 for every request; see
+	// CostTable for a declarative alternative. Requests that cost 0 or less
+	// are let through without touching the limiter.
+	CostFunc func(r *http.Request) int
+	// RefundOnFailure gives the cost of an admitted request back to the
+	// limiter when the handler responds with a 5xx status or panics, so
+	// that clients are not charged for requests that were not served.
+	RefundOnFailure bool
+	// PriorityFunc optionally returns the priority of r, such as
+	// limiter.PriorityCritical for health checks. The limiter sees it
+	// through limiter.PriorityFromContext; see limiter.PriorityLimiter.
+	PriorityFunc func(r *http.Request) limiter.Priority
 }
+
 // RateLimitMiddleware returns a new HTTP middleware that applies rate limiting.
+// If the limiter is a limiter.FeedbackReceiver, such as an AdaptiveLimiter,
+// the latency of every admitted request and whether it failed with a 5xx
+// status or a panic are reported to it. With RefundOnFailure, failed
+// requests are also refunded.
 func RateLimitMiddleware(cfg Config) func(http.Handler) http.Handler {
 	if cfg.KeyFunc == nil {
 		cfg.KeyFunc = DefaultKeyFunc
@@ -33,13 +55,30 @@ func RateLimitMiddleware(cfg Config) func(http.Handler) http.Handler {
 				http.Error(w, "Unable to determine client IP", http.StatusBadRequest)
 				return
 			}
-			allowed, err := cfg.Limiter.Allow(key)
+			cost := 1
+			if cfg.CostFunc != nil {
+				cost = cfg.CostFunc(r)
+			}
+			if cost <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ctx := r.Context()
+			if cfg.PriorityFunc != nil {
+				ctx = limiter.WithPriority(ctx, cfg.PriorityFunc(r))
+			}
+			decision, err := cfg.Limiter.DecideCtx(ctx, key, cost)
 			if err != nil {
 				http.Error(w, "Internal Server Error", 500)
 				return
 			}
 
-			if !allowed {
+			w.Header().Set("X-RateLimit-Limit", fmt.Sprint(decision.Limit))
+			w.Header().Set("X-RateLimit-Remaining", fmt.Sprint(decision.Remaining))
+			w.Header().Set("X-RateLimit-Reset", fmt.Sprint(decision.ResetAt.Unix()))
+
+			if !decision.Allowed {
+				w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(decision.RetryAfter.Seconds()))))
 				if cfg.OnLimit != nil {
 					cfg.OnLimit(w, r)
 					return
@@ -52,16 +91,80 @@ func RateLimitMiddleware(cfg Config) func(http.Handler) http.Handler {
 				return
 			}
 
-			stats, _ := cfg.Limiter.GetStats(key)
-			if stats != nil {
-				w.Header().Set("X-RateLimit-Limit", fmt.Sprint(stats.Limit))
-				w.Header().Set("X-RateLimit-Remaining", fmt.Sprint(stats.Remaining))
-				w.Header().Set("X-RateLimit-Reset", fmt.Sprint(stats.ResetAt.Unix()))
+			receiver, observe := cfg.Limiter.(limiter.FeedbackReceiver)
+			if !observe && !cfg.RefundOnFailure {
+				next.ServeHTTP(w, r)
+				return
 			}
-			next.ServeHTTP(w, r)
+
+			// Report how the request went so that the limiter can adapt,
+			// and refund it if it failed.
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			start := time.Now()
+			// panicked stays true if the handler panics, which the deferred
+			// function lets carry on up the stack.
+			panicked := true
+			defer func() {
+				failed := panicked || rec.status >= 500
+				if observe {
+					receiver.Observe(limiter.Outcome{
+						Key:     key,
+						Latency: time.Since(start),
+						Failed:  failed,
+					})
+				}
+				if failed && cfg.RefundOnFailure {
+					// The response is already on its way; a failed refund
+					// only means the client keeps paying for this request.
+					cfg.Limiter.RefundCtx(context.WithoutCancel(ctx), key, cost)
+				}
+			}()
+			next.ServeHTTP(rec, r)
+			panicked = false
 		})
 	}
 }
+
+// statusRecorder records the status code written through it. It passes
+// Flush and Hijack through, so that streaming responses and WebSocket
+// upgrades work behind the middleware.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if !s.wroteHeader {
+		s.status = status
+		s.wroteHeader = true
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	s.wroteHeader = true
+	return s.ResponseWriter.Write(b)
+}
+
+// Flush sends any buffered data to the client, if the wrapped
+// ResponseWriter supports it.
+func (s *statusRecorder) Flush() {
+	s.wroteHeader = true
+	http.NewResponseController(s.ResponseWriter).Flush()
+}
+
+// Hijack lets the handler take over the connection, if the wrapped
+// ResponseWriter supports it.
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(s.ResponseWriter).Hijack()
+}
+
+// Unwrap returns the wrapped ResponseWriter, for http.ResponseController.
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
 // DefaultKeyFunc is the default function to extract a client's IP address from a request.
 // It prioritizes "X-Forwarded-For" before falling back to "RemoteAddr".
 func DefaultKeyFunc(r *http.Request) string {
@@ -0,0 +1,115 @@
+// Package clock provides the time source used by limiters and storages,
+// so that tests can control time instead of sleeping.
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock tells the current time and waits for durations to pass.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// After waits for d to pass and then sends the current time on the
+	// returned channel.
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// Real is the Clock backed by the time package.
+var Real Clock = realClock{}
+
+// OrReal returns c, or Real if c is nil.
+func OrReal(c Clock) Clock {
+	if c == nil {
+		return Real
+	}
+	return c
+}
+
+type waiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+// Manual is a Clock that only moves when told to. It is safe for
+// concurrent use.
+type Manual struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []waiter
+}
+
+// NewManual creates a Manual clock set to start.
+func NewManual(start time.Time) *Manual {
+	return &Manual{now: start}
+}
+
+// Now returns the clock's current time.
+func (m *Manual) Now() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.now
+}
+
+// After returns a channel that receives the clock's time once it has been
+// advanced by at least d.
+func (m *Manual) After(d time.Duration) <-chan time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ch := make(chan time.Time, 1)
+	at := m.now.Add(d)
+	if d <= 0 {
+		ch <- m.now
+		return ch
+	}
+	m.waiters = append(m.waiters, waiter{at: at, ch: ch})
+	return ch
+}
+
+// Advance moves the clock forward by d, firing any After channels that
+// fall due.
+func (m *Manual) Advance(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.set(m.now.Add(d))
+}
+
+// Set moves the clock to t, firing any After channels that fall due.
+// Setting the clock backwards is allowed.
+func (m *Manual) Set(t time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.set(t)
+}
+
+// Waiters returns the number of After channels that have not fired yet.
+// Tests use it to know that a goroutine is blocked on the clock.
+func (m *Manual) Waiters() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.waiters)
+}
+
+func (m *Manual) set(t time.Time) {
+	m.now = t
+	sort.Slice(m.waiters, func(i, j int) bool {
+		return m.waiters[i].at.Before(m.waiters[j].at)
+	})
+	fired := 0
+	for _, w := range m.waiters {
+		if w.at.After(t) {
+			break
+		}
+		w.ch <- t
+		fired++
+	}
+	m.waiters = m.waiters[fired:]
+}
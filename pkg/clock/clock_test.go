@@ -0,0 +1,50 @@
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManualNowAndAdvance(t *testing.T) {
+	start := time.Unix(1_700_000_000, 0)
+	c := NewManual(start)
+	assert.Equal(t, start, c.Now())
+
+	c.Advance(time.Second)
+	assert.Equal(t, start.Add(time.Second), c.Now())
+
+	c.Set(start)
+	assert.Equal(t, start, c.Now())
+}
+
+func TestManualAfter(t *testing.T) {
+	c := NewManual(time.Unix(1_700_000_000, 0))
+
+	late := c.After(2 * time.Second)
+	early := c.After(time.Second)
+	assert.Equal(t, 2, c.Waiters())
+
+	c.Advance(999 * time.Millisecond)
+	assert.Len(t, early, 0)
+
+	c.Advance(time.Millisecond)
+	assert.Len(t, early, 1)
+	assert.Len(t, late, 0)
+	assert.Equal(t, 1, c.Waiters())
+
+	c.Advance(time.Hour)
+	assert.Equal(t, c.Now(), <-late)
+	assert.Equal(t, 0, c.Waiters())
+
+	// Non-positive durations fire immediately.
+	assert.Len(t, c.After(0), 1)
+}
+
+func TestOrReal(t *testing.T) {
+	assert.Equal(t, Real, OrReal(nil))
+
+	m := NewManual(time.Time{})
+	assert.Equal(t, Clock(m), OrReal(m))
+}
@@ -0,0 +1,238 @@
+// Package limiter provides rate limiting algorithm implementations.
+package limiter
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Outcome describes how a request admitted by a limiter went.
+type Outcome struct {
+	// Key is the key the request was admitted under.
+	Key string
+	// Latency is how long the request took to serve.
+	Latency time.Duration
+	// Failed reports whether the request failed because the service is
+	// struggling, e.g. with a 5xx response or a timeout.
+	Failed bool
+}
+
+// FeedbackReceiver is implemented by limiters that adapt to the outcome of
+// the requests they admit, such as AdaptiveLimiter. The HTTP middleware
+// reports every outcome to limiters that implement it.
+type FeedbackReceiver interface {
+	// Observe records the outcome of a request admitted by the limiter.
+	Observe(outcome Outcome)
+}
+
+// AdaptiveConfig holds the configuration for an AdaptiveLimiter.
+type AdaptiveConfig struct {
+	// Config is the configuration of the underlying token bucket. Its Rate
+	// is the rate the limiter starts at.
+	Config
+	// MinRate is the lowest rate the limiter backs off to. It defaults to 1.
+	MinRate int
+	// MaxRate is the highest rate the limiter recovers to. It defaults to
+	// Config.Rate.
+	MaxRate int
+	// TargetLatency is the mean latency above which the service counts as
+	// overloaded. Zero ignores latency.
+	TargetLatency time.Duration
+	// MaxErrorRate is the fraction of failed requests above which the
+	// service counts as overloaded. Zero backs off on any failure.
+	MaxErrorRate float64
+	// Interval is how often the rate is adjusted. It defaults to Window.
+	Interval time.Duration
+	// Increase is how much the rate grows after a healthy interval. It
+	// defaults to a twentieth of MaxRate, and at least 1.
+	Increase int
+	// Decrease is the factor the rate is multiplied by after an overloaded
+	// interval. It defaults to 0.5.
+	Decrease float64
+}
+
+// withDefaults returns the config with every unset field defaulted.
+func (c AdaptiveConfig) withDefaults() AdaptiveConfig {
+	if c.MaxRate <= 0 {
+		c.MaxRate = c.Rate
+	}
+	if c.MinRate <= 0 {
+		c.MinRate = 1
+	}
+	c.MinRate = min(c.MinRate, c.MaxRate)
+	if c.Interval <= 0 {
+		c.Interval = c.Window
+	}
+	if c.Increase <= 0 {
+		c.Increase = max(c.MaxRate/20, 1)
+	}
+	if c.Decrease <= 0 || c.Decrease >= 1 {
+		c.Decrease = 0.5
+	}
+	return c
+}
+
+// AdaptiveLimiter is a token bucket limiter whose rate follows the health of
+// the service it protects, using additive increase, multiplicative decrease
+// (AIMD). Report the outcome of every admitted request with Observe. After
+// each Interval the rate is cut by Decrease if requests were too slow or
+// failed too often, and otherwise grows by Increase, staying between MinRate
+// and MaxRate.
+//
+// The rate applies to every key and is adjusted from the outcomes this
+// instance observes. With Redis storage, instances share the buckets but
+// each one adapts its own rate.
+type AdaptiveLimiter struct {
+	config AdaptiveConfig
+	bucket *TokenBucketLimiter
+
+	mu          sync.Mutex
+	intervalEnd time.Time
+	requests    int
+	failures    int
+	latency     time.Duration
+}
+
+// NewAdaptiveLimiter creates a new AdaptiveLimiter.
+func NewAdaptiveLimiter(store Storage, cfg AdaptiveConfig) *AdaptiveLimiter {
+	cfg = cfg.withDefaults()
+	bucketCfg := cfg.Config
+	bucketCfg.Rate = min(max(cfg.Rate, cfg.MinRate), cfg.MaxRate)
+	return &AdaptiveLimiter{
+		config:      cfg,
+		bucket:      NewTokenBucketLimiter(store, bucketCfg),
+		intervalEnd: cfg.now().Add(cfg.Interval),
+	}
+}
+
+// Rate returns the current rate, in requests per Window.
+func (a *AdaptiveLimiter) Rate() int {
+	return a.bucket.Config().Rate
+}
+
+// setRate changes the rate of the token bucket. Buckets already in storage
+// are refilled at the new rate from their next check on.
+func (a *AdaptiveLimiter) setRate(rate int) {
+	cfg := a.bucket.Config()
+	cfg.Rate = rate
+	a.bucket.SetConfig(cfg)
+}
+
+// Observe records the outcome of a request admitted by the limiter and
+// adjusts the rate once the current interval is over.
+func (a *AdaptiveLimiter) Observe(outcome Outcome) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := a.config.now()
+	if !now.Before(a.intervalEnd) {
+		a.adjust()
+		a.intervalEnd = now.Add(a.config.Interval)
+	}
+
+	a.requests++
+	a.latency += outcome.Latency
+	if outcome.Failed {
+		a.failures++
+	}
+}
+
+// adjust sets the rate from the outcomes of the interval that just ended and
+// starts a new one. a.mu must be held.
+func (a *AdaptiveLimiter) adjust() {
+	if a.requests == 0 {
+		return
+	}
+
+	errorRate := float64(a.failures) / float64(a.requests)
+	meanLatency := a.latency / time.Duration(a.requests)
+	overloaded := errorRate > a.config.MaxErrorRate ||
+		(a.config.TargetLatency > 0 && meanLatency > a.config.TargetLatency)
+
+	rate := a.Rate()
+	if overloaded {
+		rate = max(int(float64(rate)*a.config.Decrease), a.config.MinRate)
+	} else {
+		rate = min(rate+a.config.Increase, a.config.MaxRate)
+	}
+	if rate != a.Rate() {
+		a.setRate(rate)
+	}
+
+	a.requests = 0
+	a.failures = 0
+	a.latency = 0
+}
+
+// Allow checks if a single request is allowed for the given key.
+func (a *AdaptiveLimiter) Allow(key string) (bool, error) {
+	return a.bucket.Allow(key)
+}
+
+// AllowCtx is like Allow but honours ctx.
+func (a *AdaptiveLimiter) AllowCtx(ctx context.Context, key string) (bool, error) {
+	return a.bucket.AllowCtx(ctx, key)
+}
+
+// AllowN checks if n requests are allowed for the given key.
+func (a *AdaptiveLimiter) AllowN(key string, n int) (bool, error) {
+	return a.bucket.AllowN(key, n)
+}
+
+// AllowNCtx is like AllowN but honours ctx.
+func (a *AdaptiveLimiter) AllowNCtx(ctx context.Context, key string, n int) (bool, error) {
+	return a.bucket.AllowNCtx(ctx, key, n)
+}
+
+// Decide checks if n requests are allowed for the given key at the current rate.
+func (a *AdaptiveLimiter) Decide(key string, n int) (*Decision, error) {
+	return a.bucket.Decide(key, n)
+}
+
+// DecideCtx is like Decide but honours ctx.
+func (a *AdaptiveLimiter) DecideCtx(ctx context.Context, key string, n int) (*Decision, error) {
+	return a.bucket.DecideCtx(ctx, key, n)
+}
+
+// decideUndo is like DecideCtx but also returns a function that gives the
+// consumed tokens back. See undoer.
+func (a *AdaptiveLimiter) decideUndo(ctx context.Context, key string, n int) (*Decision, func(context.Context) error, error) {
+	return a.bucket.decideUndo(ctx, key, n)
+}
+
+// scriptStep describes the check of key as a step of the composite Redis
+// script. See scriptable.
+func (a *AdaptiveLimiter) scriptStep(ctx context.Context, key string, n int) (*scriptStep, bool, error) {
+	return a.bucket.scriptStep(ctx, key, n)
+}
+
+// Reset clears the rate limit data for the given key. It does not reset the rate.
+func (a *AdaptiveLimiter) Reset(key string) error {
+	return a.bucket.Reset(key)
+}
+
+// ResetCtx is like Reset but honours ctx.
+func (a *AdaptiveLimiter) ResetCtx(ctx context.Context, key string) error {
+	return a.bucket.ResetCtx(ctx, key)
+}
+
+// Refund gives n tokens back to the bucket of the given key.
+func (a *AdaptiveLimiter) Refund(key string, n int) error {
+	return a.bucket.Refund(key, n)
+}
+
+// RefundCtx is like Refund but honours ctx.
+func (a *AdaptiveLimiter) RefundCtx(ctx context.Context, key string, n int) error {
+	return a.bucket.RefundCtx(ctx, key, n)
+}
+
+// GetStats returns the current rate limit statistics for the given key.
+func (a *AdaptiveLimiter) GetStats(key string) (*Stats, error) {
+	return a.bucket.GetStats(key)
+}
+
+// GetStatsCtx is like GetStats but honours ctx.
+func (a *AdaptiveLimiter) GetStatsCtx(ctx context.Context, key string) (*Stats, error) {
+	return a.bucket.GetStatsCtx(ctx, key)
+}
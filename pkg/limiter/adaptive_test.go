@@ -0,0 +1,99 @@
+package limiter_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sumedhvats/rate-limiter-go/pkg/clock"
+	"github.com/sumedhvats/rate-limiter-go/pkg/limiter"
+	"github.com/sumedhvats/rate-limiter-go/pkg/storage"
+)
+
+func newTestAdaptive(clk *clock.Manual) *limiter.AdaptiveLimiter {
+	return limiter.NewAdaptiveLimiter(storage.NewMemoryStorageWithClock(clk), limiter.AdaptiveConfig{
+		Config:        limiter.Config{Rate: 100, Window: time.Second, Clock: clk},
+		MinRate:       10,
+		TargetLatency: 100 * time.Millisecond,
+		MaxErrorRate:  0.1,
+		Increase:      5,
+	})
+}
+
+// observeInterval reports outcomes and then moves past the interval so that
+// the next observation adjusts the rate.
+func observeInterval(clk *clock.Manual, a *limiter.AdaptiveLimiter, outcomes ...limiter.Outcome) {
+	for _, o := range outcomes {
+		a.Observe(o)
+	}
+	clk.Advance(time.Second)
+	a.Observe(limiter.Outcome{Latency: time.Millisecond})
+}
+
+func TestAdaptiveAIMD(t *testing.T) {
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	a := newTestAdaptive(clk)
+	assert.Equal(t, 100, a.Rate())
+
+	healthy := limiter.Outcome{Latency: 20 * time.Millisecond}
+	failed := limiter.Outcome{Latency: 20 * time.Millisecond, Failed: true}
+	slow := limiter.Outcome{Latency: 300 * time.Millisecond}
+
+	// Errors above MaxErrorRate halve the rate.
+	observeInterval(clk, a, healthy, healthy, failed)
+	assert.Equal(t, 50, a.Rate())
+
+	// So does a mean latency above TargetLatency.
+	observeInterval(clk, a, healthy, slow)
+	assert.Equal(t, 25, a.Rate())
+
+	// Observations within an interval do not change the rate.
+	a.Observe(failed)
+	assert.Equal(t, 25, a.Rate())
+	observeInterval(clk, a, failed, failed)
+	assert.Equal(t, 12, a.Rate())
+	observeInterval(clk, a, failed)
+	assert.Equal(t, 10, a.Rate(), "the rate never drops below MinRate")
+
+	// Healthy intervals add Increase, up to the configured Rate.
+	observeInterval(clk, a, healthy)
+	assert.Equal(t, 15, a.Rate())
+	for i := 0; i < 30; i++ {
+		observeInterval(clk, a, healthy)
+	}
+	assert.Equal(t, 100, a.Rate())
+
+	// Intervals without traffic leave the rate alone.
+	clk.Advance(time.Hour)
+	a.Observe(failed)
+	assert.Equal(t, 100, a.Rate())
+}
+
+func TestAdaptiveRateAppliesToExistingBuckets(t *testing.T) {
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	a := newTestAdaptive(clk)
+
+	ok, err := a.AllowN("user1", 100)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	observeInterval(clk, a, limiter.Outcome{Failed: true})
+	assert.Equal(t, 50, a.Rate())
+
+	// With Burst unset the capacity follows the rate, and the bucket emptied
+	// above refills at the new rate.
+	stats, err := a.GetStats("user1")
+	assert.NoError(t, err)
+	assert.Equal(t, 50, stats.Limit)
+	assert.Equal(t, 50, stats.Remaining)
+	ok, err = a.AllowN("user1", 50)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	clk.Advance(100 * time.Millisecond)
+	ok, err = a.AllowN("user1", 6)
+	assert.NoError(t, err)
+	assert.False(t, ok, "50/s refills 5 tokens in 100ms")
+	ok, err = a.AllowN("user1", 5)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
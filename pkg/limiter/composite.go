@@ -0,0 +1,323 @@
+// Package limiter provides rate limiting algorithm implementations.
+package limiter
+
+import (
+	"context"
+	"slices"
+
+	"github.com/sumedhvats/rate-limiter-go/pkg/clock"
+	"github.com/sumedhvats/rate-limiter-go/pkg/storage"
+)
+
+// undoer is implemented by limiters whose admitted requests can be taken
+// back. decideUndo is like DecideCtx, but when requests were admitted it also
+// returns a function that takes exactly those requests back; otherwise the
+// function is nil.
+type undoer interface {
+	decideUndo(ctx context.Context, key string, n int) (*Decision, func(context.Context) error, error)
+}
+
+// scriptStep is one limiter's share of a composite Redis script call.
+type scriptStep struct {
+	store    *storage.RedisMemory
+	step     storage.CompositeStep
+	decision func(storage.CompositeResult) *Decision
+	undo     func(context.Context) error
+}
+
+// scriptable is implemented by limiters whose check can run as a step of the
+// composite Redis script. scriptStep resolves the key's Config and reports
+// false if the limiter does not use a RedisMemory.
+type scriptable interface {
+	scriptStep(ctx context.Context, key string, n int) (*scriptStep, bool, error)
+}
+
+// Member is one of the limiters checked by a CompositeLimiter.
+type Member struct {
+	// Name identifies the member in Decision.DeniedBy. It defaults to the
+	// member's key.
+	Name string
+	// Limiter is the limiter to check.
+	Limiter Limiter
+	// Key maps the key passed to the CompositeLimiter to the key checked on
+	// Limiter, e.g. to "global" or to "tenant:"+tenant. A nil Key checks
+	// the key unchanged.
+	Key func(key string) string
+}
+
+// CompositeLimiter checks several limiters, each on its own key, and consumes
+// from all of them or from none. A typical use is a global, a per-tenant and
+// a per-user limit checked for every request.
+//
+// When every member is a TokenBucketLimiter, FixedWindowLimiter or
+// SlidingWindowLimiter on the same RedisMemory, all checks
+// run in a single Lua script. Otherwise the members are checked in turn and the ones that
+// already admitted the request are rolled back when a later one denies it.
+// Only the built-in limiters can be rolled back; other Limiter
+// implementations are checked after them and are not rolled back.
+type CompositeLimiter struct {
+	members []Member
+	clock   clock.Clock
+}
+
+// NewCompositeLimiter creates a new CompositeLimiter.
+func NewCompositeLimiter(members ...Member) *CompositeLimiter {
+	return NewCompositeLimiterWithClock(clock.Real, members...)
+}
+
+// NewCompositeLimiterWithClock is like NewCompositeLimiter but reads the time
+// from c for decisions no member took part in. Members keep their own clocks.
+func NewCompositeLimiterWithClock(c clock.Clock, members ...Member) *CompositeLimiter {
+	members = slices.Clone(members)
+	slices.SortStableFunc(members, func(a, b Member) int {
+		_, aUndo := a.Limiter.(undoer)
+		_, bUndo := b.Limiter.(undoer)
+		switch {
+		case aUndo && !bUndo:
+			return -1
+		case !aUndo && bUndo:
+			return 1
+		}
+		return 0
+	})
+	return &CompositeLimiter{members: members, clock: clock.OrReal(c)}
+}
+
+// Allow checks if a single request is allowed for the given key by every member.
+func (c *CompositeLimiter) Allow(key string) (bool, error) {
+	return c.AllowN(key, 1)
+}
+
+// AllowCtx is like Allow but honours ctx.
+func (c *CompositeLimiter) AllowCtx(ctx context.Context, key string) (bool, error) {
+	return c.AllowNCtx(ctx, key, 1)
+}
+
+// AllowN checks if n requests are allowed for the given key by every member.
+func (c *CompositeLimiter) AllowN(key string, n int) (bool, error) {
+	return c.AllowNCtx(context.Background(), key, n)
+}
+
+// AllowNCtx is like AllowN but honours ctx.
+func (c *CompositeLimiter) AllowNCtx(ctx context.Context, key string, n int) (bool, error) {
+	decision, err := c.DecideCtx(ctx, key, n)
+	if err != nil {
+		return false, err
+	}
+	return decision.Allowed, nil
+}
+
+// Decide checks if n requests are allowed for the given key by every member.
+// If they are, Limit and Remaining describe the member with the least room
+// left. If not, the decision is the one of the first member that denied the
+// request, and DeniedBy names that member.
+func (c *CompositeLimiter) Decide(key string, n int) (*Decision, error) {
+	return c.DecideCtx(context.Background(), key, n)
+}
+
+// DecideCtx is like Decide but honours ctx.
+func (c *CompositeLimiter) DecideCtx(ctx context.Context, key string, n int) (*Decision, error) {
+	d, _, err := c.decideUndo(ctx, key, n)
+	return d, err
+}
+
+// decideUndo is like DecideCtx but also returns a function that takes the
+// admitted requests back from every member. See undoer.
+func (c *CompositeLimiter) decideUndo(ctx context.Context, key string, n int) (*Decision, func(context.Context) error, error) {
+	steps, ok, err := c.scriptSteps(ctx, key, n)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ok {
+		return c.decideScript(ctx, key, steps, n)
+	}
+	return c.decideInTurn(ctx, key, n)
+}
+
+// scriptSteps returns the script steps of every member, or false if the
+// members cannot share a single script call.
+func (c *CompositeLimiter) scriptSteps(ctx context.Context, key string, n int) ([]*scriptStep, bool, error) {
+	if len(c.members) == 0 {
+		return nil, false, nil
+	}
+	for _, m := range c.members {
+		if _, ok := m.Limiter.(scriptable); !ok {
+			return nil, false, nil
+		}
+	}
+	steps := make([]*scriptStep, len(c.members))
+	for i, m := range c.members {
+		step, ok, err := m.Limiter.(scriptable).scriptStep(ctx, m.key(key), n)
+		if err != nil || !ok || (i > 0 && step.store != steps[0].store) {
+			return nil, false, err
+		}
+		steps[i] = step
+	}
+	return steps, true, nil
+}
+
+func (c *CompositeLimiter) decideScript(ctx context.Context, key string, steps []*scriptStep, n int) (*Decision, func(context.Context) error, error) {
+	storageSteps := make([]storage.CompositeStep, len(steps))
+	for i, step := range steps {
+		storageSteps[i] = step.step
+	}
+
+	denied, results, err := steps[0].store.CompositeAllow(ctx, n, storageSteps)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	decisions := make([]*Decision, len(steps))
+	for i, step := range steps {
+		decisions[i] = step.decision(results[i])
+	}
+	d := c.merge(key, decisions, denied)
+	if !d.Allowed || n == 0 {
+		return d, nil, nil
+	}
+
+	undos := make([]func(context.Context) error, len(steps))
+	for i, step := range steps {
+		undos[i] = step.undo
+	}
+	return d, func(ctx context.Context) error {
+		return undoAll(ctx, undos, nil)
+	}, nil
+}
+
+// decideInTurn checks the members one after another and rolls back the ones
+// that admitted the request if a later one denies it.
+func (c *CompositeLimiter) decideInTurn(ctx context.Context, key string, n int) (*Decision, func(context.Context) error, error) {
+	var undos []func(context.Context) error
+	decisions := make([]*Decision, 0, len(c.members))
+	denied := -1
+	for i, m := range c.members {
+		var d *Decision
+		var undo func(context.Context) error
+		var err error
+		if u, ok := m.Limiter.(undoer); ok {
+			d, undo, err = u.decideUndo(ctx, m.key(key), n)
+		} else {
+			d, err = m.Limiter.DecideCtx(ctx, m.key(key), n)
+		}
+		if err != nil {
+			return nil, nil, undoAll(ctx, undos, err)
+		}
+		if undo != nil {
+			undos = append(undos, undo)
+		}
+
+		decisions = append(decisions, d)
+		if !d.Allowed {
+			denied = i
+			break
+		}
+	}
+
+	d := c.merge(key, decisions, denied)
+	if !d.Allowed {
+		if err := undoAll(ctx, undos, nil); err != nil {
+			return nil, nil, err
+		}
+		return d, nil, nil
+	}
+	if len(undos) == 0 {
+		return d, nil, nil
+	}
+	return d, func(ctx context.Context) error {
+		return undoAll(ctx, undos, nil)
+	}, nil
+}
+
+// undoAll runs every undo function in reverse order, even if ctx is already
+// done, and returns cause or the first undo error.
+func undoAll(ctx context.Context, undos []func(context.Context) error, cause error) error {
+	ctx = context.WithoutCancel(ctx)
+	for i := len(undos) - 1; i >= 0; i-- {
+		if err := undos[i](ctx); err != nil && cause == nil {
+			cause = err
+		}
+	}
+	return cause
+}
+
+// merge combines the decisions of the members checked for key.
+func (c *CompositeLimiter) merge(key string, decisions []*Decision, denied int) *Decision {
+	if denied >= 0 {
+		d := *decisions[denied]
+		d.DeniedBy = c.members[denied].name(key)
+		return &d
+	}
+	if len(decisions) == 0 {
+		return &Decision{Allowed: true, ResetAt: c.clock.Now()}
+	}
+
+	d := *decisions[0]
+	for _, other := range decisions[1:] {
+		if other.Remaining < d.Remaining {
+			d.Limit = other.Limit
+			d.Remaining = other.Remaining
+		}
+		if other.ResetAt.After(d.ResetAt) {
+			d.ResetAt = other.ResetAt
+		}
+	}
+	d.Allowed = true
+	return &d
+}
+
+// Reset clears the rate limit data of every member for the given key.
+// Members with a shared key, such as a global limit, are reset as well.
+func (c *CompositeLimiter) Reset(key string) error {
+	return c.ResetCtx(context.Background(), key)
+}
+
+// ResetCtx is like Reset but honours ctx.
+func (c *CompositeLimiter) ResetCtx(ctx context.Context, key string) error {
+	for _, m := range c.members {
+		if err := m.Limiter.ResetCtx(ctx, m.key(key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Refund gives n requests back to every member for the given key.
+func (c *CompositeLimiter) Refund(key string, n int) error {
+	return c.RefundCtx(context.Background(), key, n)
+}
+
+// RefundCtx is like Refund but honours ctx.
+func (c *CompositeLimiter) RefundCtx(ctx context.Context, key string, n int) error {
+	for _, m := range c.members {
+		if err := m.Limiter.RefundCtx(ctx, m.key(key), n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetStats returns the current rate limit statistics for the given key,
+// describing the member with the least room left.
+func (c *CompositeLimiter) GetStats(key string) (*Stats, error) {
+	return c.GetStatsCtx(context.Background(), key)
+}
+
+// GetStatsCtx is like GetStats but honours ctx.
+func (c *CompositeLimiter) GetStatsCtx(ctx context.Context, key string) (*Stats, error) {
+	return statsFromDecision(c.DecideCtx(ctx, key, 0))
+}
+
+func (m Member) key(key string) string {
+	if m.Key == nil {
+		return key
+	}
+	return m.Key(key)
+}
+
+func (m Member) name(key string) string {
+	if m.Name == "" {
+		return m.key(key)
+	}
+	return m.Name
+}
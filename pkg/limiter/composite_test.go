@@ -0,0 +1,152 @@
+package limiter_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sumedhvats/rate-limiter-go/pkg/clock"
+	"github.com/sumedhvats/rate-limiter-go/pkg/limiter"
+	"github.com/sumedhvats/rate-limiter-go/pkg/storage"
+)
+
+func TestCompositeAllOrNothing(t *testing.T) {
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	store := storage.NewMemoryStorageWithClock(clk)
+	cfg := func(rate int) limiter.Config {
+		return limiter.Config{Rate: rate, Window: time.Minute, Clock: clk}
+	}
+
+	global := limiter.NewTokenBucketLimiter(store, cfg(100))
+	tenant := limiter.NewFixedWindowLimiter(store, cfg(10))
+	user := limiter.NewSlidingWindowLimiter(store, cfg(3))
+	composite := limiter.NewCompositeLimiter(
+		limiter.Member{Name: "global", Limiter: global, Key: func(string) string { return "global" }},
+		limiter.Member{Name: "tenant", Limiter: tenant, Key: func(string) string { return "tenant:acme" }},
+		limiter.Member{Name: "user", Limiter: user},
+	)
+
+	for i := 0; i < 3; i++ {
+		decision, err := composite.Decide("user:alice", 1)
+		assert.NoError(t, err)
+		assert.True(t, decision.Allowed)
+	}
+
+	decision, err := composite.Decide("user:alice", 1)
+	assert.NoError(t, err)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, "user", decision.DeniedBy)
+	assert.Equal(t, 3, decision.Limit)
+	assert.Greater(t, decision.RetryAfter, time.Duration(0))
+
+	// The denied request was not counted against the shared keys.
+	stats, err := global.GetStats("global")
+	assert.NoError(t, err)
+	assert.Equal(t, 97, stats.Remaining)
+	stats, err = tenant.GetStats("tenant:acme")
+	assert.NoError(t, err)
+	assert.Equal(t, 7, stats.Remaining)
+
+	// Another user of the same tenant is limited by the tenant key.
+	decision, err = composite.Decide("user:bob", 3)
+	assert.NoError(t, err)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, 0, decision.Remaining)
+	decision, err = composite.Decide("user:carol", 2)
+	assert.NoError(t, err)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, 1, decision.Remaining, "carol's own limit has the least room left")
+	decision, err = composite.Decide("user:dave", 3)
+	assert.NoError(t, err)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, "tenant", decision.DeniedBy)
+
+	stats, err = global.GetStats("global")
+	assert.NoError(t, err)
+	assert.Equal(t, 92, stats.Remaining)
+	stats, err = composite.GetStats("user:dave")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, stats.Remaining)
+}
+
+func TestCompositeRollsBackEveryAlgorithm(t *testing.T) {
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	store := storage.NewMemoryStorageWithClock(clk)
+	cfg := limiter.Config{Rate: 5, Window: time.Minute, Burst: 5, Clock: clk}
+
+	members := map[string]limiter.Limiter{
+		"token bucket":   limiter.NewTokenBucketLimiter(store, cfg),
+		"fixed window":   limiter.NewFixedWindowLimiter(store, cfg),
+		"sliding window": limiter.NewSlidingWindowLimiter(store, cfg),
+		"sliding log":    limiter.NewSlidingWindowLogLimiter(store, cfg),
+		"leaky bucket":   limiter.NewLeakyBucketLimiter(store, cfg),
+		"gcra":           limiter.NewGCRALimiter(store, cfg),
+		"policy": limiter.NewPolicyLimiter(store, limiter.Policy{
+			Limits: []limiter.Limit{{Rate: 5, Window: time.Minute}},
+			Clock:  clk,
+		}),
+	}
+	for name, member := range members {
+		t.Run(name, func(t *testing.T) {
+			blocker := limiter.NewFixedWindowLimiter(store, limiter.Config{Rate: 1, Window: time.Minute, Clock: clk})
+			composite := limiter.NewCompositeLimiter(
+				limiter.Member{Name: "member", Limiter: member},
+				limiter.Member{Name: "blocker", Limiter: blocker, Key: func(key string) string { return key + ":blocker" }},
+			)
+			key := "rollback:" + name
+
+			ok, err := composite.AllowN(key, 1)
+			assert.NoError(t, err)
+			assert.True(t, ok)
+
+			for i := 0; i < 3; i++ {
+				decision, err := composite.Decide(key, 1)
+				assert.NoError(t, err)
+				assert.False(t, decision.Allowed)
+				assert.Equal(t, "blocker", decision.DeniedBy)
+			}
+
+			stats, err := member.GetStats(key)
+			assert.NoError(t, err)
+			assert.Equal(t, 4, stats.Remaining)
+		})
+	}
+}
+
+func TestCompositeNested(t *testing.T) {
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	store := storage.NewMemoryStorageWithClock(clk)
+	cfg := func(rate int) limiter.Config {
+		return limiter.Config{Rate: rate, Window: time.Minute, Clock: clk}
+	}
+
+	inner := limiter.NewCompositeLimiter(
+		limiter.Member{Name: "a", Limiter: limiter.NewTokenBucketLimiter(store, cfg(10))},
+		limiter.Member{Name: "b", Limiter: limiter.NewGCRALimiter(store, cfg(10)), Key: func(key string) string { return key + ":b" }},
+	)
+	outer := limiter.NewCompositeLimiter(
+		limiter.Member{Name: "inner", Limiter: inner},
+		limiter.Member{Name: "outer", Limiter: limiter.NewFixedWindowLimiter(store, cfg(2)), Key: func(key string) string { return key + ":outer" }},
+	)
+
+	ok, err := outer.AllowN("k", 2)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	decision, err := outer.Decide("k", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "outer", decision.DeniedBy)
+
+	stats, err := inner.GetStats("k")
+	assert.NoError(t, err)
+	assert.Equal(t, 8, stats.Remaining)
+}
+
+func TestCompositeWithoutMembers(t *testing.T) {
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	composite := limiter.NewCompositeLimiterWithClock(clk)
+
+	decision, err := composite.Decide("k", 1)
+	assert.NoError(t, err)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, clk.Now(), decision.ResetAt)
+}
@@ -0,0 +1,342 @@
+// Package limiter provides rate limiting algorithm implementations.
+package limiter
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sumedhvats/rate-limiter-go/pkg/clock"
+	"github.com/sumedhvats/rate-limiter-go/pkg/storage"
+)
+
+// DefaultLeaseTTL is the lease TTL used when ConcurrencyConfig.LeaseTTL is unset.
+const DefaultLeaseTTL = 30 * time.Second
+
+// ErrLeaseExpired is returned by Lease.Renew when the lease expired or was
+// released before it could be renewed. Its slot may already be held by
+// someone else.
+var ErrLeaseExpired = errors.New("limiter: lease expired")
+
+// ConcurrencyConfig holds the configuration for a ConcurrencyLimiter.
+type ConcurrencyConfig struct {
+	// Limit is the number of leases that can be held per key at once.
+	Limit int
+	// LeaseTTL is how long a lease holds its slot unless it is renewed or
+	// released. It bounds how long the slot of a crashed holder stays taken.
+	// It defaults to DefaultLeaseTTL.
+	LeaseTTL time.Duration
+	// Clock is the time source. It defaults to clock.Real.
+	Clock clock.Clock
+}
+
+// leaseTTL returns the configured LeaseTTL, falling back to DefaultLeaseTTL when unset.
+func (c ConcurrencyConfig) leaseTTL() time.Duration {
+	if c.LeaseTTL <= 0 {
+		return DefaultLeaseTTL
+	}
+	return c.LeaseTTL
+}
+
+// now returns the current time according to the configured Clock.
+func (c ConcurrencyConfig) now() time.Time {
+	return clock.OrReal(c.Clock).Now()
+}
+
+// leaseEntry is one lease held on a key.
+type leaseEntry struct {
+	id        string
+	expiresAt time.Time
+}
+
+// leaseSet is the per-key set of leases. It is never mutated once stored;
+// every update stores a fresh copy so it can be swapped atomically.
+type leaseSet struct {
+	leases []leaseEntry
+}
+
+// ConcurrencyLimiter limits how many requests per key are in flight at once,
+// rather than how many start per window. Every admitted request holds a
+// lease that it releases when done. Leases expire after LeaseTTL, so the
+// slots of a holder that crashed are freed without its help. On a RedisMemory
+// leases are timed by the Redis server clock, so that pods with skewed clocks
+// agree on when they expire; Lease.ExpiresAt is still reported by Clock.
+//
+// The leases of a key are stored under the key followed by ":inflight", so
+// that a ConcurrencyLimiter can share a store and its keys with rate
+// limiters.
+type ConcurrencyLimiter struct {
+	storage Storage
+	config  ConcurrencyConfig
+}
+
+// NewConcurrencyLimiter creates a new ConcurrencyLimiter.
+func NewConcurrencyLimiter(store Storage, cfg ConcurrencyConfig) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{
+		storage: store,
+		config:  cfg,
+	}
+}
+
+// leaseKey returns the key the leases of key are stored under.
+func leaseKey(key string) string {
+	return key + ":inflight"
+}
+
+// longest returns how long the longest of leases has left at now, which is
+// how long their set has to be kept.
+func longest(leases []leaseEntry, now time.Time) time.Duration {
+	ttl := time.Duration(0)
+	for _, e := range leases {
+		ttl = max(ttl, e.expiresAt.Sub(now))
+	}
+	return ttl
+}
+
+// Lease is a slot held on a ConcurrencyLimiter. Release it once the work is
+// done, and Renew it if the work may outlive the lease TTL.
+type Lease struct {
+	ok        bool
+	limiter   *ConcurrencyLimiter
+	key       string
+	id        string
+	limit     int
+	inFlight  int
+	ttl       time.Duration
+	mu        sync.Mutex
+	expiresAt time.Time
+	once      sync.Once
+}
+
+// OK reports whether a slot was acquired. If OK is false, Renew and Release
+// do nothing.
+func (l *Lease) OK() bool {
+	return l.ok
+}
+
+// Limit is the number of leases that can be held on the key at once.
+func (l *Lease) Limit() int {
+	return l.limit
+}
+
+// InFlight is the number of leases held on the key right after Acquire,
+// including this one if it is OK.
+func (l *Lease) InFlight() int {
+	return l.inFlight
+}
+
+// TTL is how long the lease holds its slot once acquired or renewed.
+func (l *Lease) TTL() time.Duration {
+	return l.ttl
+}
+
+// ExpiresAt returns the time at which the lease frees its slot unless it is
+// renewed first.
+func (l *Lease) ExpiresAt() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.expiresAt
+}
+
+// Renew extends the lease by the lease TTL, measured from now. It returns
+// ErrLeaseExpired if the lease is already gone.
+func (l *Lease) Renew(ctx context.Context) error {
+	if !l.ok {
+		return nil
+	}
+	expiresAt, err := l.limiter.renew(ctx, l.key, l.id)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.expiresAt = expiresAt
+	l.mu.Unlock()
+	return nil
+}
+
+// Release frees the slot held by the lease. Calling it more than once does
+// nothing.
+func (l *Lease) Release(ctx context.Context) error {
+	if !l.ok {
+		return nil
+	}
+	var err error
+	l.once.Do(func() {
+		err = l.limiter.release(ctx, l.key, l.id)
+	})
+	return err
+}
+
+// Acquire takes a slot for key if one is free. It does not wait: if every
+// slot is taken, the returned Lease is not OK.
+func (c *ConcurrencyLimiter) Acquire(ctx context.Context, key string) (*Lease, error) {
+	lease := &Lease{
+		limiter: c,
+		key:     leaseKey(key),
+		id:      strconv.FormatUint(rand.Uint64(), 36),
+		limit:   c.config.Limit,
+		ttl:     c.config.leaseTTL(),
+	}
+
+	var err error
+	if redisStore, ok := c.storage.(*storage.RedisMemory); ok {
+		err = c.acquireRedis(ctx, redisStore, lease)
+	} else {
+		err = c.acquireMemory(ctx, lease)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return lease, nil
+}
+
+func (c *ConcurrencyLimiter) acquireRedis(ctx context.Context, store *storage.RedisMemory, lease *Lease) error {
+	ttl := c.config.leaseTTL()
+	now := c.config.now()
+	ok, count, err := store.ConcurrencyAcquire(
+		ctx,
+		lease.key,
+		lease.id,
+		c.config.Limit,
+		ttl.Milliseconds(),
+	)
+	if err != nil {
+		return err
+	}
+	lease.ok = ok
+	lease.inFlight = int(count)
+	lease.expiresAt = now.Add(ttl)
+	return nil
+}
+
+func (c *ConcurrencyLimiter) acquireMemory(ctx context.Context, lease *Lease) error {
+	ttl := c.config.leaseTTL()
+	for {
+		now := c.config.now()
+		data, leases, err := c.leases(ctx, lease.key, now)
+		if err != nil {
+			return err
+		}
+
+		lease.inFlight = len(leases)
+		if len(leases) >= c.config.Limit {
+			return nil
+		}
+
+		lease.expiresAt = now.Add(ttl)
+		leases = append(leases, leaseEntry{id: lease.id, expiresAt: lease.expiresAt})
+		swapped, err := compareAndSwap(ctx, c.storage, lease.key, data, &leaseSet{leases: leases}, longest(leases, now))
+		if err != nil {
+			return err
+		}
+		if swapped {
+			lease.ok = true
+			lease.inFlight = len(leases)
+			return nil
+		}
+		// Retry
+	}
+}
+
+// leases returns the stored lease set of key together with a fresh copy of
+// its unexpired leases.
+func (c *ConcurrencyLimiter) leases(ctx context.Context, key string, now time.Time) (interface{}, []leaseEntry, error) {
+	data, err := c.storage.GetCtx(ctx, key)
+	if err != nil || data == nil {
+		return data, nil, err
+	}
+	var leases []leaseEntry
+	for _, e := range data.(*leaseSet).leases {
+		if e.expiresAt.After(now) {
+			leases = append(leases, e)
+		}
+	}
+	return data, leases, nil
+}
+
+// renew extends the lease id on key and returns its new expiry.
+func (c *ConcurrencyLimiter) renew(ctx context.Context, key, id string) (time.Time, error) {
+	ttl := c.config.leaseTTL()
+	if redisStore, ok := c.storage.(*storage.RedisMemory); ok {
+		now := c.config.now()
+		renewed, err := redisStore.ConcurrencyRenew(ctx, key, id, ttl.Milliseconds())
+		if err != nil {
+			return time.Time{}, err
+		}
+		if !renewed {
+			return time.Time{}, ErrLeaseExpired
+		}
+		return now.Add(ttl), nil
+	}
+
+	for {
+		now := c.config.now()
+		data, leases, err := c.leases(ctx, key, now)
+		if err != nil {
+			return time.Time{}, err
+		}
+		i := slices.IndexFunc(leases, func(e leaseEntry) bool { return e.id == id })
+		if i < 0 {
+			return time.Time{}, ErrLeaseExpired
+		}
+		leases[i].expiresAt = now.Add(ttl)
+
+		swapped, err := compareAndSwap(ctx, c.storage, key, data, &leaseSet{leases: leases}, longest(leases, now))
+		if err != nil {
+			return time.Time{}, err
+		}
+		if swapped {
+			return leases[i].expiresAt, nil
+		}
+		// Retry
+	}
+}
+
+// release removes the lease id from key, if it is still there.
+func (c *ConcurrencyLimiter) release(ctx context.Context, key, id string) error {
+	if redisStore, ok := c.storage.(*storage.RedisMemory); ok {
+		return redisStore.ConcurrencyRelease(ctx, key, id)
+	}
+
+	for {
+		now := c.config.now()
+		data, leases, err := c.leases(ctx, key, now)
+		if err != nil {
+			return err
+		}
+		i := slices.IndexFunc(leases, func(e leaseEntry) bool { return e.id == id })
+		if i < 0 {
+			return nil
+		}
+		leases = slices.Delete(leases, i, i+1)
+
+		swapped, err := compareAndSwap(ctx, c.storage, key, data, &leaseSet{leases: leases}, longest(leases, now))
+		if err != nil {
+			return err
+		}
+		if swapped {
+			return nil
+		}
+		// Retry
+	}
+}
+
+// InFlight returns the number of leases currently held on key.
+func (c *ConcurrencyLimiter) InFlight(ctx context.Context, key string) (int, error) {
+	if redisStore, ok := c.storage.(*storage.RedisMemory); ok {
+		count, err := redisStore.ConcurrencyCount(ctx, leaseKey(key))
+		return int(count), err
+	}
+	_, leases, err := c.leases(ctx, leaseKey(key), c.config.now())
+	return len(leases), err
+}
+
+// Reset drops every lease held on key. Holders of dropped leases are not
+// notified; their Release calls do nothing.
+func (c *ConcurrencyLimiter) Reset(ctx context.Context, key string) error {
+	return c.storage.DeleteCtx(ctx, leaseKey(key))
+}
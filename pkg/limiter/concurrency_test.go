@@ -0,0 +1,155 @@
+package limiter_test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sumedhvats/rate-limiter-go/pkg/clock"
+	"github.com/sumedhvats/rate-limiter-go/pkg/limiter"
+	"github.com/sumedhvats/rate-limiter-go/pkg/storage"
+)
+
+func TestConcurrencyAcquireRelease(t *testing.T) {
+	ctx := context.Background()
+	cl := limiter.NewConcurrencyLimiter(storage.NewMemoryStorage(), limiter.ConcurrencyConfig{Limit: 2})
+
+	first, err := cl.Acquire(ctx, "tenant1")
+	assert.NoError(t, err)
+	assert.True(t, first.OK())
+	second, err := cl.Acquire(ctx, "tenant1")
+	assert.NoError(t, err)
+	assert.True(t, second.OK())
+	assert.Equal(t, 2, second.InFlight())
+
+	third, err := cl.Acquire(ctx, "tenant1")
+	assert.NoError(t, err)
+	assert.False(t, third.OK())
+	assert.Equal(t, 2, third.InFlight())
+	assert.NoError(t, third.Release(ctx))
+
+	// Other keys have their own slots.
+	other, err := cl.Acquire(ctx, "tenant2")
+	assert.NoError(t, err)
+	assert.True(t, other.OK())
+
+	assert.NoError(t, first.Release(ctx))
+	assert.NoError(t, first.Release(ctx), "releasing twice is a no-op")
+	inFlight, err := cl.InFlight(ctx, "tenant1")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, inFlight)
+
+	third, err = cl.Acquire(ctx, "tenant1")
+	assert.NoError(t, err)
+	assert.True(t, third.OK())
+}
+
+func TestConcurrencyLeaseExpiry(t *testing.T) {
+	ctx := context.Background()
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	cl := limiter.NewConcurrencyLimiter(storage.NewMemoryStorageWithClock(clk), limiter.ConcurrencyConfig{
+		Limit:    1,
+		LeaseTTL: 10 * time.Second,
+		Clock:    clk,
+	})
+
+	renewed, err := cl.Acquire(ctx, "tenant1")
+	assert.NoError(t, err)
+	assert.True(t, renewed.OK())
+	assert.Equal(t, clk.Now().Add(10*time.Second), renewed.ExpiresAt())
+
+	// A renewed lease keeps its slot past the original TTL.
+	clk.Advance(8 * time.Second)
+	assert.NoError(t, renewed.Renew(ctx))
+	clk.Advance(8 * time.Second)
+	lease, err := cl.Acquire(ctx, "tenant1")
+	assert.NoError(t, err)
+	assert.False(t, lease.OK())
+
+	// A holder that never releases frees its slot once the lease expires.
+	clk.Advance(3 * time.Second)
+	lease, err = cl.Acquire(ctx, "tenant1")
+	assert.NoError(t, err)
+	assert.True(t, lease.OK())
+	assert.ErrorIs(t, renewed.Renew(ctx), limiter.ErrLeaseExpired)
+
+	// Releasing the expired lease must not free the new holder's slot.
+	assert.NoError(t, renewed.Release(ctx))
+	inFlight, err := cl.InFlight(ctx, "tenant1")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, inFlight)
+
+	assert.NoError(t, cl.Reset(ctx, "tenant1"))
+	inFlight, err = cl.InFlight(ctx, "tenant1")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, inFlight)
+}
+
+func TestConcurrencyConcurrent(t *testing.T) {
+	ctx := context.Background()
+	cl := limiter.NewConcurrencyLimiter(storage.NewMemoryStorage(), limiter.ConcurrencyConfig{Limit: 3})
+
+	var inFlight, peak int64
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				lease, err := cl.Acquire(ctx, "tenant1")
+				assert.NoError(t, err)
+				if !lease.OK() {
+					continue
+				}
+				n := atomic.AddInt64(&inFlight, 1)
+				for {
+					p := atomic.LoadInt64(&peak)
+					if n <= p || atomic.CompareAndSwapInt64(&peak, p, n) {
+						break
+					}
+				}
+				atomic.AddInt64(&inFlight, -1)
+				assert.NoError(t, lease.Release(ctx))
+			}
+		}()
+	}
+	wg.Wait()
+	assert.LessOrEqual(t, peak, int64(3))
+
+	held, err := cl.InFlight(ctx, "tenant1")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, held)
+}
+
+func TestConcurrencySharesStoreWithRateLimiter(t *testing.T) {
+	ctx := context.Background()
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	store := storage.NewMemoryStorageWithClock(clk)
+	tb := limiter.NewTokenBucketLimiter(store, limiter.Config{Rate: 10, Window: time.Second, Clock: clk})
+	cl := limiter.NewConcurrencyLimiter(store, limiter.ConcurrencyConfig{Limit: 1, LeaseTTL: 10 * time.Second, Clock: clk})
+
+	// Both limiters check the same key without stepping on each other.
+	ok, err := tb.Allow("user")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	lease, err := cl.Acquire(ctx, "user")
+	assert.NoError(t, err)
+	assert.True(t, lease.OK())
+	ok, err = tb.Allow("user")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// The leases live as long as the longest of them, whatever the TTL of
+	// the last one taken.
+	short := limiter.NewConcurrencyLimiter(store, limiter.ConcurrencyConfig{Limit: 2, LeaseTTL: time.Second, Clock: clk})
+	other, err := short.Acquire(ctx, "user")
+	assert.NoError(t, err)
+	assert.True(t, other.OK())
+	clk.Advance(5 * time.Second)
+	inFlight, err := cl.InFlight(ctx, "user")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, inFlight)
+}
@@ -0,0 +1,47 @@
+package limiter_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sumedhvats/rate-limiter-go/pkg/limiter"
+	"github.com/sumedhvats/rate-limiter-go/pkg/storage"
+)
+
+func TestCtxMethodsHonourCancellation(t *testing.T) {
+	cfg := limiter.Config{Rate: 5, Window: time.Second, Burst: 5}
+	limiters := map[string]func(limiter.Storage) limiter.Limiter{
+		"token bucket":   func(s limiter.Storage) limiter.Limiter { return limiter.NewTokenBucketLimiter(s, cfg) },
+		"fixed window":   func(s limiter.Storage) limiter.Limiter { return limiter.NewFixedWindowLimiter(s, cfg) },
+		"sliding window": func(s limiter.Storage) limiter.Limiter { return limiter.NewSlidingWindowLimiter(s, cfg) },
+		"sliding log":    func(s limiter.Storage) limiter.Limiter { return limiter.NewSlidingWindowLogLimiter(s, cfg) },
+		"leaky bucket":   func(s limiter.Storage) limiter.Limiter { return limiter.NewLeakyBucketLimiter(s, cfg) },
+		"gcra":           func(s limiter.Storage) limiter.Limiter { return limiter.NewGCRALimiter(s, cfg) },
+	}
+
+	for name, newLimiter := range limiters {
+		t.Run(name, func(t *testing.T) {
+			l := newLimiter(storage.NewMemoryStorage())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			_, err := l.AllowNCtx(ctx, "user1", 1)
+			assert.ErrorIs(t, err, context.Canceled)
+			_, err = l.GetStatsCtx(ctx, "user1")
+			assert.ErrorIs(t, err, context.Canceled)
+			assert.ErrorIs(t, l.ResetCtx(ctx, "user1"), context.Canceled)
+
+			// Nothing was consumed by the cancelled call.
+			stats, err := l.GetStatsCtx(context.Background(), "user1")
+			assert.NoError(t, err)
+			assert.Equal(t, 5, stats.Remaining)
+
+			allowed, err := l.AllowCtx(context.Background(), "user1")
+			assert.NoError(t, err)
+			assert.True(t, allowed)
+		})
+	}
+}
@@ -2,17 +2,30 @@
 package limiter
 
 import (
-	"fmt"
-	"strconv"
+	"context"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sumedhvats/rate-limiter-go/pkg/storage"
 )
+
 // FixedWindowLimiter implements the fixed window rate limiting algorithm.
 type FixedWindowLimiter struct {
 	storage Storage
 	config  Config
+
+	// live holds a copy of the limiter with the Config last set with
+	// SetConfig, if any. mu serializes SetConfig calls.
+	mu   sync.Mutex
+	live atomic.Pointer[FixedWindowLimiter]
+
+	// On a copy set with a new Window, previous is the limiter that keeps
+	// checking the window in progress until it ends at since.
+	previous *FixedWindowLimiter
+	since    time.Time
 }
+
 // NewFixedWindowLimiter creates a new FixedWindowLimiter.
 func NewFixedWindowLimiter(store Storage, cfg Config) *FixedWindowLimiter {
 	return &FixedWindowLimiter{
@@ -21,70 +34,344 @@ func NewFixedWindowLimiter(store Storage, cfg Config) *FixedWindowLimiter {
 	}
 }
 
+// Config returns the limiter's Config, as last set with SetConfig.
+func (fwl *FixedWindowLimiter) Config() Config {
+	if l := fwl.live.Load(); l != nil {
+		return l.config
+	}
+	return fwl.config
+}
+
+// SetConfig changes the limiter's Config while it is in use. It is safe to
+// call concurrently with checks, which use either the old or the new Config.
+//
+// Windows keep their counts. A new Rate applies from the next check on,
+// also to the window in progress. A new Window applies once the window in
+// progress ends; until then that window keeps its original length. On a
+// RedisMemory using server time, the window in progress is found from the
+// Redis clock, and the checks themselves tell which length applies.
+func (fwl *FixedWindowLimiter) SetConfig(cfg Config) {
+	fwl.mu.Lock()
+	defer fwl.mu.Unlock()
+
+	old := fwl.current()
+	next := &FixedWindowLimiter{storage: fwl.storage, config: cfg}
+	if cfg.Window != old.config.Window {
+		prevCfg := cfg
+		prevCfg.Window = old.config.Window
+		next.previous = &FixedWindowLimiter{storage: fwl.storage, config: prevCfg}
+		next.since = old.window("", changeNow(fwl.storage, old.config)).end
+	}
+	fwl.live.Store(next)
+}
+
+// current returns the limiter holding the Config in force: the copy set by
+// SetConfig, or the limiter itself. On a store using server time it is
+// always the copy set by SetConfig, whose checks hand the window change to
+// the script.
+func (fwl *FixedWindowLimiter) current() *FixedWindowLimiter {
+	l := fwl.live.Load()
+	if l == nil {
+		return fwl
+	}
+	if _, ok := serverTime(l.storage); !ok && l.previous != nil && l.config.now().Before(l.since) {
+		return l.previous
+	}
+	return l
+}
+
+// at returns the limiter whose windows are in force at now: previous until
+// since, or fwl.
+func (fwl *FixedWindowLimiter) at(now time.Time) *FixedWindowLimiter {
+	if fwl.previous != nil && now.Before(fwl.since) {
+		return fwl.previous
+	}
+	return fwl
+}
+
 // AllowN checks if n requests are allowed for the given key in the current window.
 func (fwl *FixedWindowLimiter) AllowN(key string, n int) (bool, error) {
-	// now := time.Now()
-	// windowStart := now.Truncate(fwl.config.Window)
-	// windowKey := fmt.Sprintf("%s:%d", key, windowStart.Unix())
+	return fwl.AllowNCtx(context.Background(), key, n)
+}
 
-	nowUnix := time.Now().Unix()
-	//(nowUnix / windowSize) * windowSize
-	windowStart := (nowUnix / int64(fwl.config.Window.Seconds())) * int64(fwl.config.Window.Seconds())
-	
-	// Pre-allocate key buffer or use string builder
+// AllowNCtx is like AllowN but honours ctx.
+func (fwl *FixedWindowLimiter) AllowNCtx(ctx context.Context, key string, n int) (bool, error) {
+	decision, err := fwl.DecideCtx(ctx, key, n)
+	if err != nil {
+		return false, err
+	}
+	return decision.Allowed, nil
+}
+
+// Decide checks if n requests are allowed for the given key in the current
+// window and reports the window count left behind by that check.
+func (fwl *FixedWindowLimiter) Decide(key string, n int) (*Decision, error) {
+	return fwl.DecideCtx(context.Background(), key, n)
+}
 
+// DecideCtx is like Decide but honours ctx.
+func (fwl *FixedWindowLimiter) DecideCtx(ctx context.Context, key string, n int) (*Decision, error) {
+	fwl, err := fwl.forKey(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	d, _, _, err := fwl.decide(ctx, key, n)
+	return d, err
+}
+
+// decideUndo is like DecideCtx but also returns a function that takes the
+// admitted requests back out of their window. See undoer.
+func (fwl *FixedWindowLimiter) decideUndo(ctx context.Context, key string, n int) (*Decision, func(context.Context) error, error) {
+	fwl, err := fwl.forKey(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	d, l, w, err := fwl.decide(ctx, key, n)
+	if err != nil || !d.Allowed || n == 0 {
+		return d, nil, err
+	}
+	return d, func(ctx context.Context) error {
+		return l.undo(ctx, w, n)
+	}, nil
+}
+
+// undo takes n requests back out of window w.
+func (fwl *FixedWindowLimiter) undo(ctx context.Context, w fixedWindow, n int) error {
+	now, err := storeNow(ctx, fwl.storage, fwl.config)
+	if err != nil {
+		return err
+	}
+	// Once the window is over there is nothing left to give back.
+	if !now.Before(w.end) {
+		return nil
+	}
+	_, err = fwl.storage.IncrementCtx(ctx, w.key, -n, fwl.config.Window*2)
+	return err
+}
+
+// scriptStep describes the check of key as a step of the composite Redis
+// script. See scriptable. Limiters on a store using server time are checked
+// in turn instead.
+func (fwl *FixedWindowLimiter) scriptStep(ctx context.Context, key string, n int) (*scriptStep, bool, error) {
+	fwl, err := fwl.forKey(ctx, key)
+	if err != nil {
+		return nil, false, err
+	}
+	store, ok := fwl.storage.(*storage.RedisMemory)
+	if !ok || store.ServerTime() {
+		return nil, false, nil
+	}
+	w := fwl.window(key, fwl.config.now())
+	return &scriptStep{
+		store: store,
+		step: storage.CompositeStep{
+			Kind:  storage.CompositeFixedWindow,
+			Keys:  []string{w.key},
+			Limit: fwl.config.Rate,
+			TTL:   fwl.config.Window * 2,
+		},
+		decision: func(result storage.CompositeResult) *Decision {
+			return fwl.decision(result.Allowed, result.Current, w)
+		},
+		undo: func(ctx context.Context) error {
+			return fwl.undo(ctx, w, n)
+		},
+	}, true, nil
+}
+
+// forKey returns the limiter to check key with: a copy using the key's
+// Config if the limiter has Overrides, or the current limiter.
+func (fwl *FixedWindowLimiter) forKey(ctx context.Context, key string) (*FixedWindowLimiter, error) {
+	fwl = fwl.current()
+	if fwl.config.Overrides == nil {
+		return fwl, nil
+	}
+	cfg, err := fwl.config.resolve(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return &FixedWindowLimiter{storage: fwl.storage, config: cfg}, nil
+}
 
-	windowKey := key + ":" + strconv.FormatInt(windowStart, 10)
+// windowed marks FixedWindowLimiter as a windowedLimiter.
+func (fwl *FixedWindowLimiter) windowed() {}
 
+// fixedWindow is the window observed by a single check.
+type fixedWindow struct {
+	now time.Time
+	key string
+	end time.Time
+}
+
+// window locates the window of key that contains now.
+func (fwl *FixedWindowLimiter) window(key string, now time.Time) fixedWindow {
+	start := storage.WindowStart(now, fwl.config.Window)
+	return fixedWindow{
+		now: now,
+		key: storage.WindowKey(key, start, fwl.config.Window),
+		end: start.Add(fwl.config.Window),
+	}
+}
+
+// decide checks n requests of key, and returns the limiter whose window it
+// counted them in along with that window: fwl, or its previous limiter on a
+// store using server time while a new Window waits for the window in
+// progress to end.
+func (fwl *FixedWindowLimiter) decide(ctx context.Context, key string, n int) (*Decision, *FixedWindowLimiter, fixedWindow, error) {
+	if redisStore, ok := serverTime(fwl.storage); ok {
+		return fwl.decideServerTime(ctx, redisStore, key, n)
+	}
+	w := fwl.window(key, fwl.config.now())
+
+	var allowed bool
+	var count int64
+	var err error
 	if redisStore, ok := fwl.storage.(*storage.RedisMemory); ok {
-		return fwl.allowNRedis(redisStore, windowKey, n)
+		allowed, count, err = fwl.allowNRedis(ctx, redisStore, w.key, n)
+	} else {
+		allowed, count, err = fwl.allowNMemory(ctx, w.key, n)
+	}
+	if err != nil {
+		return nil, fwl, w, err
+	}
+	return fwl.decision(allowed, count, w), fwl, w, nil
+}
+
+// decideServerTime is like decide but lets the script locate the window from
+// the Redis server time, and tell whether a change of Window is in effect.
+func (fwl *FixedWindowLimiter) decideServerTime(ctx context.Context, store *storage.RedisMemory, key string, n int) (*Decision, *FixedWindowLimiter, fixedWindow, error) {
+	var change storage.WindowChange
+	ttl := fwl.config.Window * 2
+	if fwl.previous != nil {
+		change = storage.WindowChange{Previous: fwl.previous.config.Window, Since: fwl.since}
+		ttl = max(ttl, change.Previous*2)
 	}
+	allowed, count, now, err := store.FixedWindowIncrementServerTime(
+		ctx,
+		key,
+		n,
+		fwl.config.Rate,
+		fwl.config.Window,
+		change,
+		ttl.Milliseconds(),
+	)
+	if err != nil {
+		return nil, fwl, fixedWindow{}, err
+	}
+	l := fwl.at(now)
+	w := l.window(key, now)
+	return l.decision(allowed, count, w), l, w, nil
+}
 
-	return fwl.allowNMemory(windowKey, n)
+// decision builds a Decision from the count of window w.
+func (fwl *FixedWindowLimiter) decision(allowed bool, count int64, w fixedWindow) *Decision {
+	d := &Decision{
+		Allowed:   allowed,
+		Limit:     fwl.config.Rate,
+		Remaining: max(fwl.config.Rate-int(count), 0),
+		ResetAt:   w.now,
+	}
+	if count > 0 {
+		d.ResetAt = w.end
+	}
+	if !allowed {
+		d.RetryAfter = w.end.Sub(w.now)
+	}
+	return d
 }
 
-func (fwl *FixedWindowLimiter) allowNRedis(store *storage.RedisMemory, windowKey string, n int) (bool, error) {
+func (fwl *FixedWindowLimiter) allowNRedis(ctx context.Context, store *storage.RedisMemory, windowKey string, n int) (bool, int64, error) {
 	return store.FixedWindowIncrement(
+		ctx,
 		windowKey,
 		n,
 		int(fwl.config.Rate),
-		int(fwl.config.Window.Seconds())*2,
+		(fwl.config.Window * 2).Milliseconds(),
 	)
 }
 
-func (fwl *FixedWindowLimiter) allowNMemory(windowKey string, n int) (bool, error) {
-	newCount, err := fwl.storage.Increment(windowKey, n, fwl.config.Window*2)
+func (fwl *FixedWindowLimiter) allowNMemory(ctx context.Context, windowKey string, n int) (bool, int64, error) {
+	if n == 0 {
+		data, err := fwl.storage.GetCtx(ctx, windowKey)
+		if err != nil || data == nil {
+			return true, 0, err
+		}
+		return data.(int64) <= int64(fwl.config.Rate), data.(int64), nil
+	}
+
+	newCount, err := fwl.storage.IncrementCtx(ctx, windowKey, n, fwl.config.Window*2)
 	if err != nil {
-		return false, err
+		return false, 0, err
 	}
 	if newCount <= int64(fwl.config.Rate) {
-		return true, nil
+		return true, newCount, nil
 	}
 
-	fwl.storage.Increment(windowKey, -n, fwl.config.Window*2)
-	return false, nil
+	count, err := fwl.storage.IncrementCtx(ctx, windowKey, -n, fwl.config.Window*2)
+	if err != nil {
+		return false, 0, err
+	}
+	return false, count, nil
 }
+
 // Allow checks if a single request is allowed for the given key in the current window.
 func (f *FixedWindowLimiter) Allow(key string) (bool, error) {
 	return f.AllowN(key, 1)
 }
-// Reset clears the rate limit data for the given key.
+
+// AllowCtx is like Allow but honours ctx.
+func (f *FixedWindowLimiter) AllowCtx(ctx context.Context, key string) (bool, error) {
+	return f.AllowNCtx(ctx, key, 1)
+}
+
+// Reset clears the rate limit data for the given key in the current window.
 func (f *FixedWindowLimiter) Reset(key string) error {
-	return f.storage.Delete(key)
+	return f.ResetCtx(context.Background(), key)
+}
+
+// ResetCtx is like Reset but honours ctx.
+func (f *FixedWindowLimiter) ResetCtx(ctx context.Context, key string) error {
+	f, err := f.forKey(ctx, key)
+	if err != nil {
+		return err
+	}
+	now, err := storeNow(ctx, f.storage, f.config)
+	if err != nil {
+		return err
+	}
+	return f.storage.DeleteCtx(ctx, f.at(now).window(key, now).key)
+}
+
+// Refund takes n requests back out of the current window of the given key,
+// never taking its count below zero.
+func (f *FixedWindowLimiter) Refund(key string, n int) error {
+	return f.RefundCtx(context.Background(), key, n)
+}
+
+// RefundCtx is like Refund but honours ctx.
+func (f *FixedWindowLimiter) RefundCtx(ctx context.Context, key string, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	f, err := f.forKey(ctx, key)
+	if err != nil {
+		return err
+	}
+	now, err := storeNow(ctx, f.storage, f.config)
+	if err != nil {
+		return err
+	}
+	f = f.at(now)
+	w := f.window(key, now)
+	return refundCounters(ctx, f.storage, []string{w.key}, n, f.config.Window*2)
 }
+
 // GetStats returns the current rate limit statistics for the given key.
-func (f *FixedWindowLimiter) GetStats(key string) (*stats, error) {
-	now := time.Now()
-	windowStart := now.Truncate(f.config.Window)
-	data, _ := f.storage.Get(key)
-	if data == nil {
-		return &stats{}, fmt.Errorf("not found key")
-	}
-	count := data.(int64)
-	resetAt := windowStart.Add(f.config.Window)
-	return &stats{
-		Limit:     f.config.Burst,
-		Remaining: int(int64(f.config.Burst) - count),
-		ResetAt:   resetAt,
-	}, nil
+func (f *FixedWindowLimiter) GetStats(key string) (*Stats, error) {
+	return f.GetStatsCtx(context.Background(), key)
+}
+
+// GetStatsCtx is like GetStats but honours ctx.
+func (f *FixedWindowLimiter) GetStatsCtx(ctx context.Context, key string) (*Stats, error) {
+	return statsFromDecision(f.DecideCtx(ctx, key, 0))
 }
@@ -0,0 +1,208 @@
+// Package limiter provides rate limiting algorithm implementations.
+package limiter
+
+import (
+	"context"
+	"time"
+
+	"github.com/sumedhvats/rate-limiter-go/pkg/storage"
+)
+
+// GCRALimiter implements the generic cell rate algorithm.
+// It stores a single value per key, the theoretical arrival time (TAT) of
+// the next request, and admits a request if it does not arrive earlier than
+// the TAT minus the burst tolerance. It behaves like a token bucket of size
+// Burst refilled at Rate per Window, but needs only one key and yields exact
+// retry-after values.
+type GCRALimiter struct {
+	storage Storage
+	config  Config
+}
+
+// NewGCRALimiter creates a new GCRALimiter.
+func NewGCRALimiter(store Storage, cfg Config) *GCRALimiter {
+	return &GCRALimiter{
+		storage: store,
+		config:  cfg,
+	}
+}
+
+// Allow checks if a single request is allowed for the given key.
+func (g *GCRALimiter) Allow(key string) (bool, error) {
+	return g.AllowN(key, 1)
+}
+
+// AllowCtx is like Allow but honours ctx.
+func (g *GCRALimiter) AllowCtx(ctx context.Context, key string) (bool, error) {
+	return g.AllowNCtx(ctx, key, 1)
+}
+
+// AllowN checks if n requests are allowed for the given key.
+func (g *GCRALimiter) AllowN(key string, n int) (bool, error) {
+	return g.AllowNCtx(context.Background(), key, n)
+}
+
+// AllowNCtx is like AllowN but honours ctx.
+func (g *GCRALimiter) AllowNCtx(ctx context.Context, key string, n int) (bool, error) {
+	decision, err := g.DecideCtx(ctx, key, n)
+	if err != nil {
+		return false, err
+	}
+	return decision.Allowed, nil
+}
+
+// Decide checks if n requests are allowed for the given key and reports
+// the theoretical arrival time left behind by that check.
+func (g *GCRALimiter) Decide(key string, n int) (*Decision, error) {
+	return g.DecideCtx(context.Background(), key, n)
+}
+
+// DecideCtx is like Decide but honours ctx.
+func (g *GCRALimiter) DecideCtx(ctx context.Context, key string, n int) (*Decision, error) {
+	g, err := g.forKey(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if redisStore, ok := g.storage.(*storage.RedisMemory); ok {
+		return g.decideRedis(ctx, redisStore, key, n)
+	}
+
+	return g.decideMemory(ctx, key, n)
+}
+
+// decideUndo is like DecideCtx but also returns a function that moves the
+// theoretical arrival time back by the admitted requests. See undoer.
+func (g *GCRALimiter) decideUndo(ctx context.Context, key string, n int) (*Decision, func(context.Context) error, error) {
+	d, err := g.DecideCtx(ctx, key, n)
+	if err != nil || !d.Allowed || n == 0 {
+		return d, nil, err
+	}
+	return d, func(ctx context.Context) error {
+		_, err := g.DecideCtx(ctx, key, -n)
+		return err
+	}, nil
+}
+
+// forKey returns the limiter to check key with: a copy using the key's
+// Config if the limiter has Overrides, or the limiter itself.
+func (g *GCRALimiter) forKey(ctx context.Context, key string) (*GCRALimiter, error) {
+	if g.config.Overrides == nil {
+		return g, nil
+	}
+	cfg, err := g.config.resolve(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return &GCRALimiter{storage: g.storage, config: cfg}, nil
+}
+
+// emissionInterval is the time one request "costs".
+func (g *GCRALimiter) emissionInterval() time.Duration {
+	return g.config.Window / time.Duration(g.config.Rate)
+}
+
+// tolerance is how far ahead of now the TAT may run, i.e. the burst size in time.
+func (g *GCRALimiter) tolerance() time.Duration {
+	return g.emissionInterval() * time.Duration(g.config.burst())
+}
+
+func (g *GCRALimiter) decideRedis(ctx context.Context, store *storage.RedisMemory, key string, n int) (*Decision, error) {
+	allowed, tatMicros, nowMicros, err := store.GCRAAllow(
+		ctx,
+		key,
+		n,
+		g.emissionInterval().Microseconds(),
+		g.tolerance().Microseconds(),
+		g.config.now().UnixMicro(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return g.decision(allowed, time.UnixMicro(tatMicros), n, time.UnixMicro(nowMicros)), nil
+}
+
+func (g *GCRALimiter) decideMemory(ctx context.Context, key string, n int) (*Decision, error) {
+	interval := g.emissionInterval()
+
+	for {
+		now := g.config.now()
+		data, err := g.storage.GetCtx(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+
+		tat := now
+		if data != nil {
+			if stored := time.Unix(0, data.(int64)); stored.After(now) {
+				tat = stored
+			}
+		}
+
+		newTat := tat.Add(time.Duration(n) * interval)
+		allowed := !newTat.Add(-g.tolerance()).After(now)
+		if n == 0 || !allowed {
+			return g.decision(allowed, tat, n, now), nil
+		}
+
+		swapped, err := compareAndSwap(ctx, g.storage, key, data, newTat.UnixNano(), newTat.Sub(now))
+		if err != nil {
+			return nil, err
+		}
+		if !swapped {
+			continue // Retry
+		}
+		return g.decision(true, newTat, n, now), nil
+	}
+}
+
+// decision builds a Decision from the TAT left behind by the check.
+func (g *GCRALimiter) decision(allowed bool, tat time.Time, n int, now time.Time) *Decision {
+	interval := g.emissionInterval()
+	ahead := max(tat.Sub(now), 0)
+
+	d := &Decision{
+		Allowed:   allowed,
+		Limit:     g.config.burst(),
+		Remaining: max(int((g.tolerance()-ahead)/interval), 0),
+		ResetAt:   now.Add(ahead),
+	}
+	if !allowed {
+		d.RetryAfter = max(ahead+time.Duration(n)*interval-g.tolerance(), 0)
+	}
+	return d
+}
+
+// Reset clears the rate limit data for the given key.
+func (g *GCRALimiter) Reset(key string) error {
+	return g.ResetCtx(context.Background(), key)
+}
+
+// ResetCtx is like Reset but honours ctx.
+func (g *GCRALimiter) ResetCtx(ctx context.Context, key string) error {
+	return g.storage.DeleteCtx(ctx, key)
+}
+
+// Refund moves the theoretical arrival time of the given key back by n
+// requests, never before the current time.
+func (g *GCRALimiter) Refund(key string, n int) error {
+	return g.RefundCtx(context.Background(), key, n)
+}
+
+// RefundCtx is like Refund but honours ctx.
+func (g *GCRALimiter) RefundCtx(ctx context.Context, key string, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	_, err := g.DecideCtx(ctx, key, -n)
+	return err
+}
+
+// GetStats returns the current rate limit statistics for the given key.
+func (g *GCRALimiter) GetStats(key string) (*Stats, error) {
+	return g.GetStatsCtx(context.Background(), key)
+}
+
+// GetStatsCtx is like GetStats but honours ctx.
+func (g *GCRALimiter) GetStatsCtx(ctx context.Context, key string) (*Stats, error) {
+	return statsFromDecision(g.DecideCtx(ctx, key, 0))
+}
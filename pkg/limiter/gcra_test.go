@@ -0,0 +1,81 @@
+package limiter_test
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sumedhvats/rate-limiter-go/pkg/limiter"
+	"github.com/sumedhvats/rate-limiter-go/pkg/storage"
+)
+
+func TestBasicGCRA(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	cfg := limiter.Config{Rate: 10, Window: time.Second, Burst: 5}
+	gcra := limiter.NewGCRALimiter(store, cfg)
+
+	for i := 0; i < 5; i++ {
+		ok, err := gcra.Allow("user1")
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	}
+
+	decision, err := gcra.Decide("user1", 1)
+	assert.NoError(t, err)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, 5, decision.Limit)
+	assert.Equal(t, 0, decision.Remaining)
+	assert.InDelta(t, float64(100*time.Millisecond), float64(decision.RetryAfter), float64(10*time.Millisecond))
+
+	time.Sleep(decision.RetryAfter)
+	ok, err := gcra.Allow("user1")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, _ = gcra.Allow("user2")
+	assert.True(t, ok)
+}
+
+func TestGCRAConcurrent(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	cfg := limiter.Config{Rate: 100, Window: time.Minute}
+	gcra := limiter.NewGCRALimiter(store, cfg)
+
+	var wg sync.WaitGroup
+	var allowed int64
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if ok, _ := gcra.Allow("shared"); ok {
+					atomic.AddInt64(&allowed, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int64(100), allowed)
+}
+
+func TestGCRAStats(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	cfg := limiter.Config{Rate: 60, Window: time.Minute, Burst: 10}
+	gcra := limiter.NewGCRALimiter(store, cfg)
+
+	ok, _ := gcra.AllowN("user1", 4)
+	assert.True(t, ok)
+
+	stats, err := gcra.GetStats("user1")
+	assert.NoError(t, err)
+	assert.Equal(t, 10, stats.Limit)
+	assert.Equal(t, 6, stats.Remaining)
+	assert.WithinDuration(t, time.Now().Add(4*time.Second), stats.ResetAt, 100*time.Millisecond)
+
+	assert.NoError(t, gcra.Reset("user1"))
+	stats, _ = gcra.GetStats("user1")
+	assert.Equal(t, 10, stats.Remaining)
+}
@@ -0,0 +1,461 @@
+// Package limiter provides rate limiting algorithm implementations.
+package limiter
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sumedhvats/rate-limiter-go/pkg/storage"
+)
+
+// HybridConfig holds the configuration for a HybridLimiter.
+type HybridConfig struct {
+	// Config is the fixed window limit shared by all instances: Rate
+	// requests per Window. Overrides are supported; Burst is not used.
+	Config
+	// SyncInterval is how often a key's local count is synchronized with the
+	// store while the key is in use. It defaults to 100ms.
+	SyncInterval time.Duration
+	// SyncThreshold is how many requests an instance admits for a key before
+	// synchronizing with the store, making the check that would go past it
+	// wait. Lower is more accurate, higher makes fewer checks wait on the
+	// store. It defaults to 1% of Rate, and at least 1.
+	SyncThreshold int
+	// OnSyncError is optionally called when a synchronization in the
+	// background fails. The requests it would have pushed are pushed with the
+	// next one.
+	OnSyncError func(key string, err error)
+}
+
+// syncThreshold returns the configured SyncThreshold for a limit of rate
+// requests, falling back to 1% of rate when unset.
+func (c HybridConfig) syncThreshold(rate int) int64 {
+	if c.SyncThreshold > 0 {
+		return int64(c.SyncThreshold)
+	}
+	return max(int64(rate)/100, 1)
+}
+
+// HybridLimiter is a fixed window limiter that counts requests in memory and
+// synchronizes the counts with a shared store, such as Redis. Checks are
+// answered from memory, against the global count pulled back at the last
+// synchronization.
+//
+// A key is synchronized in the background every SyncInterval while in use.
+// It is also synchronized when a check would take it past SyncThreshold
+// requests admitted since the last synchronization, and that check waits for
+// the store: this is what bounds how far the instances can run ahead of each
+// other. In exchange for the speed, instances do not see each other's latest
+// requests, and together they may admit more than Rate requests in a window:
+// at most SyncThreshold more for every instance but one. A check of more than
+// SyncThreshold requests waits for a synchronization before it is admitted,
+// and is pushed to the store right after.
+//
+// On a RedisMemory using server time, windows are located by the Redis
+// server clock, as learned when the limiter first checks a key and updated
+// with every synchronization.
+//
+// Call Close to stop the background synchronization when done with the
+// limiter.
+type HybridLimiter struct {
+	storage Storage
+	config  HybridConfig
+
+	counters sync.Map // key -> *hybridCounter
+	stop     chan struct{}
+	once     sync.Once
+
+	// offset is how far the Redis server clock is ahead of Clock, in ns, on
+	// a store using server time. offsetSet is set once it is known.
+	offset    atomic.Int64
+	offsetSet atomic.Bool
+}
+
+// hybridCounter is the local count of a key in its current window.
+type hybridCounter struct {
+	mu     sync.Mutex
+	base   string // key the window keys are derived from
+	key    string // window key in the store
+	end    time.Time
+	window time.Duration
+
+	// synced is the global count pulled back by the last synchronization,
+	// including the requests this instance pushed. pending is the number of
+	// requests admitted since, not yet pushed. own is the number of requests
+	// this instance admitted in the window, pushed or not, net of refunds.
+	synced   int64
+	pending  int64
+	own      int64
+	lastSync time.Time
+	// gen changes whenever the counts start over, with a new window or a
+	// Reset, so that a synchronization in flight does not apply to them.
+	gen int
+	// syncing is closed when the synchronization in flight, if any, ends.
+	syncing chan struct{}
+	// removed is set once the counter is dropped from the limiter.
+	removed bool
+}
+
+// NewHybridLimiter creates a HybridLimiter counting requests in store, and
+// starts synchronizing them in the background.
+func NewHybridLimiter(store Storage, cfg HybridConfig) *HybridLimiter {
+	if cfg.SyncInterval <= 0 {
+		cfg.SyncInterval = 100 * time.Millisecond
+	}
+	h := &HybridLimiter{
+		storage: store,
+		config:  cfg,
+		stop:    make(chan struct{}),
+	}
+	go h.syncLoop()
+	return h
+}
+
+// syncLoop synchronizes the keys that are due every SyncInterval, and drops
+// those whose window has ended, until Close is called.
+func (h *HybridLimiter) syncLoop() {
+	ticker := time.NewTicker(h.config.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+		}
+
+		now := h.clockNow()
+		h.counters.Range(func(k, v any) bool {
+			c := v.(*hybridCounter)
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			switch {
+			case !now.Before(c.end) && c.syncing == nil:
+				c.removed = true
+				h.counters.CompareAndDelete(k, c)
+			case c.pending != 0 && c.syncing == nil && now.Sub(c.lastSync) >= h.config.SyncInterval:
+				c.syncing = make(chan struct{})
+				h.syncBackground(k.(string), c)
+			}
+			return true
+		})
+	}
+}
+
+// Close stops the background synchronization and pushes the requests not
+// yet synchronized to the store.
+func (h *HybridLimiter) Close() error {
+	h.once.Do(func() { close(h.stop) })
+	return h.Flush(context.Background())
+}
+
+// Flush synchronizes every key with the store now and waits for it.
+func (h *HybridLimiter) Flush(ctx context.Context) error {
+	var errs []error
+	h.counters.Range(func(_, v any) bool {
+		if err := h.sync(ctx, v.(*hybridCounter)); err != nil {
+			errs = append(errs, err)
+		}
+		return true
+	})
+	return errors.Join(errs...)
+}
+
+// counter returns the local count of key in the window of cfg containing now.
+// c.mu is held on return.
+func (h *HybridLimiter) counter(key string, cfg Config, now time.Time) *hybridCounter {
+	var c *hybridCounter
+	for {
+		v, ok := h.counters.Load(key)
+		if !ok {
+			v, _ = h.counters.LoadOrStore(key, &hybridCounter{})
+		}
+		c = v.(*hybridCounter)
+		c.mu.Lock()
+		if !c.removed {
+			break
+		}
+		c.mu.Unlock()
+	}
+	if now.Before(c.end) && c.window == cfg.Window {
+		return c
+	}
+
+	// A new window starts from scratch. Requests of the old window that
+	// were never pushed are dropped, as that window is over.
+	start := storage.WindowStart(now, cfg.Window)
+	c.base = key
+	c.key = storage.WindowKey(key, start, cfg.Window)
+	c.end = start.Add(cfg.Window)
+	c.window = cfg.Window
+	c.lastSync = time.Time{}
+	c.restart()
+	return c
+}
+
+// restart sets the counts of c back to zero. c.mu must be held.
+func (c *hybridCounter) restart() {
+	c.synced = 0
+	c.pending = 0
+	c.own = 0
+	c.gen++
+}
+
+// clockNow returns the current time by Clock, moved to the Redis server
+// clock on a store using server time once the offset is known.
+func (h *HybridLimiter) clockNow() time.Time {
+	return h.config.now().Add(time.Duration(h.offset.Load()))
+}
+
+// now is like clockNow but first learns the offset of the Redis server clock
+// on a store using server time, if it is not known yet.
+func (h *HybridLimiter) now(ctx context.Context) (time.Time, error) {
+	if redisStore, ok := serverTime(h.storage); ok && !h.offsetSet.Load() {
+		serverNow, err := redisStore.Time(ctx)
+		if err != nil {
+			return time.Time{}, err
+		}
+		h.setOffset(serverNow)
+	}
+	return h.clockNow(), nil
+}
+
+// setOffset records serverNow as the current time of the Redis server.
+func (h *HybridLimiter) setOffset(serverNow time.Time) {
+	h.offset.Store(int64(serverNow.Sub(h.config.now())))
+	h.offsetSet.Store(true)
+}
+
+// sync pushes the pending requests of c to the store and pulls back the
+// global count. Only one synchronization of a counter runs at a time; if one
+// is in flight, sync waits for it first.
+func (h *HybridLimiter) sync(ctx context.Context, c *hybridCounter) error {
+	c.mu.Lock()
+	for c.syncing != nil {
+		done := c.syncing
+		c.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		c.mu.Lock()
+	}
+	if c.key == "" {
+		c.mu.Unlock()
+		return nil
+	}
+	c.syncing = make(chan struct{})
+	c.mu.Unlock()
+	return h.push(ctx, c)
+}
+
+// syncBackground runs the synchronization of c claimed by setting c.syncing,
+// without waiting for it.
+func (h *HybridLimiter) syncBackground(key string, c *hybridCounter) {
+	go func() {
+		if err := h.push(context.Background(), c); err != nil && h.config.OnSyncError != nil {
+			h.config.OnSyncError(key, err)
+		}
+	}()
+}
+
+// push runs the synchronization of c claimed by setting c.syncing.
+func (h *HybridLimiter) push(ctx context.Context, c *hybridCounter) error {
+	c.mu.Lock()
+	base, key, window, delta, done, gen := c.base, c.key, c.window, c.pending, c.syncing, c.gen
+	c.mu.Unlock()
+
+	// The fixed window scripts also set the TTL of the window key. They are
+	// given no limit, as the requests were already admitted.
+	var total int64
+	var err error
+	current := true
+	ttl := window * 2
+	if redisStore, ok := serverTime(h.storage); ok {
+		// The script pushes to the window the server is in, and tells the
+		// time it is there.
+		var serverNow time.Time
+		_, total, serverNow, err = redisStore.FixedWindowIncrementServerTime(ctx, base, int(delta), math.MaxInt32, window, storage.WindowChange{}, ttl.Milliseconds())
+		if err == nil {
+			h.setOffset(serverNow)
+			current = storage.WindowKey(base, storage.WindowStart(serverNow, window), window) == key
+		}
+	} else if redisStore, ok := h.storage.(*storage.RedisMemory); ok {
+		_, total, err = redisStore.FixedWindowIncrement(ctx, key, int(delta), math.MaxInt32, ttl.Milliseconds())
+	} else {
+		total, err = h.storage.IncrementCtx(ctx, key, int(delta), ttl)
+	}
+
+	c.mu.Lock()
+	c.syncing = nil
+	c.lastSync = h.clockNow()
+	// The window may have ended while the store was being updated.
+	if err == nil && c.gen == gen {
+		c.pending -= delta
+		if current {
+			c.synced = total
+		}
+	}
+	c.mu.Unlock()
+	close(done)
+	return err
+}
+
+// Allow checks if a single request is allowed for the given key.
+func (h *HybridLimiter) Allow(key string) (bool, error) {
+	return h.AllowN(key, 1)
+}
+
+// AllowCtx is like Allow but honours ctx.
+func (h *HybridLimiter) AllowCtx(ctx context.Context, key string) (bool, error) {
+	return h.AllowNCtx(ctx, key, 1)
+}
+
+// AllowN checks if n requests are allowed for the given key.
+func (h *HybridLimiter) AllowN(key string, n int) (bool, error) {
+	return h.AllowNCtx(context.Background(), key, n)
+}
+
+// AllowNCtx is like AllowN but honours ctx.
+func (h *HybridLimiter) AllowNCtx(ctx context.Context, key string, n int) (bool, error) {
+	decision, err := h.DecideCtx(ctx, key, n)
+	if err != nil {
+		return false, err
+	}
+	return decision.Allowed, nil
+}
+
+// Decide checks if n requests are allowed for the given key in the current
+// window, against the global count of the last synchronization plus the
+// requests admitted locally since. It only waits for the store when the key
+// has reached SyncThreshold, and returns the error of that synchronization
+// if it fails.
+func (h *HybridLimiter) Decide(key string, n int) (*Decision, error) {
+	return h.DecideCtx(context.Background(), key, n)
+}
+
+// DecideCtx is like Decide but honours ctx.
+func (h *HybridLimiter) DecideCtx(ctx context.Context, key string, n int) (*Decision, error) {
+	cfg, err := h.config.resolve(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	threshold := h.config.syncThreshold(cfg.Rate)
+
+	flushed := false
+	for {
+		now, err := h.now(ctx)
+		if err != nil {
+			return nil, err
+		}
+		c := h.counter(key, cfg, now)
+		// A check of more than threshold requests needs a synchronization
+		// of its own, even with nothing pending.
+		if n > 0 && c.pending+int64(n) > threshold && (c.pending > 0 || !flushed) {
+			c.mu.Unlock()
+			if err := h.sync(ctx, c); err != nil {
+				return nil, err
+			}
+			flushed = true
+			continue
+		}
+
+		count := c.synced + c.pending
+		allowed := count+int64(n) <= int64(cfg.Rate)
+		if allowed {
+			c.pending += int64(n)
+			c.own += int64(n)
+			count += int64(n)
+		}
+		d := &Decision{
+			Allowed:   allowed,
+			Limit:     cfg.Rate,
+			Remaining: max(cfg.Rate-int(count), 0),
+			ResetAt:   now,
+		}
+		if count > 0 {
+			d.ResetAt = c.end
+		}
+		if !allowed {
+			d.RetryAfter = c.end.Sub(now)
+		}
+		due := c.syncing == nil && (c.lastSync.IsZero() || now.Sub(c.lastSync) >= h.config.SyncInterval || c.pending > threshold)
+		if due {
+			c.syncing = make(chan struct{})
+		}
+		c.mu.Unlock()
+
+		if due {
+			h.syncBackground(key, c)
+		}
+		return d, nil
+	}
+}
+
+// Reset clears the rate limit data for the given key in the current window,
+// locally and in the store. Other instances keep the count of their last
+// synchronization until their next one.
+func (h *HybridLimiter) Reset(key string) error {
+	return h.ResetCtx(context.Background(), key)
+}
+
+// ResetCtx is like Reset but honours ctx.
+func (h *HybridLimiter) ResetCtx(ctx context.Context, key string) error {
+	cfg, err := h.config.resolve(ctx, key)
+	if err != nil {
+		return err
+	}
+	now, err := h.now(ctx)
+	if err != nil {
+		return err
+	}
+	c := h.counter(key, cfg, now)
+	c.restart()
+	windowKey := c.key
+	c.mu.Unlock()
+	return h.storage.DeleteCtx(ctx, windowKey)
+}
+
+// Refund takes n requests back out of the current window of the given key.
+// Only requests this instance admitted in the window can be taken back, so
+// that it never takes back those of other instances. The store learns of it
+// with the next synchronization.
+func (h *HybridLimiter) Refund(key string, n int) error {
+	return h.RefundCtx(context.Background(), key, n)
+}
+
+// RefundCtx is like Refund but honours ctx.
+func (h *HybridLimiter) RefundCtx(ctx context.Context, key string, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	cfg, err := h.config.resolve(ctx, key)
+	if err != nil {
+		return err
+	}
+	now, err := h.now(ctx)
+	if err != nil {
+		return err
+	}
+	c := h.counter(key, cfg, now)
+	refund := min(int64(n), c.own)
+	c.pending -= refund
+	c.own -= refund
+	c.mu.Unlock()
+	return nil
+}
+
+// GetStats returns the current rate limit statistics for the given key, as
+// known locally.
+func (h *HybridLimiter) GetStats(key string) (*Stats, error) {
+	return h.GetStatsCtx(context.Background(), key)
+}
+
+// GetStatsCtx is like GetStats but honours ctx.
+func (h *HybridLimiter) GetStatsCtx(ctx context.Context, key string) (*Stats, error) {
+	return statsFromDecision(h.DecideCtx(ctx, key, 0))
+}
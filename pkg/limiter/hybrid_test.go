@@ -0,0 +1,231 @@
+package limiter_test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sumedhvats/rate-limiter-go/pkg/clock"
+	"github.com/sumedhvats/rate-limiter-go/pkg/limiter"
+	"github.com/sumedhvats/rate-limiter-go/pkg/storage"
+)
+
+func newHybrid(t *testing.T, store limiter.Storage, clk clock.Clock, rate, threshold int) *limiter.HybridLimiter {
+	h := limiter.NewHybridLimiter(store, limiter.HybridConfig{
+		Config:        limiter.Config{Rate: rate, Window: time.Minute, Clock: clk},
+		SyncInterval:  time.Hour,
+		SyncThreshold: threshold,
+	})
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+// storedCount returns the global count of key in the store.
+func storedCount(t *testing.T, store *storage.MemoryStorage, key string) int64 {
+	keys, err := store.Keys(key + ":")
+	if !assert.NoError(t, err) || !assert.Len(t, keys, 1) {
+		return 0
+	}
+	v, err := store.Get(keys[0])
+	assert.NoError(t, err)
+	count, _ := v.(int64)
+	return count
+}
+
+func TestHybridSharesCount(t *testing.T) {
+	ctx := context.Background()
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	store := storage.NewMemoryStorageWithClock(clk)
+	a := newHybrid(t, store, clk, 10, 3)
+	b := newHybrid(t, store, clk, 10, 3)
+
+	ok, err := a.AllowN("user", 6)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.NoError(t, a.Flush(ctx))
+
+	// b learns of a's requests when it synchronizes.
+	ok, err = b.Allow("user")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.NoError(t, b.Flush(ctx))
+	decision, err := b.Decide("user", 3)
+	assert.NoError(t, err)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, 0, decision.Remaining)
+	ok, err = b.Allow("user")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// a has not synchronized since, and admits one more past the limit.
+	ok, err = a.Allow("user")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.NoError(t, a.Flush(ctx))
+	assert.NoError(t, b.Flush(ctx))
+	assert.NoError(t, a.Flush(ctx))
+	assert.Equal(t, int64(11), storedCount(t, store, "user"))
+
+	// Both now know the window is full, until it ends.
+	for _, h := range []*limiter.HybridLimiter{a, b} {
+		decision, err = h.Decide("user", 1)
+		assert.NoError(t, err)
+		assert.False(t, decision.Allowed)
+		assert.Equal(t, 40*time.Second, decision.RetryAfter)
+	}
+	clk.Advance(40 * time.Second)
+	ok, err = a.AllowN("user", 10)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestHybridSyncThreshold(t *testing.T) {
+	ctx := context.Background()
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	store := storage.NewMemoryStorageWithClock(clk)
+	h := newHybrid(t, store, clk, 100, 5)
+
+	ok, err := h.Allow("user")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.NoError(t, h.Flush(ctx))
+
+	// The check that would take the key past five unsynchronized requests
+	// waits for them to reach the store, without an explicit Flush.
+	for i := 0; i < 6; i++ {
+		ok, err := h.Allow("user")
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	}
+	assert.Equal(t, int64(6), storedCount(t, store, "user"))
+
+	assert.NoError(t, h.Refund("user", 2))
+	assert.NoError(t, h.Flush(ctx))
+	assert.Equal(t, int64(5), storedCount(t, store, "user"))
+	stats, err := h.GetStats("user")
+	assert.NoError(t, err)
+	assert.Equal(t, 95, stats.Remaining)
+
+	assert.NoError(t, h.Reset("user"))
+	keys, err := store.Keys("user:")
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+	stats, err = h.GetStats("user")
+	assert.NoError(t, err)
+	assert.Equal(t, 100, stats.Remaining)
+}
+
+func TestHybridLargeChecks(t *testing.T) {
+	ctx := context.Background()
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	store := storage.NewMemoryStorageWithClock(clk)
+	a := newHybrid(t, store, clk, 10, 3)
+	b := newHybrid(t, store, clk, 10, 3)
+
+	ok, err := a.Allow("user")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.NoError(t, a.Flush(ctx))
+	ok, err = b.AllowN("user", 2)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.NoError(t, b.Flush(ctx))
+
+	// a has nothing pending, but a check past the threshold synchronizes
+	// first and sees b's requests.
+	ok, err = a.AllowN("user", 8)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	ok, err = a.AllowN("user", 7)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.NoError(t, a.Flush(ctx))
+	assert.Equal(t, int64(10), storedCount(t, store, "user"))
+}
+
+func TestHybridRefundsOwnRequests(t *testing.T) {
+	ctx := context.Background()
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	store := storage.NewMemoryStorageWithClock(clk)
+	a := newHybrid(t, store, clk, 10, 5)
+	b := newHybrid(t, store, clk, 10, 5)
+
+	ok, err := a.AllowN("user", 2)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.NoError(t, a.Flush(ctx))
+	ok, err = b.AllowN("user", 3)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.NoError(t, b.Flush(ctx))
+	assert.NoError(t, a.Flush(ctx))
+
+	// a only takes back the two requests it admitted, not b's.
+	assert.NoError(t, a.Refund("user", 5))
+	assert.NoError(t, a.Flush(ctx))
+	assert.Equal(t, int64(3), storedCount(t, store, "user"))
+	assert.NoError(t, a.Refund("user", 1))
+	assert.NoError(t, a.Flush(ctx))
+	assert.Equal(t, int64(3), storedCount(t, store, "user"))
+
+	// A new window starts with nothing to take back.
+	clk.Advance(time.Minute)
+	assert.NoError(t, b.Refund("user", 3))
+	assert.NoError(t, b.Flush(ctx))
+	keys, err := store.Keys("user:")
+	assert.NoError(t, err)
+	for _, key := range keys {
+		v, err := store.Get(key)
+		assert.NoError(t, err)
+		assert.GreaterOrEqual(t, v.(int64), int64(0))
+	}
+}
+
+func TestHybridWorstCaseOvershoot(t *testing.T) {
+	const (
+		instances = 4
+		workers   = 8
+		rate      = 1000
+		threshold = 10
+	)
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	store := storage.NewMemoryStorageWithClock(clk)
+
+	var admitted atomic.Int64
+	var wg sync.WaitGroup
+	limiters := make([]*limiter.HybridLimiter, instances)
+	for i := range limiters {
+		limiters[i] = newHybrid(t, store, clk, rate, threshold)
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(h *limiter.HybridLimiter) {
+				defer wg.Done()
+				// Keep going until this instance has seen the window full.
+				for denied := 0; denied < 100; {
+					ok, err := h.Allow("user")
+					if !assert.NoError(t, err) {
+						return
+					}
+					if ok {
+						admitted.Add(1)
+					} else {
+						denied++
+					}
+				}
+			}(limiters[i])
+		}
+	}
+	wg.Wait()
+	for _, h := range limiters {
+		assert.NoError(t, h.Flush(context.Background()))
+	}
+
+	overshoot := admitted.Load() - rate
+	t.Logf("admitted %d of %d, overshoot %d (bound %d)", admitted.Load(), rate, overshoot, (instances-1)*threshold)
+	assert.Equal(t, admitted.Load(), storedCount(t, store, "user"))
+	assert.GreaterOrEqual(t, overshoot, int64(0))
+	assert.LessOrEqual(t, overshoot, int64((instances-1)*threshold))
+}
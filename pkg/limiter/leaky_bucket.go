@@ -0,0 +1,220 @@
+// Package limiter provides rate limiting algorithm implementations.
+package limiter
+
+import (
+	"context"
+	"time"
+
+	"github.com/sumedhvats/rate-limiter-go/pkg/storage"
+)
+
+type leakyBucket struct {
+	level    float64
+	lastLeak time.Time
+}
+
+// LeakyBucketLimiter implements the leaky bucket rate limiting algorithm.
+// Every request adds to the bucket's level, which drains at a constant
+// Rate per Window. Requests that would overflow the bucket are denied. The
+// bucket holds a single request unless Burst is set, so by default admitted
+// requests are spaced Window/Rate apart; a larger Burst lets that many
+// through at once.
+type LeakyBucketLimiter struct {
+	storage Storage
+	config  Config
+}
+
+// NewLeakyBucketLimiter creates a new LeakyBucketLimiter.
+func NewLeakyBucketLimiter(store Storage, cfg Config) *LeakyBucketLimiter {
+	return &LeakyBucketLimiter{
+		storage: store,
+		config:  cfg,
+	}
+}
+
+// Allow checks if a single request can be added to the bucket for the given key.
+func (l *LeakyBucketLimiter) Allow(key string) (bool, error) {
+	return l.AllowN(key, 1)
+}
+
+// AllowCtx is like Allow but honours ctx.
+func (l *LeakyBucketLimiter) AllowCtx(ctx context.Context, key string) (bool, error) {
+	return l.AllowNCtx(ctx, key, 1)
+}
+
+// AllowN checks if n requests can be added to the bucket for the given key.
+func (l *LeakyBucketLimiter) AllowN(key string, n int) (bool, error) {
+	return l.AllowNCtx(context.Background(), key, n)
+}
+
+// AllowNCtx is like AllowN but honours ctx.
+func (l *LeakyBucketLimiter) AllowNCtx(ctx context.Context, key string, n int) (bool, error) {
+	decision, err := l.DecideCtx(ctx, key, n)
+	if err != nil {
+		return false, err
+	}
+	return decision.Allowed, nil
+}
+
+// Decide checks if n requests can be added to the bucket for the given key
+// and reports the bucket level left behind by that check.
+func (l *LeakyBucketLimiter) Decide(key string, n int) (*Decision, error) {
+	return l.DecideCtx(context.Background(), key, n)
+}
+
+// DecideCtx is like Decide but honours ctx.
+func (l *LeakyBucketLimiter) DecideCtx(ctx context.Context, key string, n int) (*Decision, error) {
+	l, err := l.forKey(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if redisStore, ok := l.storage.(*storage.RedisMemory); ok {
+		return l.decideRedis(ctx, redisStore, key, n)
+	}
+
+	return l.decideMemory(ctx, key, n)
+}
+
+// decideUndo is like DecideCtx but also returns a function that takes the
+// admitted requests back out of the bucket. See undoer.
+func (l *LeakyBucketLimiter) decideUndo(ctx context.Context, key string, n int) (*Decision, func(context.Context) error, error) {
+	d, err := l.DecideCtx(ctx, key, n)
+	if err != nil || !d.Allowed || n == 0 {
+		return d, nil, err
+	}
+	return d, func(ctx context.Context) error {
+		_, err := l.DecideCtx(ctx, key, -n)
+		return err
+	}, nil
+}
+
+// forKey returns the limiter to check key with: a copy using the key's
+// Config if the limiter has Overrides, or the limiter itself.
+func (l *LeakyBucketLimiter) forKey(ctx context.Context, key string) (*LeakyBucketLimiter, error) {
+	if l.config.Overrides == nil {
+		return l, nil
+	}
+	cfg, err := l.config.resolve(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return &LeakyBucketLimiter{storage: l.storage, config: cfg}, nil
+}
+
+// capacity returns the size of the bucket: Burst, or a single request when
+// unset. Unlike the token bucket, bursts are opt-in.
+func (l *LeakyBucketLimiter) capacity() int {
+	if l.config.Burst <= 0 {
+		return 1
+	}
+	return l.config.Burst
+}
+
+func (l *LeakyBucketLimiter) leakRate() float64 {
+	return float64(l.config.Rate) / l.config.Window.Seconds()
+}
+
+func (l *LeakyBucketLimiter) decideRedis(ctx context.Context, store *storage.RedisMemory, key string, n int) (*Decision, error) {
+	now := l.config.now()
+	allowed, level, err := store.LeakyBucketAllow(
+		ctx,
+		key,
+		n,
+		l.capacity(),
+		l.leakRate(),
+		now.UnixMilli(),
+		(l.config.Window * 2).Milliseconds(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return l.decision(allowed, level, n, now), nil
+}
+
+func (l *LeakyBucketLimiter) decideMemory(ctx context.Context, key string, n int) (*Decision, error) {
+	capacity := float64(l.capacity())
+
+	for {
+		now := l.config.now()
+		data, err := l.storage.GetCtx(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+
+		bucket := &leakyBucket{lastLeak: now}
+		if data != nil {
+			existing := data.(*leakyBucket)
+			elapsed := max(now.Sub(existing.lastLeak).Seconds(), 0)
+			bucket.level = max(existing.level-elapsed*l.leakRate(), 0)
+		}
+
+		allowed := bucket.level+float64(n) <= capacity
+		if n == 0 {
+			// Peek only; leave the stored bucket untouched.
+			return l.decision(allowed, bucket.level, n, now), nil
+		}
+		if allowed {
+			// A negative n takes requests back out of the bucket.
+			bucket.level = max(bucket.level+float64(n), 0)
+		}
+
+		swapped, err := compareAndSwap(ctx, l.storage, key, data, bucket, l.config.Window*2)
+		if err != nil {
+			return nil, err
+		}
+		if !swapped {
+			continue // Retry
+		}
+		return l.decision(allowed, bucket.level, n, now), nil
+	}
+}
+
+// decision builds a Decision from the level left in the bucket.
+func (l *LeakyBucketLimiter) decision(allowed bool, level float64, n int, now time.Time) *Decision {
+	capacity := l.capacity()
+	d := &Decision{
+		Allowed:   allowed,
+		Limit:     capacity,
+		Remaining: max(int(float64(capacity)-level), 0),
+		ResetAt:   now.Add(secondsToDuration(level / l.leakRate())),
+	}
+	if !allowed {
+		d.RetryAfter = secondsToDuration((level + float64(n) - float64(capacity)) / l.leakRate())
+	}
+	return d
+}
+
+// Reset clears the rate limit data for the given key.
+func (l *LeakyBucketLimiter) Reset(key string) error {
+	return l.ResetCtx(context.Background(), key)
+}
+
+// ResetCtx is like Reset but honours ctx.
+func (l *LeakyBucketLimiter) ResetCtx(ctx context.Context, key string) error {
+	return l.storage.DeleteCtx(ctx, key)
+}
+
+// Refund takes n requests back out of the bucket of the given key, never
+// taking its level below zero.
+func (l *LeakyBucketLimiter) Refund(key string, n int) error {
+	return l.RefundCtx(context.Background(), key, n)
+}
+
+// RefundCtx is like Refund but honours ctx.
+func (l *LeakyBucketLimiter) RefundCtx(ctx context.Context, key string, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	_, err := l.DecideCtx(ctx, key, -n)
+	return err
+}
+
+// GetStats returns the current rate limit statistics for the given key.
+func (l *LeakyBucketLimiter) GetStats(key string) (*Stats, error) {
+	return l.GetStatsCtx(context.Background(), key)
+}
+
+// GetStatsCtx is like GetStats but honours ctx.
+func (l *LeakyBucketLimiter) GetStatsCtx(ctx context.Context, key string) (*Stats, error) {
+	return statsFromDecision(l.DecideCtx(ctx, key, 0))
+}
@@ -0,0 +1,79 @@
+package limiter_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sumedhvats/rate-limiter-go/pkg/clock"
+	"github.com/sumedhvats/rate-limiter-go/pkg/limiter"
+	"github.com/sumedhvats/rate-limiter-go/pkg/storage"
+)
+
+func TestBasicLeakyBucket(t *testing.T) {
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	store := storage.NewMemoryStorageWithClock(clk)
+	cfg := limiter.Config{Rate: 10, Window: time.Second, Burst: 2, Clock: clk}
+	leaky := limiter.NewLeakyBucketLimiter(store, cfg)
+
+	for i := 0; i < 2; i++ {
+		ok, err := leaky.Allow("user1")
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	}
+
+	decision, err := leaky.Decide("user1", 1)
+	assert.NoError(t, err)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, 2, decision.Limit)
+	assert.Equal(t, 0, decision.Remaining)
+	assert.Equal(t, 100*time.Millisecond, decision.RetryAfter)
+
+	clk.Advance(decision.RetryAfter)
+	ok, err := leaky.Allow("user1")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestLeakyBucketConstantDrain(t *testing.T) {
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	store := storage.NewMemoryStorageWithClock(clk)
+	// Burst is unset: the bucket holds a single request.
+	cfg := limiter.Config{Rate: 20, Window: time.Second, Clock: clk}
+	leaky := limiter.NewLeakyBucketLimiter(store, cfg)
+
+	allowed := 0
+	for i := 0; i < 500; i++ {
+		if ok, _ := leaky.Allow("drain"); ok {
+			allowed++
+		}
+		clk.Advance(time.Millisecond)
+	}
+
+	// A bucket of size 1 drains one request every 50ms: no bursts.
+	assert.Equal(t, 10, allowed)
+
+	decision, err := leaky.Decide("drain", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, decision.Limit)
+}
+
+func TestLeakyBucketStats(t *testing.T) {
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	store := storage.NewMemoryStorageWithClock(clk)
+	cfg := limiter.Config{Rate: 10, Window: time.Minute, Burst: 5, Clock: clk}
+	leaky := limiter.NewLeakyBucketLimiter(store, cfg)
+
+	ok, _ := leaky.AllowN("user1", 3)
+	assert.True(t, ok)
+
+	stats, err := leaky.GetStats("user1")
+	assert.NoError(t, err)
+	assert.Equal(t, 5, stats.Limit)
+	assert.Equal(t, 2, stats.Remaining)
+	assert.Equal(t, clk.Now().Add(18*time.Second), stats.ResetAt)
+
+	assert.NoError(t, leaky.Reset("user1"))
+	stats, _ = leaky.GetStats("user1")
+	assert.Equal(t, 5, stats.Remaining)
+}
@@ -0,0 +1,422 @@
+// Package limiter provides rate limiting algorithm implementations.
+package limiter
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sumedhvats/rate-limiter-go/pkg/clock"
+)
+
+// LeaseConfig holds the configuration for a LeasingLimiter.
+type LeaseConfig struct {
+	// MinLease is the smallest number of requests leased at once. It
+	// defaults to 1.
+	MinLease int
+	// MaxLease is the largest number of requests leased at once. Requests an
+	// instance holds are unavailable to the others until it uses or returns
+	// them, so keep it well below the limit. It defaults to 100.
+	MaxLease int
+	// LeaseTTL is how long a lease is served from before its unused requests
+	// are returned. Leases from a FixedWindowLimiter also end with their
+	// window. It defaults to 1 second.
+	LeaseTTL time.Duration
+	// Clock is the time source. It defaults to clock.Real.
+	Clock clock.Clock
+}
+
+// withDefaults returns the config with every unset field defaulted.
+func (c LeaseConfig) withDefaults() LeaseConfig {
+	if c.MinLease <= 0 {
+		c.MinLease = 1
+	}
+	if c.MaxLease <= 0 {
+		c.MaxLease = 100
+	}
+	c.MaxLease = max(c.MaxLease, c.MinLease)
+	if c.LeaseTTL <= 0 {
+		c.LeaseTTL = time.Second
+	}
+	return c
+}
+
+// now returns the current time according to the configured Clock.
+func (c LeaseConfig) now() time.Time {
+	return clock.OrReal(c.Clock).Now()
+}
+
+// windowedLimiter is implemented by limiters whose admitted requests only
+// count against the window they were admitted in, such as
+// FixedWindowLimiter. Their decisions admitting requests reset when that
+// window ends.
+type windowedLimiter interface {
+	windowed()
+}
+
+// LeasingLimiter serves checks of hot keys from blocks of requests leased
+// from another limiter, typically a TokenBucketLimiter or FixedWindowLimiter
+// on Redis. Leasing a block is a single check of the whole block, so a key
+// making thousands of requests per second costs a few round trips instead of
+// thousands. Requests left unused when a lease ends, after LeaseTTL or with
+// the window it was taken in, are given back with Refund; so are those held
+// when Close is called.
+//
+// Leases are taken without holding up the key: while one check waits for
+// the source, others are served from what is left of the lease, and those
+// that need more wait for that check instead of asking the source too.
+//
+// The size of each key's leases follows its demand on this instance: it
+// doubles when a lease is used up before it ends and halves when most of one
+// goes unused, between MinLease and MaxLease. Near the limit, leases shrink
+// to what is left, so instances together never admit more than the limit;
+// but requests leased by one instance are unavailable to the others until
+// it uses or returns them.
+type LeasingLimiter struct {
+	source Limiter
+	config LeaseConfig
+
+	leases sync.Map // key -> *lease
+	stop   chan struct{}
+	once   sync.Once
+	closed atomic.Bool
+}
+
+// lease is the block of requests an instance holds for a key.
+type lease struct {
+	mu     sync.Mutex
+	tokens int
+	// served is how many requests were served from the lease since it was
+	// taken, which is as many as can be refunded to it.
+	served  int
+	size    int
+	expires time.Time
+	// end is when the window the lease was taken in ends, for sources that
+	// implement windowedLimiter. Requests leased in a window that is over
+	// cannot be given back.
+	end time.Time
+	// decision is the source's decision on the lease, which checks served
+	// from it report their limit and timings from.
+	decision Decision
+	// refilling is set while a check is taking a lease from the source, and
+	// closed when it is done.
+	refilling chan struct{}
+	// removed is set once the lease is dropped from the limiter.
+	removed bool
+}
+
+// NewLeasingLimiter creates a LeasingLimiter leasing requests from source,
+// and starts returning expired leases in the background.
+func NewLeasingLimiter(source Limiter, cfg LeaseConfig) *LeasingLimiter {
+	l := &LeasingLimiter{
+		source: source,
+		config: cfg.withDefaults(),
+		stop:   make(chan struct{}),
+	}
+	go l.expireLoop()
+	return l
+}
+
+// expireLoop returns the unused requests of expired leases every LeaseTTL,
+// and drops the leases of keys that are no longer used, until Close is
+// called.
+func (l *LeasingLimiter) expireLoop() {
+	ticker := time.NewTicker(l.config.LeaseTTL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+
+		now := l.config.now()
+		l.leases.Range(func(k, v any) bool {
+			le := v.(*lease)
+			var unused int
+			le.mu.Lock()
+			switch {
+			case le.tokens > 0 && !now.Before(le.expires):
+				unused = l.end(le, now)
+			case le.tokens == 0 && le.refilling == nil && now.Sub(le.expires) >= 2*l.config.LeaseTTL:
+				le.removed = true
+				l.leases.CompareAndDelete(k, le)
+			}
+			le.mu.Unlock()
+			// Requests that cannot be given back come back with the next
+			// window or refill anyway.
+			_ = l.giveBack(context.Background(), k.(string), unused)
+			return true
+		})
+	}
+}
+
+// Close stops returning expired leases in the background and returns the
+// unused requests of every lease. Checks made after Close go straight to the
+// source.
+func (l *LeasingLimiter) Close() error {
+	l.once.Do(func() { close(l.stop) })
+	l.closed.Store(true)
+
+	var errs []error
+	now := l.config.now()
+	l.leases.Range(func(k, v any) bool {
+		le := v.(*lease)
+		le.mu.Lock()
+		// A lease being taken is given back once it is.
+		for le.refilling != nil {
+			done := le.refilling
+			le.mu.Unlock()
+			<-done
+			le.mu.Lock()
+		}
+		unused := l.end(le, now)
+		le.mu.Unlock()
+		if err := l.giveBack(context.Background(), k.(string), unused); err != nil {
+			errs = append(errs, err)
+		}
+		return true
+	})
+	return errors.Join(errs...)
+}
+
+// lease returns the lease of key, locked.
+func (l *LeasingLimiter) lease(key string) *lease {
+	for {
+		v, ok := l.leases.Load(key)
+		if !ok {
+			v, _ = l.leases.LoadOrStore(key, &lease{size: l.config.MinLease})
+		}
+		le := v.(*lease)
+		le.mu.Lock()
+		if !le.removed {
+			return le
+		}
+		le.mu.Unlock()
+	}
+}
+
+// end ends le, halving the lease size if most of it went unused, and returns
+// how many of its requests are to be given back to the source: none if the
+// window it was taken in is over. le.mu must be held.
+func (l *LeasingLimiter) end(le *lease, now time.Time) int {
+	unused := le.tokens
+	le.tokens = 0
+	le.served = 0
+	le.expires = now
+	if unused > le.size/2 {
+		le.size = max(le.size/2, l.config.MinLease)
+	}
+	if !le.end.IsZero() && !now.Before(le.end) {
+		return 0
+	}
+	return unused
+}
+
+// giveBack refunds n requests of key to the source.
+func (l *LeasingLimiter) giveBack(ctx context.Context, key string, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	return l.source.RefundCtx(ctx, key, n)
+}
+
+// take leases enough requests from the source for n more, and returns the
+// source's decision. The lease size doubles if the last lease was used up
+// before it ended. le.mu must be held, and is released while the source is
+// checked; other checks needing more than the lease holds wait on
+// le.refilling meanwhile.
+func (l *LeasingLimiter) take(ctx context.Context, key string, le *lease, n int, now time.Time) (*Decision, error) {
+	if now.Before(le.expires) {
+		le.size = min(le.size*2, l.config.MaxLease)
+	}
+	need := n - le.tokens
+	want := max(le.size, need)
+	done := make(chan struct{})
+	le.refilling = done
+	le.mu.Unlock()
+
+	d, err := l.source.DecideCtx(ctx, key, want)
+	// Near the limit, lease only what is left.
+	if err == nil && !d.Allowed && d.Remaining >= need && d.Remaining < want {
+		want = d.Remaining
+		d, err = l.source.DecideCtx(ctx, key, want)
+	}
+
+	le.mu.Lock()
+	le.refilling = nil
+	close(done)
+	if err != nil {
+		return nil, err
+	}
+	if !d.Allowed {
+		return d, nil
+	}
+
+	expires := now.Add(l.config.LeaseTTL)
+	var end time.Time
+	if _, ok := l.source.(windowedLimiter); ok {
+		end = d.ResetAt
+		if end.Before(expires) {
+			expires = end
+		}
+	}
+	if le.tokens == 0 {
+		le.served = 0
+	}
+	le.tokens += want
+	le.expires = expires
+	le.end = end
+	le.decision = *d
+	return d, nil
+}
+
+// Allow checks if a single request is allowed for the given key.
+func (l *LeasingLimiter) Allow(key string) (bool, error) {
+	return l.AllowN(key, 1)
+}
+
+// AllowCtx is like Allow but honours ctx.
+func (l *LeasingLimiter) AllowCtx(ctx context.Context, key string) (bool, error) {
+	return l.AllowNCtx(ctx, key, 1)
+}
+
+// AllowN checks if n requests are allowed for the given key.
+func (l *LeasingLimiter) AllowN(key string, n int) (bool, error) {
+	return l.AllowNCtx(context.Background(), key, n)
+}
+
+// AllowNCtx is like AllowN but honours ctx.
+func (l *LeasingLimiter) AllowNCtx(ctx context.Context, key string, n int) (bool, error) {
+	decision, err := l.DecideCtx(ctx, key, n)
+	if err != nil {
+		return false, err
+	}
+	return decision.Allowed, nil
+}
+
+// Decide checks if n requests are allowed for the given key, serving them
+// from the key's lease and only checking the source when the lease runs out
+// or ends. Remaining counts the requests left at the source when the lease
+// was taken plus those still held in the lease.
+func (l *LeasingLimiter) Decide(key string, n int) (*Decision, error) {
+	return l.DecideCtx(context.Background(), key, n)
+}
+
+// DecideCtx is like Decide but honours ctx.
+func (l *LeasingLimiter) DecideCtx(ctx context.Context, key string, n int) (*Decision, error) {
+	for {
+		now := l.config.now()
+		le := l.lease(key)
+		// Close has given back every lease, or does once it gets to this one.
+		if l.closed.Load() {
+			le.mu.Unlock()
+			return l.source.DecideCtx(ctx, key, n)
+		}
+
+		if le.tokens > 0 && !now.Before(le.expires) {
+			unused := l.end(le, now)
+			le.mu.Unlock()
+			if err := l.giveBack(ctx, key, unused); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if n == 0 {
+			tokens := le.tokens
+			le.mu.Unlock()
+			d, err := l.source.DecideCtx(ctx, key, 0)
+			if err != nil {
+				return nil, err
+			}
+			d.Remaining += tokens
+			return d, nil
+		}
+		if le.tokens < n && le.refilling != nil {
+			// Another check is taking a lease: wait for it rather than
+			// asking the source too.
+			done := le.refilling
+			le.mu.Unlock()
+			select {
+			case <-done:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			continue
+		}
+		if le.tokens < n {
+			d, err := l.take(ctx, key, le, n, now)
+			if err != nil || !d.Allowed {
+				if d != nil {
+					d.Remaining += le.tokens
+				}
+				le.mu.Unlock()
+				return d, err
+			}
+			// Checks served while the source was checked may have left
+			// too few.
+			if le.tokens < n {
+				le.mu.Unlock()
+				continue
+			}
+		}
+
+		le.tokens -= n
+		le.served += n
+		d := le.decision
+		d.Remaining += le.tokens
+		le.mu.Unlock()
+		return &d, nil
+	}
+}
+
+// Reset clears the rate limit data for the given key at the source, and
+// drops the requests leased for it.
+func (l *LeasingLimiter) Reset(key string) error {
+	return l.ResetCtx(context.Background(), key)
+}
+
+// ResetCtx is like Reset but honours ctx.
+func (l *LeasingLimiter) ResetCtx(ctx context.Context, key string) error {
+	le := l.lease(key)
+	le.tokens = 0
+	le.served = 0
+	le.mu.Unlock()
+	return l.source.ResetCtx(ctx, key)
+}
+
+// Refund gives n requests back to the given key. They are added to its lease
+// if it is still running, up to the number served from it since it was
+// taken, and refunded to the source otherwise.
+func (l *LeasingLimiter) Refund(key string, n int) error {
+	return l.RefundCtx(context.Background(), key, n)
+}
+
+// RefundCtx is like Refund but honours ctx.
+func (l *LeasingLimiter) RefundCtx(ctx context.Context, key string, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	le := l.lease(key)
+	if !l.closed.Load() && l.config.now().Before(le.expires) {
+		credit := min(n, le.served)
+		le.tokens += credit
+		le.served -= credit
+		n -= credit
+	}
+	le.mu.Unlock()
+	return l.giveBack(ctx, key, n)
+}
+
+// GetStats returns the current rate limit statistics for the given key at
+// the source, counting the requests held in its lease as remaining.
+func (l *LeasingLimiter) GetStats(key string) (*Stats, error) {
+	return l.GetStatsCtx(context.Background(), key)
+}
+
+// GetStatsCtx is like GetStats but honours ctx.
+func (l *LeasingLimiter) GetStatsCtx(ctx context.Context, key string) (*Stats, error) {
+	return statsFromDecision(l.DecideCtx(ctx, key, 0))
+}
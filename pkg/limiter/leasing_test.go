@@ -0,0 +1,263 @@
+package limiter_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sumedhvats/rate-limiter-go/pkg/clock"
+	"github.com/sumedhvats/rate-limiter-go/pkg/limiter"
+	"github.com/sumedhvats/rate-limiter-go/pkg/storage"
+)
+
+// countingLimiter counts the checks made on a Limiter.
+type countingLimiter struct {
+	limiter.Limiter
+	checks atomic.Int64
+}
+
+func (c *countingLimiter) DecideCtx(ctx context.Context, key string, n int) (*limiter.Decision, error) {
+	c.checks.Add(1)
+	return c.Limiter.DecideCtx(ctx, key, n)
+}
+
+func TestLeasingAdaptsToDemand(t *testing.T) {
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	source := &countingLimiter{Limiter: limiter.NewTokenBucketLimiter(storage.NewMemoryStorageWithClock(clk), limiter.Config{
+		Rate:   1000,
+		Window: time.Hour,
+		Clock:  clk,
+	})}
+	l := limiter.NewLeasingLimiter(source, limiter.LeaseConfig{MaxLease: 64, LeaseTTL: time.Second, Clock: clk})
+	defer l.Close()
+
+	// Leases double from 1 up to 64 as the key keeps using them up: 9 checks
+	// lease 255 requests.
+	for i := 0; i < 200; i++ {
+		ok, err := l.Allow("user")
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	}
+	assert.Equal(t, int64(9), source.checks.Load())
+	stats, err := source.GetStats("user")
+	assert.NoError(t, err)
+	assert.Equal(t, 1000-255, stats.Remaining)
+	stats, err = l.GetStats("user")
+	assert.NoError(t, err)
+	assert.Equal(t, 1000-200, stats.Remaining)
+
+	// Once the lease ends, its unused requests are given back and the next
+	// lease is halved.
+	clk.Advance(time.Second)
+	ok, err := l.Allow("user")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	stats, err = source.GetStats("user")
+	assert.NoError(t, err)
+	assert.Equal(t, 1000-201-31, stats.Remaining)
+
+	assert.NoError(t, l.Close())
+	stats, err = source.GetStats("user")
+	assert.NoError(t, err)
+	assert.Equal(t, 1000-201, stats.Remaining)
+}
+
+func TestLeasingNearLimit(t *testing.T) {
+	source := limiter.NewFixedWindowLimiter(storage.NewMemoryStorage(), limiter.Config{Rate: 10, Window: time.Hour})
+	cfg := limiter.LeaseConfig{MinLease: 4, MaxLease: 8, LeaseTTL: time.Hour}
+	a := limiter.NewLeasingLimiter(source, cfg)
+	defer a.Close()
+	b := limiter.NewLeasingLimiter(source, cfg)
+	defer b.Close()
+
+	// Leases shrink to what is left, so the instances never admit more than
+	// the limit together.
+	admitted := 0
+	for i := 0; i < 20; i++ {
+		for _, l := range []*limiter.LeasingLimiter{a, b} {
+			ok, err := l.Allow("user")
+			assert.NoError(t, err)
+			if ok {
+				admitted++
+			}
+		}
+	}
+	assert.Equal(t, 10, admitted)
+
+	decision, err := a.Decide("user", 1)
+	assert.NoError(t, err)
+	assert.False(t, decision.Allowed)
+	assert.Greater(t, decision.RetryAfter, time.Duration(0))
+}
+
+func TestLeasingEndsWithWindow(t *testing.T) {
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	source := limiter.NewFixedWindowLimiter(storage.NewMemoryStorageWithClock(clk), limiter.Config{
+		Rate:   10,
+		Window: time.Minute,
+		Clock:  clk,
+	})
+	l := limiter.NewLeasingLimiter(source, limiter.LeaseConfig{MinLease: 8, LeaseTTL: time.Hour, Clock: clk})
+	defer l.Close()
+
+	ok, err := l.Allow("user")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// The lease ends with its window, and its unused requests are not given
+	// back to the next one.
+	clk.Advance(40 * time.Second)
+	ok, err = source.AllowN("user", 2)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = l.Allow("user")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	stats, err := source.GetStats("user")
+	assert.NoError(t, err)
+	assert.Equal(t, 10-2-8, stats.Remaining)
+}
+
+func TestLeasingRefundAndReset(t *testing.T) {
+	source := limiter.NewFixedWindowLimiter(storage.NewMemoryStorage(), limiter.Config{Rate: 10, Window: time.Hour})
+	l := limiter.NewLeasingLimiter(source, limiter.LeaseConfig{MinLease: 5, LeaseTTL: time.Hour})
+	defer l.Close()
+
+	ok, err := l.AllowN("user", 5)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.NoError(t, l.Refund("user", 2))
+	decision, err := l.Decide("user", 2)
+	assert.NoError(t, err)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, 5, decision.Remaining)
+
+	assert.NoError(t, l.Reset("user"))
+	stats, err := l.GetStats("user")
+	assert.NoError(t, err)
+	assert.Equal(t, 10, stats.Remaining)
+}
+
+func TestLeasingWindowFromSource(t *testing.T) {
+	// The source's clock runs 30s ahead, so its window ends at 2m while the
+	// leasing limiter's own clock would put the end at 1m.
+	clk := clock.NewManual(time.Unix(1_700_000_020, 0)) // 40s into a minute
+	sourceClock := clock.NewManual(clk.Now().Add(30 * time.Second))
+	source := limiter.NewFixedWindowLimiter(storage.NewMemoryStorageWithClock(sourceClock), limiter.Config{
+		Rate:   10,
+		Window: time.Minute,
+		Clock:  sourceClock,
+	})
+	l := limiter.NewLeasingLimiter(source, limiter.LeaseConfig{MinLease: 8, LeaseTTL: time.Hour, Clock: clk})
+	defer l.Close()
+
+	ok, err := l.Allow("user")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// The lease runs until the source's window ends.
+	clk.Advance(25 * time.Second)
+	sourceClock.Advance(25 * time.Second)
+	ok, err = l.Allow("user")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	stats, err := source.GetStats("user")
+	assert.NoError(t, err)
+	assert.Equal(t, 10-8, stats.Remaining)
+}
+
+func TestLeasingAfterClose(t *testing.T) {
+	source := limiter.NewFixedWindowLimiter(storage.NewMemoryStorage(), limiter.Config{Rate: 10, Window: time.Hour})
+	l := limiter.NewLeasingLimiter(source, limiter.LeaseConfig{MinLease: 5, LeaseTTL: time.Hour})
+
+	ok, err := l.Allow("user")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.NoError(t, l.Close())
+
+	// Checks made after Close take exactly what they ask for from the source.
+	decision, err := l.Decide("user", 2)
+	assert.NoError(t, err)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, 10-3, decision.Remaining)
+	assert.NoError(t, l.Refund("user", 2))
+	stats, err := source.GetStats("user")
+	assert.NoError(t, err)
+	assert.Equal(t, 10-1, stats.Remaining)
+}
+
+func TestLeasingRefundsWhatItServed(t *testing.T) {
+	source := limiter.NewFixedWindowLimiter(storage.NewMemoryStorage(), limiter.Config{Rate: 10, Window: time.Hour})
+	l := limiter.NewLeasingLimiter(source, limiter.LeaseConfig{MinLease: 5, LeaseTTL: time.Hour})
+	defer l.Close()
+
+	// Two requests were admitted at the source by another instance.
+	ok, err := source.AllowN("user", 2)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = l.Allow("user")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// Only the request served from the lease goes back to it; the others go
+	// back to the source.
+	assert.NoError(t, l.Refund("user", 3))
+	stats, err := source.GetStats("user")
+	assert.NoError(t, err)
+	assert.Equal(t, 10-5, stats.Remaining)
+	stats, err = l.GetStats("user")
+	assert.NoError(t, err)
+	assert.Equal(t, 10, stats.Remaining)
+}
+
+func TestLeasingServesDuringRefill(t *testing.T) {
+	gated := &gatedLimiter{
+		Limiter: limiter.NewFixedWindowLimiter(storage.NewMemoryStorage(), limiter.Config{Rate: 100, Window: time.Hour}),
+		started: map[string]chan struct{}{},
+		gates:   map[string]chan struct{}{},
+	}
+	l := limiter.NewLeasingLimiter(gated, limiter.LeaseConfig{MinLease: 4, MaxLease: 4, LeaseTTL: time.Hour})
+	defer l.Close()
+
+	ok, err := l.Allow("user")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// A check needing more than the lease holds waits for the source...
+	gated.started["user"] = make(chan struct{})
+	gated.gates["user"] = make(chan struct{})
+	refilled := make(chan struct{})
+	go func() {
+		defer close(refilled)
+		ok, err := l.AllowN("user", 5)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	}()
+	<-gated.started["user"]
+
+	// ...while smaller ones are still served from the lease.
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		ok, err := l.AllowN("user", 2)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	}()
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatal("check held up by the refill")
+	}
+
+	close(gated.gates["user"])
+	<-refilled
+	delete(gated.gates, "user")
+	stats, err := gated.GetStats("user")
+	assert.NoError(t, err)
+	assert.Equal(t, 100-8, stats.Remaining)
+	stats, err = l.GetStats("user")
+	assert.NoError(t, err)
+	assert.Equal(t, 100-8, stats.Remaining)
+}
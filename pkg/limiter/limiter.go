@@ -1,39 +1,122 @@
 // Package limiter provides rate limiting algorithm implementations.
 package limiter
 
-import "time"
+import (
+	"context"
+	"math"
+	"time"
 
-// stats holds the current rate limit statistics for a key.
-type stats struct {
+	"github.com/sumedhvats/rate-limiter-go/pkg/clock"
+	"github.com/sumedhvats/rate-limiter-go/pkg/storage"
+)
+
+// Stats holds the current rate limit statistics for a key. The fields have
+// the same meaning for every algorithm and storage backend.
+type Stats struct {
+	// Limit is the maximum number of requests the key can make at once
+	// (Burst for token bucket, Rate for the window algorithms).
+	Limit int
+	// Remaining is the number of requests the key can make right now.
+	Remaining int
+	// ResetAt is the time when Remaining will be back at Limit if no further
+	// requests are made. It is the current time when nothing has been used.
+	ResetAt time.Time
+}
+
+// Decision is the outcome of a rate limit check. All fields are computed
+// from the same state that produced Allowed.
+type Decision struct {
+	// Allowed reports whether the request may proceed.
+	Allowed bool
 	// Limit is the configured rate limit (e.g., Burst for token bucket).
-	Limit     int
-	// Remaining is the number of requests remaining in the current window.
+	Limit int
+	// Remaining is the number of requests remaining after this check.
 	Remaining int
-	// ResetAt is the time when the rate limit window resets.
-	ResetAt   time.Time
+	// RetryAfter is how long to wait before the same request could be allowed.
+	// It is zero when the request was allowed.
+	RetryAfter time.Duration
+	// ResetAt is the time when the rate limit is fully replenished.
+	ResetAt time.Time
+	// DeniedBy names the limit that denied the request when a limiter
+	// enforces several limits, such as PolicyLimiter. It is empty when the
+	// request was allowed or the limiter has a single limit.
+	DeniedBy string
 }
 
 // Limiter is the interface for a rate limiter.
+//
+// Every method has a Ctx variant that passes ctx down to the storage, so
+// deadlines and cancellation reach Redis. The plain methods use
+// context.Background().
 type Limiter interface {
 	// Allow checks if a single request (n=1) is allowed for the given key.
 	Allow(key string) (bool, error)
 	// AllowN checks if n requests are allowed for the given key.
 	AllowN(key string, n int) (bool, error)
+	// Decide checks if n requests are allowed for the given key and returns
+	// the full decision, including the limit, remaining quota and timings.
+	Decide(key string, n int) (*Decision, error)
 	// Reset clears the rate limit data for the given key.
 	Reset(key string) error
-	// GetStats returns the current rate limit statistics for the given key.
-	GetStats(key string) (*stats, error)
+	// GetStats returns the current rate limit statistics for the given key
+	// without consuming anything. It reports what Decide(key, 0) would.
+	GetStats(key string) (*Stats, error)
+
+	// AllowCtx is like Allow but honours ctx.
+	AllowCtx(ctx context.Context, key string) (bool, error)
+	// AllowNCtx is like AllowN but honours ctx.
+	AllowNCtx(ctx context.Context, key string, n int) (bool, error)
+	// DecideCtx is like Decide but honours ctx.
+	DecideCtx(ctx context.Context, key string, n int) (*Decision, error)
+	// ResetCtx is like Reset but honours ctx.
+	ResetCtx(ctx context.Context, key string) error
+	// GetStatsCtx is like GetStats but honours ctx.
+	GetStatsCtx(ctx context.Context, key string) (*Stats, error)
+
+	// Refund gives n requests back to the given key, for requests that were
+	// allowed but never served, e.g. because the upstream failed. Window
+	// algorithms take them back out of the current window; requests counted
+	// in a window that has since ended cannot be refunded.
+	Refund(key string, n int) error
+	// RefundCtx is like Refund but honours ctx.
+	RefundCtx(ctx context.Context, key string, n int) error
 }
 
 // Config holds the configuration for a rate limiter.
 type Config struct {
 	// Rate is the number of requests allowed per window.
-	Rate   int
+	Rate int
 	// Window is the time duration of the rate limit window.
 	Window time.Duration
 	// Burst is the maximum number of requests allowed in a burst.
-	// This is typically used by Token Bucket algorithms.
-	Burst  int
+	// This is typically used by Token Bucket algorithms and defaults to Rate.
+	// For the leaky bucket it is the bucket size and defaults to 1.
+	Burst int
+	// Clock is the time source. It defaults to clock.Real; tests can pass a
+	// *clock.Manual to control time. Use the same clock for a MemoryStorage
+	// (see storage.NewMemoryStorageWithClock) so that keys expire in step.
+	Clock clock.Clock
+	// Overrides optionally resolves a different Config per key, such as the
+	// limits of a pricing tier. It is consulted on every check.
+	Overrides Overrides
+}
+
+// burst returns the configured Burst, falling back to Rate when unset.
+func (c Config) burst() int {
+	if c.Burst <= 0 {
+		return c.Rate
+	}
+	return c.Burst
+}
+
+// clock returns the configured Clock, falling back to clock.Real when unset.
+func (c Config) clock() clock.Clock {
+	return clock.OrReal(c.Clock)
+}
+
+// now returns the current time according to the configured Clock.
+func (c Config) now() time.Time {
+	return c.clock().Now()
 }
 
 // Storage is the interface for storing rate limit data.
@@ -46,4 +129,117 @@ type Storage interface {
 	Increment(key string, value int, ttl time.Duration) (int64, error)
 	// Delete removes a key from the store.
 	Delete(key string) error
-}
\ No newline at end of file
+
+	// GetCtx is like Get but honours ctx.
+	GetCtx(ctx context.Context, key string) (interface{}, error)
+	// SetCtx is like Set but honours ctx.
+	SetCtx(ctx context.Context, key string, value interface{}, ttl time.Duration) error
+	// IncrementCtx is like Increment but honours ctx.
+	IncrementCtx(ctx context.Context, key string, value int, ttl time.Duration) (int64, error)
+	// DeleteCtx is like Delete but honours ctx.
+	DeleteCtx(ctx context.Context, key string) error
+}
+
+// statsFromDecision converts a Decide(key, 0) result into Stats.
+func statsFromDecision(d *Decision, err error) (*Stats, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &Stats{
+		Limit:     d.Limit,
+		Remaining: d.Remaining,
+		ResetAt:   d.ResetAt,
+	}, nil
+}
+
+// casStorage is implemented by storages that can atomically swap a value,
+// such as storage.MemoryStorage.
+type casStorage interface {
+	CompareAndSwap(key string, old, new interface{}, ttl time.Duration) (bool, error)
+}
+
+// compareAndSwap stores new under key if the current value is still old.
+// Storages without compare-and-swap support fall back to a plain Set.
+func compareAndSwap(ctx context.Context, store Storage, key string, old, new interface{}, ttl time.Duration) (bool, error) {
+	if redisStore, ok := store.(*storage.RedisMemory); ok {
+		return redisStore.CompareAndSwapCtx(ctx, key, old, new, ttl)
+	}
+	if cs, ok := store.(casStorage); ok {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		return cs.CompareAndSwap(key, old, new, ttl)
+	}
+	if err := store.SetCtx(ctx, key, new, ttl); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// refundCounters takes up to n back out of the counters at keys, in order,
+// never taking a counter below zero. On Redis this happens atomically.
+func refundCounters(ctx context.Context, store Storage, keys []string, n int, ttl time.Duration) error {
+	if redisStore, ok := store.(*storage.RedisMemory); ok {
+		_, err := redisStore.RefundCounters(ctx, keys, n)
+		return err
+	}
+
+	for _, key := range keys {
+		for n > 0 {
+			data, err := store.GetCtx(ctx, key)
+			if err != nil {
+				return err
+			}
+			if data == nil || data.(int64) <= 0 {
+				break
+			}
+			count := data.(int64)
+			taken := min(count, int64(n))
+			swapped, err := compareAndSwap(ctx, store, key, data, count-taken, ttl)
+			if err != nil {
+				return err
+			}
+			if swapped {
+				n -= int(taken)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// serverTime returns store as a RedisMemory if it reads the current time
+// from the Redis server. See storage.RedisMemory.WithServerTime.
+func serverTime(store Storage) (*storage.RedisMemory, bool) {
+	redisStore, ok := store.(*storage.RedisMemory)
+	return redisStore, ok && redisStore.ServerTime()
+}
+
+// storeNow returns the current time: that of the Redis server if store reads
+// the time from the server, and that of cfg's Clock otherwise.
+func storeNow(ctx context.Context, store Storage, cfg Config) (time.Time, error) {
+	if redisStore, ok := serverTime(store); ok {
+		return redisStore.Time(ctx)
+	}
+	return cfg.now(), nil
+}
+
+// changeNow returns the time SetConfig locates the window in progress at:
+// that of the Redis server if store reads the time from the server and it
+// answers, and that of cfg's Clock otherwise.
+func changeNow(store Storage, cfg Config) time.Time {
+	now, err := storeNow(context.Background(), store, cfg)
+	if err != nil {
+		return cfg.now()
+	}
+	return now
+}
+
+// secondsToDuration converts fractional seconds to a Duration, rounding up
+// so that waiting the returned duration is always long enough.
+func secondsToDuration(seconds float64) time.Duration {
+	if seconds <= 0 {
+		return 0
+	}
+	return time.Duration(math.Ceil(seconds * float64(time.Second)))
+}
@@ -0,0 +1,255 @@
+// Package limiter provides rate limiting algorithm implementations.
+package limiter
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sumedhvats/rate-limiter-go/pkg/clock"
+	"github.com/sumedhvats/rate-limiter-go/pkg/storage"
+)
+
+// Overrides resolves the Config of individual keys, such as the limits of a
+// pricing tier or of a custom contract. Set it as Config.Overrides.
+//
+// The Rate, Window and Burst of an override replace those of the limiter;
+// fields left zero keep the limiter's values. Clock is always the limiter's.
+type Overrides interface {
+	// Override returns the Config to use for key, and false if key uses the
+	// limiter's own Config.
+	Override(ctx context.Context, key string) (Config, bool, error)
+}
+
+// OverridesFunc adapts a function to the Overrides interface.
+type OverridesFunc func(ctx context.Context, key string) (Config, bool, error)
+
+// Override calls f(ctx, key).
+func (f OverridesFunc) Override(ctx context.Context, key string) (Config, bool, error) {
+	return f(ctx, key)
+}
+
+// resolve returns the Config to check key with. The result has no
+// Overrides, so it is resolved only once per check.
+func (c Config) resolve(ctx context.Context, key string) (Config, error) {
+	overrides := c.Overrides
+	c.Overrides = nil
+	if overrides == nil {
+		return c, nil
+	}
+
+	o, ok, err := overrides.Override(ctx, key)
+	if err != nil {
+		return c, resolveError{err}
+	}
+	if !ok {
+		return c, nil
+	}
+	if o.Rate > 0 {
+		c.Rate = o.Rate
+	}
+	if o.Window > 0 {
+		c.Window = o.Window
+	}
+	if o.Burst > 0 {
+		c.Burst = o.Burst
+	}
+	return c, nil
+}
+
+// resolveError wraps an error met while resolving how to check a key, such
+// as from Overrides, before the storage was reached. It reads as the error it
+// wraps. See ResilientLimiter.
+type resolveError struct {
+	err error
+}
+
+func (e resolveError) Error() string { return e.err.Error() }
+
+func (e resolveError) Unwrap() error { return e.err }
+
+// MemoryOverrides holds per-key overrides in memory. It is safe for
+// concurrent use, and changes apply from the next check of the key on.
+type MemoryOverrides struct {
+	mu      sync.RWMutex
+	configs map[string]Config
+}
+
+// NewMemoryOverrides creates a new, empty MemoryOverrides.
+func NewMemoryOverrides() *MemoryOverrides {
+	return &MemoryOverrides{configs: make(map[string]Config)}
+}
+
+// Set overrides the Config of key.
+func (m *MemoryOverrides) Set(key string, cfg Config) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.configs[key] = cfg
+}
+
+// Delete removes the override of key, if any.
+func (m *MemoryOverrides) Delete(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.configs, key)
+}
+
+// Override returns the override of key.
+func (m *MemoryOverrides) Override(ctx context.Context, key string) (Config, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return Config{}, false, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	cfg, ok := m.configs[key]
+	return cfg, ok, nil
+}
+
+// DefaultOverridesHash is the Redis hash used by NewRedisOverrides when no
+// hash is given.
+const DefaultOverridesHash = "ratelimit:overrides"
+
+// DefaultOverridesCacheTTL is how long NewRedisOverrides caches the override
+// of a key.
+const DefaultOverridesCacheTTL = time.Second
+
+// RedisOverrides holds per-key overrides in a Redis hash, so that every
+// instance sees them. The override of a key, or its absence, is read with
+// one HGET and then cached for a short TTL, so hot keys do not pay an extra
+// round trip per check. Edits made through a RedisOverrides apply to it at
+// once; other instances see them once their cached copy expires.
+//
+// The override is read apart from the script that checks the key, rather
+// than by it, because the limiter needs the Config before it can build the
+// script's arguments: window keys, TTLs and composite steps all derive from
+// the resolved Rate and Window. The cache keeps that extra round trip off
+// all but one check per key and TTL.
+//
+// Overrides are stored as JSON, so they can also be edited with redis-cli:
+//
+//	HSET ratelimit:overrides user:42 '{"rate":5000,"window":"1h"}'
+type RedisOverrides struct {
+	store *storage.RedisMemory
+	hash  string
+	ttl   time.Duration
+	clock clock.Clock
+
+	cache sync.Map     // key -> *cachedOverride
+	swept atomic.Int64 // when expired entries were last dropped, in unix ns
+}
+
+// cachedOverride is the override of a key as last read from Redis.
+type cachedOverride struct {
+	cfg     Config
+	ok      bool
+	expires time.Time
+}
+
+// NewRedisOverrides creates a RedisOverrides keeping its overrides in the
+// given hash, or in DefaultOverridesHash if hash is empty, and caching them
+// for DefaultOverridesCacheTTL.
+func NewRedisOverrides(store *storage.RedisMemory, hash string) *RedisOverrides {
+	return NewRedisOverridesWithCacheTTL(store, hash, DefaultOverridesCacheTTL)
+}
+
+// NewRedisOverridesWithCacheTTL is like NewRedisOverrides but caches
+// overrides for ttl. A ttl of zero reads the override from Redis on every
+// check.
+func NewRedisOverridesWithCacheTTL(store *storage.RedisMemory, hash string, ttl time.Duration) *RedisOverrides {
+	return NewRedisOverridesWithClock(clock.Real, store, hash, ttl)
+}
+
+// NewRedisOverridesWithClock is like NewRedisOverridesWithCacheTTL but reads
+// the time cached overrides expire by from c.
+func NewRedisOverridesWithClock(c clock.Clock, store *storage.RedisMemory, hash string, ttl time.Duration) *RedisOverrides {
+	if hash == "" {
+		hash = DefaultOverridesHash
+	}
+	return &RedisOverrides{store: store, hash: hash, ttl: max(ttl, 0), clock: clock.OrReal(c)}
+}
+
+// redisOverride is the JSON form of an override.
+type redisOverride struct {
+	Rate   int    `json:"rate,omitempty"`
+	Window string `json:"window,omitempty"`
+	Burst  int    `json:"burst,omitempty"`
+}
+
+// Set overrides the Config of key.
+func (r *RedisOverrides) Set(ctx context.Context, key string, cfg Config) error {
+	o := redisOverride{Rate: cfg.Rate, Burst: cfg.Burst}
+	if cfg.Window > 0 {
+		o.Window = cfg.Window.String()
+	}
+	data, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	defer r.cache.Delete(key)
+	return r.store.SetField(ctx, r.hash, key, string(data))
+}
+
+// Delete removes the override of key, if any.
+func (r *RedisOverrides) Delete(ctx context.Context, key string) error {
+	defer r.cache.Delete(key)
+	return r.store.DeleteField(ctx, r.hash, key)
+}
+
+// Override returns the override of key, from the cache if it was read less
+// than the cache TTL ago.
+func (r *RedisOverrides) Override(ctx context.Context, key string) (Config, bool, error) {
+	if r.ttl == 0 {
+		return r.load(ctx, key)
+	}
+	now := r.clock.Now()
+	if v, ok := r.cache.Load(key); ok {
+		if c := v.(*cachedOverride); now.Before(c.expires) {
+			return c.cfg, c.ok, nil
+		}
+	}
+
+	cfg, ok, err := r.load(ctx, key)
+	if err != nil {
+		return Config{}, false, err
+	}
+	r.sweep(now)
+	r.cache.Store(key, &cachedOverride{cfg: cfg, ok: ok, expires: now.Add(r.ttl)})
+	return cfg, ok, nil
+}
+
+// sweep drops the expired entries of the cache, at most once per cache TTL,
+// so that keys that are no longer checked do not pile up.
+func (r *RedisOverrides) sweep(now time.Time) {
+	last := r.swept.Load()
+	if now.UnixNano()-last < int64(r.ttl) || !r.swept.CompareAndSwap(last, now.UnixNano()) {
+		return
+	}
+	r.cache.Range(func(k, v any) bool {
+		if !now.Before(v.(*cachedOverride).expires) {
+			r.cache.CompareAndDelete(k, v)
+		}
+		return true
+	})
+}
+
+// load reads the override of key from Redis.
+func (r *RedisOverrides) load(ctx context.Context, key string) (Config, bool, error) {
+	data, ok, err := r.store.GetField(ctx, r.hash, key)
+	if err != nil || !ok {
+		return Config{}, false, err
+	}
+
+	var o redisOverride
+	if err := json.Unmarshal([]byte(data), &o); err != nil {
+		return Config{}, false, err
+	}
+	cfg := Config{Rate: o.Rate, Burst: o.Burst}
+	if o.Window != "" {
+		if cfg.Window, err = time.ParseDuration(o.Window); err != nil {
+			return Config{}, false, err
+		}
+	}
+	return cfg, true, nil
+}
@@ -0,0 +1,133 @@
+package limiter_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sumedhvats/rate-limiter-go/pkg/clock"
+	"github.com/sumedhvats/rate-limiter-go/pkg/limiter"
+	"github.com/sumedhvats/rate-limiter-go/pkg/storage"
+)
+
+func TestOverridesEveryAlgorithm(t *testing.T) {
+	overrides := limiter.NewMemoryOverrides()
+	overrides.Set("premium", limiter.Config{Rate: 5, Burst: 5})
+
+	limiters := map[string]func(limiter.Storage, limiter.Config) limiter.Limiter{
+		"token bucket": func(s limiter.Storage, c limiter.Config) limiter.Limiter {
+			return limiter.NewTokenBucketLimiter(s, c)
+		},
+		"fixed window": func(s limiter.Storage, c limiter.Config) limiter.Limiter {
+			return limiter.NewFixedWindowLimiter(s, c)
+		},
+		"sliding window": func(s limiter.Storage, c limiter.Config) limiter.Limiter {
+			return limiter.NewSlidingWindowLimiter(s, c)
+		},
+		"sliding log": func(s limiter.Storage, c limiter.Config) limiter.Limiter {
+			return limiter.NewSlidingWindowLogLimiter(s, c)
+		},
+		"leaky bucket": func(s limiter.Storage, c limiter.Config) limiter.Limiter {
+			c.Burst = c.Rate
+			return limiter.NewLeakyBucketLimiter(s, c)
+		},
+		"gcra": func(s limiter.Storage, c limiter.Config) limiter.Limiter {
+			return limiter.NewGCRALimiter(s, c)
+		},
+	}
+	for name, newLimiter := range limiters {
+		t.Run(name, func(t *testing.T) {
+			clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+			l := newLimiter(storage.NewMemoryStorageWithClock(clk), limiter.Config{
+				Rate:      2,
+				Window:    time.Minute,
+				Clock:     clk,
+				Overrides: overrides,
+			})
+			free, premium := "free", "premium"
+
+			ok, err := l.AllowN(free, 2)
+			assert.NoError(t, err)
+			assert.True(t, ok)
+			ok, err = l.Allow(free)
+			assert.NoError(t, err)
+			assert.False(t, ok)
+
+			decision, err := l.Decide(premium, 5)
+			assert.NoError(t, err)
+			assert.True(t, decision.Allowed)
+			assert.Equal(t, 5, decision.Limit)
+			ok, err = l.Allow(premium)
+			assert.NoError(t, err)
+			assert.False(t, ok)
+
+			stats, err := l.GetStats(premium)
+			assert.NoError(t, err)
+			assert.Equal(t, 5, stats.Limit)
+		})
+	}
+}
+
+func TestOverridesEditedAtRuntime(t *testing.T) {
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	overrides := limiter.NewMemoryOverrides()
+	fw := limiter.NewFixedWindowLimiter(storage.NewMemoryStorageWithClock(clk), limiter.Config{
+		Rate:      2,
+		Window:    time.Minute,
+		Clock:     clk,
+		Overrides: overrides,
+	})
+
+	ok, err := fw.AllowN("user1", 3)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// A custom contract with its own window applies from the next check on.
+	overrides.Set("user1", limiter.Config{Rate: 10, Window: time.Hour})
+	decision, err := fw.Decide("user1", 3)
+	assert.NoError(t, err)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, 7, decision.Remaining)
+	assert.Equal(t, time.Unix(1_700_000_000, 0).Truncate(time.Hour).Add(time.Hour), decision.ResetAt)
+
+	assert.NoError(t, fw.Reset("user1"))
+	decision, err = fw.Decide("user1", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, decision.Remaining)
+
+	overrides.Delete("user1")
+	decision, err = fw.Decide("user1", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, decision.Limit)
+}
+
+func TestOverridesFunc(t *testing.T) {
+	errLookup := errors.New("lookup failed")
+	tiers := limiter.OverridesFunc(func(ctx context.Context, key string) (limiter.Config, bool, error) {
+		switch key {
+		case "broken":
+			return limiter.Config{}, false, errLookup
+		case "premium:42":
+			return limiter.Config{Rate: 100, Burst: 10}, true, nil
+		}
+		return limiter.Config{}, false, nil
+	})
+	tb := limiter.NewTokenBucketLimiter(storage.NewMemoryStorage(), limiter.Config{
+		Rate:      10,
+		Window:    time.Second,
+		Overrides: tiers,
+	})
+
+	stats, err := tb.GetStats("premium:42")
+	assert.NoError(t, err)
+	assert.Equal(t, 10, stats.Limit, "Burst comes from the override")
+
+	stats, err = tb.GetStats("free:7")
+	assert.NoError(t, err)
+	assert.Equal(t, 10, stats.Limit)
+
+	_, err = tb.Allow("broken")
+	assert.ErrorIs(t, err, errLookup)
+}
@@ -0,0 +1,360 @@
+// Package limiter provides rate limiting algorithm implementations.
+package limiter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sumedhvats/rate-limiter-go/pkg/clock"
+)
+
+// ErrCannotListKeys is returned by PenaltyBox.Bans when its storage cannot
+// list keys. storage.MemoryStorage and storage.RedisMemory both can.
+var ErrCannotListKeys = errors.New("limiter: storage cannot list keys")
+
+// keyLister is implemented by storages that can list their keys, such as
+// storage.MemoryStorage and storage.RedisMemory.
+type keyLister interface {
+	KeysCtx(ctx context.Context, prefix string) ([]string, error)
+}
+
+// DefaultPenaltyPrefix is the storage key prefix used by a PenaltyBox when
+// PenaltyConfig.Prefix is empty.
+const DefaultPenaltyPrefix = "penalty:"
+
+// PenaltyConfig holds the configuration for a PenaltyBox.
+type PenaltyConfig struct {
+	// Threshold is how many denied checks within Window get a key banned.
+	// It defaults to 5.
+	Threshold int
+	// Window is the time span denials are counted over. Like the requests
+	// of a FixedWindowLimiter, they are counted in fixed windows of this
+	// length. It defaults to 10 minutes.
+	Window time.Duration
+	// BanDuration is how long a key's first ban lasts. It defaults to Window.
+	BanDuration time.Duration
+	// Multiplier is the factor each further ban is longer than the last. It
+	// defaults to 2.
+	Multiplier float64
+	// MaxBanDuration caps the length of a ban. It defaults to 24 hours.
+	MaxBanDuration time.Duration
+	// ForgetAfter is how long after a ban ends the key's bans are forgotten,
+	// so that its next ban lasts BanDuration again. It defaults to
+	// MaxBanDuration.
+	ForgetAfter time.Duration
+	// Prefix is prepended to the storage keys of violations and bans. It
+	// defaults to DefaultPenaltyPrefix.
+	Prefix string
+	// Clock is the time source. It defaults to clock.Real.
+	Clock clock.Clock
+}
+
+// withDefaults returns the config with every unset field defaulted.
+func (c PenaltyConfig) withDefaults() PenaltyConfig {
+	if c.Threshold <= 0 {
+		c.Threshold = 5
+	}
+	if c.Window <= 0 {
+		c.Window = 10 * time.Minute
+	}
+	if c.BanDuration <= 0 {
+		c.BanDuration = c.Window
+	}
+	if c.Multiplier < 1 {
+		c.Multiplier = 2
+	}
+	if c.MaxBanDuration <= 0 {
+		c.MaxBanDuration = 24 * time.Hour
+	}
+	if c.ForgetAfter <= 0 {
+		c.ForgetAfter = c.MaxBanDuration
+	}
+	if c.Prefix == "" {
+		c.Prefix = DefaultPenaltyPrefix
+	}
+	return c
+}
+
+// now returns the current time according to the configured Clock.
+func (c PenaltyConfig) now() time.Time {
+	return clock.OrReal(c.Clock).Now()
+}
+
+// Ban describes a key banned by a PenaltyBox.
+type Ban struct {
+	// Key is the banned key.
+	Key string
+	// Count is how many times the key has been banned, this ban included.
+	Count int
+	// Until is when the ban ends.
+	Until time.Time
+}
+
+// PenaltyBox wraps a Limiter and bans keys that keep getting denied, in the
+// manner of fail2ban. Once a key is denied Threshold times within Window, its
+// checks are denied outright for BanDuration without reaching the wrapped
+// limiter. Each further ban lasts Multiplier times longer than the last, up
+// to MaxBanDuration, until the key stays out of trouble for ForgetAfter.
+//
+// Violations and bans are kept in storage, so with Redis storage a key
+// banned by one instance is banned on all of them. Bans are swapped in
+// atomically, so concurrent denials past the threshold, on one instance or
+// several, ban the key once.
+type PenaltyBox struct {
+	limiter Limiter
+	storage Storage
+	config  PenaltyConfig
+
+	// violations counts the denials of each key since its last ban. Its
+	// limit is Threshold, so the denial that reaches Threshold is the only
+	// one it admits with none remaining: concurrent denials past the
+	// threshold ban the key once.
+	violations *FixedWindowLimiter
+}
+
+// NewPenaltyBox creates a PenaltyBox around l, keeping violations and bans in
+// store.
+func NewPenaltyBox(l Limiter, store Storage, cfg PenaltyConfig) *PenaltyBox {
+	cfg = cfg.withDefaults()
+	return &PenaltyBox{
+		limiter: l,
+		storage: store,
+		config:  cfg,
+		violations: NewFixedWindowLimiter(store, Config{
+			Rate:   cfg.Threshold,
+			Window: cfg.Window,
+			Clock:  cfg.Clock,
+		}),
+	}
+}
+
+func (p *PenaltyBox) banKey(key string) string {
+	return p.config.Prefix + "ban:" + key
+}
+
+// violationsKey returns the key of the violations of key since its ban
+// number bans, so that a new ban starts a fresh count.
+func (p *PenaltyBox) violationsKey(key string, bans int) string {
+	return p.config.Prefix + "violations:" + strconv.Itoa(bans) + ":" + key
+}
+
+// ban returns the last ban of key, which may be over, or nil if the key's
+// bans are forgotten. Bans are stored as "count:until", until in Unix ms.
+func (p *PenaltyBox) ban(ctx context.Context, key string) (*Ban, error) {
+	data, err := p.storage.GetCtx(ctx, p.banKey(key))
+	if err != nil {
+		return nil, err
+	}
+	return parseBan(key, data)
+}
+
+// parseBan parses the stored ban of key, or returns nil for no ban.
+func parseBan(key string, data interface{}) (*Ban, error) {
+	if data == nil {
+		return nil, nil
+	}
+	var count int
+	var untilMs int64
+	if _, err := fmt.Sscanf(fmt.Sprint(data), "%d:%d", &count, &untilMs); err != nil {
+		return nil, fmt.Errorf("limiter: malformed ban of %q: %w", key, err)
+	}
+	return &Ban{Key: key, Count: count, Until: time.UnixMilli(untilMs)}, nil
+}
+
+// impose bans key, escalating from last, its ban stored as data, and returns
+// the new ban. The ban is swapped in atomically, and only if data is still
+// stored: it returns nil if another check banned the key meanwhile.
+func (p *PenaltyBox) impose(ctx context.Context, key string, data interface{}, last *Ban, now time.Time) (*Ban, error) {
+	count := 1
+	if last != nil {
+		count = last.Count + 1
+	}
+	duration := float64(p.config.BanDuration)
+	for i := 1; i < count && duration < float64(p.config.MaxBanDuration); i++ {
+		duration *= p.config.Multiplier
+	}
+	b := &Ban{
+		Key:   key,
+		Count: count,
+		Until: now.Add(min(time.Duration(duration), p.config.MaxBanDuration)),
+	}
+
+	value := fmt.Sprintf("%d:%d", b.Count, b.Until.UnixMilli())
+	swapped, err := compareAndSwap(ctx, p.storage, p.banKey(key), data, value, b.Until.Sub(now)+p.config.ForgetAfter)
+	if err != nil || !swapped {
+		return nil, err
+	}
+	return b, nil
+}
+
+// banned builds the Decision of a check of a banned key.
+func banned(b *Ban, now time.Time) *Decision {
+	return &Decision{
+		Allowed:    false,
+		RetryAfter: b.Until.Sub(now),
+		ResetAt:    b.Until,
+		DeniedBy:   "penalty",
+	}
+}
+
+// Allow checks if a single request is allowed for the given key.
+func (p *PenaltyBox) Allow(key string) (bool, error) {
+	return p.AllowN(key, 1)
+}
+
+// AllowCtx is like Allow but honours ctx.
+func (p *PenaltyBox) AllowCtx(ctx context.Context, key string) (bool, error) {
+	return p.AllowNCtx(ctx, key, 1)
+}
+
+// AllowN checks if n requests are allowed for the given key.
+func (p *PenaltyBox) AllowN(key string, n int) (bool, error) {
+	return p.AllowNCtx(context.Background(), key, n)
+}
+
+// AllowNCtx is like AllowN but honours ctx.
+func (p *PenaltyBox) AllowNCtx(ctx context.Context, key string, n int) (bool, error) {
+	decision, err := p.DecideCtx(ctx, key, n)
+	if err != nil {
+		return false, err
+	}
+	return decision.Allowed, nil
+}
+
+// Decide checks if n requests are allowed for the given key. Checks of a
+// banned key are denied with DeniedBy "penalty" and a zero Limit, and
+// RetryAfter tells when the ban ends.
+func (p *PenaltyBox) Decide(key string, n int) (*Decision, error) {
+	return p.DecideCtx(context.Background(), key, n)
+}
+
+// DecideCtx is like Decide but honours ctx.
+func (p *PenaltyBox) DecideCtx(ctx context.Context, key string, n int) (*Decision, error) {
+	data, err := p.storage.GetCtx(ctx, p.banKey(key))
+	if err != nil {
+		return nil, err
+	}
+	last, err := parseBan(key, data)
+	if err != nil {
+		return nil, err
+	}
+	now := p.config.now()
+	if last != nil && now.Before(last.Until) {
+		return banned(last, now), nil
+	}
+
+	d, err := p.limiter.DecideCtx(ctx, key, n)
+	if err != nil || d.Allowed || n == 0 {
+		return d, err
+	}
+
+	// Only the denial that reaches Threshold bans the key; those after it
+	// are denied by violations. Denials are counted since the ban they saw,
+	// so that a ban starts a fresh count.
+	bans := 0
+	if last != nil {
+		bans = last.Count
+	}
+	v, err := p.violations.DecideCtx(ctx, p.violationsKey(key, bans), 1)
+	if err != nil {
+		return nil, err
+	}
+	if !v.Allowed || v.Remaining > 0 {
+		return d, nil
+	}
+	b, err := p.impose(ctx, key, data, last, now)
+	if err != nil {
+		return nil, err
+	}
+	if b == nil {
+		return d, nil
+	}
+	d.RetryAfter = b.Until.Sub(now)
+	d.ResetAt = b.Until
+	d.DeniedBy = "penalty"
+	return d, nil
+}
+
+// Banned returns the ban of key, and false if the key is not banned.
+func (p *PenaltyBox) Banned(ctx context.Context, key string) (Ban, bool, error) {
+	b, err := p.ban(ctx, key)
+	if err != nil || b == nil || !p.config.now().Before(b.Until) {
+		return Ban{}, false, err
+	}
+	return *b, true, nil
+}
+
+// Bans returns every key banned right now. It returns ErrCannotListKeys if
+// the storage cannot list keys.
+func (p *PenaltyBox) Bans(ctx context.Context) ([]Ban, error) {
+	lister, ok := p.storage.(keyLister)
+	if !ok {
+		return nil, ErrCannotListKeys
+	}
+	prefix := p.banKey("")
+	keys, err := lister.KeysCtx(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var bans []Ban
+	for _, k := range keys {
+		b, ok, err := p.Banned(ctx, strings.TrimPrefix(k, prefix))
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			bans = append(bans, b)
+		}
+	}
+	return bans, nil
+}
+
+// Lift ends the ban of key, if any, and forgets its violations and earlier
+// bans. It leaves the wrapped limiter's state alone.
+func (p *PenaltyBox) Lift(ctx context.Context, key string) error {
+	if err := p.storage.DeleteCtx(ctx, p.banKey(key)); err != nil {
+		return err
+	}
+	return p.violations.ResetCtx(ctx, p.violationsKey(key, 0))
+}
+
+// Reset clears the rate limit data of the given key in the wrapped limiter
+// and lifts its ban.
+func (p *PenaltyBox) Reset(key string) error {
+	return p.ResetCtx(context.Background(), key)
+}
+
+// ResetCtx is like Reset but honours ctx.
+func (p *PenaltyBox) ResetCtx(ctx context.Context, key string) error {
+	if err := p.Lift(ctx, key); err != nil {
+		return err
+	}
+	return p.limiter.ResetCtx(ctx, key)
+}
+
+// Refund gives n requests back to the given key in the wrapped limiter. It
+// does not take back violations.
+func (p *PenaltyBox) Refund(key string, n int) error {
+	return p.RefundCtx(context.Background(), key, n)
+}
+
+// RefundCtx is like Refund but honours ctx.
+func (p *PenaltyBox) RefundCtx(ctx context.Context, key string, n int) error {
+	return p.limiter.RefundCtx(ctx, key, n)
+}
+
+// GetStats returns the current rate limit statistics for the given key. A
+// banned key has no requests remaining until its ban ends.
+func (p *PenaltyBox) GetStats(key string) (*Stats, error) {
+	return p.GetStatsCtx(context.Background(), key)
+}
+
+// GetStatsCtx is like GetStats but honours ctx.
+func (p *PenaltyBox) GetStatsCtx(ctx context.Context, key string) (*Stats, error) {
+	return statsFromDecision(p.DecideCtx(ctx, key, 0))
+}
@@ -0,0 +1,199 @@
+package limiter_test
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sumedhvats/rate-limiter-go/pkg/clock"
+	"github.com/sumedhvats/rate-limiter-go/pkg/limiter"
+	"github.com/sumedhvats/rate-limiter-go/pkg/storage"
+)
+
+// offend uses up the limit of key and gets it denied threshold times.
+func offend(t *testing.T, box *limiter.PenaltyBox, key string, threshold int) *limiter.Decision {
+	t.Helper()
+	var decision *limiter.Decision
+	for range threshold {
+		var err error
+		decision, err = box.Decide(key, 2)
+		assert.NoError(t, err)
+		assert.False(t, decision.Allowed)
+	}
+	return decision
+}
+
+func TestPenaltyBoxEscalates(t *testing.T) {
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	store := storage.NewMemoryStorageWithClock(clk)
+	fw := limiter.NewFixedWindowLimiter(store, limiter.Config{
+		Rate:   1,
+		Window: time.Second,
+		Clock:  clk,
+	})
+	box := limiter.NewPenaltyBox(fw, store, limiter.PenaltyConfig{
+		Threshold:   3,
+		Window:      time.Minute,
+		BanDuration: 10 * time.Minute,
+		Clock:       clk,
+	})
+	ctx := context.Background()
+
+	// Two denials stay below the threshold.
+	offend(t, box, "bot", 2)
+	_, ok, err := box.Banned(ctx, "bot")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	decision := offend(t, box, "bot", 1)
+	assert.Equal(t, "penalty", decision.DeniedBy)
+	assert.Equal(t, 10*time.Minute, decision.RetryAfter)
+
+	// A banned key is denied without reaching the limiter.
+	ok, err = box.Allow("bot")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	stats, err := fw.GetStats("bot")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, stats.Remaining)
+
+	// The second ban lasts twice as long.
+	clk.Advance(10 * time.Minute)
+	ok, err = box.Allow("bot")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	decision = offend(t, box, "bot", 3)
+	assert.Equal(t, 20*time.Minute, decision.RetryAfter)
+
+	ban, ok, err := box.Banned(ctx, "bot")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 2, ban.Count)
+	assert.Equal(t, clk.Now().Add(20*time.Minute), ban.Until)
+}
+
+func TestPenaltyBoxForgets(t *testing.T) {
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	store := storage.NewMemoryStorageWithClock(clk)
+	fw := limiter.NewFixedWindowLimiter(store, limiter.Config{Rate: 1, Window: time.Second, Clock: clk})
+	box := limiter.NewPenaltyBox(fw, store, limiter.PenaltyConfig{
+		Threshold:      1,
+		BanDuration:    time.Minute,
+		MaxBanDuration: time.Hour,
+		ForgetAfter:    time.Hour,
+		Clock:          clk,
+	})
+
+	offend(t, box, "bot", 1)
+	clk.Advance(time.Minute + time.Hour + time.Second)
+	decision := offend(t, box, "bot", 1)
+	assert.Equal(t, time.Minute, decision.RetryAfter)
+}
+
+func TestPenaltyBoxListAndLift(t *testing.T) {
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	store := storage.NewMemoryStorageWithClock(clk)
+	fw := limiter.NewFixedWindowLimiter(store, limiter.Config{Rate: 1, Window: time.Second, Clock: clk})
+	box := limiter.NewPenaltyBox(fw, store, limiter.PenaltyConfig{
+		Threshold: 1,
+		Clock:     clk,
+	})
+	ctx := context.Background()
+
+	offend(t, box, "ip:1.2.3.4", 1)
+	offend(t, box, "ip:5.6.7.8", 1)
+	bans, err := box.Bans(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, bans, 2)
+
+	assert.NoError(t, box.Lift(ctx, "ip:1.2.3.4"))
+	bans, err = box.Bans(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, bans, 1)
+	assert.Equal(t, "ip:5.6.7.8", bans[0].Key)
+
+	ok, err := box.Allow("ip:1.2.3.4")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// Ended bans are not listed.
+	clk.Advance(10 * time.Minute)
+	bans, err = box.Bans(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, bans)
+}
+
+// banCountingStorage counts the writes of bans to a MemoryStorage.
+type banCountingStorage struct {
+	*storage.MemoryStorage
+	writes atomic.Int64
+}
+
+func (s *banCountingStorage) SetCtx(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	if strings.Contains(key, "ban:") {
+		s.writes.Add(1)
+	}
+	return s.MemoryStorage.SetCtx(ctx, key, value, ttl)
+}
+
+func (s *banCountingStorage) CompareAndSwap(key string, old, new interface{}, ttl time.Duration) (bool, error) {
+	swapped, err := s.MemoryStorage.CompareAndSwap(key, old, new, ttl)
+	if swapped && strings.Contains(key, "ban:") {
+		s.writes.Add(1)
+	}
+	return swapped, err
+}
+
+// barrierLimiter holds every check until parties checks are under way.
+type barrierLimiter struct {
+	limiter.Limiter
+	barrier *sync.WaitGroup
+}
+
+func (b *barrierLimiter) DecideCtx(ctx context.Context, key string, n int) (*limiter.Decision, error) {
+	b.barrier.Done()
+	b.barrier.Wait()
+	return b.Limiter.DecideCtx(ctx, key, n)
+}
+
+func TestPenaltyBoxConcurrentDenials(t *testing.T) {
+	const checks = 10
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	store := &banCountingStorage{MemoryStorage: storage.NewMemoryStorageWithClock(clk)}
+	var barrier sync.WaitGroup
+	barrier.Add(checks)
+	fw := &barrierLimiter{
+		Limiter: limiter.NewFixedWindowLimiter(store, limiter.Config{Rate: 0, Window: time.Minute, Clock: clk}),
+		barrier: &barrier,
+	}
+	box := limiter.NewPenaltyBox(fw, store, limiter.PenaltyConfig{Threshold: 3, Clock: clk})
+
+	// Every check is past the ban check before any is denied.
+	var wg sync.WaitGroup
+	var penalized atomic.Int64
+	for range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			decision, err := box.Decide("bot", 1)
+			assert.NoError(t, err)
+			assert.False(t, decision.Allowed)
+			if decision.DeniedBy == "penalty" {
+				penalized.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Crossing the threshold once bans the key once.
+	assert.Equal(t, int64(1), penalized.Load())
+	assert.Equal(t, int64(1), store.writes.Load())
+	ban, ok, err := box.Banned(context.Background(), "bot")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 1, ban.Count)
+}
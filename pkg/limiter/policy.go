@@ -0,0 +1,358 @@
+// Package limiter provides rate limiting algorithm implementations.
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sumedhvats/rate-limiter-go/pkg/clock"
+	"github.com/sumedhvats/rate-limiter-go/pkg/storage"
+)
+
+// Limit is one of the limits enforced by a PolicyLimiter.
+type Limit struct {
+	// Name identifies the limit in Decision.DeniedBy and in storage keys,
+	// so it must be unique within a Policy. It defaults to "<Rate>/<Window>",
+	// e.g. "10/1s".
+	Name string
+	// Rate is the number of requests allowed per window.
+	Rate int
+	// Window is the time duration of the rate limit window.
+	Window time.Duration
+}
+
+// Policy holds the configuration for a PolicyLimiter.
+type Policy struct {
+	// Limits are enforced together: a request is allowed only if every
+	// limit has room for it.
+	Limits []Limit
+	// Clock is the time source. It defaults to clock.Real.
+	Clock clock.Clock
+}
+
+// PolicyLimiter enforces several sliding window limits per key, such as
+// 10 per second and 1000 per hour. A request is counted against every limit
+// or against none of them, so a denial by one limit never uses up another.
+type PolicyLimiter struct {
+	storage Storage
+	limits  []Limit
+	windows []*SlidingWindowLimiter
+	clock   clock.Clock
+}
+
+// NewPolicyLimiter creates a new PolicyLimiter.
+func NewPolicyLimiter(store Storage, policy Policy) *PolicyLimiter {
+	p := &PolicyLimiter{
+		storage: store,
+		clock:   clock.OrReal(policy.Clock),
+	}
+	for _, l := range policy.Limits {
+		if l.Name == "" {
+			l.Name = fmt.Sprintf("%d/%s", l.Rate, l.Window)
+		}
+		p.limits = append(p.limits, l)
+		p.windows = append(p.windows, NewSlidingWindowLimiter(store, Config{
+			Rate:   l.Rate,
+			Window: l.Window,
+			Clock:  p.clock,
+		}))
+	}
+	return p
+}
+
+// Allow checks if a single request is allowed for the given key.
+func (p *PolicyLimiter) Allow(key string) (bool, error) {
+	return p.AllowN(key, 1)
+}
+
+// AllowCtx is like Allow but honours ctx.
+func (p *PolicyLimiter) AllowCtx(ctx context.Context, key string) (bool, error) {
+	return p.AllowNCtx(ctx, key, 1)
+}
+
+// AllowN checks if n requests are allowed for the given key.
+func (p *PolicyLimiter) AllowN(key string, n int) (bool, error) {
+	return p.AllowNCtx(context.Background(), key, n)
+}
+
+// AllowNCtx is like AllowN but honours ctx.
+func (p *PolicyLimiter) AllowNCtx(ctx context.Context, key string, n int) (bool, error) {
+	decision, err := p.DecideCtx(ctx, key, n)
+	if err != nil {
+		return false, err
+	}
+	return decision.Allowed, nil
+}
+
+// Decide checks if n requests are allowed for the given key under every
+// limit of the policy. Limit and Remaining describe the limit with the least
+// room left, and DeniedBy names the first limit that denied the request.
+func (p *PolicyLimiter) Decide(key string, n int) (*Decision, error) {
+	return p.DecideCtx(context.Background(), key, n)
+}
+
+// DecideCtx is like Decide but honours ctx.
+func (p *PolicyLimiter) DecideCtx(ctx context.Context, key string, n int) (*Decision, error) {
+	d, _, err := p.decideUndo(ctx, key, n)
+	return d, err
+}
+
+// decideUndo is like DecideCtx but also returns a function that takes the
+// admitted requests back out of every limit. See undoer.
+func (p *PolicyLimiter) decideUndo(ctx context.Context, key string, n int) (*Decision, func(context.Context) error, error) {
+	var states []*slidingState
+	var denied int
+	var err error
+	if redisStore, ok := serverTime(p.storage); ok {
+		states, denied, err = p.decideServerTime(ctx, redisStore, key, n)
+	} else {
+		states = p.states(key, p.clock.Now())
+		if redisStore, ok := p.storage.(*storage.RedisMemory); ok {
+			denied, err = p.decideRedis(ctx, redisStore, states, n)
+		} else {
+			denied, err = p.decideMemory(ctx, states, n)
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	d := p.decision(denied, states, n)
+	if !d.Allowed || n == 0 {
+		return d, nil, nil
+	}
+	return d, func(ctx context.Context) error {
+		return p.rollback(ctx, states, n, nil)
+	}, nil
+}
+
+// states locates the windows of every limit for key at now.
+func (p *PolicyLimiter) states(key string, now time.Time) []*slidingState {
+	states := make([]*slidingState, len(p.windows))
+	for i, w := range p.windows {
+		states[i] = w.newState(key+":"+p.limits[i].Name, now)
+	}
+	return states
+}
+
+func (p *PolicyLimiter) decideRedis(ctx context.Context, store *storage.RedisMemory, states []*slidingState, n int) (int, error) {
+	currentKeys := make([]string, len(states))
+	previousKeys := make([]string, len(states))
+	limits := make([]int, len(states))
+	weights := make([]float64, len(states))
+	ttls := make([]time.Duration, len(states))
+	for i, state := range states {
+		currentKeys[i] = state.currWinKey
+		previousKeys[i] = state.prevWinKey
+		limits[i] = p.limits[i].Rate
+		weights[i] = state.weight
+		ttls[i] = p.limits[i].Window * 2
+	}
+
+	denied, current, previous, err := store.SlidingWindowPolicyIncrement(
+		ctx,
+		currentKeys,
+		previousKeys,
+		n,
+		limits,
+		weights,
+		ttls,
+	)
+	if err != nil {
+		return 0, err
+	}
+	for i, state := range states {
+		state.currCount = current[i]
+		state.prevCount = previous[i]
+	}
+	return denied, nil
+}
+
+// decideServerTime is like decideRedis but lets the script locate the
+// windows from the Redis server time, and returns the states it located.
+func (p *PolicyLimiter) decideServerTime(ctx context.Context, store *storage.RedisMemory, key string, n int) ([]*slidingState, int, error) {
+	keys := make([]string, len(p.limits))
+	limits := make([]int, len(p.limits))
+	windows := make([]time.Duration, len(p.limits))
+	ttls := make([]time.Duration, len(p.limits))
+	for i, l := range p.limits {
+		keys[i] = key + ":" + l.Name
+		limits[i] = l.Rate
+		windows[i] = l.Window
+		ttls[i] = l.Window * 2
+	}
+
+	denied, current, previous, now, err := store.SlidingWindowPolicyIncrementServerTime(
+		ctx,
+		keys,
+		n,
+		limits,
+		windows,
+		ttls,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	states := p.states(key, now)
+	for i, state := range states {
+		state.currCount = current[i]
+		state.prevCount = previous[i]
+	}
+	return states, denied, nil
+}
+
+// decideMemory increments the current window of every limit in turn. If one
+// of them ends up over its limit, the increments made so far are rolled back
+// and the remaining limits are only read.
+func (p *PolicyLimiter) decideMemory(ctx context.Context, states []*slidingState, n int) (int, error) {
+	denied := -1
+	applied := 0
+	for i, state := range states {
+		prevCount, err := p.getCount(ctx, state.prevWinKey)
+		if err != nil {
+			return 0, p.rollback(ctx, states[:applied], n, err)
+		}
+		state.prevCount = prevCount
+
+		if n == 0 || denied >= 0 {
+			currCount, err := p.getCount(ctx, state.currWinKey)
+			if err != nil {
+				return 0, p.rollback(ctx, states[:applied], n, err)
+			}
+			state.currCount = currCount
+			if denied < 0 && !p.windows[i].fits(state, n) {
+				denied = i
+			}
+			continue
+		}
+
+		// Increment first and roll back on denial so that concurrent callers
+		// can never both squeeze into the last slot.
+		currCount, err := p.storage.IncrementCtx(ctx, state.currWinKey, n, p.limits[i].Window*2)
+		if err != nil {
+			return 0, p.rollback(ctx, states[:applied], n, err)
+		}
+		applied++
+		state.currCount = currCount
+		if !p.windows[i].fits(state, 0) {
+			denied = i
+		}
+	}
+
+	if denied >= 0 && applied > 0 {
+		if err := p.rollback(ctx, states[:applied], n, nil); err != nil {
+			return 0, err
+		}
+	}
+	return denied, nil
+}
+
+// rollback takes n back out of the current window of every state, even if
+// ctx is already done, and returns cause or the first rollback error.
+// Windows that are already over are left alone.
+func (p *PolicyLimiter) rollback(ctx context.Context, states []*slidingState, n int, cause error) error {
+	ctx = context.WithoutCancel(ctx)
+	now, err := storeNow(ctx, p.storage, Config{Clock: p.clock})
+	if err != nil {
+		if cause == nil {
+			cause = err
+		}
+		return cause
+	}
+	for i, state := range states {
+		if !now.Before(state.windowStart.Add(p.limits[i].Window)) {
+			continue
+		}
+		currCount, err := p.storage.IncrementCtx(ctx, state.currWinKey, -n, p.limits[i].Window*2)
+		if err != nil {
+			if cause == nil {
+				cause = err
+			}
+			continue
+		}
+		state.currCount = currCount
+	}
+	return cause
+}
+
+func (p *PolicyLimiter) getCount(ctx context.Context, key string) (int64, error) {
+	data, err := p.storage.GetCtx(ctx, key)
+	if err != nil || data == nil {
+		return 0, err
+	}
+	return data.(int64), nil
+}
+
+// decision merges the per-limit decisions. It reports the limit with the
+// least room left, waits for every limit that cannot fit n, and resets once
+// the slowest limit has drained.
+func (p *PolicyLimiter) decision(denied int, states []*slidingState, n int) *Decision {
+	allowed := denied < 0
+	var d *Decision
+	for i, w := range p.windows {
+		limitDecision := w.decision(allowed || w.fits(states[i], n), states[i], n)
+		if d == nil {
+			d = limitDecision
+			continue
+		}
+		if limitDecision.Remaining < d.Remaining {
+			d.Limit = limitDecision.Limit
+			d.Remaining = limitDecision.Remaining
+		}
+		d.RetryAfter = max(d.RetryAfter, limitDecision.RetryAfter)
+		if limitDecision.ResetAt.After(d.ResetAt) {
+			d.ResetAt = limitDecision.ResetAt
+		}
+	}
+	if d == nil {
+		return &Decision{Allowed: true, ResetAt: p.clock.Now()}
+	}
+
+	d.Allowed = allowed
+	if !allowed {
+		d.DeniedBy = p.limits[denied].Name
+	}
+	return d
+}
+
+// Reset clears the rate limit data of every limit for the given key.
+func (p *PolicyLimiter) Reset(key string) error {
+	return p.ResetCtx(context.Background(), key)
+}
+
+// ResetCtx is like Reset but honours ctx.
+func (p *PolicyLimiter) ResetCtx(ctx context.Context, key string) error {
+	for i, w := range p.windows {
+		if err := w.ResetCtx(ctx, key+":"+p.limits[i].Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Refund gives n requests back to every limit of the given key.
+func (p *PolicyLimiter) Refund(key string, n int) error {
+	return p.RefundCtx(context.Background(), key, n)
+}
+
+// RefundCtx is like Refund but honours ctx.
+func (p *PolicyLimiter) RefundCtx(ctx context.Context, key string, n int) error {
+	for i, w := range p.windows {
+		if err := w.RefundCtx(ctx, key+":"+p.limits[i].Name, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetStats returns the current rate limit statistics for the given key,
+// describing the limit with the least room left.
+func (p *PolicyLimiter) GetStats(key string) (*Stats, error) {
+	return p.GetStatsCtx(context.Background(), key)
+}
+
+// GetStatsCtx is like GetStats but honours ctx.
+func (p *PolicyLimiter) GetStatsCtx(ctx context.Context, key string) (*Stats, error) {
+	return statsFromDecision(p.DecideCtx(ctx, key, 0))
+}
@@ -0,0 +1,157 @@
+package limiter_test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sumedhvats/rate-limiter-go/pkg/clock"
+	"github.com/sumedhvats/rate-limiter-go/pkg/limiter"
+	"github.com/sumedhvats/rate-limiter-go/pkg/storage"
+)
+
+func newTestPolicy(clk *clock.Manual) *limiter.PolicyLimiter {
+	store := storage.NewMemoryStorageWithClock(clk)
+	return limiter.NewPolicyLimiter(store, limiter.Policy{
+		Limits: []limiter.Limit{
+			{Name: "second", Rate: 3, Window: time.Second},
+			{Name: "minute", Rate: 5, Window: time.Minute},
+		},
+		Clock: clk,
+	})
+}
+
+func TestPolicyDeniedBy(t *testing.T) {
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	policy := newTestPolicy(clk)
+
+	for i := 0; i < 3; i++ {
+		decision, err := policy.Decide("user1", 1)
+		assert.NoError(t, err)
+		assert.True(t, decision.Allowed)
+		assert.Empty(t, decision.DeniedBy)
+	}
+
+	decision, err := policy.Decide("user1", 1)
+	assert.NoError(t, err)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, "second", decision.DeniedBy)
+	assert.Equal(t, 3, decision.Limit)
+	assert.Equal(t, 0, decision.Remaining)
+	assert.Greater(t, decision.RetryAfter, time.Duration(0))
+
+	// Let the per-second limit drain; the minute limit then has 2 left.
+	clk.Advance(2 * time.Second)
+	decision, err = policy.Decide("user1", 2)
+	assert.NoError(t, err)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, 5, decision.Limit)
+	assert.Equal(t, 0, decision.Remaining)
+
+	clk.Advance(2 * time.Second)
+	decision, err = policy.Decide("user1", 1)
+	assert.NoError(t, err)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, "minute", decision.DeniedBy)
+}
+
+func TestPolicyDenialDoesNotConsume(t *testing.T) {
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	policy := newTestPolicy(clk)
+
+	// Denied by the per-second limit, so the minute limit must stay untouched.
+	for i := 0; i < 10; i++ {
+		_, err := policy.AllowN("user1", 4)
+		assert.NoError(t, err)
+	}
+	ok, err := policy.AllowN("user1", 3)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	clk.Advance(2 * time.Second)
+	ok, err = policy.AllowN("user1", 2)
+	assert.NoError(t, err)
+	assert.True(t, ok, "earlier denials should not have used up the minute limit")
+
+	stats, err := policy.GetStats("user1")
+	assert.NoError(t, err)
+	assert.Equal(t, 5, stats.Limit)
+	assert.Equal(t, 0, stats.Remaining)
+
+	assert.NoError(t, policy.Reset("user1"))
+	stats, err = policy.GetStats("user1")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, stats.Remaining)
+}
+
+func TestPolicyConcurrent(t *testing.T) {
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	policy := newTestPolicy(clk)
+
+	var allowed int64
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ok, _ := policy.Allow("user1"); ok {
+				atomic.AddInt64(&allowed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.LessOrEqual(t, allowed, int64(3))
+}
+
+func TestPolicyDefaultNames(t *testing.T) {
+	policy := limiter.NewPolicyLimiter(storage.NewMemoryStorage(), limiter.Policy{
+		Limits: []limiter.Limit{{Rate: 1, Window: time.Minute}},
+	})
+
+	_, err := policy.Allow("user1")
+	assert.NoError(t, err)
+	decision, err := policy.Decide("user1", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "1/1m0s", decision.DeniedBy)
+}
+
+// lateDenier denies every check, after moving the clock past the end of the
+// current second.
+type lateDenier struct {
+	limiter.Limiter
+	clk *clock.Manual
+}
+
+func (l *lateDenier) DecideCtx(ctx context.Context, key string, n int) (*limiter.Decision, error) {
+	l.clk.Advance(time.Second)
+	return &limiter.Decision{Allowed: false, ResetAt: l.clk.Now()}, nil
+}
+
+func TestPolicyRollbackSkipsEndedWindows(t *testing.T) {
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	store := storage.NewMemoryStorageWithClock(clk)
+	policy := limiter.NewPolicyLimiter(store, limiter.Policy{
+		Limits: []limiter.Limit{{Name: "second", Rate: 5, Window: time.Second}},
+		Clock:  clk,
+	})
+	composite := limiter.NewCompositeLimiter(
+		limiter.Member{Name: "policy", Limiter: policy},
+		limiter.Member{Name: "late", Limiter: &lateDenier{Limiter: policy, clk: clk}},
+	)
+
+	ok, err := policy.AllowN("user1", 2)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = composite.Allow("user1")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// The denial came after the window ended, so the request stays counted
+	// in what is now the previous window.
+	stats, err := policy.GetStats("user1")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, stats.Remaining)
+}
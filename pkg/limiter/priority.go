@@ -0,0 +1,230 @@
+// Package limiter provides rate limiting algorithm implementations.
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Priority is how important a request is to serve. Priorities compare in
+// order of importance, PrioritySheddable < PriorityNormal < PriorityCritical,
+// and the zero value is PriorityNormal. Values below PrioritySheddable or
+// above PriorityCritical are treated as the nearest of the two.
+type Priority int
+
+const (
+	// PrioritySheddable is the priority of requests that are the first to
+	// go under load, such as bulk exports and scrapers.
+	PrioritySheddable Priority = iota - 1
+	// PriorityNormal is the priority of ordinary traffic.
+	PriorityNormal
+	// PriorityCritical is the priority of requests that must not be shed,
+	// such as health checks and payment callbacks. They may use the whole
+	// capacity of a key.
+	PriorityCritical
+)
+
+// String returns "critical", "normal" or "sheddable".
+func (p Priority) String() string {
+	switch p {
+	case PriorityCritical:
+		return "critical"
+	case PriorityNormal:
+		return "normal"
+	case PrioritySheddable:
+		return "sheddable"
+	default:
+		return fmt.Sprintf("Priority(%d)", int(p))
+	}
+}
+
+// ParsePriority parses "critical", "normal" or "sheddable", in any case.
+func ParsePriority(s string) (Priority, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "critical":
+		return PriorityCritical, nil
+	case "normal":
+		return PriorityNormal, nil
+	case "sheddable":
+		return PrioritySheddable, nil
+	default:
+		return PriorityNormal, fmt.Errorf("limiter: unknown priority %q", s)
+	}
+}
+
+type priorityKey struct{}
+
+// WithPriority returns a copy of ctx carrying priority p. A PriorityLimiter
+// checks requests at the priority carried by the ctx passed to it.
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// PriorityFromContext returns the priority carried by ctx, or PriorityNormal
+// if it carries none.
+func PriorityFromContext(ctx context.Context) Priority {
+	p, _ := ctx.Value(priorityKey{}).(Priority)
+	return p
+}
+
+// PriorityConfig holds the configuration for a PriorityLimiter.
+type PriorityConfig struct {
+	// Config is the configuration of the token bucket shared by all
+	// priorities.
+	Config
+	// NormalShare is the fraction of the bucket that PriorityNormal requests
+	// may use; the rest is kept for PriorityCritical ones. It defaults to
+	// 0.8.
+	NormalShare float64
+	// SheddableShare is the fraction of the bucket that PrioritySheddable
+	// requests may use. It defaults to 0.5 and is at most NormalShare.
+	SheddableShare float64
+}
+
+// withDefaults returns the config with every unset field defaulted.
+func (c PriorityConfig) withDefaults() PriorityConfig {
+	if c.NormalShare <= 0 || c.NormalShare > 1 {
+		c.NormalShare = 0.8
+	}
+	if c.SheddableShare <= 0 || c.SheddableShare > 1 {
+		c.SheddableShare = 0.5
+	}
+	c.SheddableShare = min(c.SheddableShare, c.NormalShare)
+	return c
+}
+
+// PriorityLimiter is a token bucket limiter that keeps part of each key's
+// bucket for its more important requests. PriorityCritical requests may use
+// every token, PriorityNormal requests only those above the headroom that
+// NormalShare leaves, and PrioritySheddable requests only those above the
+// larger headroom that SheddableShare leaves. Under a surge, sheddable
+// traffic is denied first and critical traffic last.
+//
+// Checks use the priority carried by their ctx; see WithPriority. The
+// methods without a ctx check at PriorityNormal. All priorities draw from
+// the same bucket, which refills as that of a TokenBucketLimiter does, and
+// with Redis storage the headroom is enforced atomically across instances.
+type PriorityLimiter struct {
+	config PriorityConfig
+	bucket *TokenBucketLimiter
+}
+
+// NewPriorityLimiter creates a new PriorityLimiter.
+func NewPriorityLimiter(store Storage, cfg PriorityConfig) *PriorityLimiter {
+	cfg = cfg.withDefaults()
+	return &PriorityLimiter{
+		config: cfg,
+		bucket: NewTokenBucketLimiter(store, cfg.Config),
+	}
+}
+
+// floor returns how many tokens requests of priority p must leave in a
+// bucket of the given capacity.
+func (l *PriorityLimiter) floor(p Priority, capacity int) float64 {
+	share := l.config.NormalShare
+	switch {
+	case p >= PriorityCritical:
+		share = 1
+	case p <= PrioritySheddable:
+		share = l.config.SheddableShare
+	}
+	return math.Round(float64(capacity) * (1 - share))
+}
+
+// Allow checks if a single normal priority request is allowed for the given
+// key.
+func (l *PriorityLimiter) Allow(key string) (bool, error) {
+	return l.AllowN(key, 1)
+}
+
+// AllowCtx is like Allow but checks at the priority carried by ctx.
+func (l *PriorityLimiter) AllowCtx(ctx context.Context, key string) (bool, error) {
+	return l.AllowNCtx(ctx, key, 1)
+}
+
+// AllowN checks if n normal priority requests are allowed for the given key.
+func (l *PriorityLimiter) AllowN(key string, n int) (bool, error) {
+	return l.AllowNCtx(context.Background(), key, n)
+}
+
+// AllowNCtx is like AllowN but checks at the priority carried by ctx.
+func (l *PriorityLimiter) AllowNCtx(ctx context.Context, key string, n int) (bool, error) {
+	decision, err := l.DecideCtx(ctx, key, n)
+	if err != nil {
+		return false, err
+	}
+	return decision.Allowed, nil
+}
+
+// Decide checks if n normal priority requests are allowed for the given key.
+// The Decision describes the part of the bucket the priority may use: Limit
+// is its share of the capacity and Remaining the tokens above its headroom.
+func (l *PriorityLimiter) Decide(key string, n int) (*Decision, error) {
+	return l.DecideCtx(context.Background(), key, n)
+}
+
+// DecideCtx is like Decide but checks at the priority carried by ctx.
+func (l *PriorityLimiter) DecideCtx(ctx context.Context, key string, n int) (*Decision, error) {
+	t, err := l.bucket.forKey(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	floor := l.floor(PriorityFromContext(ctx), t.config.burst())
+	allowed, tokens, now, err := t.takeAbove(ctx, key, n, floor, false)
+	if err != nil {
+		return nil, err
+	}
+	return l.decision(t, allowed, tokens, floor, n, now), nil
+}
+
+// decision builds a Decision from the tokens left in the bucket and the
+// headroom of the checked priority.
+func (l *PriorityLimiter) decision(t *TokenBucketLimiter, allowed bool, tokens, floor float64, n int, now time.Time) *Decision {
+	capacity := float64(t.config.burst())
+	d := &Decision{
+		Allowed:   allowed,
+		Limit:     int(capacity - floor),
+		Remaining: max(int(tokens-floor), 0),
+		ResetAt:   now.Add(secondsToDuration((capacity - tokens) / t.refillRate())),
+	}
+	if !allowed {
+		d.RetryAfter = secondsToDuration((float64(n) + floor - tokens) / t.refillRate())
+	}
+	return d
+}
+
+// Reset clears the rate limit data for the given key.
+func (l *PriorityLimiter) Reset(key string) error {
+	return l.bucket.Reset(key)
+}
+
+// ResetCtx is like Reset but honours ctx.
+func (l *PriorityLimiter) ResetCtx(ctx context.Context, key string) error {
+	return l.bucket.ResetCtx(ctx, key)
+}
+
+// Refund gives n tokens back to the bucket of the given key, never filling it
+// past its capacity.
+func (l *PriorityLimiter) Refund(key string, n int) error {
+	return l.bucket.Refund(key, n)
+}
+
+// RefundCtx is like Refund but honours ctx.
+func (l *PriorityLimiter) RefundCtx(ctx context.Context, key string, n int) error {
+	return l.bucket.RefundCtx(ctx, key, n)
+}
+
+// GetStats returns the current rate limit statistics of normal priority
+// requests for the given key.
+func (l *PriorityLimiter) GetStats(key string) (*Stats, error) {
+	return l.GetStatsCtx(context.Background(), key)
+}
+
+// GetStatsCtx is like GetStats but reports the statistics of the priority
+// carried by ctx.
+func (l *PriorityLimiter) GetStatsCtx(ctx context.Context, key string) (*Stats, error) {
+	return statsFromDecision(l.DecideCtx(ctx, key, 0))
+}
@@ -0,0 +1,112 @@
+package limiter_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sumedhvats/rate-limiter-go/pkg/clock"
+	"github.com/sumedhvats/rate-limiter-go/pkg/limiter"
+	"github.com/sumedhvats/rate-limiter-go/pkg/storage"
+)
+
+func TestPriorityHeadroom(t *testing.T) {
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	l := limiter.NewPriorityLimiter(storage.NewMemoryStorageWithClock(clk), limiter.PriorityConfig{
+		Config: limiter.Config{Rate: 10, Window: 10 * time.Second, Clock: clk},
+	})
+	critical := limiter.WithPriority(context.Background(), limiter.PriorityCritical)
+	sheddable := limiter.WithPriority(context.Background(), limiter.PrioritySheddable)
+
+	// Sheddable requests may use half of the bucket.
+	decision, err := l.DecideCtx(sheddable, "user", 5)
+	assert.NoError(t, err)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, 5, decision.Limit)
+	assert.Equal(t, 0, decision.Remaining)
+	decision, err = l.DecideCtx(sheddable, "user", 1)
+	assert.NoError(t, err)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, time.Second, decision.RetryAfter)
+
+	// Normal requests may use 80% of it.
+	ok, err := l.AllowN("user", 3)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = l.Allow("user")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// Critical requests may use all of it.
+	ok, err = l.AllowNCtx(critical, "user", 2)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = l.AllowCtx(critical, "user")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	stats, err := l.GetStatsCtx(critical, "user")
+	assert.NoError(t, err)
+	assert.Equal(t, 10, stats.Limit)
+	assert.Equal(t, 0, stats.Remaining)
+
+	// The bucket refills for everyone.
+	clk.Advance(10 * time.Second)
+	ok, err = l.AllowNCtx(sheddable, "user", 5)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestPriorityShares(t *testing.T) {
+	l := limiter.NewPriorityLimiter(storage.NewMemoryStorage(), limiter.PriorityConfig{
+		Config:         limiter.Config{Rate: 100, Window: time.Minute},
+		NormalShare:    0.6,
+		SheddableShare: 0.9,
+	})
+
+	// SheddableShare is capped at NormalShare.
+	sheddable := limiter.WithPriority(context.Background(), limiter.PrioritySheddable)
+	stats, err := l.GetStatsCtx(sheddable, "user")
+	assert.NoError(t, err)
+	assert.Equal(t, 60, stats.Limit)
+	stats, err = l.GetStats("user")
+	assert.NoError(t, err)
+	assert.Equal(t, 60, stats.Limit)
+}
+
+func TestParsePriority(t *testing.T) {
+	for _, p := range []limiter.Priority{limiter.PriorityCritical, limiter.PriorityNormal, limiter.PrioritySheddable} {
+		parsed, err := limiter.ParsePriority(p.String())
+		assert.NoError(t, err)
+		assert.Equal(t, p, parsed)
+	}
+	parsed, err := limiter.ParsePriority(" Critical ")
+	assert.NoError(t, err)
+	assert.Equal(t, limiter.PriorityCritical, parsed)
+
+	_, err = limiter.ParsePriority("urgent")
+	assert.Error(t, err)
+	assert.Equal(t, limiter.PriorityNormal, limiter.PriorityFromContext(context.Background()))
+}
+
+func TestPriorityOrder(t *testing.T) {
+	assert.Less(t, limiter.PrioritySheddable, limiter.PriorityNormal)
+	assert.Less(t, limiter.PriorityNormal, limiter.PriorityCritical)
+
+	// Values past either end count as the nearest priority.
+	l := limiter.NewPriorityLimiter(storage.NewMemoryStorage(), limiter.PriorityConfig{
+		Config: limiter.Config{Rate: 10, Window: time.Minute},
+	})
+	for p, limit := range map[limiter.Priority]int{
+		limiter.PrioritySheddable - 1: 5,
+		limiter.PrioritySheddable:     5,
+		limiter.PriorityNormal:        8,
+		limiter.PriorityCritical:      10,
+		limiter.PriorityCritical + 1:  10,
+	} {
+		stats, err := l.GetStatsCtx(limiter.WithPriority(context.Background(), p), "user")
+		assert.NoError(t, err, p)
+		assert.Equal(t, limit, stats.Limit, p)
+	}
+}
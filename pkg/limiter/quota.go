@@ -0,0 +1,376 @@
+// Package limiter provides rate limiting algorithm implementations.
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sumedhvats/rate-limiter-go/pkg/clock"
+	"github.com/sumedhvats/rate-limiter-go/pkg/storage"
+)
+
+// Period is a calendar period that a quota resets after.
+type Period int
+
+const (
+	// Daily quotas reset at midnight.
+	Daily Period = iota + 1
+	// Weekly quotas reset at midnight at the start of QuotaConfig.WeekStart.
+	Weekly
+	// Monthly quotas reset at midnight on the first of the month.
+	Monthly
+)
+
+// String returns "day", "week" or "month".
+func (p Period) String() string {
+	switch p {
+	case Daily:
+		return "day"
+	case Weekly:
+		return "week"
+	case Monthly:
+		return "month"
+	default:
+		return fmt.Sprintf("Period(%d)", int(p))
+	}
+}
+
+// quotaGrace is how long a period's count outlives the period, so that
+// instances whose clocks are slightly apart still share it.
+const quotaGrace = time.Hour
+
+// QuotaConfig holds the configuration for a QuotaLimiter.
+type QuotaConfig struct {
+	// Limit is the number of requests allowed per period.
+	Limit int
+	// Period is the calendar period the quota resets after. It defaults to
+	// Daily.
+	Period Period
+	// Location is the time zone periods are aligned to. It defaults to UTC.
+	Location *time.Location
+	// KeyLocation optionally returns the time zone of a key, such as that of
+	// the customer it belongs to. Keys for which it returns a nil Location
+	// use Location. It is consulted on every check.
+	KeyLocation func(ctx context.Context, key string) (*time.Location, error)
+	// WeekStart is the first day of Weekly periods. It defaults to Sunday.
+	WeekStart time.Weekday
+	// Clock is the time source. It defaults to clock.Real.
+	Clock clock.Clock
+}
+
+// now returns the current time according to the configured Clock.
+func (c QuotaConfig) now() time.Time {
+	return clock.OrReal(c.Clock).Now()
+}
+
+// QuotaLimiter allows Limit requests per calendar day, week or month, such
+// as "10,000 calls per month". Unlike FixedWindowLimiter, whose windows are
+// multiples of Window since the Unix epoch, its periods start at midnight in
+// the time zone of each key, and months have their calendar length.
+//
+// On a RedisMemory using server time, periods are located at the time read
+// from the Redis server.
+type QuotaLimiter struct {
+	storage Storage
+	config  QuotaConfig
+}
+
+// NewQuotaLimiter creates a new QuotaLimiter.
+func NewQuotaLimiter(store Storage, cfg QuotaConfig) *QuotaLimiter {
+	if cfg.Period < Daily || cfg.Period > Monthly {
+		cfg.Period = Daily
+	}
+	return &QuotaLimiter{
+		storage: store,
+		config:  cfg,
+	}
+}
+
+// quotaPeriod is the period observed by a single check.
+type quotaPeriod struct {
+	now   time.Time
+	key   string
+	start time.Time
+	end   time.Time
+}
+
+// location returns the time zone of key.
+func (q *QuotaLimiter) location(ctx context.Context, key string) (*time.Location, error) {
+	if q.config.KeyLocation != nil {
+		loc, err := q.config.KeyLocation(ctx, key)
+		if err != nil {
+			return nil, resolveError{err}
+		}
+		if loc != nil {
+			return loc, nil
+		}
+	}
+	if q.config.Location != nil {
+		return q.config.Location, nil
+	}
+	return time.UTC, nil
+}
+
+// period locates the period of key that contains now in time zone loc.
+func (q *QuotaLimiter) period(key string, now time.Time, loc *time.Location) quotaPeriod {
+	local := now.In(loc)
+	year, month, day := local.Date()
+
+	var start, end time.Time
+	switch q.config.Period {
+	case Weekly:
+		day -= (int(local.Weekday()) - int(q.config.WeekStart) + 7) % 7
+		start = time.Date(year, month, day, 0, 0, 0, 0, loc)
+		end = start.AddDate(0, 0, 7)
+	case Monthly:
+		start = time.Date(year, month, 1, 0, 0, 0, 0, loc)
+		end = start.AddDate(0, 1, 0)
+	default:
+		start = time.Date(year, month, day, 0, 0, 0, 0, loc)
+		end = start.AddDate(0, 0, 1)
+	}
+	return quotaPeriod{
+		now:   now,
+		key:   key + ":" + q.config.Period.String() + ":" + start.Format(time.DateOnly),
+		start: start,
+		end:   end,
+	}
+}
+
+// currentPeriod locates the period of key that contains the current time.
+func (q *QuotaLimiter) currentPeriod(ctx context.Context, key string) (quotaPeriod, error) {
+	loc, err := q.location(ctx, key)
+	if err != nil {
+		return quotaPeriod{}, err
+	}
+	now := q.config.now()
+	if redisStore, ok := serverTime(q.storage); ok {
+		if now, err = redisStore.Time(ctx); err != nil {
+			return quotaPeriod{}, err
+		}
+	}
+	return q.period(key, now, loc), nil
+}
+
+// ttl returns how long the count of period p is kept.
+func (q *QuotaLimiter) ttl(p quotaPeriod) time.Duration {
+	return p.end.Sub(p.now) + quotaGrace
+}
+
+// AllowN checks if n requests are allowed for the given key in the current period.
+func (q *QuotaLimiter) AllowN(key string, n int) (bool, error) {
+	return q.AllowNCtx(context.Background(), key, n)
+}
+
+// AllowNCtx is like AllowN but honours ctx.
+func (q *QuotaLimiter) AllowNCtx(ctx context.Context, key string, n int) (bool, error) {
+	decision, err := q.DecideCtx(ctx, key, n)
+	if err != nil {
+		return false, err
+	}
+	return decision.Allowed, nil
+}
+
+// Decide checks if n requests are allowed for the given key in the current
+// period and reports the quota left behind by that check.
+func (q *QuotaLimiter) Decide(key string, n int) (*Decision, error) {
+	return q.DecideCtx(context.Background(), key, n)
+}
+
+// DecideCtx is like Decide but honours ctx.
+func (q *QuotaLimiter) DecideCtx(ctx context.Context, key string, n int) (*Decision, error) {
+	d, _, err := q.decide(ctx, key, n)
+	return d, err
+}
+
+// decideUndo is like DecideCtx but also returns a function that takes the
+// admitted requests back out of their period. See undoer.
+func (q *QuotaLimiter) decideUndo(ctx context.Context, key string, n int) (*Decision, func(context.Context) error, error) {
+	d, p, err := q.decide(ctx, key, n)
+	if err != nil || !d.Allowed || n == 0 {
+		return d, nil, err
+	}
+	return d, func(ctx context.Context) error {
+		return q.undo(ctx, p, n)
+	}, nil
+}
+
+// scriptStep describes the check of key as a step of the composite Redis
+// script. See scriptable. Limiters with a KeyLocation or on a store using
+// server time are checked in turn instead.
+func (q *QuotaLimiter) scriptStep(ctx context.Context, key string, n int) (*scriptStep, bool, error) {
+	store, ok := q.storage.(*storage.RedisMemory)
+	if !ok || store.ServerTime() || q.config.KeyLocation != nil {
+		return nil, false, nil
+	}
+	p, err := q.currentPeriod(ctx, key)
+	if err != nil {
+		return nil, false, err
+	}
+	return &scriptStep{
+		store: store,
+		step: storage.CompositeStep{
+			Kind:  storage.CompositeFixedWindow,
+			Keys:  []string{p.key},
+			Limit: q.config.Limit,
+			TTL:   q.ttl(p),
+		},
+		decision: func(result storage.CompositeResult) *Decision {
+			return q.decision(result.Allowed, result.Current, p)
+		},
+		undo: func(ctx context.Context) error {
+			return q.undo(ctx, p, n)
+		},
+	}, true, nil
+}
+
+// undo takes n requests back out of period p.
+func (q *QuotaLimiter) undo(ctx context.Context, p quotaPeriod, n int) error {
+	// Once the period is over there is nothing left to give back.
+	if !q.config.now().Before(p.end) {
+		return nil
+	}
+	_, err := q.storage.IncrementCtx(ctx, p.key, -n, q.ttl(p))
+	return err
+}
+
+func (q *QuotaLimiter) decide(ctx context.Context, key string, n int) (*Decision, quotaPeriod, error) {
+	loc, err := q.location(ctx, key)
+	if err != nil {
+		return nil, quotaPeriod{}, err
+	}
+	p := q.period(key, q.config.now(), loc)
+
+	var allowed bool
+	var count int64
+	if redisStore, ok := serverTime(q.storage); ok {
+		// The script reads the server time itself and only counts the
+		// request if it falls in the period located by Clock. Otherwise the
+		// period is located again at the server time it returned.
+		for {
+			var now time.Time
+			allowed, count, now, err = redisStore.PeriodIncrementServerTime(
+				ctx,
+				p.key,
+				n,
+				q.config.Limit,
+				p.start,
+				p.end,
+				q.ttl(p).Milliseconds(),
+			)
+			if err != nil || !now.Before(p.start) && now.Before(p.end) {
+				p.now = now
+				break
+			}
+			p = q.period(key, now, loc)
+		}
+	} else if redisStore, ok := q.storage.(*storage.RedisMemory); ok {
+		allowed, count, err = redisStore.FixedWindowIncrement(
+			ctx,
+			p.key,
+			n,
+			q.config.Limit,
+			q.ttl(p).Milliseconds(),
+		)
+	} else {
+		allowed, count, err = q.allowNMemory(ctx, p, n)
+	}
+	if err != nil {
+		return nil, p, err
+	}
+	return q.decision(allowed, count, p), p, nil
+}
+
+// decision builds a Decision from the count of period p.
+func (q *QuotaLimiter) decision(allowed bool, count int64, p quotaPeriod) *Decision {
+	d := &Decision{
+		Allowed:   allowed,
+		Limit:     q.config.Limit,
+		Remaining: max(q.config.Limit-int(count), 0),
+		ResetAt:   p.now,
+	}
+	if count > 0 {
+		d.ResetAt = p.end
+	}
+	if !allowed {
+		d.RetryAfter = p.end.Sub(p.now)
+	}
+	return d
+}
+
+func (q *QuotaLimiter) allowNMemory(ctx context.Context, p quotaPeriod, n int) (bool, int64, error) {
+	if n == 0 {
+		data, err := q.storage.GetCtx(ctx, p.key)
+		if err != nil || data == nil {
+			return true, 0, err
+		}
+		return data.(int64) <= int64(q.config.Limit), data.(int64), nil
+	}
+
+	newCount, err := q.storage.IncrementCtx(ctx, p.key, n, q.ttl(p))
+	if err != nil {
+		return false, 0, err
+	}
+	if newCount <= int64(q.config.Limit) {
+		return true, newCount, nil
+	}
+
+	count, err := q.storage.IncrementCtx(ctx, p.key, -n, q.ttl(p))
+	if err != nil {
+		return false, 0, err
+	}
+	return false, count, nil
+}
+
+// Allow checks if a single request is allowed for the given key in the current period.
+func (q *QuotaLimiter) Allow(key string) (bool, error) {
+	return q.AllowN(key, 1)
+}
+
+// AllowCtx is like Allow but honours ctx.
+func (q *QuotaLimiter) AllowCtx(ctx context.Context, key string) (bool, error) {
+	return q.AllowNCtx(ctx, key, 1)
+}
+
+// Reset clears the quota used by the given key in the current period.
+func (q *QuotaLimiter) Reset(key string) error {
+	return q.ResetCtx(context.Background(), key)
+}
+
+// ResetCtx is like Reset but honours ctx.
+func (q *QuotaLimiter) ResetCtx(ctx context.Context, key string) error {
+	p, err := q.currentPeriod(ctx, key)
+	if err != nil {
+		return err
+	}
+	return q.storage.DeleteCtx(ctx, p.key)
+}
+
+// Refund gives n requests back to the quota of the given key in the current
+// period, never taking its count below zero.
+func (q *QuotaLimiter) Refund(key string, n int) error {
+	return q.RefundCtx(context.Background(), key, n)
+}
+
+// RefundCtx is like Refund but honours ctx.
+func (q *QuotaLimiter) RefundCtx(ctx context.Context, key string, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	p, err := q.currentPeriod(ctx, key)
+	if err != nil {
+		return err
+	}
+	return refundCounters(ctx, q.storage, []string{p.key}, n, q.ttl(p))
+}
+
+// GetStats returns the current quota statistics for the given key.
+func (q *QuotaLimiter) GetStats(key string) (*Stats, error) {
+	return q.GetStatsCtx(context.Background(), key)
+}
+
+// GetStatsCtx is like GetStats but honours ctx.
+func (q *QuotaLimiter) GetStatsCtx(ctx context.Context, key string) (*Stats, error) {
+	return statsFromDecision(q.DecideCtx(ctx, key, 0))
+}
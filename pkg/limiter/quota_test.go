@@ -0,0 +1,154 @@
+package limiter_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sumedhvats/rate-limiter-go/pkg/clock"
+	"github.com/sumedhvats/rate-limiter-go/pkg/limiter"
+	"github.com/sumedhvats/rate-limiter-go/pkg/storage"
+)
+
+func TestQuotaMonthly(t *testing.T) {
+	clk := clock.NewManual(time.Date(2026, time.October, 17, 12, 0, 0, 0, time.UTC))
+	q := limiter.NewQuotaLimiter(storage.NewMemoryStorageWithClock(clk), limiter.QuotaConfig{
+		Limit:  3,
+		Period: limiter.Monthly,
+		Clock:  clk,
+	})
+	nextMonth := time.Date(2026, time.November, 1, 0, 0, 0, 0, time.UTC)
+
+	decision, err := q.Decide("acme", 3)
+	assert.NoError(t, err)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, 0, decision.Remaining)
+	assert.Equal(t, nextMonth, decision.ResetAt)
+
+	decision, err = q.Decide("acme", 1)
+	assert.NoError(t, err)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, nextMonth.Sub(clk.Now()), decision.RetryAfter)
+
+	clk.Set(nextMonth)
+	stats, err := q.GetStats("acme")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, stats.Remaining)
+	ok, err := q.Allow("acme")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestQuotaWeekly(t *testing.T) {
+	// Saturday.
+	clk := clock.NewManual(time.Date(2026, time.October, 17, 12, 0, 0, 0, time.UTC))
+	q := limiter.NewQuotaLimiter(storage.NewMemoryStorageWithClock(clk), limiter.QuotaConfig{
+		Limit:     10,
+		Period:    limiter.Weekly,
+		WeekStart: time.Monday,
+		Clock:     clk,
+	})
+
+	decision, err := q.Decide("acme", 1)
+	assert.NoError(t, err)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC), decision.ResetAt)
+}
+
+func TestQuotaDefaultsToDaily(t *testing.T) {
+	clk := clock.NewManual(time.Date(2026, time.October, 17, 12, 0, 0, 0, time.UTC))
+	store := storage.NewMemoryStorageWithClock(clk)
+	q := limiter.NewQuotaLimiter(store, limiter.QuotaConfig{Limit: 1, Clock: clk})
+
+	decision, err := q.Decide("acme", 1)
+	assert.NoError(t, err)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, time.Date(2026, time.October, 18, 0, 0, 0, 0, time.UTC), decision.ResetAt)
+	count, err := store.Get("acme:day:2026-10-17")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+}
+
+func TestQuotaKeyLocation(t *testing.T) {
+	newYork := time.FixedZone("EDT", -4*60*60)
+	clk := clock.NewManual(time.Date(2026, time.October, 17, 3, 0, 0, 0, time.UTC))
+	q := limiter.NewQuotaLimiter(storage.NewMemoryStorageWithClock(clk), limiter.QuotaConfig{
+		Limit:  1,
+		Period: limiter.Daily,
+		KeyLocation: func(ctx context.Context, key string) (*time.Location, error) {
+			if key == "ny" {
+				return newYork, nil
+			}
+			return nil, nil
+		},
+		Clock: clk,
+	})
+
+	for _, key := range []string{"ny", "utc"} {
+		ok, err := q.Allow(key)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		ok, err = q.Allow(key)
+		assert.NoError(t, err)
+		assert.False(t, ok)
+	}
+
+	// Midnight in New York; still the same day in UTC.
+	clk.Advance(time.Hour)
+	ok, err := q.Allow("ny")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = q.Allow("utc")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	stats, err := q.GetStats("ny")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2026, time.October, 18, 0, 0, 0, 0, newYork), stats.ResetAt)
+}
+
+func TestQuotaKeyLocationError(t *testing.T) {
+	lookupErr := errors.New("lookup failed")
+	q := limiter.NewQuotaLimiter(storage.NewMemoryStorage(), limiter.QuotaConfig{
+		Limit:  1,
+		Period: limiter.Daily,
+		KeyLocation: func(ctx context.Context, key string) (*time.Location, error) {
+			return nil, lookupErr
+		},
+	})
+
+	_, err := q.Allow("acme")
+	assert.ErrorIs(t, err, lookupErr)
+	assert.ErrorIs(t, q.Reset("acme"), lookupErr)
+}
+
+func TestQuotaInComposite(t *testing.T) {
+	clk := clock.NewManual(time.Date(2026, time.October, 17, 12, 0, 0, 0, time.UTC))
+	store := storage.NewMemoryStorageWithClock(clk)
+	quota := limiter.NewQuotaLimiter(store, limiter.QuotaConfig{
+		Limit:  5,
+		Period: limiter.Monthly,
+		Clock:  clk,
+	})
+	rate := limiter.NewFixedWindowLimiter(store, limiter.Config{
+		Rate:   2,
+		Window: time.Minute,
+		Clock:  clk,
+	})
+	c := limiter.NewCompositeLimiter(
+		limiter.Member{Name: "quota", Limiter: quota, Key: func(k string) string { return "quota:" + k }},
+		limiter.Member{Name: "rate", Limiter: rate},
+	)
+
+	decision, err := c.Decide("acme", 3)
+	assert.NoError(t, err)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, "rate", decision.DeniedBy)
+
+	// The denied request did not use up quota.
+	stats, err := quota.GetStats("quota:acme")
+	assert.NoError(t, err)
+	assert.Equal(t, 5, stats.Remaining)
+}
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/sumedhvats/rate-limiter-go/pkg/clock"
 	"github.com/sumedhvats/rate-limiter-go/pkg/storage"
 
 	"github.com/testcontainers/testcontainers-go/modules/redis"
@@ -94,3 +95,531 @@ func TestRedis_DestributedRateLimiting(t *testing.T) {
 	allowed, _ = limiter2.Allow("user:123")
 	assert.False(t, allowed)
 }
+
+func TestSlidingWindowLog_Redis_Exact(t *testing.T) {
+	store, cleanup := RedisTest(t)
+	defer cleanup()
+
+	limiter := NewSlidingWindowLogLimiter(store, Config{
+		Rate:   100,
+		Window: time.Minute,
+	})
+	var wg sync.WaitGroup
+	var allowed, denied int64
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				ok, _ := limiter.Allow("log1")
+				if ok {
+					atomic.AddInt64(&allowed, 1)
+				} else {
+					atomic.AddInt64(&denied, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int64(100), allowed, "log counting must be exact")
+	assert.Equal(t, int64(100), denied)
+
+	stats, err := limiter.GetStats("log1")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, stats.Remaining)
+}
+
+func TestGCRA_Redis_SingleKey(t *testing.T) {
+	store, cleanup := RedisTest(t)
+	defer cleanup()
+
+	limiter := NewGCRALimiter(store, Config{
+		Rate:   10,
+		Window: time.Second,
+		Burst:  5,
+	})
+	for i := 0; i < 5; i++ {
+		allowed, err := limiter.Allow("gcra:1")
+		assert.NoError(t, err)
+		assert.True(t, allowed)
+	}
+
+	decision, err := limiter.Decide("gcra:1", 1)
+	assert.NoError(t, err)
+	assert.False(t, decision.Allowed)
+	assert.InDelta(t, float64(100*time.Millisecond), float64(decision.RetryAfter), float64(10*time.Millisecond))
+
+	// Only the theoretical arrival time is stored.
+	tat, err := store.Get("gcra:1")
+	assert.NoError(t, err)
+	assert.IsType(t, int64(0), tat)
+}
+
+func TestTokenBucket_Redis_ContextDeadline(t *testing.T) {
+	store, cleanup := RedisTest(t)
+	defer cleanup()
+
+	limiter := NewTokenBucketLimiter(store, Config{
+		Rate:   10,
+		Window: time.Second,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+
+	_, err := limiter.DecideCtx(ctx, "ctx:1", 1)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	stats, err := limiter.GetStatsCtx(context.Background(), "ctx:1")
+	assert.NoError(t, err)
+	assert.Equal(t, 10, stats.Remaining)
+}
+
+func TestPolicy_Redis_AllOrNothing(t *testing.T) {
+	store, cleanup := RedisTest(t)
+	defer cleanup()
+
+	policy := NewPolicyLimiter(store, Policy{Limits: []Limit{
+		{Name: "second", Rate: 3, Window: time.Second},
+		{Name: "hour", Rate: 100, Window: time.Hour},
+	}})
+
+	decision, err := policy.Decide("policy:1", 4)
+	assert.NoError(t, err)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, "second", decision.DeniedBy)
+
+	// The denied request must not have been counted against the hourly limit.
+	decision, err = policy.Decide("policy:1", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, decision.Remaining)
+	stats, err := NewSlidingWindowLimiter(store, Config{Rate: 100, Window: time.Hour}).GetStats("policy:1:hour")
+	assert.NoError(t, err)
+	assert.Equal(t, 100, stats.Remaining)
+}
+
+func TestComposite_Redis_AllOrNothing(t *testing.T) {
+	store, cleanup := RedisTest(t)
+	defer cleanup()
+
+	global := NewTokenBucketLimiter(store, Config{Rate: 100, Window: time.Minute})
+	user := NewSlidingWindowLimiter(store, Config{Rate: 3, Window: time.Minute})
+	log := NewSlidingWindowLogLimiter(store, Config{Rate: 100, Window: time.Minute})
+
+	// Token bucket and sliding window share one script call.
+	composite := NewCompositeLimiter(
+		Member{Name: "global", Limiter: global, Key: func(string) string { return "composite:global" }},
+		Member{Name: "user", Limiter: user},
+	)
+	decision, err := composite.Decide("composite:user", 4)
+	assert.NoError(t, err)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, "user", decision.DeniedBy)
+
+	// The sliding window log is checked in turn and rolled back.
+	composite = NewCompositeLimiter(
+		Member{Name: "log", Limiter: log, Key: func(string) string { return "composite:log" }},
+		Member{Name: "user", Limiter: user},
+	)
+	decision, err = composite.Decide("composite:user", 4)
+	assert.NoError(t, err)
+	assert.Equal(t, "user", decision.DeniedBy)
+
+	stats, err := global.GetStats("composite:global")
+	assert.NoError(t, err)
+	assert.Equal(t, 100, stats.Remaining)
+	stats, err = log.GetStats("composite:log")
+	assert.NoError(t, err)
+	assert.Equal(t, 100, stats.Remaining)
+}
+
+func TestConcurrency_Redis_Leases(t *testing.T) {
+	store, cleanup := RedisTest(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	pod1 := NewConcurrencyLimiter(store, ConcurrencyConfig{Limit: 2, LeaseTTL: time.Second})
+	pod2 := NewConcurrencyLimiter(store, ConcurrencyConfig{Limit: 2, LeaseTTL: time.Second})
+
+	first, err := pod1.Acquire(ctx, "concurrency:1")
+	assert.NoError(t, err)
+	assert.True(t, first.OK())
+	second, err := pod2.Acquire(ctx, "concurrency:1")
+	assert.NoError(t, err)
+	assert.True(t, second.OK())
+
+	denied, err := pod2.Acquire(ctx, "concurrency:1")
+	assert.NoError(t, err)
+	assert.False(t, denied.OK())
+
+	assert.NoError(t, first.Release(ctx))
+	third, err := pod2.Acquire(ctx, "concurrency:1")
+	assert.NoError(t, err)
+	assert.True(t, third.OK())
+
+	// Leases that are never released free their slots after the TTL.
+	time.Sleep(1100 * time.Millisecond)
+	assert.ErrorIs(t, second.Renew(ctx), ErrLeaseExpired)
+	inFlight, err := pod1.InFlight(ctx, "concurrency:1")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, inFlight)
+}
+
+func TestOverrides_Redis_EditedAtRuntime(t *testing.T) {
+	store, cleanup := RedisTest(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	overrides := NewRedisOverrides(store, "")
+	sw := NewSlidingWindowLimiter(store, Config{Rate: 1, Window: time.Minute, Overrides: overrides})
+
+	decision, err := sw.Decide("overrides:1", 3)
+	assert.NoError(t, err)
+	assert.False(t, decision.Allowed)
+
+	assert.NoError(t, overrides.Set(ctx, "overrides:1", Config{Rate: 5}))
+	decision, err = sw.Decide("overrides:1", 3)
+	assert.NoError(t, err)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, 5, decision.Limit)
+
+	assert.NoError(t, overrides.Delete(ctx, "overrides:1"))
+	stats, err := sw.GetStats("overrides:1")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, stats.Limit)
+}
+
+func TestOverrides_Redis_CachedPerInstance(t *testing.T) {
+	store, cleanup := RedisTest(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	editor := NewRedisOverrides(store, "")
+	clk := clock.NewManual(time.Now())
+	pod := NewRedisOverridesWithClock(clk, store, "", time.Second)
+	fw := NewFixedWindowLimiter(store, Config{Rate: 1, Window: time.Minute, Overrides: pod})
+	composite := NewCompositeLimiter(
+		Member{Name: "user", Limiter: fw},
+		Member{Name: "global", Limiter: NewFixedWindowLimiter(store, Config{Rate: 100, Window: time.Minute}), Key: func(string) string { return "overrides:global" }},
+	)
+
+	decision, err := composite.Decide("overrides:2", 3)
+	assert.NoError(t, err)
+	assert.Equal(t, "user", decision.DeniedBy)
+
+	// Other instances see an edit once their cached copy expires.
+	assert.NoError(t, editor.Set(ctx, "overrides:2", Config{Rate: 5}))
+	decision, err = composite.Decide("overrides:2", 3)
+	assert.NoError(t, err)
+	assert.False(t, decision.Allowed)
+
+	clk.Advance(time.Second)
+	decision, err = composite.Decide("overrides:2", 3)
+	assert.NoError(t, err)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, 2, decision.Remaining)
+}
+
+func TestSetConfig_Redis_KeepsCounts(t *testing.T) {
+	store, cleanup := RedisTest(t)
+	defer cleanup()
+
+	fw := NewFixedWindowLimiter(store, Config{Rate: 2, Window: time.Minute})
+	ok, err := fw.AllowN("setconfig:1", 2)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	fw.SetConfig(Config{Rate: 3, Window: time.Minute})
+	decision, err := fw.Decide("setconfig:1", 1)
+	assert.NoError(t, err)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, 0, decision.Remaining)
+}
+
+func TestQuota_Redis_Monthly(t *testing.T) {
+	store, cleanup := RedisTest(t)
+	defer cleanup()
+
+	q := NewQuotaLimiter(store, QuotaConfig{Limit: 3, Period: Monthly})
+	decision, err := q.Decide("quota:1", 3)
+	assert.NoError(t, err)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, 1, decision.ResetAt.Day())
+
+	decision, err = q.Decide("quota:1", 1)
+	assert.NoError(t, err)
+	assert.False(t, decision.Allowed)
+	assert.Greater(t, decision.RetryAfter, time.Duration(0))
+}
+
+func TestPenaltyBox_Redis_BanAndLift(t *testing.T) {
+	store, cleanup := RedisTest(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	fw := NewFixedWindowLimiter(store, Config{Rate: 1, Window: time.Minute})
+	box := NewPenaltyBox(fw, store, PenaltyConfig{Threshold: 2, Prefix: "penalty:test:"})
+
+	for range 2 {
+		ok, err := box.AllowN("penalty:1", 2)
+		assert.NoError(t, err)
+		assert.False(t, ok)
+	}
+	bans, err := box.Bans(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, bans, 1)
+
+	assert.NoError(t, box.Lift(ctx, "penalty:1"))
+	ok, err := box.Allow("penalty:1")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestRefund_Redis_SlidingWindow(t *testing.T) {
+	store, cleanup := RedisTest(t)
+	defer cleanup()
+
+	sw := NewSlidingWindowLimiter(store, Config{Rate: 5, Window: time.Minute})
+	ok, err := sw.AllowN("refund:1", 5)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	assert.NoError(t, sw.Refund("refund:1", 2))
+	decision, err := sw.Decide("refund:1", 2)
+	assert.NoError(t, err)
+	assert.True(t, decision.Allowed)
+}
+
+func TestPriority_Redis_Headroom(t *testing.T) {
+	store, cleanup := RedisTest(t)
+	defer cleanup()
+
+	l := NewPriorityLimiter(store, PriorityConfig{Config: Config{Rate: 10, Window: time.Minute}})
+	sheddable := WithPriority(context.Background(), PrioritySheddable)
+	critical := WithPriority(context.Background(), PriorityCritical)
+
+	ok, err := l.AllowNCtx(sheddable, "priority:1", 5)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = l.AllowCtx(sheddable, "priority:1")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	ok, err = l.AllowNCtx(critical, "priority:1", 5)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestSubSecondWindows_Redis(t *testing.T) {
+	store, cleanup := RedisTest(t)
+	defer cleanup()
+
+	cfg := Config{Rate: 20, Window: 100 * time.Millisecond}
+	for name, l := range map[string]Limiter{
+		"tb": NewTokenBucketLimiter(store, cfg),
+		"fw": NewFixedWindowLimiter(store, cfg),
+		"sw": NewSlidingWindowLimiter(store, cfg),
+	} {
+		key := "subsecond:" + name
+		ok, err := l.AllowN(key, 20)
+		assert.NoError(t, err, name)
+		assert.True(t, ok, name)
+		ok, err = l.Allow(key)
+		assert.NoError(t, err, name)
+		assert.False(t, ok, name)
+
+		time.Sleep(200 * time.Millisecond)
+		ok, err = l.AllowN(key, 20)
+		assert.NoError(t, err, name)
+		assert.True(t, ok, name)
+	}
+}
+
+func TestServerTime_Redis_SkewedClocks(t *testing.T) {
+	base, cleanup := RedisTest(t)
+	defer cleanup()
+	store := base.WithServerTime()
+
+	// Two instances whose clocks are minutes apart share the same windows.
+	now := time.Now()
+	early := NewFixedWindowLimiter(store, Config{Rate: 4, Window: time.Hour, Clock: clock.NewManual(now.Add(-3 * time.Hour))})
+	late := NewFixedWindowLimiter(store, Config{Rate: 4, Window: time.Hour, Clock: clock.NewManual(now.Add(2 * time.Hour))})
+
+	ok, err := early.AllowN("skew:1", 2)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = late.AllowN("skew:1", 2)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = early.Allow("skew:1")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// So do the windows of a policy.
+	limits := []Limit{{Rate: 4, Window: time.Hour}, {Rate: 10, Window: 24 * time.Hour}}
+	earlyPolicy := NewPolicyLimiter(store, Policy{Limits: limits, Clock: clock.NewManual(now.Add(-3 * time.Hour))})
+	latePolicy := NewPolicyLimiter(store, Policy{Limits: limits, Clock: clock.NewManual(now.Add(2 * time.Hour))})
+	ok, err = earlyPolicy.AllowN("skew:2", 2)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = latePolicy.AllowN("skew:2", 2)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	decision, err := earlyPolicy.Decide("skew:2", 1)
+	assert.NoError(t, err)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, "4/1h0m0s", decision.DeniedBy)
+
+	// And those of hybrid limiters, which are pushed to the same key.
+	hybridConfig := func(clk clock.Clock) HybridConfig {
+		return HybridConfig{
+			Config:        Config{Rate: 4, Window: time.Hour, Clock: clk},
+			SyncInterval:  time.Hour,
+			SyncThreshold: 10,
+		}
+	}
+	earlyHybrid := NewHybridLimiter(store, hybridConfig(clock.NewManual(now.Add(-3*time.Hour))))
+	defer earlyHybrid.Close()
+	lateHybrid := NewHybridLimiter(store, hybridConfig(clock.NewManual(now.Add(2*time.Hour))))
+	defer lateHybrid.Close()
+	ok, err = earlyHybrid.AllowN("skew:3", 2)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.NoError(t, earlyHybrid.Flush(context.Background()))
+	ok, err = lateHybrid.AllowN("skew:3", 2)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.NoError(t, lateHybrid.Flush(context.Background()))
+	assert.NoError(t, earlyHybrid.Flush(context.Background()))
+	ok, err = earlyHybrid.Allow("skew:3")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// And the periods of quotas, even from clocks days apart.
+	earlyQuota := NewQuotaLimiter(store, QuotaConfig{Limit: 4, Period: Daily, Clock: clock.NewManual(now.Add(-72 * time.Hour))})
+	lateQuota := NewQuotaLimiter(store, QuotaConfig{Limit: 4, Period: Daily, Clock: clock.NewManual(now.Add(48 * time.Hour))})
+	ok, err = earlyQuota.AllowN("skew:5", 2)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = lateQuota.AllowN("skew:5", 2)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = earlyQuota.Allow("skew:5")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestServerTime_Redis_SetConfigAndRollback(t *testing.T) {
+	base, cleanup := RedisTest(t)
+	defer cleanup()
+	store := base.WithServerTime()
+	clk := clock.NewManual(time.Now().Add(-3 * time.Hour))
+
+	// The window in progress keeps its length until it ends by the Redis
+	// clock, not the instance's.
+	fw := NewFixedWindowLimiter(store, Config{Rate: 4, Window: time.Hour, Clock: clk})
+	ok, err := fw.AllowN("skew:4", 2)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	fw.SetConfig(Config{Rate: 4, Window: 2 * time.Hour, Clock: clk})
+	stats, err := fw.GetStats("skew:4")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, stats.Remaining)
+
+	// Rollbacks find the window by the Redis clock too, even on an instance
+	// whose clock is past its end.
+	late := clock.NewManual(time.Now().Add(2 * time.Hour))
+	lateFixed := NewFixedWindowLimiter(store, Config{Rate: 4, Window: time.Hour, Clock: late})
+	blocker := NewFixedWindowLimiter(store, Config{Rate: 0, Window: time.Hour, Clock: late})
+	composite := NewCompositeLimiter(
+		Member{Name: "fw", Limiter: lateFixed},
+		Member{Name: "blocker", Limiter: blocker, Key: func(k string) string { return k + ":blocker" }},
+	)
+	decision, err := composite.Decide("skew:5", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "blocker", decision.DeniedBy)
+	stats, err = lateFixed.GetStats("skew:5")
+	assert.NoError(t, err)
+	assert.Equal(t, 4, stats.Remaining)
+}
+
+func TestResilient_Redis_Outage(t *testing.T) {
+	store, cleanup := RedisTest(t)
+	fallback := NewFixedWindowLimiter(storage.NewMemoryStorage(), Config{Rate: 1, Window: time.Minute})
+	l := NewResilientLimiter(NewFixedWindowLimiter(store, Config{Rate: 3, Window: time.Minute}), ResilientConfig{
+		Mode:             FailFallback,
+		Fallback:         fallback,
+		FailureThreshold: 1,
+		Probe:            store.Ping,
+	})
+
+	ok, err := l.AllowN("outage:1", 3)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// Once Redis is gone, requests are checked on the fallback instead.
+	cleanup()
+	ok, err = l.Allow("outage:1")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, l.Open())
+	ok, err = l.Allow("outage:1")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestHybrid_Redis_SharedCount(t *testing.T) {
+	store, cleanup := RedisTest(t)
+	defer cleanup()
+	cfg := HybridConfig{
+		Config:        Config{Rate: 20, Window: time.Hour},
+		SyncInterval:  10 * time.Millisecond,
+		SyncThreshold: 2,
+	}
+	a := NewHybridLimiter(store, cfg)
+	defer a.Close()
+	b := NewHybridLimiter(store, cfg)
+	defer b.Close()
+
+	var admitted int
+	for i := 0; i < 40; i++ {
+		for _, h := range []*HybridLimiter{a, b} {
+			ok, err := h.Allow("hybrid:1")
+			assert.NoError(t, err)
+			if ok {
+				admitted++
+			}
+		}
+	}
+	assert.GreaterOrEqual(t, admitted, 20)
+	assert.LessOrEqual(t, admitted, 22)
+}
+
+func TestLeasing_Redis_FewRoundTrips(t *testing.T) {
+	store, cleanup := RedisTest(t)
+	defer cleanup()
+	source := NewTokenBucketLimiter(store, Config{Rate: 100, Window: time.Hour})
+	a := NewLeasingLimiter(source, LeaseConfig{MaxLease: 16})
+	b := NewLeasingLimiter(source, LeaseConfig{MaxLease: 16})
+
+	var admitted int
+	for i := 0; i < 100; i++ {
+		for _, l := range []*LeasingLimiter{a, b} {
+			ok, err := l.Allow("leasing:1")
+			assert.NoError(t, err)
+			if ok {
+				admitted++
+			}
+		}
+	}
+	assert.Equal(t, 100, admitted)
+
+	// Closing gives back what is left, here nothing.
+	assert.NoError(t, a.Close())
+	assert.NoError(t, b.Close())
+	stats, err := source.GetStats("leasing:1")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, stats.Remaining)
+}
@@ -0,0 +1,127 @@
+package limiter_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sumedhvats/rate-limiter-go/pkg/clock"
+	"github.com/sumedhvats/rate-limiter-go/pkg/limiter"
+	"github.com/sumedhvats/rate-limiter-go/pkg/storage"
+)
+
+func TestRefundEveryLimiter(t *testing.T) {
+	cfg := func(clk clock.Clock) limiter.Config {
+		return limiter.Config{Rate: 5, Window: time.Minute, Burst: 5, Clock: clk}
+	}
+	limiters := map[string]func(limiter.Storage, clock.Clock) limiter.Limiter{
+		"token bucket": func(s limiter.Storage, clk clock.Clock) limiter.Limiter {
+			return limiter.NewTokenBucketLimiter(s, cfg(clk))
+		},
+		"fixed window": func(s limiter.Storage, clk clock.Clock) limiter.Limiter {
+			return limiter.NewFixedWindowLimiter(s, cfg(clk))
+		},
+		"sliding window": func(s limiter.Storage, clk clock.Clock) limiter.Limiter {
+			return limiter.NewSlidingWindowLimiter(s, cfg(clk))
+		},
+		"sliding log": func(s limiter.Storage, clk clock.Clock) limiter.Limiter {
+			return limiter.NewSlidingWindowLogLimiter(s, cfg(clk))
+		},
+		"leaky bucket": func(s limiter.Storage, clk clock.Clock) limiter.Limiter {
+			return limiter.NewLeakyBucketLimiter(s, cfg(clk))
+		},
+		"gcra": func(s limiter.Storage, clk clock.Clock) limiter.Limiter {
+			return limiter.NewGCRALimiter(s, cfg(clk))
+		},
+		"adaptive": func(s limiter.Storage, clk clock.Clock) limiter.Limiter {
+			return limiter.NewAdaptiveLimiter(s, limiter.AdaptiveConfig{Config: cfg(clk)})
+		},
+		"policy": func(s limiter.Storage, clk clock.Clock) limiter.Limiter {
+			return limiter.NewPolicyLimiter(s, limiter.Policy{
+				Limits: []limiter.Limit{{Rate: 5, Window: time.Minute}, {Rate: 50, Window: time.Hour}},
+				Clock:  clk,
+			})
+		},
+		"composite": func(s limiter.Storage, clk clock.Clock) limiter.Limiter {
+			return limiter.NewCompositeLimiter(limiter.Member{Limiter: limiter.NewFixedWindowLimiter(s, cfg(clk))})
+		},
+		"quota": func(s limiter.Storage, clk clock.Clock) limiter.Limiter {
+			return limiter.NewQuotaLimiter(s, limiter.QuotaConfig{Limit: 5, Period: limiter.Daily, Clock: clk})
+		},
+		"penalty box": func(s limiter.Storage, clk clock.Clock) limiter.Limiter {
+			return limiter.NewPenaltyBox(limiter.NewFixedWindowLimiter(s, cfg(clk)), s, limiter.PenaltyConfig{Clock: clk})
+		},
+	}
+	for name, newLimiter := range limiters {
+		t.Run(name, func(t *testing.T) {
+			clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+			l := newLimiter(storage.NewMemoryStorageWithClock(clk), clk)
+
+			ok, err := l.AllowN("user", 3)
+			assert.NoError(t, err)
+			assert.True(t, ok)
+
+			assert.NoError(t, l.Refund("user", 2))
+			stats, err := l.GetStats("user")
+			assert.NoError(t, err)
+			assert.Equal(t, 4, stats.Remaining)
+
+			// Refunds never give back more than was used.
+			assert.NoError(t, l.Refund("user", 10))
+			stats, err = l.GetStats("user")
+			assert.NoError(t, err)
+			assert.Equal(t, 5, stats.Remaining)
+			ok, err = l.AllowN("user", 6)
+			assert.NoError(t, err)
+			assert.False(t, ok)
+		})
+	}
+}
+
+func TestSlidingWindowRefundAfterRollover(t *testing.T) {
+	// Start 10s before a minute boundary.
+	clk := clock.NewManual(time.Unix(1_700_000_030, 0))
+	sw := limiter.NewSlidingWindowLimiter(storage.NewMemoryStorageWithClock(clk), limiter.Config{
+		Rate:   10,
+		Window: time.Minute,
+		Clock:  clk,
+	})
+
+	ok, err := sw.AllowN("user", 4)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// The requests now count in the previous window, which the refund
+	// drains once the current one is empty.
+	clk.Advance(20 * time.Second)
+	assert.NoError(t, sw.Refund("user", 4))
+	stats, err := sw.GetStats("user")
+	assert.NoError(t, err)
+	assert.Equal(t, 10, stats.Remaining)
+}
+
+func TestSlidingWindowLogRefundsNewest(t *testing.T) {
+	start := time.Unix(1_700_000_000, 0)
+	clk := clock.NewManual(start)
+	log := limiter.NewSlidingWindowLogLimiter(storage.NewMemoryStorageWithClock(clk), limiter.Config{
+		Rate:   5,
+		Window: time.Minute,
+		Clock:  clk,
+	})
+
+	ok, err := log.AllowN("user", 2)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	clk.Advance(10 * time.Second)
+	ok, err = log.Allow("user")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// The refund takes the newest request and one of the two before it, so
+	// the remaining one slides out with the oldest.
+	assert.NoError(t, log.Refund("user", 2))
+	decision, err := log.Decide("user", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, decision.Remaining)
+	assert.Equal(t, start.Add(time.Minute), decision.ResetAt)
+}
@@ -0,0 +1,103 @@
+// Package limiter provides rate limiting algorithm implementations.
+package limiter
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/sumedhvats/rate-limiter-go/pkg/clock"
+)
+
+// InfDuration is the delay returned by a Reservation that is not OK.
+const InfDuration = time.Duration(math.MaxInt64)
+
+var (
+	// ErrExceedsLimit is returned by Wait when n can never be allowed.
+	ErrExceedsLimit = errors.New("limiter: n exceeds limit")
+	// ErrWouldExceedDeadline is returned by Wait when the required delay
+	// is longer than the time left before the context deadline.
+	ErrWouldExceedDeadline = errors.New("limiter: wait would exceed context deadline")
+)
+
+// Reservation holds requests that were counted ahead of time. The caller
+// should wait Delay before acting on them, or Cancel to give them back.
+type Reservation struct {
+	ok        bool
+	timeToAct time.Time
+	cancel    func() error
+	clock     clock.Clock
+	once      sync.Once
+}
+
+// OK reports whether the limiter can ever provide the requested amount.
+// If OK is false, Delay returns InfDuration and Cancel does nothing.
+func (r *Reservation) OK() bool {
+	return r.ok
+}
+
+// Delay returns how long the caller must wait before acting on the reservation.
+func (r *Reservation) Delay() time.Duration {
+	return r.DelayFrom(clock.OrReal(r.clock).Now())
+}
+
+// DelayFrom returns how long, measured from now, the caller must wait before
+// acting on the reservation.
+func (r *Reservation) DelayFrom(now time.Time) time.Duration {
+	if !r.ok {
+		return InfDuration
+	}
+	return max(r.timeToAct.Sub(now), 0)
+}
+
+// Cancel gives the reserved requests back to the limiter. Call it only if
+// the reservation will not be acted on. Calling it more than once does nothing.
+func (r *Reservation) Cancel() error {
+	if !r.ok {
+		return nil
+	}
+	var err error
+	r.once.Do(func() {
+		err = r.cancel()
+	})
+	return err
+}
+
+// waitFor reserves through reserve and blocks until the reservation may be
+// acted on, cancelling it if ctx is done first. The delay is measured on clk;
+// the ctx deadline is always real time.
+func waitFor(ctx context.Context, clk clock.Clock, reserve func() (*Reservation, error)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r, err := reserve()
+	if err != nil {
+		return err
+	}
+	if !r.OK() {
+		return ErrExceedsLimit
+	}
+
+	delay := r.Delay()
+	if delay == 0 {
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+		if err := r.Cancel(); err != nil {
+			return err
+		}
+		return ErrWouldExceedDeadline
+	}
+
+	select {
+	case <-clk.After(delay):
+		return nil
+	case <-ctx.Done():
+		if err := r.Cancel(); err != nil {
+			return err
+		}
+		return ctx.Err()
+	}
+}
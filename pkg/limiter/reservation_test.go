@@ -0,0 +1,146 @@
+package limiter_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sumedhvats/rate-limiter-go/pkg/clock"
+	"github.com/sumedhvats/rate-limiter-go/pkg/limiter"
+	"github.com/sumedhvats/rate-limiter-go/pkg/storage"
+)
+
+func TestTokenBucketReserve(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	cfg := limiter.Config{Rate: 10, Window: time.Second, Burst: 5}
+	tb := limiter.NewTokenBucketLimiter(store, cfg)
+
+	r, err := tb.Reserve("user1", 5)
+	assert.NoError(t, err)
+	assert.True(t, r.OK())
+	assert.Zero(t, r.Delay())
+
+	// The bucket is empty, so the next reservation goes into debt.
+	r, err = tb.Reserve("user1", 2)
+	assert.NoError(t, err)
+	assert.True(t, r.OK())
+	assert.InDelta(t, float64(200*time.Millisecond), float64(r.Delay()), float64(20*time.Millisecond))
+
+	ok, _ := tb.Allow("user1")
+	assert.False(t, ok)
+
+	// Cancelling pays the debt back.
+	assert.NoError(t, r.Cancel())
+	stats, err := tb.GetStats("user1")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, stats.Remaining)
+	assert.WithinDuration(t, time.Now().Add(500*time.Millisecond), stats.ResetAt, 50*time.Millisecond)
+
+	r, err = tb.Reserve("user1", 6)
+	assert.NoError(t, err)
+	assert.False(t, r.OK())
+	assert.Equal(t, limiter.InfDuration, r.Delay())
+}
+
+func TestTokenBucketWait(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	cfg := limiter.Config{Rate: 20, Window: time.Second, Burst: 1}
+	tb := limiter.NewTokenBucketLimiter(store, cfg)
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, tb.Wait(context.Background(), "batch", 1))
+	}
+	// One request is free, the other four wait 50ms each.
+	assert.InDelta(t, float64(200*time.Millisecond), float64(time.Since(start)), float64(50*time.Millisecond))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := tb.Wait(ctx, "batch", 1)
+	assert.ErrorIs(t, err, limiter.ErrWouldExceedDeadline)
+
+	err = tb.Wait(context.Background(), "batch", 2)
+	assert.ErrorIs(t, err, limiter.ErrExceedsLimit)
+}
+
+func TestTokenBucketWaitManualClock(t *testing.T) {
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	store := storage.NewMemoryStorageWithClock(clk)
+	cfg := limiter.Config{Rate: 1, Window: time.Minute, Burst: 1, Clock: clk}
+	tb := limiter.NewTokenBucketLimiter(store, cfg)
+
+	assert.NoError(t, tb.Wait(context.Background(), "batch", 1))
+
+	done := make(chan error, 1)
+	go func() {
+		done <- tb.Wait(context.Background(), "batch", 1)
+	}()
+	assert.Eventually(t, func() bool { return clk.Waiters() == 1 }, time.Second, time.Millisecond)
+
+	clk.Advance(59 * time.Second)
+	select {
+	case <-done:
+		t.Fatal("Wait returned before the token was refilled")
+	default:
+	}
+
+	clk.Advance(time.Second)
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Wait did not return after the clock advanced")
+	}
+}
+
+func TestSlidingWindowReserve(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	cfg := limiter.Config{Rate: 5, Window: time.Minute}
+	sw := limiter.NewSlidingWindowLimiter(store, cfg)
+
+	r, err := sw.Reserve("user1", 5)
+	assert.NoError(t, err)
+	assert.True(t, r.OK())
+	assert.Zero(t, r.Delay())
+
+	r, err = sw.Reserve("user1", 1)
+	assert.NoError(t, err)
+	assert.True(t, r.OK())
+	assert.Greater(t, r.Delay(), time.Duration(0))
+
+	stats, _ := sw.GetStats("user1")
+	assert.Equal(t, 0, stats.Remaining)
+
+	assert.NoError(t, r.Cancel())
+	assert.NoError(t, r.Cancel(), "second cancel is a no-op")
+
+	decision, err := sw.Decide("user1", 1)
+	assert.NoError(t, err)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, 0, decision.Remaining)
+}
+
+func TestSlidingWindowWaitCancelled(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	cfg := limiter.Config{Rate: 2, Window: time.Minute}
+	sw := limiter.NewSlidingWindowLimiter(store, cfg)
+
+	assert.NoError(t, sw.Wait(context.Background(), "user1", 2))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- sw.Wait(ctx, "user1", 1)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+
+	// The cancelled wait must not keep its reservation.
+	windowStart := time.Now().Truncate(time.Minute)
+	count, err := store.Get(fmt.Sprintf("user1:%d", windowStart.Unix()))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), count)
+}
@@ -0,0 +1,323 @@
+// Package limiter provides rate limiting algorithm implementations.
+package limiter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sumedhvats/rate-limiter-go/pkg/clock"
+)
+
+// FailureMode is how a ResilientLimiter answers while its limiter fails.
+type FailureMode int
+
+const (
+	// FailClosed denies every request.
+	FailClosed FailureMode = iota
+	// FailOpen allows every request.
+	FailOpen
+	// FailFallback checks requests on ResilientConfig.Fallback, typically a
+	// limiter on a storage.MemoryStorage with a scaled-down rate.
+	FailFallback
+)
+
+// String returns "closed", "open" or "fallback".
+func (m FailureMode) String() string {
+	switch m {
+	case FailClosed:
+		return "closed"
+	case FailOpen:
+		return "open"
+	case FailFallback:
+		return "fallback"
+	default:
+		return fmt.Sprintf("FailureMode(%d)", int(m))
+	}
+}
+
+// ResilientConfig holds the configuration for a ResilientLimiter.
+type ResilientConfig struct {
+	// Mode is how requests are answered while the limiter fails. It
+	// defaults to FailClosed.
+	Mode FailureMode
+	// Fallback is the limiter checked in FailFallback mode. Without one,
+	// FailFallback fails closed.
+	Fallback Limiter
+	// FailureThreshold is how many checks in a row have to fail for the
+	// circuit to open. It defaults to 5.
+	FailureThreshold int
+	// ProbeInterval is how long the circuit stays open before the limiter is
+	// tried again. It defaults to 5 seconds.
+	ProbeInterval time.Duration
+	// Probe optionally checks whether the limiter's backend is healthy, such
+	// as storage.RedisMemory.Ping. While the circuit is open it is run in the
+	// background every ProbeInterval, with ProbeInterval as its timeout, and
+	// closes the circuit once it succeeds. Without a Probe, one request per
+	// ProbeInterval is let through to the limiter instead.
+	Probe func(ctx context.Context) error
+	// OnStateChange is optionally called when the circuit opens or closes.
+	OnStateChange func(open bool)
+	// Clock is the time source. It defaults to clock.Real.
+	Clock clock.Clock
+}
+
+// withDefaults returns the config with every unset field defaulted.
+func (c ResilientConfig) withDefaults() ResilientConfig {
+	if c.FailureThreshold <= 0 {
+		c.FailureThreshold = 5
+	}
+	if c.ProbeInterval <= 0 {
+		c.ProbeInterval = 5 * time.Second
+	}
+	return c
+}
+
+// now returns the current time according to the configured Clock.
+func (c ResilientConfig) now() time.Time {
+	return clock.OrReal(c.Clock).Now()
+}
+
+// ResilientLimiter wraps a Limiter whose storage may become unavailable, such
+// as one on Redis, and keeps answering checks when it fails. Checks that fail
+// are answered according to Mode instead of returning the error. After
+// FailureThreshold failures in a row a circuit breaker opens and checks skip
+// the limiter altogether, until a health probe or a trial request succeeds
+// and the circuit closes again.
+//
+// Only errors from the limiter's storage count as failures, including
+// timeouts and ctx deadlines passing while the storage hangs. Errors caused
+// by the caller canceling ctx, or by resolving how to check a key, such as
+// from Config.Overrides or QuotaConfig.KeyLocation, are returned as they are.
+type ResilientLimiter struct {
+	limiter Limiter
+	config  ResilientConfig
+
+	mu       sync.Mutex
+	failures int
+	open     bool
+	retryAt  time.Time
+	probing  bool
+}
+
+// NewResilientLimiter creates a ResilientLimiter around l.
+func NewResilientLimiter(l Limiter, cfg ResilientConfig) *ResilientLimiter {
+	return &ResilientLimiter{
+		limiter: l,
+		config:  cfg.withDefaults(),
+	}
+}
+
+// Open reports whether the circuit is open, i.e. whether checks currently
+// skip the wrapped limiter.
+func (r *ResilientLimiter) Open() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.open
+}
+
+// try reports whether the wrapped limiter should be called: always while the
+// circuit is closed, and once per ProbeInterval as a trial while it is open
+// and there is no Probe. With a Probe, it starts the probe instead. trial is
+// set for the trial call, whose outcome has to be passed on to failed.
+func (r *ResilientLimiter) try() (call, trial bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.open {
+		return true, false
+	}
+	if r.probing || r.config.now().Before(r.retryAt) {
+		return false, false
+	}
+	r.probing = true
+	if r.config.Probe != nil {
+		go r.probe()
+		return false, false
+	}
+	return true, true
+}
+
+// probe runs the health probe and closes the circuit if it succeeds.
+func (r *ResilientLimiter) probe() {
+	ctx, cancel := context.WithTimeout(context.Background(), r.config.ProbeInterval)
+	defer cancel()
+	err := r.config.Probe(ctx)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.probing = false
+	if err != nil {
+		r.retryAt = r.config.now().Add(r.config.ProbeInterval)
+		return
+	}
+	r.setOpen(false)
+}
+
+// failed records the outcome of a call to the wrapped limiter and reports
+// whether its storage failed. trial is as returned by try.
+func (r *ResilientLimiter) failed(ctx context.Context, trial bool, err error) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if trial {
+		r.probing = false
+	}
+	if err != nil && !storageFailure(ctx, err) {
+		return false
+	}
+	if err == nil {
+		r.failures = 0
+		r.setOpen(false)
+		return false
+	}
+
+	r.failures++
+	if r.open || r.failures >= r.config.FailureThreshold {
+		r.retryAt = r.config.now().Add(r.config.ProbeInterval)
+		r.setOpen(true)
+	}
+	return true
+}
+
+// storageFailure reports whether err, returned by a call made with ctx, is
+// a failure of the wrapped limiter's storage. A deadline passing counts, as
+// a storage that hangs only ever fails that way.
+func storageFailure(ctx context.Context, err error) bool {
+	if errors.Is(ctx.Err(), context.Canceled) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var re resolveError
+	return !errors.As(err, &re)
+}
+
+// setOpen opens or closes the circuit. r.mu must be held.
+func (r *ResilientLimiter) setOpen(open bool) {
+	if r.open == open {
+		return
+	}
+	r.open = open
+	if !open {
+		r.failures = 0
+	}
+	if r.config.OnStateChange != nil {
+		r.config.OnStateChange(open)
+	}
+}
+
+// degraded answers a check while the wrapped limiter fails.
+func (r *ResilientLimiter) degraded(ctx context.Context, key string, n int) (*Decision, error) {
+	now := r.config.now()
+	switch {
+	case r.config.Mode == FailOpen:
+		return &Decision{Allowed: true, ResetAt: now}, nil
+	case r.config.Mode == FailFallback && r.config.Fallback != nil:
+		return r.config.Fallback.DecideCtx(ctx, key, n)
+	}
+
+	if n <= 0 {
+		return &Decision{Allowed: true, ResetAt: now}, nil
+	}
+	r.mu.Lock()
+	retryAfter := r.retryAt.Sub(now)
+	r.mu.Unlock()
+	if retryAfter <= 0 {
+		retryAfter = r.config.ProbeInterval
+	}
+	return &Decision{
+		RetryAfter: retryAfter,
+		ResetAt:    now.Add(retryAfter),
+		DeniedBy:   "unavailable",
+	}, nil
+}
+
+// Allow checks if a single request is allowed for the given key.
+func (r *ResilientLimiter) Allow(key string) (bool, error) {
+	return r.AllowN(key, 1)
+}
+
+// AllowCtx is like Allow but honours ctx.
+func (r *ResilientLimiter) AllowCtx(ctx context.Context, key string) (bool, error) {
+	return r.AllowNCtx(ctx, key, 1)
+}
+
+// AllowN checks if n requests are allowed for the given key.
+func (r *ResilientLimiter) AllowN(key string, n int) (bool, error) {
+	return r.AllowNCtx(context.Background(), key, n)
+}
+
+// AllowNCtx is like AllowN but honours ctx.
+func (r *ResilientLimiter) AllowNCtx(ctx context.Context, key string, n int) (bool, error) {
+	decision, err := r.DecideCtx(ctx, key, n)
+	if err != nil {
+		return false, err
+	}
+	return decision.Allowed, nil
+}
+
+// Decide checks if n requests are allowed for the given key on the wrapped
+// limiter or, while it fails, according to Mode. Checks denied by FailClosed
+// have DeniedBy "unavailable" and RetryAfter set to when the limiter is
+// tried again.
+func (r *ResilientLimiter) Decide(key string, n int) (*Decision, error) {
+	return r.DecideCtx(context.Background(), key, n)
+}
+
+// DecideCtx is like Decide but honours ctx.
+func (r *ResilientLimiter) DecideCtx(ctx context.Context, key string, n int) (*Decision, error) {
+	call, trial := r.try()
+	if !call {
+		return r.degraded(ctx, key, n)
+	}
+	d, err := r.limiter.DecideCtx(ctx, key, n)
+	if r.failed(ctx, trial, err) {
+		return r.degraded(ctx, key, n)
+	}
+	return d, err
+}
+
+// Reset clears the rate limit data for the given key on the wrapped limiter
+// and on Fallback.
+func (r *ResilientLimiter) Reset(key string) error {
+	return r.ResetCtx(context.Background(), key)
+}
+
+// ResetCtx is like Reset but honours ctx.
+func (r *ResilientLimiter) ResetCtx(ctx context.Context, key string) error {
+	if r.config.Fallback != nil {
+		if err := r.config.Fallback.ResetCtx(ctx, key); err != nil {
+			return err
+		}
+	}
+	return r.limiter.ResetCtx(ctx, key)
+}
+
+// Refund gives n requests back to the given key on the wrapped limiter or,
+// while it fails, on Fallback.
+func (r *ResilientLimiter) Refund(key string, n int) error {
+	return r.RefundCtx(context.Background(), key, n)
+}
+
+// RefundCtx is like Refund but honours ctx.
+func (r *ResilientLimiter) RefundCtx(ctx context.Context, key string, n int) error {
+	if call, trial := r.try(); call {
+		err := r.limiter.RefundCtx(ctx, key, n)
+		if !r.failed(ctx, trial, err) {
+			return err
+		}
+	}
+	if r.config.Mode == FailFallback && r.config.Fallback != nil {
+		return r.config.Fallback.RefundCtx(ctx, key, n)
+	}
+	return nil
+}
+
+// GetStats returns the current rate limit statistics for the given key.
+func (r *ResilientLimiter) GetStats(key string) (*Stats, error) {
+	return r.GetStatsCtx(context.Background(), key)
+}
+
+// GetStatsCtx is like GetStats but honours ctx.
+func (r *ResilientLimiter) GetStatsCtx(ctx context.Context, key string) (*Stats, error) {
+	return statsFromDecision(r.DecideCtx(ctx, key, 0))
+}
@@ -0,0 +1,341 @@
+package limiter_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sumedhvats/rate-limiter-go/pkg/clock"
+	"github.com/sumedhvats/rate-limiter-go/pkg/limiter"
+	"github.com/sumedhvats/rate-limiter-go/pkg/storage"
+)
+
+// flakyStorage is a MemoryStorage that fails while down is set.
+type flakyStorage struct {
+	*storage.MemoryStorage
+	down *atomic.Bool
+}
+
+var errStorageDown = errors.New("storage down")
+
+func (f flakyStorage) GetCtx(ctx context.Context, key string) (interface{}, error) {
+	if f.down.Load() {
+		return nil, errStorageDown
+	}
+	return f.MemoryStorage.GetCtx(ctx, key)
+}
+
+func (f flakyStorage) IncrementCtx(ctx context.Context, key string, value int, ttl time.Duration) (int64, error) {
+	if f.down.Load() {
+		return 0, errStorageDown
+	}
+	return f.MemoryStorage.IncrementCtx(ctx, key, value, ttl)
+}
+
+// flakyLimiter returns a limiter allowing limit requests a day whose storage
+// fails while down is set.
+func flakyLimiter(clk clock.Clock, limit int, down *atomic.Bool) limiter.Limiter {
+	return limiter.NewQuotaLimiter(flakyStorage{storage.NewMemoryStorageWithClock(clk), down}, limiter.QuotaConfig{
+		Limit:  limit,
+		Period: limiter.Daily,
+		Clock:  clk,
+	})
+}
+
+func TestResilientFailClosed(t *testing.T) {
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	var down atomic.Bool
+	var changes []bool
+	r := limiter.NewResilientLimiter(flakyLimiter(clk, 10, &down), limiter.ResilientConfig{
+		FailureThreshold: 2,
+		ProbeInterval:    time.Second,
+		OnStateChange:    func(open bool) { changes = append(changes, open) },
+		Clock:            clk,
+	})
+
+	ok, err := r.Allow("user")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	down.Store(true)
+	decision, err := r.Decide("user", 1)
+	assert.NoError(t, err)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, "unavailable", decision.DeniedBy)
+	assert.False(t, r.Open())
+
+	_, err = r.Decide("user", 1)
+	assert.NoError(t, err)
+	assert.True(t, r.Open())
+
+	// The limiter is not tried again until ProbeInterval has passed.
+	down.Store(false)
+	decision, err = r.Decide("user", 1)
+	assert.NoError(t, err)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, time.Second, decision.RetryAfter)
+
+	// Then one trial request closes the circuit.
+	clk.Advance(time.Second)
+	ok, err = r.Allow("user")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.False(t, r.Open())
+	assert.Equal(t, []bool{true, false}, changes)
+
+	stats, err := r.GetStats("user")
+	assert.NoError(t, err)
+	assert.Equal(t, 8, stats.Remaining)
+}
+
+func TestResilientFailedTrialReopens(t *testing.T) {
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	var down atomic.Bool
+	down.Store(true)
+	r := limiter.NewResilientLimiter(flakyLimiter(clk, 10, &down), limiter.ResilientConfig{
+		FailureThreshold: 1,
+		ProbeInterval:    time.Second,
+		Clock:            clk,
+	})
+
+	_, err := r.Allow("user")
+	assert.NoError(t, err)
+	assert.True(t, r.Open())
+
+	clk.Advance(time.Second)
+	decision, err := r.Decide("user", 1)
+	assert.NoError(t, err)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, time.Second, decision.RetryAfter)
+	assert.True(t, r.Open())
+}
+
+func TestResilientFailOpen(t *testing.T) {
+	var down atomic.Bool
+	down.Store(true)
+	r := limiter.NewResilientLimiter(flakyLimiter(nil, 1, &down), limiter.ResilientConfig{
+		Mode: limiter.FailOpen,
+	})
+
+	for i := 0; i < 10; i++ {
+		ok, err := r.Allow("user")
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	}
+	assert.True(t, r.Open())
+	assert.NoError(t, r.Refund("user", 1))
+}
+
+func TestResilientFailFallback(t *testing.T) {
+	var down atomic.Bool
+	down.Store(true)
+	fallback := limiter.NewFixedWindowLimiter(storage.NewMemoryStorage(), limiter.Config{
+		Rate:   2,
+		Window: time.Minute,
+	})
+	r := limiter.NewResilientLimiter(flakyLimiter(nil, 100, &down), limiter.ResilientConfig{
+		Mode:     limiter.FailFallback,
+		Fallback: fallback,
+	})
+
+	ok, err := r.AllowN("user", 2)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = r.Allow("user")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	assert.NoError(t, r.Refund("user", 1))
+	ok, err = r.Allow("user")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestResilientProbe(t *testing.T) {
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	var down atomic.Bool
+	down.Store(true)
+	probes := make(chan struct{}, 1)
+	r := limiter.NewResilientLimiter(flakyLimiter(clk, 10, &down), limiter.ResilientConfig{
+		Mode:             limiter.FailOpen,
+		FailureThreshold: 1,
+		ProbeInterval:    time.Second,
+		Probe: func(ctx context.Context) error {
+			defer func() { probes <- struct{}{} }()
+			if down.Load() {
+				return errors.New("storage down")
+			}
+			return nil
+		},
+		Clock: clk,
+	})
+
+	_, err := r.Allow("user")
+	assert.NoError(t, err)
+	assert.True(t, r.Open())
+
+	// Requests are never let through while the circuit is open; the probe
+	// closes it in the background.
+	down.Store(false)
+	clk.Advance(time.Second)
+	ok, err := r.Allow("user")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	<-probes
+	assert.Eventually(t, func() bool { return !r.Open() }, time.Second, time.Millisecond)
+
+	stats, err := r.GetStats("user")
+	assert.NoError(t, err)
+	assert.Equal(t, 10, stats.Remaining)
+}
+
+func TestResilientCanceledContext(t *testing.T) {
+	var down atomic.Bool
+	down.Store(true)
+	r := limiter.NewResilientLimiter(flakyLimiter(nil, 10, &down), limiter.ResilientConfig{
+		FailureThreshold: 1,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := r.AllowCtx(ctx, "user")
+	assert.Error(t, err)
+	assert.False(t, r.Open())
+}
+
+func TestResilientResolveErrors(t *testing.T) {
+	failing := limiter.OverridesFunc(func(ctx context.Context, key string) (limiter.Config, bool, error) {
+		return limiter.Config{}, false, errors.New("directory down")
+	})
+	r := limiter.NewResilientLimiter(limiter.NewFixedWindowLimiter(storage.NewMemoryStorage(), limiter.Config{
+		Rate:      10,
+		Window:    time.Minute,
+		Overrides: failing,
+	}), limiter.ResilientConfig{FailureThreshold: 1})
+
+	// The storage is fine, so the error is returned and the circuit stays
+	// closed.
+	_, err := r.Allow("user")
+	assert.EqualError(t, err, "directory down")
+	assert.False(t, r.Open())
+}
+
+// gatedLimiter holds checks of the keys in gates until their gate is closed,
+// and then fails them if ctx is done.
+type gatedLimiter struct {
+	limiter.Limiter
+	started map[string]chan struct{}
+	gates   map[string]chan struct{}
+}
+
+func (g *gatedLimiter) DecideCtx(ctx context.Context, key string, n int) (*limiter.Decision, error) {
+	if gate, ok := g.gates[key]; ok {
+		close(g.started[key])
+		<-gate
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return g.Limiter.DecideCtx(ctx, key, n)
+}
+
+func TestResilientSingleTrial(t *testing.T) {
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	var down atomic.Bool
+	gated := &gatedLimiter{
+		Limiter: flakyLimiter(clk, 10, &down),
+		started: map[string]chan struct{}{"early": make(chan struct{}), "trial": make(chan struct{})},
+		gates:   map[string]chan struct{}{"early": make(chan struct{}), "trial": make(chan struct{})},
+	}
+	r := limiter.NewResilientLimiter(gated, limiter.ResilientConfig{
+		FailureThreshold: 1,
+		ProbeInterval:    time.Second,
+		Clock:            clk,
+	})
+
+	// A check is under way when the circuit opens.
+	ctx, cancel := context.WithCancel(context.Background())
+	early := make(chan struct{})
+	go func() {
+		defer close(early)
+		_, err := r.AllowCtx(ctx, "early")
+		assert.ErrorIs(t, err, context.Canceled)
+	}()
+	<-gated.started["early"]
+	down.Store(true)
+	_, err := r.Allow("user")
+	assert.NoError(t, err)
+	assert.True(t, r.Open())
+
+	// It ends while the trial is under way, and does not let another trial
+	// through.
+	clk.Advance(time.Second)
+	trial := make(chan struct{})
+	go func() {
+		defer close(trial)
+		ok, err := r.Allow("trial")
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	}()
+	<-gated.started["trial"]
+	cancel()
+	close(gated.gates["early"])
+	<-early
+
+	down.Store(false)
+	decision, err := r.Decide("user", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "unavailable", decision.DeniedBy)
+
+	// The trial closes the circuit.
+	close(gated.gates["trial"])
+	<-trial
+	assert.False(t, r.Open())
+}
+
+// stalledStorage is a MemoryStorage whose reads hang until ctx is done.
+type stalledStorage struct {
+	*storage.MemoryStorage
+}
+
+func (s stalledStorage) GetCtx(ctx context.Context, key string) (interface{}, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (s stalledStorage) IncrementCtx(ctx context.Context, key string, value int, ttl time.Duration) (int64, error) {
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
+func TestResilientDeadlines(t *testing.T) {
+	stalled := limiter.NewQuotaLimiter(stalledStorage{storage.NewMemoryStorage()}, limiter.QuotaConfig{
+		Limit:  10,
+		Period: limiter.Daily,
+	})
+	r := limiter.NewResilientLimiter(stalled, limiter.ResilientConfig{
+		Mode:             limiter.FailOpen,
+		FailureThreshold: 2,
+		ProbeInterval:    time.Hour,
+	})
+
+	// Checks whose deadline passes while the storage hangs count as failures.
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		ok, err := r.AllowCtx(ctx, "user")
+		cancel()
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	}
+	assert.True(t, r.Open())
+
+	// Once open, checks no longer wait on the storage.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	ok, err := r.AllowCtx(ctx, "user")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
@@ -0,0 +1,151 @@
+package limiter_test
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sumedhvats/rate-limiter-go/pkg/clock"
+	"github.com/sumedhvats/rate-limiter-go/pkg/limiter"
+	"github.com/sumedhvats/rate-limiter-go/pkg/storage"
+)
+
+func TestTokenBucketSetConfigKeepsTokens(t *testing.T) {
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	tb := limiter.NewTokenBucketLimiter(storage.NewMemoryStorageWithClock(clk), limiter.Config{
+		Rate:   10,
+		Window: time.Minute,
+		Clock:  clk,
+	})
+
+	ok, err := tb.AllowN("user", 8)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// The bucket keeps its tokens rather than starting over full.
+	tb.SetConfig(limiter.Config{Rate: 60, Window: time.Minute, Clock: clk})
+	assert.Equal(t, 60, tb.Config().Rate)
+	stats, err := tb.GetStats("user")
+	assert.NoError(t, err)
+	assert.Equal(t, 60, stats.Limit)
+	assert.Equal(t, 2, stats.Remaining)
+
+	// It refills at the new rate of one token per second.
+	clk.Advance(time.Second)
+	stats, err = tb.GetStats("user")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, stats.Remaining)
+
+	// A smaller Burst caps the tokens already in the bucket.
+	tb.SetConfig(limiter.Config{Rate: 60, Window: time.Minute, Burst: 2, Clock: clk})
+	stats, err = tb.GetStats("user")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, stats.Limit)
+	assert.Equal(t, 2, stats.Remaining)
+}
+
+func TestFixedWindowSetConfig(t *testing.T) {
+	// The minute window in progress ends at 1_700_000_040.
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	fw := limiter.NewFixedWindowLimiter(storage.NewMemoryStorageWithClock(clk), limiter.Config{
+		Rate:   5,
+		Window: time.Minute,
+		Clock:  clk,
+	})
+
+	ok, err := fw.AllowN("user", 4)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// A new Rate applies to the count of the window in progress.
+	fw.SetConfig(limiter.Config{Rate: 10, Window: time.Minute, Clock: clk})
+	stats, err := fw.GetStats("user")
+	assert.NoError(t, err)
+	assert.Equal(t, 6, stats.Remaining)
+
+	// A new Window waits for the window in progress to end.
+	fw.SetConfig(limiter.Config{Rate: 10, Window: 10 * time.Second, Clock: clk})
+	assert.Equal(t, 10*time.Second, fw.Config().Window)
+	decision, err := fw.Decide("user", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, decision.Remaining)
+	assert.Equal(t, time.Unix(1_700_000_040, 0), decision.ResetAt)
+
+	clk.Advance(40 * time.Second)
+	ok, err = fw.AllowN("user", 10)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	decision, err = fw.Decide("user", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Unix(1_700_000_050, 0), decision.ResetAt)
+}
+
+func TestSlidingWindowSetConfig(t *testing.T) {
+	// Start on a minute boundary.
+	clk := clock.NewManual(time.Unix(1_700_000_040, 0))
+	sw := limiter.NewSlidingWindowLimiter(storage.NewMemoryStorageWithClock(clk), limiter.Config{
+		Rate:   10,
+		Window: time.Minute,
+		Clock:  clk,
+	})
+
+	ok, err := sw.AllowN("user", 6)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	sw.SetConfig(limiter.Config{Rate: 10, Window: 10 * time.Second, Clock: clk})
+	stats, err := sw.GetStats("user")
+	assert.NoError(t, err)
+	assert.Equal(t, 4, stats.Remaining)
+
+	// The last minute window is the previous window of the first 10s one.
+	clk.Advance(time.Minute)
+	stats, err = sw.GetStats("user")
+	assert.NoError(t, err)
+	assert.Equal(t, 4, stats.Remaining)
+
+	clk.Advance(5 * time.Second)
+	stats, err = sw.GetStats("user")
+	assert.NoError(t, err)
+	assert.Equal(t, 7, stats.Remaining)
+
+	clk.Advance(5 * time.Second)
+	stats, err = sw.GetStats("user")
+	assert.NoError(t, err)
+	assert.Equal(t, 10, stats.Remaining)
+}
+
+func TestSetConfigConcurrentWithChecks(t *testing.T) {
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	tb := limiter.NewTokenBucketLimiter(storage.NewMemoryStorageWithClock(clk), limiter.Config{
+		Rate:   10,
+		Window: time.Minute,
+		Clock:  clk,
+	})
+
+	var admitted atomic.Int64
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				ok, err := tb.Allow("user")
+				assert.NoError(t, err)
+				if ok {
+					admitted.Add(1)
+				}
+			}
+		}()
+	}
+	for i := range 100 {
+		tb.SetConfig(limiter.Config{Rate: 10 + 10*(i%2), Window: time.Minute, Clock: clk})
+	}
+	wg.Wait()
+
+	// The clock never moves, so no more than the largest Burst gets in.
+	assert.LessOrEqual(t, admitted.Load(), int64(20))
+	assert.GreaterOrEqual(t, admitted.Load(), int64(10))
+}
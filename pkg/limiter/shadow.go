@@ -0,0 +1,242 @@
+// Package limiter provides rate limiting algorithm implementations.
+package limiter
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/sumedhvats/rate-limiter-go/pkg/clock"
+)
+
+// DefaultShadowPrefix is prepended to the keys checked on the candidate of a
+// ShadowLimiter when ShadowConfig.Prefix is empty.
+const DefaultShadowPrefix = "shadow:"
+
+// ShadowConfig holds the configuration for a ShadowLimiter.
+type ShadowConfig struct {
+	// Enforced is the limiter whose decisions are returned. When nil, every
+	// request is allowed and the candidate runs in dry-run mode.
+	Enforced Limiter
+	// OnWouldDeny is called, before the check returns, for every check the
+	// candidate denies. d is the candidate's decision.
+	OnWouldDeny func(ctx context.Context, key string, n int, d *Decision)
+	// Prefix is prepended to the keys checked on the candidate, so that it
+	// can share a store with Enforced without sharing its counts. It
+	// defaults to DefaultShadowPrefix.
+	Prefix string
+	// Clock is the time source. It defaults to clock.Real.
+	Clock clock.Clock
+}
+
+// now returns the current time according to the configured Clock.
+func (c ShadowConfig) now() time.Time {
+	return clock.OrReal(c.Clock).Now()
+}
+
+// ShadowCounts counts the checks made by a ShadowLimiter.
+type ShadowCounts struct {
+	// Checks is the number of checks made.
+	Checks int64
+	// WouldDeny is the number of checks the candidate denied.
+	WouldDeny int64
+	// Errors is the number of checks the candidate failed. Failed checks
+	// count neither as allowed nor as denied.
+	Errors int64
+	// Denied is the number of checks Enforced denied.
+	Denied int64
+	// OnlyCandidateDenied is the number of checks the candidate denied but
+	// Enforced allowed: the requests that switching to the candidate would
+	// start blocking.
+	OnlyCandidateDenied int64
+	// OnlyEnforcedDenied is the number of checks Enforced denied but the
+	// candidate allowed: the requests that switching to the candidate would
+	// let through.
+	OnlyEnforcedDenied int64
+}
+
+// ShadowLimiter evaluates a candidate limiter without enforcing it, to see
+// how a new limit would behave on real traffic before rolling it out. Every
+// check is made on the candidate and recorded in Counts, and OnWouldDeny is
+// called for the checks it denies. The decisions returned are those of
+// Enforced or, without one, the candidate's with every request allowed.
+//
+// Errors from the candidate never fail a check; they are only counted.
+// Without Enforced, a check the candidate fails is allowed.
+type ShadowLimiter struct {
+	candidate Limiter
+	config    ShadowConfig
+
+	checks              atomic.Int64
+	wouldDeny           atomic.Int64
+	errors              atomic.Int64
+	denied              atomic.Int64
+	onlyCandidateDenied atomic.Int64
+	onlyEnforcedDenied  atomic.Int64
+}
+
+// NewShadowLimiter creates a ShadowLimiter evaluating candidate.
+func NewShadowLimiter(candidate Limiter, cfg ShadowConfig) *ShadowLimiter {
+	if cfg.Prefix == "" {
+		cfg.Prefix = DefaultShadowPrefix
+	}
+	return &ShadowLimiter{
+		candidate: candidate,
+		config:    cfg,
+	}
+}
+
+// Counts returns the checks counted so far.
+func (s *ShadowLimiter) Counts() ShadowCounts {
+	return ShadowCounts{
+		Checks:              s.checks.Load(),
+		WouldDeny:           s.wouldDeny.Load(),
+		Errors:              s.errors.Load(),
+		Denied:              s.denied.Load(),
+		OnlyCandidateDenied: s.onlyCandidateDenied.Load(),
+		OnlyEnforcedDenied:  s.onlyEnforcedDenied.Load(),
+	}
+}
+
+// ResetCounts sets every count back to zero.
+func (s *ShadowLimiter) ResetCounts() {
+	s.checks.Store(0)
+	s.wouldDeny.Store(0)
+	s.errors.Store(0)
+	s.denied.Store(0)
+	s.onlyCandidateDenied.Store(0)
+	s.onlyEnforcedDenied.Store(0)
+}
+
+// Allow checks if a single request is allowed for the given key.
+func (s *ShadowLimiter) Allow(key string) (bool, error) {
+	return s.AllowN(key, 1)
+}
+
+// AllowCtx is like Allow but honours ctx.
+func (s *ShadowLimiter) AllowCtx(ctx context.Context, key string) (bool, error) {
+	return s.AllowNCtx(ctx, key, 1)
+}
+
+// AllowN checks if n requests are allowed for the given key.
+func (s *ShadowLimiter) AllowN(key string, n int) (bool, error) {
+	return s.AllowNCtx(context.Background(), key, n)
+}
+
+// AllowNCtx is like AllowN but honours ctx.
+func (s *ShadowLimiter) AllowNCtx(ctx context.Context, key string, n int) (bool, error) {
+	decision, err := s.DecideCtx(ctx, key, n)
+	if err != nil {
+		return false, err
+	}
+	return decision.Allowed, nil
+}
+
+// Decide checks n requests for the given key on the candidate and, if set,
+// on Enforced, and returns the decision of Enforced. Without Enforced it
+// returns the candidate's decision with the requests allowed.
+func (s *ShadowLimiter) Decide(key string, n int) (*Decision, error) {
+	return s.DecideCtx(context.Background(), key, n)
+}
+
+// DecideCtx is like Decide but honours ctx.
+func (s *ShadowLimiter) DecideCtx(ctx context.Context, key string, n int) (*Decision, error) {
+	var enforced *Decision
+	if s.config.Enforced != nil {
+		var err error
+		enforced, err = s.config.Enforced.DecideCtx(ctx, key, n)
+		if err != nil {
+			return nil, err
+		}
+	}
+	candidate, err := s.candidate.DecideCtx(ctx, s.config.Prefix+key, n)
+	if n != 0 {
+		s.record(ctx, key, n, enforced, candidate, err)
+	}
+
+	if enforced != nil {
+		return enforced, nil
+	}
+	if err != nil {
+		return &Decision{Allowed: true, ResetAt: s.config.now()}, nil
+	}
+	allowed := *candidate
+	allowed.Allowed = true
+	allowed.RetryAfter = 0
+	allowed.DeniedBy = ""
+	return &allowed, nil
+}
+
+// record counts a check and calls OnWouldDeny if the candidate denied it.
+func (s *ShadowLimiter) record(ctx context.Context, key string, n int, enforced, candidate *Decision, err error) {
+	s.checks.Add(1)
+	if enforced != nil && !enforced.Allowed {
+		s.denied.Add(1)
+	}
+	if err != nil {
+		s.errors.Add(1)
+		return
+	}
+
+	if !candidate.Allowed {
+		s.wouldDeny.Add(1)
+	}
+	if enforced != nil {
+		switch {
+		case enforced.Allowed && !candidate.Allowed:
+			s.onlyCandidateDenied.Add(1)
+		case !enforced.Allowed && candidate.Allowed:
+			s.onlyEnforcedDenied.Add(1)
+		}
+	}
+	if !candidate.Allowed && s.config.OnWouldDeny != nil {
+		s.config.OnWouldDeny(ctx, key, n, candidate)
+	}
+}
+
+// Reset clears the rate limit data for the given key on the candidate and on
+// Enforced.
+func (s *ShadowLimiter) Reset(key string) error {
+	return s.ResetCtx(context.Background(), key)
+}
+
+// ResetCtx is like Reset but honours ctx.
+func (s *ShadowLimiter) ResetCtx(ctx context.Context, key string) error {
+	if s.config.Enforced != nil {
+		if err := s.config.Enforced.ResetCtx(ctx, key); err != nil {
+			return err
+		}
+	}
+	return s.candidate.ResetCtx(ctx, s.config.Prefix+key)
+}
+
+// Refund gives n requests back to the given key on the candidate and on
+// Enforced. Errors from the candidate are ignored.
+func (s *ShadowLimiter) Refund(key string, n int) error {
+	return s.RefundCtx(context.Background(), key, n)
+}
+
+// RefundCtx is like Refund but honours ctx.
+func (s *ShadowLimiter) RefundCtx(ctx context.Context, key string, n int) error {
+	// The candidate only loses accuracy when a refund fails, so its error is
+	// dropped rather than failing the refund on Enforced.
+	_ = s.candidate.RefundCtx(ctx, s.config.Prefix+key, n)
+	if s.config.Enforced != nil {
+		return s.config.Enforced.RefundCtx(ctx, key, n)
+	}
+	return nil
+}
+
+// GetStats returns the current rate limit statistics for the given key on
+// Enforced or, without one, on the candidate.
+func (s *ShadowLimiter) GetStats(key string) (*Stats, error) {
+	return s.GetStatsCtx(context.Background(), key)
+}
+
+// GetStatsCtx is like GetStats but honours ctx.
+func (s *ShadowLimiter) GetStatsCtx(ctx context.Context, key string) (*Stats, error) {
+	if s.config.Enforced != nil {
+		return s.config.Enforced.GetStatsCtx(ctx, key)
+	}
+	return s.candidate.GetStatsCtx(ctx, s.config.Prefix+key)
+}
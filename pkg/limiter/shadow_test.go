@@ -0,0 +1,95 @@
+package limiter_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sumedhvats/rate-limiter-go/pkg/clock"
+	"github.com/sumedhvats/rate-limiter-go/pkg/limiter"
+	"github.com/sumedhvats/rate-limiter-go/pkg/storage"
+)
+
+func TestShadowDryRun(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	var wouldDeny []string
+	s := limiter.NewShadowLimiter(limiter.NewFixedWindowLimiter(store, limiter.Config{Rate: 2, Window: time.Minute}), limiter.ShadowConfig{
+		OnWouldDeny: func(ctx context.Context, key string, n int, d *limiter.Decision) {
+			assert.False(t, d.Allowed)
+			wouldDeny = append(wouldDeny, key)
+		},
+	})
+
+	for i := 0; i < 3; i++ {
+		decision, err := s.Decide("user", 1)
+		assert.NoError(t, err)
+		assert.True(t, decision.Allowed, "dry-run checks are always allowed")
+		assert.Zero(t, decision.RetryAfter)
+	}
+	assert.Equal(t, []string{"user"}, wouldDeny)
+	assert.Equal(t, limiter.ShadowCounts{Checks: 3, WouldDeny: 1}, s.Counts())
+
+	// The candidate counts under its own prefix.
+	keys, err := store.KeysCtx(context.Background(), "shadow:user")
+	assert.NoError(t, err)
+	assert.Len(t, keys, 1)
+	stats, err := s.GetStats("user")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, stats.Remaining)
+
+	s.ResetCounts()
+	assert.Equal(t, limiter.ShadowCounts{}, s.Counts())
+}
+
+func TestShadowCompare(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	enforced := limiter.NewFixedWindowLimiter(store, limiter.Config{Rate: 3, Window: time.Minute})
+	candidate := limiter.NewFixedWindowLimiter(store, limiter.Config{Rate: 2, Window: time.Minute})
+	s := limiter.NewShadowLimiter(candidate, limiter.ShadowConfig{Enforced: enforced})
+
+	var allowed []bool
+	for i := 0; i < 4; i++ {
+		ok, err := s.Allow("user")
+		assert.NoError(t, err)
+		allowed = append(allowed, ok)
+	}
+	assert.Equal(t, []bool{true, true, true, false}, allowed, "the enforced limiter decides")
+	assert.Equal(t, limiter.ShadowCounts{
+		Checks:              4,
+		WouldDeny:           2,
+		Denied:              1,
+		OnlyCandidateDenied: 1,
+	}, s.Counts())
+
+	assert.NoError(t, s.Reset("user"))
+	stats, err := enforced.GetStats("user")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, stats.Remaining)
+	stats, err = candidate.GetStats("shadow:user")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, stats.Remaining)
+}
+
+func TestShadowCandidateErrors(t *testing.T) {
+	failing := limiter.NewQuotaLimiter(storage.NewMemoryStorage(), limiter.QuotaConfig{
+		Limit:  1,
+		Period: limiter.Daily,
+		KeyLocation: func(ctx context.Context, key string) (*time.Location, error) {
+			return nil, errors.New("directory down")
+		},
+	})
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	s := limiter.NewShadowLimiter(failing, limiter.ShadowConfig{Clock: clk})
+
+	decision, err := s.Decide("user", 1)
+	assert.NoError(t, err)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, clk.Now(), decision.ResetAt)
+	assert.Equal(t, limiter.ShadowCounts{Checks: 1, Errors: 1}, s.Counts())
+
+	// Failed refunds are not failed checks.
+	assert.NoError(t, s.Refund("user", 1))
+	assert.Equal(t, limiter.ShadowCounts{Checks: 1, Errors: 1}, s.Counts())
+}
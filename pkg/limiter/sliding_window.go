@@ -2,16 +2,31 @@
 package limiter
 
 import (
-	"fmt"
-	"github.com/sumedhvats/rate-limiter-go/pkg/storage"
+	"context"
 	"math"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/sumedhvats/rate-limiter-go/pkg/storage"
 )
+
 // SlidingWindowLimiter implements the sliding window rate limiting algorithm.
 type SlidingWindowLimiter struct {
 	storage Storage
 	config  Config
+
+	// live holds a copy of the limiter with the Config last set with
+	// SetConfig, if any. mu serializes SetConfig calls.
+	mu   sync.Mutex
+	live atomic.Pointer[SlidingWindowLimiter]
+
+	// On a copy set with a new Window, previous is the limiter that keeps
+	// checking the window in progress until it ends at since.
+	previous *SlidingWindowLimiter
+	since    time.Time
 }
+
 // NewSlidingWindowLimiter creates a new SlidingWindowLimiter.
 func NewSlidingWindowLimiter(store Storage, cfg Config) *SlidingWindowLimiter {
 	return &SlidingWindowLimiter{
@@ -20,120 +35,494 @@ func NewSlidingWindowLimiter(store Storage, cfg Config) *SlidingWindowLimiter {
 	}
 }
 
+// Config returns the limiter's Config, as last set with SetConfig.
+func (swl *SlidingWindowLimiter) Config() Config {
+	if l := swl.live.Load(); l != nil {
+		return l.config
+	}
+	return swl.config
+}
+
+// SetConfig changes the limiter's Config while it is in use. It is safe to
+// call concurrently with checks, which use either the old or the new Config.
+//
+// Windows keep their counts. A new Rate applies from the next check on. A
+// new Window applies once the window in progress ends; until then that
+// window keeps its original length, and afterwards it serves as the
+// previous window of the first window of the new length. On a RedisMemory
+// using server time, the window in progress is found from the Redis clock,
+// and the checks themselves tell which length applies.
+func (swl *SlidingWindowLimiter) SetConfig(cfg Config) {
+	swl.mu.Lock()
+	defer swl.mu.Unlock()
+
+	old := swl.current()
+	next := &SlidingWindowLimiter{storage: swl.storage, config: cfg}
+	if cfg.Window != old.config.Window {
+		prevCfg := cfg
+		prevCfg.Window = old.config.Window
+		next.previous = &SlidingWindowLimiter{storage: swl.storage, config: prevCfg}
+		next.since = storage.WindowStart(changeNow(swl.storage, old.config), old.config.Window).Add(old.config.Window)
+	}
+	swl.live.Store(next)
+}
+
+// current returns the limiter holding the Config in force: the copy set by
+// SetConfig, or the limiter itself. On a store using server time it is
+// always the copy set by SetConfig, whose checks hand the window change to
+// the script.
+func (swl *SlidingWindowLimiter) current() *SlidingWindowLimiter {
+	l := swl.live.Load()
+	if l == nil {
+		return swl
+	}
+	if _, ok := serverTime(l.storage); !ok && l.previous != nil && l.config.now().Before(l.since) {
+		return l.previous
+	}
+	return l
+}
+
+// at returns the limiter whose windows are in force at now: previous until
+// since, or swl.
+func (swl *SlidingWindowLimiter) at(now time.Time) *SlidingWindowLimiter {
+	if swl.previous != nil && now.Before(swl.since) {
+		return swl.previous
+	}
+	return swl
+}
+
 // AllowN checks if n requests are allowed for the given key.
 func (swl *SlidingWindowLimiter) AllowN(key string, n int) (bool, error) {
-	now := time.Now()
-	windowStart := now.Truncate(swl.config.Window)
-	currWinKey := fmt.Sprintf("%s:%d", key, windowStart.Unix())
+	return swl.AllowNCtx(context.Background(), key, n)
+}
+
+// AllowNCtx is like AllowN but honours ctx.
+func (swl *SlidingWindowLimiter) AllowNCtx(ctx context.Context, key string, n int) (bool, error) {
+	decision, err := swl.DecideCtx(ctx, key, n)
+	if err != nil {
+		return false, err
+	}
+	return decision.Allowed, nil
+}
+
+// slidingState is the view of both windows observed by a single check.
+type slidingState struct {
+	now         time.Time
+	windowStart time.Time
+	currWinKey  string
+	prevWinKey  string
+	weight      float64
+	currCount   int64
+	prevCount   int64
+}
+
+// newState locates the current and previous windows of key at now.
+func (swl *SlidingWindowLimiter) newState(key string, now time.Time) *slidingState {
+	windowStart := storage.WindowStart(now, swl.config.Window)
+	prevStart, prevWindow := windowStart.Add(-swl.config.Window), swl.config.Window
+	if swl.previous != nil && !windowStart.After(swl.since) {
+		// The first window after a Window change follows the last window
+		// of the previous length.
+		prevWindow = swl.previous.config.Window
+		prevStart = swl.since.Add(-prevWindow)
+	}
+	return &slidingState{
+		now:         now,
+		windowStart: windowStart,
+		currWinKey:  storage.WindowKey(key, windowStart, swl.config.Window),
+		prevWinKey:  storage.WindowKey(key, prevStart, prevWindow),
+		weight:      swl.weight(now.Sub(windowStart)),
+	}
+}
+
+// forKey returns the limiter to check key with: a copy using the key's
+// Config if the limiter has Overrides, or the current limiter.
+func (swl *SlidingWindowLimiter) forKey(ctx context.Context, key string) (*SlidingWindowLimiter, error) {
+	swl = swl.current()
+	if swl.config.Overrides == nil {
+		return swl, nil
+	}
+	cfg, err := swl.config.resolve(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	l := &SlidingWindowLimiter{storage: swl.storage, config: cfg}
+	if cfg.Window == swl.config.Window {
+		l.previous, l.since = swl.previous, swl.since
+	}
+	return l, nil
+}
+
+// Decide checks if n requests are allowed for the given key and reports
+// the window counts left behind by that check.
+func (swl *SlidingWindowLimiter) Decide(key string, n int) (*Decision, error) {
+	return swl.DecideCtx(context.Background(), key, n)
+}
+
+// DecideCtx is like Decide but honours ctx.
+func (swl *SlidingWindowLimiter) DecideCtx(ctx context.Context, key string, n int) (*Decision, error) {
+	swl, err := swl.forKey(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	allowed, l, state, err := swl.take(ctx, key, n, false)
+	if err != nil {
+		return nil, err
+	}
+	return l.decision(allowed, state, n), nil
+}
+
+// decideUndo is like DecideCtx but also returns a function that takes the
+// admitted requests back out of their window. See undoer.
+func (swl *SlidingWindowLimiter) decideUndo(ctx context.Context, key string, n int) (*Decision, func(context.Context) error, error) {
+	swl, err := swl.forKey(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	allowed, l, state, err := swl.take(ctx, key, n, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	d := l.decision(allowed, state, n)
+	if !allowed || n == 0 {
+		return d, nil, nil
+	}
+	return d, func(ctx context.Context) error {
+		return l.undo(ctx, state, n)
+	}, nil
+}
+
+// scriptStep describes the check of key as a step of the composite Redis
+// script. See scriptable. Limiters on a store using server time are checked
+// in turn instead.
+func (swl *SlidingWindowLimiter) scriptStep(ctx context.Context, key string, n int) (*scriptStep, bool, error) {
+	swl, err := swl.forKey(ctx, key)
+	if err != nil {
+		return nil, false, err
+	}
+	store, ok := swl.storage.(*storage.RedisMemory)
+	if !ok || store.ServerTime() {
+		return nil, false, nil
+	}
+	state := swl.newState(key, swl.config.now())
+	return &scriptStep{
+		store: store,
+		step: storage.CompositeStep{
+			Kind:   storage.CompositeSlidingWindow,
+			Keys:   []string{state.currWinKey, state.prevWinKey},
+			Limit:  swl.config.Rate,
+			Weight: state.weight,
+			TTL:    swl.config.Window * 2,
+		},
+		decision: func(result storage.CompositeResult) *Decision {
+			state.currCount = result.Current
+			state.prevCount = result.Previous
+			return swl.decision(result.Allowed, state, n)
+		},
+		undo: func(ctx context.Context) error {
+			return swl.undo(ctx, state, n)
+		},
+	}, true, nil
+}
 
-	prevStart := windowStart.Add(-swl.config.Window)
-	prevWinKey := fmt.Sprintf("%s:%d", key, prevStart.Unix())
+// undo takes n requests back out of the window they were counted in.
+func (swl *SlidingWindowLimiter) undo(ctx context.Context, state *slidingState, n int) error {
+	now, err := storeNow(ctx, swl.storage, swl.config)
+	if err != nil {
+		return err
+	}
+	// Once both windows have expired there is nothing left to give back.
+	if !now.Before(state.windowStart.Add(2 * swl.config.Window)) {
+		return nil
+	}
+	_, err = swl.storage.IncrementCtx(ctx, state.currWinKey, -n, swl.config.Window*2)
+	return err
+}
+
+// decision builds a Decision from the window counts in state.
+func (swl *SlidingWindowLimiter) decision(allowed bool, state *slidingState, n int) *Decision {
+	elapsed := state.now.Sub(state.windowStart)
+	weightedCount := math.Ceil((float64(state.prevCount) * state.weight) + float64(state.currCount))
+	d := &Decision{
+		Allowed:   allowed,
+		Limit:     swl.config.Rate,
+		Remaining: max(swl.config.Rate-int(weightedCount), 0),
+		ResetAt:   state.now,
+	}
+	// Requests stop counting once they slide out of the previous window.
+	if state.currCount > 0 {
+		d.ResetAt = state.windowStart.Add(2 * swl.config.Window)
+	} else if weightedCount > 0 {
+		d.ResetAt = state.windowStart.Add(swl.config.Window)
+	}
+	if !allowed {
+		d.RetryAfter = swl.retryAfter(state.prevCount, state.currCount, n, elapsed)
+	}
+	return d
+}
 
+// fits reports whether n more requests fit next to the counts in state.
+func (swl *SlidingWindowLimiter) fits(state *slidingState, n int) bool {
+	weightedCount := math.Ceil((float64(state.prevCount) * state.weight) + float64(state.currCount))
+	return weightedCount+float64(n) <= float64(swl.config.Rate)
+}
+
+// Reserve counts n requests for the given key in the current window even if
+// that exceeds the limit, and returns a Reservation telling the caller how
+// long to wait until the window has room for them. The reservation is not
+// OK if n exceeds Rate.
+func (swl *SlidingWindowLimiter) Reserve(key string, n int) (*Reservation, error) {
+	return swl.ReserveCtx(context.Background(), key, n)
+}
+
+// ReserveCtx is like Reserve but honours ctx. Cancelling the returned
+// reservation is not bound to ctx.
+func (swl *SlidingWindowLimiter) ReserveCtx(ctx context.Context, key string, n int) (*Reservation, error) {
+	swl, err := swl.forKey(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if n > swl.config.Rate {
+		return &Reservation{}, nil
+	}
+	_, l, state, err := swl.take(ctx, key, n, true)
+	if err != nil {
+		return nil, err
+	}
+
+	elapsed := state.now.Sub(state.windowStart)
+	return &Reservation{
+		ok:        true,
+		timeToAct: state.now.Add(l.retryAfter(state.prevCount, state.currCount, 0, elapsed)),
+		clock:     l.config.clock(),
+		cancel: func() error {
+			return l.undo(context.Background(), state, n)
+		},
+	}, nil
+}
+
+// Wait blocks until n requests are allowed for the given key or ctx is done.
+func (swl *SlidingWindowLimiter) Wait(ctx context.Context, key string, n int) error {
+	return waitFor(ctx, swl.current().config.clock(), func() (*Reservation, error) {
+		return swl.ReserveCtx(ctx, key, n)
+	})
+}
+
+// take increments the current window by n if the weighted count allows it,
+// or unconditionally when force is set. It returns the limiter whose windows
+// the check was made in: swl, or its previous limiter on a store using
+// server time while a new Window waits for the window in progress to end.
+func (swl *SlidingWindowLimiter) take(ctx context.Context, key string, n int, force bool) (bool, *SlidingWindowLimiter, *slidingState, error) {
+	if redisStore, ok := serverTime(swl.storage); ok {
+		return swl.takeServerTime(ctx, redisStore, key, n, force)
+	}
+	state := swl.newState(key, swl.config.now())
+	var allowed bool
+	var err error
 	if redisStore, ok := swl.storage.(*storage.RedisMemory); ok {
-		elapsed := now.Sub(windowStart)
-		weight := 1.0 - (float64(elapsed) / float64(swl.config.Window))
-		return redisStore.SlidingWindowIncrement(
-			currWinKey,
-			prevWinKey,
+		increment := redisStore.SlidingWindowIncrement
+		if force {
+			increment = redisStore.SlidingWindowReserve
+		}
+		allowed, state.currCount, state.prevCount, err = increment(
+			ctx,
+			state.currWinKey,
+			state.prevWinKey,
+			n,
 			int(swl.config.Rate),
-			weight,
+			state.weight,
 			swl.config.Window*2,
 		)
+	} else {
+		allowed, state.currCount, state.prevCount, err = swl.allowNMemory(ctx, state.currWinKey, state.prevWinKey, state.weight, n, force)
+	}
+	if err != nil {
+		return false, nil, nil, err
 	}
+	return allowed, swl, state, nil
+}
 
-	return swl.allowNMemory(currWinKey, prevWinKey, now, windowStart, n)
+// takeServerTime is like take but lets the script locate the windows from
+// the Redis server time, and tell whether a change of Window is in effect.
+func (swl *SlidingWindowLimiter) takeServerTime(ctx context.Context, store *storage.RedisMemory, key string, n int, force bool) (bool, *SlidingWindowLimiter, *slidingState, error) {
+	increment := store.SlidingWindowIncrementServerTime
+	if force {
+		increment = store.SlidingWindowReserveServerTime
+	}
+	var change storage.WindowChange
+	ttl := swl.config.Window * 2
+	if swl.previous != nil {
+		change = storage.WindowChange{Previous: swl.previous.config.Window, Since: swl.since}
+		ttl = max(ttl, change.Previous*2)
+	}
+	allowed, currCount, prevCount, now, err := increment(
+		ctx,
+		key,
+		n,
+		swl.config.Rate,
+		swl.config.Window,
+		change,
+		ttl,
+	)
+	if err != nil {
+		return false, nil, nil, err
+	}
+	l := swl.at(now)
+	state := l.newState(key, now)
+	state.currCount, state.prevCount = currCount, prevCount
+	return allowed, l, state, nil
 }
 
 func (swl *SlidingWindowLimiter) allowNMemory(
+	ctx context.Context,
 	currWinKey, prevWinKey string,
-	now, windowStart time.Time,
+	weight float64,
 	n int,
-) (bool, error) {
-	current_data, _ := swl.storage.Get(currWinKey)
-	previous_data, _ := swl.storage.Get(prevWinKey)
-
-	var currCount, prevCount int64
-	if current_data != nil {
-		currCount = current_data.(int64)
+	force bool,
+) (bool, int64, int64, error) {
+	previous_data, err := swl.storage.GetCtx(ctx, prevWinKey)
+	if err != nil {
+		return false, 0, 0, err
 	}
+	var prevCount int64
 	if previous_data != nil {
 		prevCount = previous_data.(int64)
 	}
 
-	currElapsedTime := now.Sub(windowStart)
-	weight := 1 - (float64(currElapsedTime) / float64(swl.config.Window))
+	if n == 0 {
+		current_data, err := swl.storage.GetCtx(ctx, currWinKey)
+		if err != nil {
+			return false, 0, 0, err
+		}
+		var currCount int64
+		if current_data != nil {
+			currCount = current_data.(int64)
+		}
+		weightedCount := math.Ceil((float64(prevCount) * weight) + float64(currCount))
+		return weightedCount <= float64(swl.config.Rate), currCount, prevCount, nil
+	}
+
+	// Increment first and roll back on denial so that concurrent callers
+	// can never both squeeze into the last slot.
+	currCount, err := swl.storage.IncrementCtx(ctx, currWinKey, n, swl.config.Window*2)
+	if err != nil {
+		return false, 0, 0, err
+	}
+
+	weightedCount := math.Ceil((float64(prevCount) * weight) + float64(currCount))
+	if force || weightedCount <= float64(swl.config.Rate) {
+		return true, currCount, prevCount, nil
+	}
+
+	currCount, err = swl.storage.IncrementCtx(ctx, currWinKey, -n, swl.config.Window*2)
+	if err != nil {
+		return false, 0, 0, err
+	}
+	return false, currCount, prevCount, nil
+}
+
+// weight returns how much of the previous window still overlaps the sliding
+// window, given the time elapsed in the current window.
+func (swl *SlidingWindowLimiter) weight(elapsed time.Duration) float64 {
+	weight := 1 - (float64(elapsed) / float64(swl.config.Window))
 	if weight < 0 {
 		weight = 0
 	}
 	if weight > 1 {
 		weight = 1
 	}
+	return weight
+}
 
-	weightedCount := math.Ceil((float64(prevCount) * weight) + float64(currCount))
+// retryAfter estimates how long until n more requests fit, assuming no other
+// traffic arrives in the meantime.
+func (swl *SlidingWindowLimiter) retryAfter(prevCount, currCount int64, n int, elapsed time.Duration) time.Duration {
+	window := swl.config.Window
+	rate := int64(swl.config.Rate)
+	if int64(n) > rate {
+		// Can never fit; report when both windows have fully drained.
+		return 2*window - elapsed
+	}
 
-	if weightedCount+float64(n) > float64(swl.config.Rate) {
-		return false, nil
+	if currCount+int64(n) <= rate {
+		if prevCount == 0 {
+			return 0
+		}
+		// Wait for the previous window's weight to decay far enough.
+		target := float64(rate-currCount-int64(n)) / float64(prevCount)
+		wait := time.Duration(float64(window)*(1-target)) - elapsed
+		return max(wait, 0)
 	}
 
-	swl.storage.Increment(currWinKey, n, swl.config.Window*2)
-	return true, nil
+	// Wait for the next window, where the current count becomes the
+	// previous one and decays in turn.
+	target := float64(rate-int64(n)) / float64(currCount)
+	return (window - elapsed) + time.Duration(float64(window)*(1-target))
 }
+
 // Allow checks if a single request is allowed for the given key.
 func (swl *SlidingWindowLimiter) Allow(key string) (bool, error) {
 	return swl.AllowN(key, 1)
 }
-// Reset clears the rate limit data for the given key.
-func (swl *SlidingWindowLimiter) Reset(key string) error {
-	now := time.Now()
-	windowStart := now.Truncate(swl.config.Window)
-	prevStart := windowStart.Add(-swl.config.Window)
-
-	currWinKey := fmt.Sprintf("%s:%d", key, windowStart.Unix())
-	prevWinKey := fmt.Sprintf("%s:%d", key, prevStart.Unix())
 
-	_ = swl.storage.Delete(currWinKey)
-	_ = swl.storage.Delete(prevWinKey)
-	return nil
+// AllowCtx is like Allow but honours ctx.
+func (swl *SlidingWindowLimiter) AllowCtx(ctx context.Context, key string) (bool, error) {
+	return swl.AllowNCtx(ctx, key, 1)
 }
-// GetStats returns the current rate limit statistics for the given key.
-func (swl *SlidingWindowLimiter) GetStats(key string) (*stats, error) {
-	now := time.Now()
-	windowStart := now.Truncate(swl.config.Window)
-	prevStart := windowStart.Add(-swl.config.Window)
-
-	currWinKey := fmt.Sprintf("%s:%d", key, windowStart.Unix())
-	prevWinKey := fmt.Sprintf("%s:%d", key, prevStart.Unix())
 
-	currData, _ := swl.storage.Get(currWinKey)
-	prevData, _ := swl.storage.Get(prevWinKey)
+// Reset clears the rate limit data for the given key.
+func (swl *SlidingWindowLimiter) Reset(key string) error {
+	return swl.ResetCtx(context.Background(), key)
+}
 
-	var currCount, prevCount int64
-	if currData != nil {
-		currCount = currData.(int64)
+// ResetCtx is like Reset but honours ctx.
+func (swl *SlidingWindowLimiter) ResetCtx(ctx context.Context, key string) error {
+	swl, err := swl.forKey(ctx, key)
+	if err != nil {
+		return err
+	}
+	now, err := storeNow(ctx, swl.storage, swl.config)
+	if err != nil {
+		return err
 	}
-	if prevData != nil {
-		prevCount = prevData.(int64)
+	state := swl.at(now).newState(key, now)
+	if err := swl.storage.DeleteCtx(ctx, state.currWinKey); err != nil {
+		return err
 	}
+	return swl.storage.DeleteCtx(ctx, state.prevWinKey)
+}
 
-	elapsed := now.Sub(windowStart)
-	weight := 1 - (float64(elapsed) / float64(swl.config.Window))
-	if weight < 0 {
-		weight = 0
+// Refund takes n requests back out of the current window of the given key,
+// and out of the previous window if the current one holds fewer, as after
+// the window rolled over. Counts never go below zero.
+func (swl *SlidingWindowLimiter) Refund(key string, n int) error {
+	return swl.RefundCtx(context.Background(), key, n)
+}
+
+// RefundCtx is like Refund but honours ctx.
+func (swl *SlidingWindowLimiter) RefundCtx(ctx context.Context, key string, n int) error {
+	if n <= 0 {
+		return nil
 	}
-	if weight > 1 {
-		weight = 1
+	swl, err := swl.forKey(ctx, key)
+	if err != nil {
+		return err
 	}
-
-	weightedCount := math.Ceil((float64(prevCount) * weight) + float64(currCount))
-	remaining := int64(swl.config.Rate) - int64(weightedCount)
-	if remaining < 0 {
-		remaining = 0
+	now, err := storeNow(ctx, swl.storage, swl.config)
+	if err != nil {
+		return err
 	}
+	swl = swl.at(now)
+	state := swl.newState(key, now)
+	return refundCounters(ctx, swl.storage, []string{state.currWinKey, state.prevWinKey}, n, swl.config.Window*2)
+}
 
-	resetAt := windowStart.Add(swl.config.Window)
-	return &stats{
-		Limit:     int(swl.config.Rate),
-		Remaining: int(remaining),
-		ResetAt:   resetAt,
-	}, nil
+// GetStats returns the current rate limit statistics for the given key.
+func (swl *SlidingWindowLimiter) GetStats(key string) (*Stats, error) {
+	return swl.GetStatsCtx(context.Background(), key)
+}
+
+// GetStatsCtx is like GetStats but honours ctx.
+func (swl *SlidingWindowLimiter) GetStatsCtx(ctx context.Context, key string) (*Stats, error) {
+	return statsFromDecision(swl.DecideCtx(ctx, key, 0))
 }
@@ -0,0 +1,306 @@
+// Package limiter provides rate limiting algorithm implementations.
+package limiter
+
+import (
+	"context"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/sumedhvats/rate-limiter-go/pkg/storage"
+)
+
+// logEntry records n requests admitted at the same instant.
+type logEntry struct {
+	at time.Time
+	n  int
+}
+
+// slidingLog is the per-key request log. It is never mutated once stored;
+// every update stores a fresh copy so it can be swapped atomically.
+type slidingLog struct {
+	entries []logEntry
+}
+
+// SlidingWindowLogLimiter implements the sliding window log rate limiting algorithm.
+// It records the timestamp of every admitted request and counts exactly how
+// many fall inside the window, trading memory for precision.
+type SlidingWindowLogLimiter struct {
+	storage Storage
+	config  Config
+}
+
+// NewSlidingWindowLogLimiter creates a new SlidingWindowLogLimiter.
+func NewSlidingWindowLogLimiter(store Storage, cfg Config) *SlidingWindowLogLimiter {
+	return &SlidingWindowLogLimiter{
+		storage: store,
+		config:  cfg,
+	}
+}
+
+// Allow checks if a single request is allowed for the given key.
+func (l *SlidingWindowLogLimiter) Allow(key string) (bool, error) {
+	return l.AllowN(key, 1)
+}
+
+// AllowCtx is like Allow but honours ctx.
+func (l *SlidingWindowLogLimiter) AllowCtx(ctx context.Context, key string) (bool, error) {
+	return l.AllowNCtx(ctx, key, 1)
+}
+
+// AllowN checks if n requests are allowed for the given key.
+func (l *SlidingWindowLogLimiter) AllowN(key string, n int) (bool, error) {
+	return l.AllowNCtx(context.Background(), key, n)
+}
+
+// AllowNCtx is like AllowN but honours ctx.
+func (l *SlidingWindowLogLimiter) AllowNCtx(ctx context.Context, key string, n int) (bool, error) {
+	decision, err := l.DecideCtx(ctx, key, n)
+	if err != nil {
+		return false, err
+	}
+	return decision.Allowed, nil
+}
+
+// Decide checks if n requests are allowed for the given key and reports
+// the log left behind by that check.
+func (l *SlidingWindowLogLimiter) Decide(key string, n int) (*Decision, error) {
+	return l.DecideCtx(context.Background(), key, n)
+}
+
+// DecideCtx is like Decide but honours ctx.
+func (l *SlidingWindowLogLimiter) DecideCtx(ctx context.Context, key string, n int) (*Decision, error) {
+	d, _, err := l.decideUndo(ctx, key, n)
+	return d, err
+}
+
+// decideUndo is like DecideCtx but also returns a function that removes the
+// admitted requests from the log. See undoer.
+func (l *SlidingWindowLogLimiter) decideUndo(ctx context.Context, key string, n int) (*Decision, func(context.Context) error, error) {
+	l, err := l.forKey(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if redisStore, ok := l.storage.(*storage.RedisMemory); ok {
+		return l.decideRedis(ctx, redisStore, key, n)
+	}
+
+	return l.decideMemory(ctx, key, n)
+}
+
+// forKey returns the limiter to check key with: a copy using the key's
+// Config if the limiter has Overrides, or the limiter itself.
+func (l *SlidingWindowLogLimiter) forKey(ctx context.Context, key string) (*SlidingWindowLogLimiter, error) {
+	if l.config.Overrides == nil {
+		return l, nil
+	}
+	cfg, err := l.config.resolve(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return &SlidingWindowLogLimiter{storage: l.storage, config: cfg}, nil
+}
+
+func (l *SlidingWindowLogLimiter) decideRedis(ctx context.Context, store *storage.RedisMemory, key string, n int) (*Decision, func(context.Context) error, error) {
+	id := strconv.FormatUint(rand.Uint64(), 36)
+	allowed, count, freeAtMs, resetAtMs, nowMs, err := store.SlidingWindowLogAllow(
+		ctx,
+		key,
+		n,
+		l.config.Rate,
+		l.config.now().UnixMilli(),
+		l.config.Window.Milliseconds(),
+		id,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.UnixMilli(nowMs)
+
+	d := &Decision{
+		Allowed:   allowed,
+		Limit:     l.config.Rate,
+		Remaining: max(l.config.Rate-int(count), 0),
+		ResetAt:   now,
+	}
+	if resetAtMs > 0 {
+		d.ResetAt = time.UnixMilli(resetAtMs)
+	}
+	if !allowed {
+		d.RetryAfter = l.config.Window
+		if freeAtMs > 0 {
+			d.RetryAfter = max(time.UnixMilli(freeAtMs).Sub(now), 0)
+		}
+	}
+	if !allowed || n == 0 {
+		return d, nil, nil
+	}
+	return d, func(ctx context.Context) error {
+		return store.SlidingWindowLogRemove(ctx, key, n, id)
+	}, nil
+}
+
+func (l *SlidingWindowLogLimiter) decideMemory(ctx context.Context, key string, n int) (*Decision, func(context.Context) error, error) {
+	for {
+		now := l.config.now()
+		data, err := l.storage.GetCtx(ctx, key)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// Drop entries that slid out of the window.
+		cutoff := now.Add(-l.config.Window)
+		var entries []logEntry
+		if data != nil {
+			old := data.(*slidingLog).entries
+			for i, e := range old {
+				if e.at.After(cutoff) {
+					entries = append(make([]logEntry, 0, len(old)-i+1), old[i:]...)
+					break
+				}
+			}
+		}
+
+		count := 0
+		for _, e := range entries {
+			count += e.n
+		}
+
+		allowed := count+n <= l.config.Rate
+		if !allowed || n == 0 {
+			return l.decision(allowed, entries, count, n, now), nil, nil
+		}
+
+		entry := logEntry{at: now, n: n}
+		entries = append(entries, entry)
+		count += n
+		swapped, err := compareAndSwap(ctx, l.storage, key, data, &slidingLog{entries: entries}, l.config.Window)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !swapped {
+			continue // Retry
+		}
+		return l.decision(true, entries, count, n, now), func(ctx context.Context) error {
+			return l.removeEntry(ctx, key, entry)
+		}, nil
+	}
+}
+
+// removeEntry removes entry from the log of key, if it is still there.
+func (l *SlidingWindowLogLimiter) removeEntry(ctx context.Context, key string, entry logEntry) error {
+	for {
+		data, err := l.storage.GetCtx(ctx, key)
+		if err != nil || data == nil {
+			return err
+		}
+
+		old := data.(*slidingLog).entries
+		i := slices.Index(old, entry)
+		if i < 0 {
+			return nil
+		}
+		entries := slices.Concat(old[:i], old[i+1:])
+
+		swapped, err := compareAndSwap(ctx, l.storage, key, data, &slidingLog{entries: entries}, l.config.Window)
+		if err != nil {
+			return err
+		}
+		if swapped {
+			return nil
+		}
+	}
+}
+
+// decision builds a Decision from the entries currently inside the window.
+func (l *SlidingWindowLogLimiter) decision(allowed bool, entries []logEntry, count, n int, now time.Time) *Decision {
+	d := &Decision{
+		Allowed:   allowed,
+		Limit:     l.config.Rate,
+		Remaining: max(l.config.Rate-count, 0),
+		ResetAt:   now,
+	}
+	if len(entries) > 0 {
+		d.ResetAt = entries[len(entries)-1].at.Add(l.config.Window)
+	}
+	if !allowed {
+		// Wait until enough of the oldest entries have slid out.
+		excess := count + n - l.config.Rate
+		d.RetryAfter = l.config.Window
+		for _, e := range entries {
+			excess -= e.n
+			if excess <= 0 {
+				d.RetryAfter = max(e.at.Add(l.config.Window).Sub(now), 0)
+				break
+			}
+		}
+	}
+	return d
+}
+
+// Reset clears the rate limit data for the given key.
+func (l *SlidingWindowLogLimiter) Reset(key string) error {
+	return l.ResetCtx(context.Background(), key)
+}
+
+// ResetCtx is like Reset but honours ctx.
+func (l *SlidingWindowLogLimiter) ResetCtx(ctx context.Context, key string) error {
+	return l.storage.DeleteCtx(ctx, key)
+}
+
+// Refund removes the n newest requests from the log of the given key, in
+// memory and on Redis alike. The log does not record who made each request,
+// so these may be requests other than the ones being refunded; either way the
+// key gets room for n more requests back, for as long as the log allows.
+func (l *SlidingWindowLogLimiter) Refund(key string, n int) error {
+	return l.RefundCtx(context.Background(), key, n)
+}
+
+// RefundCtx is like Refund but honours ctx.
+func (l *SlidingWindowLogLimiter) RefundCtx(ctx context.Context, key string, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	l, err := l.forKey(ctx, key)
+	if err != nil {
+		return err
+	}
+	if redisStore, ok := l.storage.(*storage.RedisMemory); ok {
+		return redisStore.SlidingWindowLogRefund(ctx, key, n)
+	}
+
+	for {
+		data, err := l.storage.GetCtx(ctx, key)
+		if err != nil || data == nil {
+			return err
+		}
+
+		// Like ZPOPMAX on Redis, take the newest requests first.
+		entries := slices.Clone(data.(*slidingLog).entries)
+		for left := n; left > 0 && len(entries) > 0; {
+			last := &entries[len(entries)-1]
+			if last.n > left {
+				last.n -= left
+				break
+			}
+			left -= last.n
+			entries = entries[:len(entries)-1]
+		}
+
+		swapped, err := compareAndSwap(ctx, l.storage, key, data, &slidingLog{entries: entries}, l.config.Window)
+		if err != nil || swapped {
+			return err
+		}
+	}
+}
+
+// GetStats returns the current rate limit statistics for the given key.
+func (l *SlidingWindowLogLimiter) GetStats(key string) (*Stats, error) {
+	return l.GetStatsCtx(context.Background(), key)
+}
+
+// GetStatsCtx is like GetStats but honours ctx.
+func (l *SlidingWindowLogLimiter) GetStatsCtx(ctx context.Context, key string) (*Stats, error) {
+	return statsFromDecision(l.DecideCtx(ctx, key, 0))
+}
@@ -0,0 +1,75 @@
+package limiter_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sumedhvats/rate-limiter-go/pkg/limiter"
+	"github.com/sumedhvats/rate-limiter-go/pkg/storage"
+)
+
+func TestBasicSlidingWindowLog(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	cfg := limiter.Config{Rate: 10, Window: time.Minute}
+	log := limiter.NewSlidingWindowLogLimiter(store, cfg)
+
+	for i := 0; i < 10; i++ {
+		ok, err := log.Allow("user1")
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	}
+
+	ok, err := log.Allow("user1")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	ok, err = log.Allow("user2")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestSlidingWindowLogExactExpiry(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	cfg := limiter.Config{Rate: 5, Window: 400 * time.Millisecond}
+	log := limiter.NewSlidingWindowLogLimiter(store, cfg)
+
+	ok, _ := log.AllowN("user1", 3)
+	assert.True(t, ok)
+	time.Sleep(200 * time.Millisecond)
+	ok, _ = log.AllowN("user1", 2)
+	assert.True(t, ok)
+
+	decision, err := log.Decide("user1", 1)
+	assert.NoError(t, err)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, 0, decision.Remaining)
+	assert.InDelta(t, float64(200*time.Millisecond), float64(decision.RetryAfter), float64(50*time.Millisecond))
+
+	// Only the first three requests have slid out of the window.
+	time.Sleep(decision.RetryAfter + 20*time.Millisecond)
+	ok, _ = log.AllowN("user1", 3)
+	assert.True(t, ok)
+	ok, _ = log.Allow("user1")
+	assert.False(t, ok)
+}
+
+func TestSlidingWindowLogStats(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	cfg := limiter.Config{Rate: 5, Window: time.Minute}
+	log := limiter.NewSlidingWindowLogLimiter(store, cfg)
+
+	ok, _ := log.AllowN("user1", 2)
+	assert.True(t, ok)
+
+	stats, err := log.GetStats("user1")
+	assert.NoError(t, err)
+	assert.Equal(t, 5, stats.Limit)
+	assert.Equal(t, 3, stats.Remaining)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), stats.ResetAt, time.Second)
+
+	assert.NoError(t, log.Reset("user1"))
+	stats, err = log.GetStats("user1")
+	assert.NoError(t, err)
+	assert.Equal(t, 5, stats.Remaining)
+}
@@ -2,8 +2,12 @@
 package limiter
 
 import (
-	"github.com/sumedhvats/rate-limiter-go/pkg/storage"
+	"context"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/sumedhvats/rate-limiter-go/pkg/storage"
 )
 
 type tokenBucket struct {
@@ -12,11 +16,18 @@ type tokenBucket struct {
 	capacity      int
 	refillRate    float64
 }
+
 // TokenBucketLimiter implements the token bucket rate limiting algorithm.
 type TokenBucketLimiter struct {
 	storage Storage
 	config  Config
+
+	// live holds a copy of the limiter with the Config last set with
+	// SetConfig, if any. mu serializes SetConfig calls.
+	mu   sync.Mutex
+	live atomic.Pointer[TokenBucketLimiter]
 }
+
 // NewTokenBucketLimiter creates a new TokenBucketLimiter.
 func NewTokenBucketLimiter(store Storage, cfg Config) *TokenBucketLimiter {
 	return &TokenBucketLimiter{
@@ -24,110 +35,320 @@ func NewTokenBucketLimiter(store Storage, cfg Config) *TokenBucketLimiter {
 		config:  cfg,
 	}
 }
+
+// Config returns the limiter's current Config.
+func (t *TokenBucketLimiter) Config() Config {
+	return t.current().config
+}
+
+// SetConfig changes the limiter's Config while it is in use. It is safe to
+// call concurrently with checks, which use either the old or the new Config.
+//
+// Buckets already in storage keep their tokens. From their next check on
+// they refill at the new rate, counted from their last check, and hold no
+// more than the new Burst.
+func (t *TokenBucketLimiter) SetConfig(cfg Config) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.live.Store(&TokenBucketLimiter{storage: t.storage, config: cfg})
+}
+
+// current returns the limiter holding the Config in force: the copy set by
+// SetConfig, or the limiter itself.
+func (t *TokenBucketLimiter) current() *TokenBucketLimiter {
+	if l := t.live.Load(); l != nil {
+		return l
+	}
+	return t
+}
+
 // AllowN checks if n tokens can be consumed for the given key.
 func (t *TokenBucketLimiter) AllowN(key string, n int) (bool, error) {
-	if redisStore, ok := t.storage.(*storage.RedisMemory); ok {
-		return t.allowNRedis(redisStore, key, n)
+	return t.AllowNCtx(context.Background(), key, n)
+}
+
+// AllowNCtx is like AllowN but honours ctx.
+func (t *TokenBucketLimiter) AllowNCtx(ctx context.Context, key string, n int) (bool, error) {
+	decision, err := t.DecideCtx(ctx, key, n)
+	if err != nil {
+		return false, err
 	}
+	return decision.Allowed, nil
+}
 
-	return t.allowNMemory(key, n)
+// Decide checks if n tokens can be consumed for the given key and reports
+// the bucket state left behind by that check.
+func (t *TokenBucketLimiter) Decide(key string, n int) (*Decision, error) {
+	return t.DecideCtx(context.Background(), key, n)
 }
 
-func (t *TokenBucketLimiter) allowNRedis(store *storage.RedisMemory, key string, n int) (bool, error) {
-	now := time.Now().Unix()
-	refillRate := float64(t.config.Rate) / float64(t.config.Window.Seconds())
+// DecideCtx is like Decide but honours ctx.
+func (t *TokenBucketLimiter) DecideCtx(ctx context.Context, key string, n int) (*Decision, error) {
+	t, err := t.forKey(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	allowed, tokens, now, err := t.take(ctx, key, n, false)
+	if err != nil {
+		return nil, err
+	}
+	return t.decision(allowed, tokens, n, now), nil
+}
 
-	return store.TokenBucketAllow(
-		key,
-		n,
-		t.config.Burst,
-		refillRate,
-		now,
-		int(t.config.Window.Seconds())*2,
-	)
+// decideUndo is like DecideCtx but also returns a function that gives the
+// consumed tokens back. See undoer.
+func (t *TokenBucketLimiter) decideUndo(ctx context.Context, key string, n int) (*Decision, func(context.Context) error, error) {
+	t, err := t.forKey(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	d, err := t.DecideCtx(ctx, key, n)
+	if err != nil || !d.Allowed || n == 0 {
+		return d, nil, err
+	}
+	return d, func(ctx context.Context) error {
+		_, _, _, err := t.take(ctx, key, -n, true)
+		return err
+	}, nil
+}
+
+// Reserve consumes n tokens for the given key even if the bucket does not
+// hold them yet, and returns a Reservation telling the caller how long to
+// wait before acting. The bucket goes into debt that later requests have to
+// wait out. The reservation is not OK if n exceeds the bucket capacity.
+func (t *TokenBucketLimiter) Reserve(key string, n int) (*Reservation, error) {
+	return t.ReserveCtx(context.Background(), key, n)
+}
+
+// ReserveCtx is like Reserve but honours ctx. Cancelling the returned
+// reservation is not bound to ctx.
+func (t *TokenBucketLimiter) ReserveCtx(ctx context.Context, key string, n int) (*Reservation, error) {
+	t, err := t.forKey(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if n > t.config.burst() {
+		return &Reservation{}, nil
+	}
+	_, tokens, now, err := t.take(ctx, key, n, true)
+	if err != nil {
+		return nil, err
+	}
+	return &Reservation{
+		ok:        true,
+		timeToAct: now.Add(secondsToDuration(-tokens / t.refillRate())),
+		clock:     t.config.clock(),
+		cancel: func() error {
+			_, _, _, err := t.take(context.Background(), key, -n, true)
+			return err
+		},
+	}, nil
+}
+
+// Wait blocks until n tokens are available for the given key or ctx is done.
+func (t *TokenBucketLimiter) Wait(ctx context.Context, key string, n int) error {
+	return waitFor(ctx, t.current().config.clock(), func() (*Reservation, error) {
+		return t.ReserveCtx(ctx, key, n)
+	})
+}
+
+// scriptStep describes the check of key as a step of the composite Redis
+// script. See scriptable.
+func (t *TokenBucketLimiter) scriptStep(ctx context.Context, key string, n int) (*scriptStep, bool, error) {
+	t, err := t.forKey(ctx, key)
+	if err != nil {
+		return nil, false, err
+	}
+	store, ok := t.storage.(*storage.RedisMemory)
+	if !ok {
+		return nil, false, nil
+	}
+	now := t.config.now()
+	return &scriptStep{
+		store: store,
+		step: storage.CompositeStep{
+			Kind:       storage.CompositeTokenBucket,
+			Keys:       []string{key},
+			Limit:      t.config.burst(),
+			RefillRate: t.refillRate(),
+			NowMs:      now.UnixMilli(),
+			TTL:        t.config.Window * 2,
+		},
+		decision: func(result storage.CompositeResult) *Decision {
+			return t.decision(result.Allowed, result.Tokens, n, now)
+		},
+		undo: func(ctx context.Context) error {
+			_, _, _, err := t.take(ctx, key, -n, true)
+			return err
+		},
+	}, true, nil
 }
 
-func (t *TokenBucketLimiter) allowNMemory(key string, n int) (bool, error) {
-	now := time.Now()
-	refillRate := float64(t.config.Rate) / float64(t.config.Window.Seconds())
+// forKey returns the limiter to check key with: a copy using the key's
+// Config if the limiter has Overrides, or the current limiter.
+func (t *TokenBucketLimiter) forKey(ctx context.Context, key string) (*TokenBucketLimiter, error) {
+	t = t.current()
+	if t.config.Overrides == nil {
+		return t, nil
+	}
+	cfg, err := t.config.resolve(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenBucketLimiter{storage: t.storage, config: cfg}, nil
+}
 
+func (t *TokenBucketLimiter) refillRate() float64 {
+	return float64(t.config.Rate) / t.config.Window.Seconds()
+}
+
+// take consumes n tokens if the bucket holds them, or unconditionally when
+// force is set, and returns the tokens left. A negative n gives tokens back,
+// never filling the bucket past its capacity.
+func (t *TokenBucketLimiter) take(ctx context.Context, key string, n int, force bool) (bool, float64, time.Time, error) {
+	return t.takeAbove(ctx, key, n, 0, force)
+}
+
+// takeAbove is like take but, unless force is set, consumes the tokens only
+// if at least floor tokens are left afterwards.
+func (t *TokenBucketLimiter) takeAbove(ctx context.Context, key string, n int, floor float64, force bool) (bool, float64, time.Time, error) {
+	if redisStore, ok := t.storage.(*storage.RedisMemory); ok {
+		return t.takeRedis(ctx, redisStore, key, n, floor, force)
+	}
+
+	return t.takeMemory(ctx, key, n, floor, force)
+}
+
+func (t *TokenBucketLimiter) takeRedis(ctx context.Context, store *storage.RedisMemory, key string, n int, floor float64, force bool) (bool, float64, time.Time, error) {
+	now := t.config.now()
+	capacity := t.config.burst()
+	refillRate := t.refillRate()
+	ttl := (t.config.Window * 2).Milliseconds()
+
+	var allowed bool
+	var tokens float64
+	var err error
+	if force {
+		allowed, tokens, err = store.TokenBucketReserve(ctx, key, n, capacity, refillRate, now.UnixMilli(), ttl)
+	} else {
+		allowed, tokens, err = store.TokenBucketAllowAbove(ctx, key, n, floor, capacity, refillRate, now.UnixMilli(), ttl)
+	}
+	return allowed, tokens, now, err
+}
+
+func (t *TokenBucketLimiter) takeMemory(ctx context.Context, key string, n int, floor float64, force bool) (bool, float64, time.Time, error) {
 	for {
-		data, err := t.storage.Get(key)
+		now := t.config.now()
+		data, err := t.storage.GetCtx(ctx, key)
 		if err != nil {
-			return false, err
+			return false, 0, now, err
 		}
 
 		var bucket *tokenBucket
 		if data == nil {
 			bucket = &tokenBucket{
-				tokens:        float64(t.config.Burst),
+				tokens:        float64(t.config.burst()),
 				lastRefilTime: now,
-				capacity:      t.config.Burst,
-				refillRate:    refillRate,
+				capacity:      t.config.burst(),
+				refillRate:    t.refillRate(),
 			}
 		} else {
+			// Refill at the configured rate and capacity rather than the
+			// stored ones, as the Redis script does, so that SetConfig
+			// applies to existing buckets too.
 			existingBucket := data.(*tokenBucket)
 			bucket = &tokenBucket{
 				tokens:        existingBucket.tokens,
 				lastRefilTime: existingBucket.lastRefilTime,
-				capacity:      existingBucket.capacity,
-				refillRate:    existingBucket.refillRate,
+				capacity:      t.config.burst(),
+				refillRate:    t.refillRate(),
 			}
 
-			elapsed := now.Sub(bucket.lastRefilTime).Seconds()
+			elapsed := max(now.Sub(bucket.lastRefilTime).Seconds(), 0)
 			tokenAdded := elapsed * bucket.refillRate
 			bucket.tokens = min(bucket.tokens+tokenAdded, float64(bucket.capacity))
 			bucket.lastRefilTime = now
 		}
 
-		if bucket.tokens >= float64(n) {
-			bucket.tokens -= float64(n)
-
-			if data == nil {
-				err := t.storage.Set(key, bucket, t.config.Window*2)
-				if err != nil {
-					continue // Retry
-				}
-				return true, nil
-			} else {
-				t.storage.Set(key, bucket, t.config.Window*2)
-				return true, nil
-			}
-		} else {
-			t.storage.Set(key, bucket, t.config.Window*2)
-			return false, nil
+		allowed := force || bucket.tokens-float64(n) >= floor
+		if n == 0 {
+			// Peek only; leave the stored bucket untouched.
+			return allowed, bucket.tokens, now, nil
+		}
+		if allowed {
+			bucket.tokens = min(bucket.tokens-float64(n), float64(bucket.capacity))
+		}
+
+		swapped, err := compareAndSwap(ctx, t.storage, key, data, bucket, t.config.Window*2)
+		if err != nil {
+			return false, 0, now, err
+		}
+		if !swapped {
+			continue // Retry
 		}
+		return allowed, bucket.tokens, now, nil
 	}
 }
+
+// decision builds a Decision from the tokens left in the bucket.
+func (t *TokenBucketLimiter) decision(allowed bool, tokens float64, n int, now time.Time) *Decision {
+	d := &Decision{
+		Allowed:   allowed,
+		Limit:     t.config.burst(),
+		Remaining: max(int(tokens), 0),
+		ResetAt:   now.Add(secondsToDuration((float64(t.config.burst()) - tokens) / t.refillRate())),
+	}
+	if !allowed {
+		d.RetryAfter = secondsToDuration((float64(n) - tokens) / t.refillRate())
+	}
+	return d
+}
+
 // Allow checks if a single request (1 token) can be consumed for the given key.
 func (t *TokenBucketLimiter) Allow(key string) (bool, error) {
 	return t.AllowN(key, 1)
 }
+
+// AllowCtx is like Allow but honours ctx.
+func (t *TokenBucketLimiter) AllowCtx(ctx context.Context, key string) (bool, error) {
+	return t.AllowNCtx(ctx, key, 1)
+}
+
 // Reset clears the rate limit data for the given key.
 func (t *TokenBucketLimiter) Reset(key string) error {
-	return t.storage.Delete(key)
+	return t.ResetCtx(context.Background(), key)
+}
+
+// ResetCtx is like Reset but honours ctx.
+func (t *TokenBucketLimiter) ResetCtx(ctx context.Context, key string) error {
+	return t.storage.DeleteCtx(ctx, key)
 }
+
+// Refund gives n tokens back to the bucket of the given key, never filling it
+// past its capacity.
+func (t *TokenBucketLimiter) Refund(key string, n int) error {
+	return t.RefundCtx(context.Background(), key, n)
+}
+
+// RefundCtx is like Refund but honours ctx.
+func (t *TokenBucketLimiter) RefundCtx(ctx context.Context, key string, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	t, err := t.forKey(ctx, key)
+	if err != nil {
+		return err
+	}
+	_, _, _, err = t.take(ctx, key, -n, true)
+	return err
+}
+
 // GetStats returns the current rate limit statistics for the given key.
-func (t *TokenBucketLimiter) GetStats(key string) (*stats, error) {
-	now := time.Now()
-	data, _ := t.storage.Get(key)
-
-	if data == nil {
-		return &stats{
-			Limit:     t.config.Burst,
-			Remaining: t.config.Burst,
-			ResetAt:   now.Add(t.config.Window),
-		}, nil
-	}
-
-	bucket := data.(*tokenBucket)
-	elapsed := now.Sub(bucket.lastRefilTime).Seconds()
-	tokenAdded := elapsed * bucket.refillRate
-	currentTokens := min(bucket.tokens+tokenAdded, float64(bucket.capacity))
-
-	return &stats{
-		Limit:     t.config.Burst,
-		Remaining: int(currentTokens),
-		ResetAt:   bucket.lastRefilTime.Add(t.config.Window),
-	}, nil
+func (t *TokenBucketLimiter) GetStats(key string) (*Stats, error) {
+	return t.GetStatsCtx(context.Background(), key)
+}
+
+// GetStatsCtx is like GetStats but honours ctx.
+func (t *TokenBucketLimiter) GetStatsCtx(ctx context.Context, key string) (*Stats, error) {
+	return statsFromDecision(t.DecideCtx(ctx, key, 0))
 }
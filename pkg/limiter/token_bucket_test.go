@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/sumedhvats/rate-limiter-go/pkg/clock"
 	"github.com/sumedhvats/rate-limiter-go/pkg/limiter"
 	"github.com/sumedhvats/rate-limiter-go/pkg/storage"
 )
@@ -23,8 +24,9 @@ func TestBasicRateLimiting(t *testing.T) {
 	assert.True(t, ok)
 }
 func TestTokenRefil(t *testing.T) {
-	store := storage.NewMemoryStorage()
-	config := limiter.Config{Rate: 10, Window: 1 * time.Minute, Burst: 10}
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	store := storage.NewMemoryStorageWithClock(clk)
+	config := limiter.Config{Rate: 10, Window: 1 * time.Minute, Burst: 10, Clock: clk}
 	limiter := limiter.NewTokenBucketLimiter(store, config)
 	for i := 0; i < 10; i++ {
 		ok, err := limiter.Allow("test2")
@@ -32,7 +34,7 @@ func TestTokenRefil(t *testing.T) {
 		assert.True(t, ok)
 	}
 
-	time.Sleep(6 * time.Second)
+	clk.Advance(6 * time.Second)
 
 	stats, err := limiter.GetStats("test2")
 	assert.NoError(t, err)
@@ -44,8 +46,9 @@ func TestTokenRefil(t *testing.T) {
 	assert.False(t, ok)
 }
 func TestBurstHandling(t *testing.T) {
-	store := storage.NewMemoryStorage()
-	config := limiter.Config{Rate: 100, Window: time.Minute, Burst: 20}
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	store := storage.NewMemoryStorageWithClock(clk)
+	config := limiter.Config{Rate: 100, Window: time.Minute, Burst: 20, Clock: clk}
 	limiter := limiter.NewTokenBucketLimiter(store, config)
 	for i := 0; i < 20; i++ {
 		ok, err := limiter.Allow("test3")
@@ -54,7 +57,7 @@ func TestBurstHandling(t *testing.T) {
 	}
 	ok, _ := limiter.Allow("test3")
 	assert.False(t, ok)
-	time.Sleep(12 * time.Second)
+	clk.Advance(12 * time.Second)
 	for i := 0; i < 20; i++ {
 		ok, err := limiter.Allow("test3")
 		assert.NoError(t, err)
@@ -90,3 +93,23 @@ func TestMultipleKeys(t *testing.T) {
 	ok, _ := limiter.Allow("user2")
 	assert.True(t, ok)
 }
+
+func TestTokenBucketDecide(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	cfg := limiter.Config{Rate: 10, Window: 10 * time.Second, Burst: 5}
+	limiter := limiter.NewTokenBucketLimiter(store, cfg)
+
+	decision, err := limiter.Decide("decide", 3)
+	assert.NoError(t, err)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, 5, decision.Limit)
+	assert.Equal(t, 2, decision.Remaining)
+	assert.Zero(t, decision.RetryAfter)
+	assert.WithinDuration(t, time.Now().Add(3*time.Second), decision.ResetAt, 100*time.Millisecond)
+
+	decision, err = limiter.Decide("decide", 3)
+	assert.NoError(t, err)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, 2, decision.Remaining)
+	assert.InDelta(t, float64(time.Second), float64(decision.RetryAfter), float64(100*time.Millisecond))
+}
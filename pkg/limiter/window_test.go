@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/sumedhvats/rate-limiter-go/pkg/clock"
 	"github.com/sumedhvats/rate-limiter-go/pkg/limiter"
 	"github.com/sumedhvats/rate-limiter-go/pkg/storage"
 )
@@ -26,8 +27,9 @@ func TestBasicFixedWindow(t *testing.T) {
 }
 
 func TestWindowReset(t *testing.T) {
-	store := storage.NewMemoryStorage()
-	cfg := limiter.Config{Rate: 5, Window: 2 * time.Second, Burst: 5}
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	store := storage.NewMemoryStorageWithClock(clk)
+	cfg := limiter.Config{Rate: 5, Window: 2 * time.Second, Burst: 5, Clock: clk}
 	fixed := limiter.NewFixedWindowLimiter(store, cfg)
 
 	for i := 0; i < 5; i++ {
@@ -38,15 +40,16 @@ func TestWindowReset(t *testing.T) {
 	ok, _ := fixed.Allow("user2")
 	assert.False(t, ok)
 
-	time.Sleep(3 * time.Second)
+	clk.Advance(3 * time.Second)
 
 	ok, _ = fixed.Allow("user2")
 	assert.True(t, ok, "Should reset after window expires")
 }
 
 func TestFixedWindowBoundary(t *testing.T) {
-	store := storage.NewMemoryStorage()
-	cfg := limiter.Config{Rate: 10, Window: 5 * time.Second, Burst: 10}
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	store := storage.NewMemoryStorageWithClock(clk)
+	cfg := limiter.Config{Rate: 10, Window: 5 * time.Second, Burst: 10, Clock: clk}
 	fixed := limiter.NewFixedWindowLimiter(store, cfg)
 
 	for i := 0; i < 10; i++ {
@@ -55,7 +58,7 @@ func TestFixedWindowBoundary(t *testing.T) {
 		assert.True(t, ok)
 	}
 
-	time.Sleep(6 * time.Second)
+	clk.Advance(6 * time.Second)
 
 	successCount := 0
 	for i := 0; i < 10; i++ {
@@ -104,8 +107,9 @@ func TestMultipleUsersFixedWindow(t *testing.T) {
 }
 
 func TestSmallWindowBehavior(t *testing.T) {
-	store := storage.NewMemoryStorage()
-	cfg := limiter.Config{Rate: 3, Window: 1 * time.Second}
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	store := storage.NewMemoryStorageWithClock(clk)
+	cfg := limiter.Config{Rate: 3, Window: 1 * time.Second, Clock: clk}
 	fixed := limiter.NewFixedWindowLimiter(store, cfg)
 
 	for i := 0; i < 3; i++ {
@@ -116,7 +120,7 @@ func TestSmallWindowBehavior(t *testing.T) {
 	ok, _ := fixed.Allow("tinyUser")
 	assert.False(t, ok)
 
-	time.Sleep(1100 * time.Millisecond) // wait for new window
+	clk.Advance(1100 * time.Millisecond)
 	ok, _ = fixed.Allow("tinyUser")
 	assert.True(t, ok)
 }
@@ -136,8 +140,9 @@ func TestBasicSlidingWindow(t *testing.T) {
 	assert.False(t, ok)
 }
 func TestSlidingWindowReset(t *testing.T) {
-	store := storage.NewMemoryStorage()
-	cfg := limiter.Config{Rate: 5, Window: 2 * time.Second, Burst: 5}
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	store := storage.NewMemoryStorageWithClock(clk)
+	cfg := limiter.Config{Rate: 5, Window: 2 * time.Second, Burst: 5, Clock: clk}
 	fixed := limiter.NewSlidingWindowLimiter(store, cfg)
 
 	for i := 0; i < 5; i++ {
@@ -148,15 +153,16 @@ func TestSlidingWindowReset(t *testing.T) {
 	ok, _ := fixed.Allow("user2")
 	assert.False(t, ok)
 
-	time.Sleep(3 * time.Second)
+	clk.Advance(3 * time.Second)
 
 	ok, _ = fixed.Allow("user2")
 	assert.True(t, ok, "Should reset after window expires")
 }
 
 func TestSlidingWindowBurstHandling(t *testing.T) {
-	store := storage.NewMemoryStorage()
-	config := limiter.Config{Rate: 20, Window: 10 * time.Second}
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	store := storage.NewMemoryStorageWithClock(clk)
+	config := limiter.Config{Rate: 20, Window: 10 * time.Second, Clock: clk}
 	limiter := limiter.NewSlidingWindowLimiter(store, config)
 
 	for i := 0; i < 20; i++ {
@@ -168,7 +174,7 @@ func TestSlidingWindowBurstHandling(t *testing.T) {
 	assert.False(t, ok)
 
 	// Wait for MORE than a full window to completely reset
-	time.Sleep(21 * time.Second)
+	clk.Advance(21 * time.Second)
 
 	for i := 0; i < 20; i++ {
 		ok, err := limiter.Allow("test3")
@@ -207,3 +213,129 @@ func TestSWMultipleKeys(t *testing.T) {
 	ok, _ := limiter.Allow("user2")
 	assert.True(t, ok)
 }
+
+func TestFixedWindowDecide(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	cfg := limiter.Config{Rate: 5, Window: time.Minute}
+	fixed := limiter.NewFixedWindowLimiter(store, cfg)
+
+	decision, err := fixed.Decide("decideUser", 4)
+	assert.NoError(t, err)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, 5, decision.Limit)
+	assert.Equal(t, 1, decision.Remaining)
+	assert.Zero(t, decision.RetryAfter)
+
+	decision, err = fixed.Decide("decideUser", 2)
+	assert.NoError(t, err)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, 1, decision.Remaining)
+	assert.Equal(t, decision.ResetAt.Sub(time.Now()).Round(time.Second), decision.RetryAfter.Round(time.Second))
+}
+
+func TestSlidingWindowDecide(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	cfg := limiter.Config{Rate: 5, Window: time.Minute}
+	sliding := limiter.NewSlidingWindowLimiter(store, cfg)
+
+	decision, err := sliding.Decide("decideUser", 5)
+	assert.NoError(t, err)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, 5, decision.Limit)
+	assert.Equal(t, 0, decision.Remaining)
+
+	decision, err = sliding.Decide("decideUser", 1)
+	assert.NoError(t, err)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, 0, decision.Remaining)
+	assert.Greater(t, decision.RetryAfter, time.Duration(0))
+	assert.True(t, decision.ResetAt.After(time.Now()))
+}
+
+func TestGetStatsConsistency(t *testing.T) {
+	cfg := limiter.Config{Rate: 5, Window: time.Minute}
+	limiters := map[string]limiter.Limiter{
+		"TokenBucket":   limiter.NewTokenBucketLimiter(storage.NewMemoryStorage(), cfg),
+		"FixedWindow":   limiter.NewFixedWindowLimiter(storage.NewMemoryStorage(), cfg),
+		"SlidingWindow": limiter.NewSlidingWindowLimiter(storage.NewMemoryStorage(), cfg),
+	}
+	for name, l := range limiters {
+		t.Run(name, func(t *testing.T) {
+			stats, err := l.GetStats("statsUser")
+			assert.NoError(t, err)
+			assert.Equal(t, 5, stats.Limit)
+			assert.Equal(t, 5, stats.Remaining)
+			assert.WithinDuration(t, time.Now(), stats.ResetAt, time.Second)
+
+			ok, err := l.AllowN("statsUser", 3)
+			assert.NoError(t, err)
+			assert.True(t, ok)
+
+			stats, err = l.GetStats("statsUser")
+			assert.NoError(t, err)
+			assert.Equal(t, 5, stats.Limit)
+			assert.Equal(t, 2, stats.Remaining)
+			assert.True(t, stats.ResetAt.After(time.Now()))
+
+			// Reading stats must not consume anything.
+			stats, err = l.GetStats("statsUser")
+			assert.NoError(t, err)
+			assert.Equal(t, 2, stats.Remaining)
+		})
+	}
+}
+
+func TestSubSecondWindows(t *testing.T) {
+	cfg := func(clk clock.Clock) limiter.Config {
+		return limiter.Config{Rate: 20, Window: 100 * time.Millisecond, Clock: clk}
+	}
+	limiters := map[string]func(limiter.Storage, clock.Clock) limiter.Limiter{
+		"token bucket": func(s limiter.Storage, clk clock.Clock) limiter.Limiter {
+			return limiter.NewTokenBucketLimiter(s, cfg(clk))
+		},
+		"fixed window": func(s limiter.Storage, clk clock.Clock) limiter.Limiter {
+			return limiter.NewFixedWindowLimiter(s, cfg(clk))
+		},
+		"sliding window": func(s limiter.Storage, clk clock.Clock) limiter.Limiter {
+			return limiter.NewSlidingWindowLimiter(s, cfg(clk))
+		},
+	}
+	for name, newLimiter := range limiters {
+		t.Run(name, func(t *testing.T) {
+			clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+			l := newLimiter(storage.NewMemoryStorageWithClock(clk), clk)
+
+			ok, err := l.AllowN("conn", 20)
+			assert.NoError(t, err)
+			assert.True(t, ok)
+			decision, err := l.Decide("conn", 1)
+			assert.NoError(t, err)
+			assert.False(t, decision.Allowed)
+			assert.Greater(t, decision.RetryAfter, time.Duration(0))
+			assert.LessOrEqual(t, decision.RetryAfter, 200*time.Millisecond)
+
+			// Everything is available again within two windows.
+			clk.Advance(200 * time.Millisecond)
+			ok, err = l.AllowN("conn", 20)
+			assert.NoError(t, err)
+			assert.True(t, ok)
+		})
+	}
+}
+
+func TestTokenBucketRefillsBetweenSeconds(t *testing.T) {
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	tb := limiter.NewTokenBucketLimiter(storage.NewMemoryStorageWithClock(clk), limiter.Config{
+		Rate:   20,
+		Window: 100 * time.Millisecond,
+		Clock:  clk,
+	})
+
+	ok, err := tb.AllowN("conn", 20)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	clk.Advance(50 * time.Millisecond)
+	stats, err := tb.GetStats("conn")
+	assert.NoError(t, err)
+	assert.Equal(t, 10, stats.Remaining)
+}
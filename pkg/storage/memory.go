@@ -1,17 +1,22 @@
-// Package storage provides interfaces and implementations 
+// Package storage provides interfaces and implementations
 // for rate limiter data storage.
 package storage
 
 import (
+	"context"
 	"errors"
-
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/sumedhvats/rate-limiter-go/pkg/clock"
 )
+
 // MemoryStorage implements a storage backend using a thread-safe in-memory map.
 type MemoryStorage struct {
 	data    sync.Map
 	cleanup *time.Ticker
+	clock   clock.Clock
 }
 
 type memoryEntry struct {
@@ -22,15 +27,23 @@ type memoryEntry struct {
 // NewMemoryStorage creates and returns a new MemoryStorage.
 // It also starts a background goroutine to clean up expired entries.
 func NewMemoryStorage() *MemoryStorage {
+	return NewMemoryStorageWithClock(clock.Real)
+}
+
+// NewMemoryStorageWithClock is like NewMemoryStorage but reads the time
+// from c when expiring entries. The cleanup goroutine still runs once a
+// minute of real time.
+func NewMemoryStorageWithClock(c clock.Clock) *MemoryStorage {
 	s := &MemoryStorage{
 		cleanup: time.NewTicker(1 * time.Minute),
+		clock:   clock.OrReal(c),
 	}
 	go s.cleanupExpired()
 	return s
 }
 func (s *MemoryStorage) cleanupExpired() {
 	for range s.cleanup.C {
-		now := time.Now()
+		now := s.clock.Now()
 		s.data.Range(func(key, value interface{}) bool {
 			entry := value.(*memoryEntry)
 			if now.After(entry.expiresAt) {
@@ -49,15 +62,16 @@ func (s *MemoryStorage) Get(key string) (interface{}, error) {
 		return nil, nil
 	}
 	entry := val.(*memoryEntry)
-	if time.Now().After(entry.expiresAt) {
+	if s.clock.Now().After(entry.expiresAt) {
 		s.data.Delete(key)
 		return nil, nil
 	}
 	return entry.value, nil
 }
+
 // Set stores a value in the in-memory store with a specified TTL.
 func (s *MemoryStorage) Set(key string, value interface{}, ttl time.Duration) error {
-	now := time.Now()
+	now := s.clock.Now()
 	entry := &memoryEntry{
 		value:     value,
 		expiresAt: now.Add(ttl),
@@ -65,11 +79,60 @@ func (s *MemoryStorage) Set(key string, value interface{}, ttl time.Duration) er
 	s.data.Store(key, entry)
 	return nil
 }
+
+// CompareAndSwap atomically stores new under key if the current value is old.
+// A nil old matches a missing or expired key. Values must be comparable;
+// pointers are compared by identity.
+func (s *MemoryStorage) CompareAndSwap(key string, old, new interface{}, ttl time.Duration) (bool, error) {
+	now := s.clock.Now()
+	newEntry := &memoryEntry{
+		value:     new,
+		expiresAt: now.Add(ttl),
+	}
+
+	entryAny, ok := s.data.Load(key)
+	if !ok {
+		if old != nil {
+			return false, nil
+		}
+		_, loaded := s.data.LoadOrStore(key, newEntry)
+		return !loaded, nil
+	}
+
+	entry, ok := entryAny.(*memoryEntry)
+	if !ok {
+		return false, errors.New("invalid entry type")
+	}
+	if now.After(entry.expiresAt) {
+		if old != nil {
+			return false, nil
+		}
+	} else if entry.value != old {
+		return false, nil
+	}
+	return s.data.CompareAndSwap(key, entry, newEntry), nil
+}
+
 // Delete removes a key from the in-memory store.
 func (s *MemoryStorage) Delete(key string) error {
 	s.data.Delete(key)
 	return nil
 }
+
+// Keys returns the unexpired keys starting with prefix.
+func (s *MemoryStorage) Keys(prefix string) ([]string, error) {
+	now := s.clock.Now()
+	var keys []string
+	s.data.Range(func(key, value interface{}) bool {
+		k := key.(string)
+		if strings.HasPrefix(k, prefix) && !now.After(value.(*memoryEntry).expiresAt) {
+			keys = append(keys, k)
+		}
+		return true
+	})
+	return keys, nil
+}
+
 // Increment atomically increments a key's value in the in-memory store.
 // It uses a Compare-And-Swap loop to handle concurrency.
 func (s *MemoryStorage) Increment(key string, amount int, ttl time.Duration) (int64, error) {
@@ -78,7 +141,7 @@ func (s *MemoryStorage) Increment(key string, amount int, ttl time.Duration) (in
 		if !ok {
 			entry := &memoryEntry{
 				value:     int64(amount),
-				expiresAt: time.Now().Add(ttl),
+				expiresAt: s.clock.Now().Add(ttl),
 			}
 			//another go routing may created it
 			actual, loaded := s.data.LoadOrStore(key, entry)
@@ -93,10 +156,10 @@ func (s *MemoryStorage) Increment(key string, amount int, ttl time.Duration) (in
 			return 0, errors.New("invalid entry type")
 		}
 		//expiry
-		if time.Now().After(entry.expiresAt) {
+		if s.clock.Now().After(entry.expiresAt) {
 			newEntry := &memoryEntry{
 				value:     int64(amount),
-				expiresAt: time.Now().Add(ttl),
+				expiresAt: s.clock.Now().Add(ttl),
 			}
 			if s.data.CompareAndSwap(key, entry, newEntry) {
 				return int64(amount), nil
@@ -121,3 +184,43 @@ func (s *MemoryStorage) Increment(key string, amount int, ttl time.Duration) (in
 		// else retry
 	}
 }
+
+// GetCtx is like Get but returns ctx.Err() if ctx is already done.
+func (s *MemoryStorage) GetCtx(ctx context.Context, key string) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Get(key)
+}
+
+// SetCtx is like Set but returns ctx.Err() if ctx is already done.
+func (s *MemoryStorage) SetCtx(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Set(key, value, ttl)
+}
+
+// DeleteCtx is like Delete but returns ctx.Err() if ctx is already done.
+func (s *MemoryStorage) DeleteCtx(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Delete(key)
+}
+
+// KeysCtx is like Keys but returns ctx.Err() if ctx is already done.
+func (s *MemoryStorage) KeysCtx(ctx context.Context, prefix string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Keys(prefix)
+}
+
+// IncrementCtx is like Increment but returns ctx.Err() if ctx is already done.
+func (s *MemoryStorage) IncrementCtx(ctx context.Context, key string, amount int, ttl time.Duration) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return s.Increment(key, amount, ttl)
+}
@@ -5,6 +5,8 @@ import (
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/sumedhvats/rate-limiter-go/pkg/clock"
 )
 
 func TestMemoryStorate_GetSet(t *testing.T) {
@@ -67,3 +69,44 @@ func TestConcurrentAccess(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, currVal, int64(10000))
 }
+
+func TestExpiration_ManualClock(t *testing.T) {
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	store := NewMemoryStorageWithClock(clk)
+
+	assert.NoError(t, store.Set("tempKey", "tempValue", time.Minute))
+	_, err := store.Increment("counter", 1, time.Minute)
+	assert.NoError(t, err)
+
+	clk.Advance(59 * time.Second)
+	val, err := store.Get("tempKey")
+	assert.NoError(t, err)
+	assert.Equal(t, "tempValue", val)
+
+	clk.Advance(2 * time.Second)
+	val, err = store.Get("tempKey")
+	assert.NoError(t, err)
+	assert.Nil(t, val)
+
+	count, err := store.Increment("counter", 1, time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), count, "expired counter should start over")
+}
+
+func TestMemoryStorage_Keys(t *testing.T) {
+	clk := clock.NewManual(time.Unix(1_700_000_000, 0))
+	store := NewMemoryStorageWithClock(clk)
+
+	assert.NoError(t, store.Set("ban:alice", "1", time.Minute))
+	assert.NoError(t, store.Set("ban:bob", "1", time.Hour))
+	assert.NoError(t, store.Set("other", "1", time.Hour))
+
+	keys, err := store.Keys("ban:")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"ban:alice", "ban:bob"}, keys)
+
+	clk.Advance(2 * time.Minute)
+	keys, err = store.Keys("ban:")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ban:bob"}, keys)
+}
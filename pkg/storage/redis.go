@@ -1,24 +1,41 @@
-// Package storage provides interfaces and implementations 
+// Package storage provides interfaces and implementations
 // for rate limiter data storage.
 package storage
 
 import (
 	"context"
+	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
+
 // RedisMemory implements a storage backend using a Redis client.
 type RedisMemory struct {
-	client *redis.Client
-	ctx    context.Context
+	client     *redis.Client
+	ctx        context.Context
+	serverTime bool
 }
+
 // NewRedisStorage creates and returns a new RedisMemory store,
-// connecting to the Redis instance at the given address.
+// connecting to the Redis instance at the given address. It panics if Redis
+// cannot be reached; see DialRedisStorage for a version that returns an error.
 func NewRedisStorage(addr string) *RedisMemory {
-	ctx := context.Background()
-	client := redis.NewClient(&redis.Options{
+	r, err := DialRedisStorage(context.Background(), addr)
+	if err != nil {
+		panic("Failed to connect to Redis: " + err.Error())
+	}
+	return r
+}
+
+// DialRedisStorage creates a RedisMemory store connected to the Redis
+// instance at the given address, and returns an error if Redis does not
+// answer a PING. The client is kept open on error, so that callers can keep
+// the store and wait for Redis to come up.
+func DialRedisStorage(ctx context.Context, addr string) (*RedisMemory, error) {
+	r := NewRedisStorageWithClient(redis.NewClient(&redis.Options{
 		Addr:         addr,
 		Password:     "",
 		DB:           0,
@@ -26,20 +43,60 @@ func NewRedisStorage(addr string) *RedisMemory {
 		MinIdleConns: 5,
 		DialTimeout:  5 * time.Second,
 		ReadTimeout:  3 * time.Second,
-		WriteTimeout: 3 * time.Second})
-
-	if err := client.Ping(ctx).Err(); err != nil {
-		panic("Failed to connect to Redis: " + err.Error())
-	}
+		WriteTimeout: 3 * time.Second}))
+	return r, r.Ping(ctx)
+}
 
+// NewRedisStorageWithClient creates a RedisMemory store using client. It does
+// not check that Redis can be reached.
+func NewRedisStorageWithClient(client *redis.Client) *RedisMemory {
 	return &RedisMemory{
 		client: client,
-		ctx:    ctx,
+		ctx:    context.Background(),
 	}
 }
+
+// Ping checks that Redis can be reached, e.g. as the health probe of a
+// limiter.ResilientLimiter.
+func (r *RedisMemory) Ping(ctx context.Context) error {
+	return r.client.Ping(ctx).Err()
+}
+
+// WithServerTime returns a copy of the store, sharing its connection, whose
+// scripts read the current time from the Redis server with TIME instead of
+// using the timestamps passed to them, and derive window keys from it. All
+// instances then agree on time however far their own clocks drift. The
+// limiters in package limiter check the store with ServerTime. Windows
+// located by the server then have to be a whole number of microseconds.
+//
+// Keys derived inside a script are not declared to Redis. On Redis Cluster,
+// give rate limit keys a hash tag, such as "{user:42}", so that all windows
+// of a key live in the same slot.
+func (r *RedisMemory) WithServerTime() *RedisMemory {
+	c := *r
+	c.serverTime = true
+	return &c
+}
+
+// ServerTime reports whether the store's scripts read the current time from
+// the Redis server. See WithServerTime.
+func (r *RedisMemory) ServerTime() bool {
+	return r.serverTime
+}
+
+// Time returns the current time of the Redis server.
+func (r *RedisMemory) Time(ctx context.Context) (time.Time, error) {
+	return r.client.Time(ctx).Result()
+}
+
 // Get retrieves a value from Redis by key.
 func (r *RedisMemory) Get(key string) (interface{}, error) {
-	data, err := r.client.Get(r.ctx, key).Result()
+	return r.GetCtx(r.ctx, key)
+}
+
+// GetCtx retrieves a value from Redis by key, honouring ctx.
+func (r *RedisMemory) GetCtx(ctx context.Context, key string) (interface{}, error) {
+	data, err := r.client.Get(ctx, key).Result()
 	if err == redis.Nil {
 		return nil, nil
 	} else if err != nil {
@@ -50,34 +107,771 @@ func (r *RedisMemory) Get(key string) (interface{}, error) {
 	}
 	return data, nil
 }
+
 // Set stores a value in Redis with a specified TTL.
 func (r *RedisMemory) Set(key string, value interface{}, ttl time.Duration) error {
-	return r.client.Set(r.ctx, key, value, ttl).Err()
+	return r.SetCtx(r.ctx, key, value, ttl)
+}
+
+// SetCtx stores a value in Redis with a specified TTL, honouring ctx.
+func (r *RedisMemory) SetCtx(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	return r.client.Set(ctx, key, value, ttl).Err()
+}
+
+// CompareAndSwap atomically stores new under key if the current value is old.
+// A nil old matches a missing key. Values are compared as the strings Redis
+// stores them as.
+func (r *RedisMemory) CompareAndSwap(key string, old, new interface{}, ttl time.Duration) (bool, error) {
+	return r.CompareAndSwapCtx(r.ctx, key, old, new, ttl)
+}
+
+// CompareAndSwapCtx is like CompareAndSwap but honours ctx.
+func (r *RedisMemory) CompareAndSwapCtx(ctx context.Context, key string, old, new interface{}, ttl time.Duration) (bool, error) {
+	exists, oldValue := 0, ""
+	if old != nil {
+		exists, oldValue = 1, fmt.Sprint(old)
+	}
+	swapped, err := compareAndSwapScript.Run(
+		ctx,
+		r.client,
+		[]string{key},
+		exists,
+		oldValue,
+		fmt.Sprint(new),
+		ttl.Milliseconds(),
+	).Int()
+	return swapped == 1, err
 }
+
 // Delete removes a key from Redis.
 func (r *RedisMemory) Delete(key string) error {
-	return r.client.Del(r.ctx, key).Err()
+	return r.DeleteCtx(r.ctx, key)
 }
+
+// DeleteCtx removes a key from Redis, honouring ctx.
+func (r *RedisMemory) DeleteCtx(ctx context.Context, key string) error {
+	return r.client.Del(ctx, key).Err()
+}
+
 // Increment atomically increments a key's value by amount and returns the new value.
 func (r *RedisMemory) Increment(key string, amount int, ttl time.Duration) (int64, error) {
-	return r.client.IncrBy(r.ctx, key, int64(amount)).Result()
+	return r.IncrementCtx(r.ctx, key, amount, ttl)
+}
+
+// IncrementCtx atomically increments a key's value by amount and returns the new value,
+// honouring ctx.
+func (r *RedisMemory) IncrementCtx(ctx context.Context, key string, amount int, ttl time.Duration) (int64, error) {
+	return r.client.IncrBy(ctx, key, int64(amount)).Result()
+}
+
+// Keys returns the keys starting with prefix.
+func (r *RedisMemory) Keys(prefix string) ([]string, error) {
+	return r.KeysCtx(r.ctx, prefix)
+}
+
+// KeysCtx is like Keys but honours ctx. It walks the keyspace with SCAN, so
+// keys written meanwhile may or may not be returned.
+func (r *RedisMemory) KeysCtx(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	iter := r.client.Scan(ctx, 0, globEscape(prefix)+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	return keys, iter.Err()
+}
+
+// globEscape escapes the characters that are special in Redis glob patterns.
+func globEscape(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// GetField retrieves a field of the hash at key. It reports false if the
+// field does not exist.
+func (r *RedisMemory) GetField(ctx context.Context, key, field string) (string, bool, error) {
+	data, err := r.client.HGet(ctx, key, field).Result()
+	if err == redis.Nil {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	return data, true, nil
+}
+
+// SetField stores a field of the hash at key.
+func (r *RedisMemory) SetField(ctx context.Context, key, field, value string) error {
+	return r.client.HSet(ctx, key, field, value).Err()
+}
+
+// DeleteField removes a field of the hash at key.
+func (r *RedisMemory) DeleteField(ctx context.Context, key, field string) error {
+	return r.client.HDel(ctx, key, field).Err()
 }
 
 // SlidingWindowIncrement performs an atomic sliding window check and increment using a Lua script.
+// It returns whether the increment was applied together with the current and
+// previous window counts it was checked against.
 func (r *RedisMemory) SlidingWindowIncrement(
+	ctx context.Context,
 	currentKey, previousKey string,
+	increment int,
 	limit int,
 	weight float64,
 	ttl time.Duration,
+) (bool, int64, int64, error) {
+	return r.runSlidingWindow(ctx, currentKey, previousKey, increment, limit, weight, ttl, false)
+}
+
+// SlidingWindowReserve atomically increments the current window even if that
+// exceeds the limit. It returns the resulting current and previous window counts.
+func (r *RedisMemory) SlidingWindowReserve(
+	ctx context.Context,
+	currentKey, previousKey string,
+	increment int,
+	limit int,
+	weight float64,
+	ttl time.Duration,
+) (bool, int64, int64, error) {
+	return r.runSlidingWindow(ctx, currentKey, previousKey, increment, limit, weight, ttl, true)
+}
+
+func (r *RedisMemory) runSlidingWindow(
+	ctx context.Context,
+	currentKey, previousKey string,
+	increment int,
+	limit int,
+	weight float64,
+	ttl time.Duration,
+	force bool,
+) (bool, int64, int64, error) {
+	result, err := slidingWindowScript.Run(
+		ctx,
+		r.client,
+		[]string{currentKey, previousKey},
+		limit,
+		weight,
+		ttl.Milliseconds(),
+		increment,
+		force,
+	).Int64Slice()
+	if err != nil {
+		return false, 0, 0, err
+	}
+	return result[0] == 1, result[1], result[2], nil
+}
+
+// SlidingWindowIncrementServerTime is like SlidingWindowIncrement but locates
+// the current and previous windows of length window inside the script, from
+// the Redis server time, using the window keys that WindowKey derives from
+// key. While change is in progress, the windows are those of length
+// change.Previous, and the first window after it follows the last of them.
+// It also returns the server time the windows were located at.
+func (r *RedisMemory) SlidingWindowIncrementServerTime(
+	ctx context.Context,
+	key string,
+	increment int,
+	limit int,
+	window time.Duration,
+	change WindowChange,
+	ttl time.Duration,
+) (bool, int64, int64, time.Time, error) {
+	return r.runSlidingWindowServerTime(ctx, key, increment, limit, window, change, ttl, false)
+}
+
+// SlidingWindowReserveServerTime is like SlidingWindowReserve but locates the
+// windows from the Redis server time. See SlidingWindowIncrementServerTime.
+func (r *RedisMemory) SlidingWindowReserveServerTime(
+	ctx context.Context,
+	key string,
+	increment int,
+	limit int,
+	window time.Duration,
+	change WindowChange,
+	ttl time.Duration,
+) (bool, int64, int64, time.Time, error) {
+	return r.runSlidingWindowServerTime(ctx, key, increment, limit, window, change, ttl, true)
+}
+
+func (r *RedisMemory) runSlidingWindowServerTime(
+	ctx context.Context,
+	key string,
+	increment int,
+	limit int,
+	window time.Duration,
+	change WindowChange,
+	ttl time.Duration,
+	force bool,
+) (bool, int64, int64, time.Time, error) {
+	windowUs, unitUs, err := serverTimeWindow(window)
+	if err != nil {
+		return false, 0, 0, time.Time{}, err
+	}
+	previousUs, previousUnitUs, sinceUs, err := change.args()
+	if err != nil {
+		return false, 0, 0, time.Time{}, err
+	}
+	result, err := slidingWindowServerTimeScript.Run(
+		ctx,
+		r.client,
+		[]string{key},
+		limit,
+		ttl.Milliseconds(),
+		increment,
+		force,
+		windowUs,
+		unitUs,
+		previousUs,
+		previousUnitUs,
+		sinceUs,
+	).Int64Slice()
+	if err != nil {
+		return false, 0, 0, time.Time{}, err
+	}
+	return result[0] == 1, result[1], result[2], time.UnixMicro(result[3]), nil
+}
+
+// SlidingWindowPolicyIncrement atomically checks several sliding windows and
+// increments the current window of each of them only if every one has room
+// for increment. currentKeys, previousKeys, limits, weights and ttls hold one
+// entry per window. It returns the index of the first window that denied the
+// increment, or -1 if it was applied, together with the current and previous
+// counts of every window.
+func (r *RedisMemory) SlidingWindowPolicyIncrement(
+	ctx context.Context,
+	currentKeys, previousKeys []string,
+	increment int,
+	limits []int,
+	weights []float64,
+	ttls []time.Duration,
+) (int, []int64, []int64, error) {
+	keys := make([]string, 0, 2*len(currentKeys))
+	args := make([]interface{}, 0, 1+3*len(currentKeys))
+	args = append(args, increment)
+	for i := range currentKeys {
+		keys = append(keys, currentKeys[i], previousKeys[i])
+		args = append(args, limits[i], weights[i], ttls[i].Milliseconds())
+	}
+
+	result, err := slidingWindowPolicyScript.Run(ctx, r.client, keys, args...).Int64Slice()
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	current := make([]int64, len(currentKeys))
+	previous := make([]int64, len(currentKeys))
+	for i := range currentKeys {
+		current[i] = result[1+2*i]
+		previous[i] = result[2+2*i]
+	}
+	return int(result[0]) - 1, current, previous, nil
+}
+
+// SlidingWindowPolicyIncrementServerTime is like SlidingWindowPolicyIncrement
+// but locates the current and previous windows of every key inside the
+// script, from the Redis server time, using the window keys that WindowKey
+// derives from it. keys, limits, windows and ttls hold one entry per window.
+// It also returns the server time the windows were located at. Windows that
+// are not a whole number of microseconds fail with ErrServerTimeWindow.
+func (r *RedisMemory) SlidingWindowPolicyIncrementServerTime(
+	ctx context.Context,
+	keys []string,
+	increment int,
+	limits []int,
+	windows []time.Duration,
+	ttls []time.Duration,
+) (int, []int64, []int64, time.Time, error) {
+	args := make([]interface{}, 0, 1+4*len(keys))
+	args = append(args, increment)
+	for i := range keys {
+		windowUs, unitUs, err := serverTimeWindow(windows[i])
+		if err != nil {
+			return 0, nil, nil, time.Time{}, err
+		}
+		args = append(args, limits[i], windowUs, unitUs, ttls[i].Milliseconds())
+	}
+
+	result, err := slidingWindowPolicyServerTimeScript.Run(ctx, r.client, keys, args...).Int64Slice()
+	if err != nil {
+		return 0, nil, nil, time.Time{}, err
+	}
+
+	current := make([]int64, len(keys))
+	previous := make([]int64, len(keys))
+	for i := range keys {
+		current[i] = result[1+2*i]
+		previous[i] = result[2+2*i]
+	}
+	return int(result[0]) - 1, current, previous, time.UnixMicro(result[len(result)-1]), nil
+}
+
+// CompositeKind selects the algorithm of a CompositeStep.
+type CompositeKind string
+
+// Algorithms supported by CompositeAllow.
+const (
+	CompositeTokenBucket   CompositeKind = "tb"
+	CompositeFixedWindow   CompositeKind = "fw"
+	CompositeSlidingWindow CompositeKind = "sw"
+)
+
+// CompositeStep describes one check of a CompositeAllow call.
+type CompositeStep struct {
+	// Kind is the algorithm of the check.
+	Kind CompositeKind
+	// Keys holds the bucket or window key. Sliding windows take the current
+	// and the previous window key.
+	Keys []string
+	// Limit is the bucket capacity or the window limit.
+	Limit int
+	// RefillRate is the token bucket refill rate in tokens per second.
+	RefillRate float64
+	// Weight is the weight of the previous sliding window.
+	Weight float64
+	// NowMs is the current Unix timestamp in milliseconds used by token
+	// buckets. A store using server time ignores it.
+	NowMs int64
+	// TTL is how long an updated key lives.
+	TTL time.Duration
+}
+
+// CompositeResult is the outcome of one CompositeStep.
+type CompositeResult struct {
+	// Allowed reports whether the step on its own had room for the increment.
+	Allowed bool
+	// Tokens is the number of tokens left in a token bucket.
+	Tokens float64
+	// Current and Previous are the window counts. Fixed windows only use Current.
+	Current  int64
+	Previous int64
+}
+
+// CompositeAllow atomically runs several token bucket, fixed window and
+// sliding window checks and applies increment to all of them only if every
+// check passes. It returns the index of the first step that denied the
+// increment, or -1 if it was applied, together with the state of every step.
+// When the increment was applied the results describe the state after it.
+func (r *RedisMemory) CompositeAllow(ctx context.Context, increment int, steps []CompositeStep) (int, []CompositeResult, error) {
+	var keys []string
+	args := make([]interface{}, 0, 1+6*len(steps))
+	args = append(args, increment)
+	for _, step := range steps {
+		keys = append(keys, step.Keys...)
+		rateOrWeight := step.RefillRate
+		if step.Kind == CompositeSlidingWindow {
+			rateOrWeight = step.Weight
+		}
+		nowMs := step.NowMs
+		if r.serverTime {
+			nowMs = 0
+		}
+		args = append(args, string(step.Kind), len(step.Keys), step.Limit, rateOrWeight, nowMs, step.TTL.Milliseconds())
+	}
+
+	raw, err := compositeScript.Run(ctx, r.client, keys, args...).Slice()
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(raw) != 1+3*len(steps) {
+		return 0, nil, fmt.Errorf("unexpected composite result: %v", raw)
+	}
+
+	results := make([]CompositeResult, len(steps))
+	for i := range steps {
+		allowed, _ := raw[1+3*i].(int64)
+		first, err := strconv.ParseFloat(fmt.Sprint(raw[2+3*i]), 64)
+		if err != nil {
+			return 0, nil, err
+		}
+		second, err := strconv.ParseFloat(fmt.Sprint(raw[3+3*i]), 64)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		results[i].Allowed = allowed == 1
+		if steps[i].Kind == CompositeTokenBucket {
+			results[i].Tokens = first
+		} else {
+			results[i].Current = int64(first)
+			results[i].Previous = int64(second)
+		}
+	}
+	denied, _ := raw[0].(int64)
+	return int(denied) - 1, results, nil
+}
+
+// FixedWindowIncrement performs an atomic fixed window check and increment using a Lua script.
+// It returns whether the increment was applied and the resulting window count.
+func (r *RedisMemory) FixedWindowIncrement(
+	ctx context.Context,
+	key string,
+	increment int,
+	limit int,
+	ttlMs int64,
+) (bool, int64, error) {
+	result, err := fixedWindowScript.Run(
+		ctx,
+		r.client,
+		[]string{key},
+		increment,
+		limit,
+		ttlMs,
+	).Int64Slice()
+	if err != nil {
+		return false, 0, err
+	}
+	return result[0] == 1, result[1], nil
+}
+
+// FixedWindowIncrementServerTime is like FixedWindowIncrement but locates the
+// window of length window inside the script, from the Redis server time, and
+// increments the window key that WindowKey derives from key. While change is
+// in progress, the window is one of length change.Previous. It also returns
+// the server time the window was located at. Windows that are not a whole
+// number of microseconds fail with ErrServerTimeWindow.
+func (r *RedisMemory) FixedWindowIncrementServerTime(
+	ctx context.Context,
+	key string,
+	increment int,
+	limit int,
+	window time.Duration,
+	change WindowChange,
+	ttlMs int64,
+) (bool, int64, time.Time, error) {
+	windowUs, unitUs, err := serverTimeWindow(window)
+	if err != nil {
+		return false, 0, time.Time{}, err
+	}
+	previousUs, previousUnitUs, sinceUs, err := change.args()
+	if err != nil {
+		return false, 0, time.Time{}, err
+	}
+	result, err := fixedWindowServerTimeScript.Run(
+		ctx,
+		r.client,
+		[]string{key},
+		increment,
+		limit,
+		ttlMs,
+		windowUs,
+		unitUs,
+		previousUs,
+		previousUnitUs,
+		sinceUs,
+	).Int64Slice()
+	if err != nil {
+		return false, 0, time.Time{}, err
+	}
+	return result[0] == 1, result[1], time.UnixMicro(result[2]), nil
+}
+
+// PeriodIncrementServerTime is like FixedWindowIncrement for the period
+// [start, end) that key counts, provided the Redis server time falls inside
+// it. Otherwise nothing is checked or incremented and it returns false and a
+// count of 0. Either way it also returns the server time, so that callers
+// can locate the right period from it and try again.
+func (r *RedisMemory) PeriodIncrementServerTime(
+	ctx context.Context,
+	key string,
+	increment int,
+	limit int,
+	start time.Time,
+	end time.Time,
+	ttlMs int64,
+) (bool, int64, time.Time, error) {
+	result, err := periodServerTimeScript.Run(
+		ctx,
+		r.client,
+		[]string{key},
+		increment,
+		limit,
+		ttlMs,
+		start.UnixMicro(),
+		end.UnixMicro(),
+	).Int64Slice()
+	if err != nil {
+		return false, 0, time.Time{}, err
+	}
+	return result[0] == 1, result[1], time.UnixMicro(result[2]), nil
+}
+
+// TokenBucketAllow performs an atomic token bucket check and update using a Lua script.
+// It returns whether the tokens were consumed and the tokens left in the bucket.
+// A negative tokens value gives tokens back, never exceeding capacity.
+// refillRate is in tokens per second and nowMs is a Unix timestamp in ms.
+func (r *RedisMemory) TokenBucketAllow(
+	ctx context.Context,
+	key string,
+	tokens int,
+	capacity int,
+	refillRate float64,
+	nowMs int64,
+	ttlMs int64,
+) (bool, float64, error) {
+	return r.runTokenBucket(ctx, key, tokens, 0, capacity, refillRate, nowMs, ttlMs, false)
+}
+
+// TokenBucketAllowAbove is like TokenBucketAllow but consumes the tokens only
+// if at least floor tokens are left in the bucket afterwards, keeping them
+// for other callers.
+func (r *RedisMemory) TokenBucketAllowAbove(
+	ctx context.Context,
+	key string,
+	tokens int,
+	floor float64,
+	capacity int,
+	refillRate float64,
+	nowMs int64,
+	ttlMs int64,
+) (bool, float64, error) {
+	return r.runTokenBucket(ctx, key, tokens, floor, capacity, refillRate, nowMs, ttlMs, false)
+}
+
+// TokenBucketReserve atomically consumes tokens even if the bucket does not hold
+// them, letting the balance go negative. It returns the tokens left in the bucket.
+func (r *RedisMemory) TokenBucketReserve(
+	ctx context.Context,
+	key string,
+	tokens int,
+	capacity int,
+	refillRate float64,
+	nowMs int64,
+	ttlMs int64,
+) (bool, float64, error) {
+	return r.runTokenBucket(ctx, key, tokens, 0, capacity, refillRate, nowMs, ttlMs, true)
+}
+
+func (r *RedisMemory) runTokenBucket(
+	ctx context.Context,
+	key string,
+	tokens int,
+	floor float64,
+	capacity int,
+	refillRate float64,
+	nowMs int64,
+	ttlMs int64,
+	force bool,
+) (bool, float64, error) {
+	if r.serverTime {
+		nowMs = 0
+	}
+	result, err := tokenBucketScript.Run(
+		ctx,
+		r.client,
+		[]string{key},
+		tokens,
+		capacity,
+		refillRate,
+		nowMs,
+		ttlMs,
+		force,
+		floor,
+	).Slice()
+	if err != nil {
+		return false, 0, err
+	}
+	return parseBucketResult(result)
+}
+
+// SlidingWindowLogAllow performs an atomic sliding window log check and insert using a Lua script.
+// Each admitted request is stored as a sorted set member scored by its timestamp.
+// It returns whether the requests were admitted, the number of requests in the
+// window, the time (unix ms) at which enough entries expire for the requests to
+// fit, the time (unix ms) at which the whole log expires, and the time (unix ms)
+// the check was made at: nowMs, or the Redis server time if the store uses it.
+func (r *RedisMemory) SlidingWindowLogAllow(
+	ctx context.Context,
+	key string,
+	n int,
+	limit int,
+	nowMs int64,
+	windowMs int64,
+	id string,
+) (bool, int64, int64, int64, int64, error) {
+	if r.serverTime {
+		nowMs = 0
+	}
+	result, err := slidingWindowLogScript.Run(
+		ctx,
+		r.client,
+		[]string{key},
+		n,
+		limit,
+		nowMs,
+		windowMs,
+		id,
+	).Int64Slice()
+	if err != nil {
+		return false, 0, 0, 0, 0, err
+	}
+	return result[0] == 1, result[1], result[2], result[3], result[4], nil
+}
+
+// SlidingWindowLogRemove removes the n entries that a SlidingWindowLogAllow
+// call with the same id added to the log.
+func (r *RedisMemory) SlidingWindowLogRemove(ctx context.Context, key string, n int, id string) error {
+	members := make([]interface{}, n)
+	for i := range members {
+		members[i] = id + ":" + strconv.Itoa(i+1)
+	}
+	return r.client.ZRem(ctx, key, members...).Err()
+}
+
+// SlidingWindowLogRefund removes the n newest entries from the log, whichever
+// calls added them. Use SlidingWindowLogRemove to remove the entries of a
+// given call.
+func (r *RedisMemory) SlidingWindowLogRefund(ctx context.Context, key string, n int) error {
+	return r.client.ZPopMax(ctx, key, int64(n)).Err()
+}
+
+// RefundCounters atomically takes up to amount back out of the counters at
+// keys, in order, never taking a counter below zero. It returns how much it
+// took back in total.
+func (r *RedisMemory) RefundCounters(ctx context.Context, keys []string, amount int) (int64, error) {
+	return refundCountersScript.Run(ctx, r.client, keys, amount).Int64()
+}
+
+// LeakyBucketAllow performs an atomic leaky bucket check and update using a Lua script.
+// It returns whether the requests were added and the resulting bucket level.
+func (r *RedisMemory) LeakyBucketAllow(
+	ctx context.Context,
+	key string,
+	n int,
+	capacity int,
+	leakRate float64,
+	nowMs int64,
+	ttlMs int64,
+) (bool, float64, error) {
+	if r.serverTime {
+		nowMs = 0
+	}
+	result, err := leakyBucketScript.Run(
+		ctx,
+		r.client,
+		[]string{key},
+		n,
+		capacity,
+		leakRate,
+		nowMs,
+		ttlMs,
+	).Slice()
+	if err != nil {
+		return false, 0, err
+	}
+	return parseBucketResult(result)
+}
+
+// GCRAAllow performs an atomic generic cell rate algorithm check using a Lua script.
+// Only the theoretical arrival time (unix µs) is stored under the key. It returns
+// whether the requests were admitted, the theoretical arrival time after the check,
+// and the time (unix µs) the check was made at: nowMicros, or the Redis server
+// time if the store uses it.
+func (r *RedisMemory) GCRAAllow(
+	ctx context.Context,
+	key string,
+	n int,
+	emissionIntervalMicros int64,
+	toleranceMicros int64,
+	nowMicros int64,
+) (bool, int64, int64, error) {
+	if r.serverTime {
+		nowMicros = 0
+	}
+	result, err := gcraScript.Run(
+		ctx,
+		r.client,
+		[]string{key},
+		n,
+		emissionIntervalMicros,
+		toleranceMicros,
+		nowMicros,
+	).Int64Slice()
+	if err != nil {
+		return false, 0, 0, err
+	}
+	return result[0] == 1, result[1], result[2], nil
+}
+
+// ConcurrencyAcquire atomically adds a lease to the sorted set at key if fewer
+// than limit unexpired leases are held. Each lease is scored by the time (unix ms)
+// at which it expires, so leases of a crashed holder free their slot on their own.
+// Leases are timed by the Redis server clock, so that every client agrees on
+// when they expire.
+// It returns whether the lease was added and the number of leases held afterwards.
+func (r *RedisMemory) ConcurrencyAcquire(
+	ctx context.Context,
+	key string,
+	id string,
+	limit int,
+	ttlMs int64,
+) (bool, int64, error) {
+	result, err := concurrencyAcquireScript.Run(
+		ctx,
+		r.client,
+		[]string{key},
+		id,
+		limit,
+		ttlMs,
+	).Int64Slice()
+	if err != nil {
+		return false, 0, err
+	}
+	return result[0] == 1, result[1], nil
+}
+
+// ConcurrencyRenew moves the expiry of the lease id at key to ttlMs from now,
+// by the Redis server clock. It reports false if the lease has already expired
+// or been released.
+func (r *RedisMemory) ConcurrencyRenew(ctx context.Context, key string, id string, ttlMs int64) (bool, error) {
+	renewed, err := concurrencyRenewScript.Run(ctx, r.client, []string{key}, id, ttlMs).Int64()
+	if err != nil {
+		return false, err
+	}
+	return renewed == 1, nil
+}
+
+// ConcurrencyRelease removes the lease id from the sorted set at key.
+func (r *RedisMemory) ConcurrencyRelease(ctx context.Context, key string, id string) error {
+	return r.client.ZRem(ctx, key, id).Err()
+}
+
+// ConcurrencyCount returns the number of leases at key that have not expired
+// by the Redis server clock.
+func (r *RedisMemory) ConcurrencyCount(ctx context.Context, key string) (int64, error) {
+	return concurrencyCountScript.Run(ctx, r.client, []string{key}).Int64()
+}
 
-) (bool, error) {
-	script := redis.NewScript(`
+// parseBucketResult parses the {allowed, "float"} reply shared by the bucket scripts.
+// Lua numbers are truncated to integers in replies, so the float is sent as a string.
+func parseBucketResult(result []interface{}) (bool, float64, error) {
+	if len(result) != 2 {
+		return false, 0, fmt.Errorf("unexpected bucket result: %v", result)
+	}
+	allowed, _ := result[0].(int64)
+	raw, _ := result[1].(string)
+	tokens, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return false, 0, err
+	}
+	return allowed == 1, tokens, nil
+}
+
+var slidingWindowScript = redis.NewScript(`
+-- Sliding Window Rate Limiter
 -- KEYS[1]: current window key
 -- KEYS[2]: previous window key
 -- ARGV[1]: limit
 -- ARGV[2]: weight
--- ARGV[3]: TTL in seconds
+-- ARGV[3]: TTL in ms
 -- ARGV[4]: increment
+-- ARGV[5]: 1 to increment even when over the limit (reservation)
+-- Returns {allowed, current count, previous count}
 
 local current_key = KEYS[1]
 local previous_key = KEYS[2]
@@ -85,47 +879,327 @@ local limit = tonumber(ARGV[1])
 local weight = tonumber(ARGV[2])
 local ttl = tonumber(ARGV[3])
 local increment = tonumber(ARGV[4])
+local force = tonumber(ARGV[5]) == 1
+
+local current = tonumber(redis.call('GET', current_key) or '0')
+local previous = tonumber(redis.call('GET', previous_key) or '0')
+
+local weighted_count = math.ceil(previous * weight + current)
+if not force and weighted_count + increment > limit then
+    return {0, current, previous}
+end
+if increment == 0 then
+    return {1, current, previous}
+end
+
+current = redis.call('INCRBY', current_key, increment)
+redis.call('PEXPIRE', current_key, ttl)
+return {1, current, previous}
+`)
+
+// serverTimeLua defines the functions scripts use to read the server time
+// and to derive window keys from it the way WindowKey does.
+const serverTimeLua = `
+local function server_now_us()
+    local time = redis.call('TIME')
+    return tonumber(time[1]) * 1000000 + tonumber(time[2])
+end
+
+-- unit_us is the unit of the window start in the key in µs, or 0 for ns.
+local function window_key(key, start_us, unit_us)
+    if unit_us == 0 then
+        return key .. ':' .. string.format('%.0f', start_us) .. '000'
+    end
+    return key .. ':' .. string.format('%.0f', start_us / unit_us)
+end
+`
+
+var slidingWindowServerTimeScript = redis.NewScript(serverTimeLua + `
+-- Sliding Window Rate Limiter on server time
+-- KEYS[1]: key the window keys are derived from
+-- ARGV[1]: limit
+-- ARGV[2]: TTL in ms
+-- ARGV[3]: increment
+-- ARGV[4]: 1 to increment even when over the limit (reservation)
+-- ARGV[5]: window length in µs
+-- ARGV[6]: unit of the window start in window keys in µs, or 0 for ns
+-- ARGV[7]: window length in µs before a change of length, or 0 for none
+-- ARGV[8]: unit of the window start in window keys before the change
+-- ARGV[9]: time the change takes effect (unix µs)
+-- Returns {allowed, current count, previous count, server time (unix µs)}
+
+local limit = tonumber(ARGV[1])
+local ttl = tonumber(ARGV[2])
+local increment = tonumber(ARGV[3])
+local force = tonumber(ARGV[4]) == 1
+local window = tonumber(ARGV[5])
+local unit = tonumber(ARGV[6])
+local old_window = tonumber(ARGV[7])
+local old_unit = tonumber(ARGV[8])
+local since = tonumber(ARGV[9])
+
+local now = server_now_us()
+if old_window > 0 and now < since then
+    window, unit, old_window = old_window, old_unit, 0
+end
+local start = now - now % window
+local current_key = window_key(KEYS[1], start, unit)
+local previous_key = window_key(KEYS[1], start - window, unit)
+if old_window > 0 and start <= since then
+    -- The first window after the change follows the last of the old length.
+    previous_key = window_key(KEYS[1], since - old_window, old_unit)
+end
+local weight = math.min(math.max(1 - (now - start) / window, 0), 1)
 
 local current = tonumber(redis.call('GET', current_key) or '0')
 local previous = tonumber(redis.call('GET', previous_key) or '0')
 
-local weighted_count = math.floor(previous * weight) + current
-if weighted_count + increment > limit then
+local weighted_count = math.ceil(previous * weight + current)
+if not force and weighted_count + increment > limit then
+    return {0, current, previous, now}
+end
+if increment == 0 then
+    return {1, current, previous, now}
+end
+
+current = redis.call('INCRBY', current_key, increment)
+redis.call('PEXPIRE', current_key, ttl)
+return {1, current, previous, now}
+`)
+
+var slidingWindowPolicyScript = redis.NewScript(`
+-- Sliding Window Policy: several sliding windows that pass or fail together
+-- KEYS[2i-1]: current window key of window i
+-- KEYS[2i]: previous window key of window i
+-- ARGV[1]: increment
+-- ARGV[3i-1]: limit of window i
+-- ARGV[3i]: weight of window i
+-- ARGV[3i+1]: TTL in ms of window i
+-- Returns {denied window (1-based, 0 if allowed), current 1, previous 1, current 2, ...}
+
+local increment = tonumber(ARGV[1])
+local windows = #KEYS / 2
+local result = {0}
+
+for i = 1, windows do
+    local limit = tonumber(ARGV[3 * i - 1])
+    local weight = tonumber(ARGV[3 * i])
+    local current = tonumber(redis.call('GET', KEYS[2 * i - 1]) or '0')
+    local previous = tonumber(redis.call('GET', KEYS[2 * i]) or '0')
+    result[2 * i] = current
+    result[2 * i + 1] = previous
+
+    if result[1] == 0 and math.ceil(previous * weight + current) + increment > limit then
+        result[1] = i
+    end
+end
+
+if result[1] ~= 0 or increment == 0 then
+    return result
+end
+
+for i = 1, windows do
+    result[2 * i] = redis.call('INCRBY', KEYS[2 * i - 1], increment)
+    redis.call('PEXPIRE', KEYS[2 * i - 1], tonumber(ARGV[3 * i + 1]))
+end
+return result
+`)
+
+var slidingWindowPolicyServerTimeScript = redis.NewScript(serverTimeLua + `
+-- Sliding Window Policy on server time
+-- KEYS[i]: key the window keys of window i are derived from
+-- ARGV[1]: increment
+-- ARGV[4i-2]: limit of window i
+-- ARGV[4i-1]: length of window i in µs
+-- ARGV[4i]: unit of the window start in the window keys of window i in µs, or 0 for ns
+-- ARGV[4i+1]: TTL in ms of window i
+-- Returns {denied window (1-based, 0 if allowed), current 1, previous 1, current 2, ..., server time (unix µs)}
+
+local increment = tonumber(ARGV[1])
+local now = server_now_us()
+local current_keys = {}
+local result = {0}
+
+for i = 1, #KEYS do
+    local limit = tonumber(ARGV[4 * i - 2])
+    local window = tonumber(ARGV[4 * i - 1])
+    local unit = tonumber(ARGV[4 * i])
+    local start = now - now % window
+    local weight = math.min(math.max(1 - (now - start) / window, 0), 1)
+    current_keys[i] = window_key(KEYS[i], start, unit)
+    local current = tonumber(redis.call('GET', current_keys[i]) or '0')
+    local previous = tonumber(redis.call('GET', window_key(KEYS[i], start - window, unit)) or '0')
+    result[2 * i] = current
+    result[2 * i + 1] = previous
+
+    if result[1] == 0 and math.ceil(previous * weight + current) + increment > limit then
+        result[1] = i
+    end
+end
+
+if result[1] == 0 and increment ~= 0 then
+    for i = 1, #KEYS do
+        result[2 * i] = redis.call('INCRBY', current_keys[i], increment)
+        redis.call('PEXPIRE', current_keys[i], tonumber(ARGV[4 * i + 1]))
+    end
+end
+table.insert(result, now)
+return result
+`)
+
+var compositeScript = redis.NewScript(serverTimeLua + `
+-- Composite: token buckets, fixed windows and sliding windows that pass or fail together
+-- KEYS: the keys of every step, in order
+-- ARGV[1]: increment
+-- Then six values per step:
+--   kind ("tb", "fw" or "sw"), number of keys, limit or capacity,
+--   refill rate (tb) or previous window weight (sw), current timestamp (tb, unix ms, or 0 to use the server time), TTL in ms
+-- Returns {denied step (1-based, 0 if allowed), then per step: allowed, value, value}
+--   tb: tokens left as a string, 0
+--   fw: current count, 0
+--   sw: current count, previous count
+
+local increment = tonumber(ARGV[1])
+local steps = {}
+local denied = 0
+local key_index = 1
+local arg_index = 2
+
+while arg_index <= #ARGV do
+    local step = {
+        kind = ARGV[arg_index],
+        keys = {},
+        limit = tonumber(ARGV[arg_index + 2]),
+        rate_or_weight = tonumber(ARGV[arg_index + 3]),
+        now = tonumber(ARGV[arg_index + 4]),
+        ttl = tonumber(ARGV[arg_index + 5]),
+        allowed = 0,
+    }
+    for i = 1, tonumber(ARGV[arg_index + 1]) do
+        step.keys[i] = KEYS[key_index]
+        key_index = key_index + 1
+    end
+    arg_index = arg_index + 6
+
+    if step.kind == 'tb' then
+        if step.now == 0 then
+            step.now = math.floor(server_now_us() / 1000)
+        end
+        -- Format: "tokens:last_refill_time"
+        local tokens = step.limit
+        local bucket = redis.call('GET', step.keys[1])
+        if bucket then
+            local colon_pos = string.find(bucket, ":")
+            tokens = tonumber(string.sub(bucket, 1, colon_pos - 1))
+            local last_refill = tonumber(string.sub(bucket, colon_pos + 1))
+            local elapsed = math.max(0, step.now - last_refill) / 1000
+            tokens = math.min(tokens + elapsed * step.rate_or_weight, step.limit)
+        end
+        step.tokens = tokens
+        if tokens >= increment then
+            step.allowed = 1
+        end
+    elseif step.kind == 'fw' then
+        step.current = tonumber(redis.call('GET', step.keys[1]) or '0')
+        step.previous = 0
+        if step.current + increment <= step.limit then
+            step.allowed = 1
+        end
+    else
+        step.current = tonumber(redis.call('GET', step.keys[1]) or '0')
+        step.previous = tonumber(redis.call('GET', step.keys[2]) or '0')
+        if math.ceil(step.previous * step.rate_or_weight + step.current) + increment <= step.limit then
+            step.allowed = 1
+        end
+    end
+
+    if step.allowed == 0 and denied == 0 then
+        denied = #steps + 1
+    end
+    table.insert(steps, step)
+end
+
+if denied == 0 and increment ~= 0 then
+    for _, step in ipairs(steps) do
+        if step.kind == 'tb' then
+            step.tokens = step.tokens - increment
+            redis.call('PSETEX', step.keys[1], step.ttl, string.format("%.6f:%d", step.tokens, step.now))
+        else
+            step.current = redis.call('INCRBY', step.keys[1], increment)
+            redis.call('PEXPIRE', step.keys[1], step.ttl)
+        end
+    end
+end
+
+local result = {denied}
+for _, step in ipairs(steps) do
+    table.insert(result, step.allowed)
+    if step.kind == 'tb' then
+        table.insert(result, string.format("%.6f", step.tokens))
+        table.insert(result, '0')
+    else
+        table.insert(result, tostring(step.current))
+        table.insert(result, tostring(step.previous))
+    end
+end
+return result
+`)
+
+var refundCountersScript = redis.NewScript(`
+-- Refund counters
+-- KEYS: counter keys, drained in order
+-- ARGV[1]: amount to take back
+-- Returns the amount taken back
+
+local left = tonumber(ARGV[1])
+for _, key in ipairs(KEYS) do
+    if left <= 0 then
+        break
+    end
+    local current = tonumber(redis.call('GET', key) or '0')
+    local taken = math.min(current, left)
+    if taken > 0 then
+        redis.call('DECRBY', key, taken)
+        left = left - taken
+    end
+end
+return tonumber(ARGV[1]) - left
+`)
+
+var compareAndSwapScript = redis.NewScript(`
+-- Compare and swap
+-- KEYS[1]: key
+-- ARGV[1]: 1 if the key is expected to exist, 0 if it is expected to be missing
+-- ARGV[2]: expected value
+-- ARGV[3]: new value
+-- ARGV[4]: TTL in ms, or 0 for none
+-- Returns 1 if the new value was stored, 0 otherwise
+
+local current = redis.call('GET', KEYS[1])
+if ARGV[1] == '1' then
+    if current ~= ARGV[2] then
+        return 0
+    end
+elseif current then
     return 0
 end
 
-redis.call('INCRBY', current_key, increment)
-redis.call('EXPIRE', current_key, ttl)
+local ttl = tonumber(ARGV[4])
+if ttl > 0 then
+    redis.call('SET', KEYS[1], ARGV[3], 'PX', ttl)
+else
+    redis.call('SET', KEYS[1], ARGV[3])
+end
 return 1
-
 `)
-	result, err := script.Run(
-		r.ctx,
-		r.client,
-		[]string{currentKey, previousKey},
-		limit,
-		weight,
-		int(ttl.Seconds()),
-		1,
-	).Int()
-	if err != nil {
-		return false, err
-	}
-	return result == 1, err
-}
-// FixedWindowIncrement performs an atomic fixed window check and increment using a Lua script.
-func (r *RedisMemory) FixedWindowIncrement(
-	key string,
-	increment int,
-	limit int,
-	ttl int,
-) (bool, error) {
-	script := redis.NewScript(`
+
+var fixedWindowScript = redis.NewScript(`
 -- Fixed Window Rate Limiter
 -- KEYS[1]: window key
 -- ARGV[1]: increment amount
 -- ARGV[2]: rate limit
--- ARGV[3]: TTL in seconds
+-- ARGV[3]: TTL in ms
+-- Returns {allowed, current count}
 
 local key = KEYS[1]
 local increment = tonumber(ARGV[1])
@@ -137,48 +1211,231 @@ local current = tonumber(redis.call('GET', key) or '0')
 
 -- Check if incrementing would exceed limit
 if current + increment > limit then
-    return 0  -- Denied
+    return {0, current}  -- Denied
+end
+if increment == 0 then
+    return {1, current}  -- Peek only
 end
 
 -- Increment and set expiry
-redis.call('INCRBY', key, increment)
-redis.call('EXPIRE', key, ttl)
+current = redis.call('INCRBY', key, increment)
+redis.call('PEXPIRE', key, ttl)
 
-return 1  -- Allowed
+return {1, current}  -- Allowed
 `)
 
-	result, err := script.Run(
-		r.ctx,
-		r.client,
-		[]string{key},
-		increment,
-		limit,
-		ttl,
-	).Int()
+var fixedWindowServerTimeScript = redis.NewScript(serverTimeLua + `
+-- Fixed Window Rate Limiter on server time
+-- KEYS[1]: key the window key is derived from
+-- ARGV[1]: increment amount
+-- ARGV[2]: rate limit
+-- ARGV[3]: TTL in ms
+-- ARGV[4]: window length in µs
+-- ARGV[5]: unit of the window start in the window key in µs, or 0 for ns
+-- ARGV[6]: window length in µs before a change of length, or 0 for none
+-- ARGV[7]: unit of the window start in the window key before the change
+-- ARGV[8]: time the change takes effect (unix µs)
+-- Returns {allowed, current count, server time (unix µs)}
 
-	if err != nil {
-		return false, err
-	}
+local increment = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+local ttl = tonumber(ARGV[3])
+local window = tonumber(ARGV[4])
+local unit = tonumber(ARGV[5])
 
-	return result == 1, nil
-}
-// TokenBucketAllow performs an atomic token bucket check and update using a Lua script.
-func (r *RedisMemory) TokenBucketAllow(
-	key string,
-	tokens int,
-	capacity int,
-	refillRate float64,
-	nowUnix int64,
-	ttl int,
-) (bool, error) {
-	script := redis.NewScript(`
+local now = server_now_us()
+if tonumber(ARGV[6]) > 0 and now < tonumber(ARGV[8]) then
+    window, unit = tonumber(ARGV[6]), tonumber(ARGV[7])
+end
+local key = window_key(KEYS[1], now - now % window, unit)
+
+local current = tonumber(redis.call('GET', key) or '0')
+if current + increment > limit then
+    return {0, current, now}
+end
+if increment == 0 then
+    return {1, current, now}
+end
+
+current = redis.call('INCRBY', key, increment)
+redis.call('PEXPIRE', key, ttl)
+return {1, current, now}
+`)
+
+var periodServerTimeScript = redis.NewScript(serverTimeLua + `
+-- Fixed period counter on server time
+-- KEYS[1]: counter key of the period
+-- ARGV[1]: increment amount
+-- ARGV[2]: rate limit
+-- ARGV[3]: TTL in ms
+-- ARGV[4]: period start (unix µs)
+-- ARGV[5]: period end (unix µs)
+-- Returns {allowed, current count, server time (unix µs)}, or
+-- {0, 0, server time} if the server time is outside the period
+
+local increment = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+local ttl = tonumber(ARGV[3])
+
+local now = server_now_us()
+if now < tonumber(ARGV[4]) or now >= tonumber(ARGV[5]) then
+    return {0, 0, now}
+end
+
+local current = tonumber(redis.call('GET', KEYS[1]) or '0')
+if current + increment > limit then
+    return {0, current, now}
+end
+if increment == 0 then
+    return {1, current, now}
+end
+
+current = redis.call('INCRBY', KEYS[1], increment)
+redis.call('PEXPIRE', KEYS[1], ttl)
+return {1, current, now}
+`)
+
+var slidingWindowLogScript = redis.NewScript(serverTimeLua + `
+-- Sliding Window Log Rate Limiter
+-- KEYS[1]: log key (sorted set scored by timestamp)
+-- ARGV[1]: requests to add
+-- ARGV[2]: rate limit
+-- ARGV[3]: current timestamp (unix ms), or 0 to use the server time
+-- ARGV[4]: window in ms
+-- ARGV[5]: unique id used to build member names
+-- Returns {allowed, count, free_at_ms, reset_at_ms, now_ms}
+
+local key = KEYS[1]
+local n = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local window = tonumber(ARGV[4])
+local id = ARGV[5]
+if now == 0 then
+    now = math.floor(server_now_us() / 1000)
+end
+
+-- Drop entries that slid out of the window
+redis.call('ZREMRANGEBYSCORE', key, '-inf', now - window)
+local count = redis.call('ZCARD', key)
+
+local allowed = 0
+local free_at = 0
+if count + n <= limit then
+    allowed = 1
+    if n > 0 then
+        for i = 1, n do
+            redis.call('ZADD', key, now, id .. ':' .. i)
+        end
+        redis.call('PEXPIRE', key, window)
+        count = count + n
+    end
+elseif n <= limit then
+    -- The request fits once the oldest (count + n - limit) entries expire
+    local oldest = redis.call('ZRANGE', key, count + n - limit - 1, count + n - limit - 1, 'WITHSCORES')
+    free_at = tonumber(oldest[2]) + window
+end
+
+local reset_at = 0
+local newest = redis.call('ZRANGE', key, -1, -1, 'WITHSCORES')
+if newest[2] then
+    reset_at = tonumber(newest[2]) + window
+end
+
+return {allowed, count, free_at, reset_at, now}
+`)
+
+var leakyBucketScript = redis.NewScript(serverTimeLua + `
+-- Leaky Bucket Rate Limiter
+-- KEYS[1]: bucket key
+-- ARGV[1]: requests to add
+-- ARGV[2]: bucket capacity
+-- ARGV[3]: leak rate (requests per second)
+-- ARGV[4]: current timestamp (unix ms), or 0 to use the server time
+-- ARGV[5]: TTL in ms
+-- Returns {allowed, level as a string}
+
+local key = KEYS[1]
+local n = tonumber(ARGV[1])
+local capacity = tonumber(ARGV[2])
+local leak_rate = tonumber(ARGV[3])
+local now = tonumber(ARGV[4])
+local ttl = tonumber(ARGV[5])
+if now == 0 then
+    now = math.floor(server_now_us() / 1000)
+end
+
+-- Format: "level:last_leak_ms"
+local level = 0
+local bucket = redis.call('GET', key)
+if bucket then
+    local colon_pos = string.find(bucket, ":")
+    level = tonumber(string.sub(bucket, 1, colon_pos - 1))
+    local last_leak = tonumber(string.sub(bucket, colon_pos + 1))
+    local elapsed = math.max(0, now - last_leak) / 1000
+    level = math.max(0, level - elapsed * leak_rate)
+end
+
+local allowed = 0
+if level + n <= capacity then
+    -- A negative n takes requests back out of the bucket
+    level = math.max(0, level + n)
+    allowed = 1
+end
+
+if n ~= 0 then
+    redis.call('PSETEX', key, ttl, string.format("%.6f:%d", level, now))
+end
+
+return {allowed, string.format("%.6f", level)}
+`)
+
+var gcraScript = redis.NewScript(serverTimeLua + `
+-- Generic Cell Rate Algorithm
+-- KEYS[1]: theoretical arrival time key
+-- ARGV[1]: requests to admit
+-- ARGV[2]: emission interval in µs
+-- ARGV[3]: burst tolerance in µs
+-- ARGV[4]: current timestamp (unix µs), or 0 to use the server time
+-- Returns {allowed, theoretical arrival time in µs, current timestamp in µs}
+
+local key = KEYS[1]
+local n = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local tolerance = tonumber(ARGV[3])
+local now = tonumber(ARGV[4])
+if now == 0 then
+    now = server_now_us()
+end
+
+local tat = tonumber(redis.call('GET', key) or '0')
+if tat < now then
+    tat = now
+end
+
+local new_tat = tat + n * interval
+if new_tat - tolerance > now then
+    return {0, tat, now}  -- Denied
+end
+if n == 0 then
+    return {1, tat, now}  -- Peek only
+end
+
+redis.call('SET', key, string.format("%.0f", new_tat), 'PX', math.max(1, math.ceil((new_tat - now) / 1000)))
+return {1, new_tat, now}
+`)
+
+var tokenBucketScript = redis.NewScript(serverTimeLua + `
 -- Token Bucket Rate Limiter
 -- KEYS[1]: bucket key
 -- ARGV[1]: tokens to consume
 -- ARGV[2]: bucket capacity
 -- ARGV[3]: refill rate (tokens per second)
--- ARGV[4]: current timestamp (unix)
--- ARGV[5]: TTL in seconds
+-- ARGV[4]: current timestamp (unix ms), or 0 to use the server time
+-- ARGV[5]: TTL in ms
+-- ARGV[6]: 1 to consume even when the bucket runs short (reservation)
+-- ARGV[7]: tokens that must be left after consuming (optional, default 0)
+-- Returns {allowed, tokens left as a string}
 
 local key = KEYS[1]
 local tokens_to_consume = tonumber(ARGV[1])
@@ -186,6 +1443,11 @@ local capacity = tonumber(ARGV[2])
 local refill_rate = tonumber(ARGV[3])
 local now = tonumber(ARGV[4])
 local ttl = tonumber(ARGV[5])
+local force = tonumber(ARGV[6]) == 1
+local floor = tonumber(ARGV[7] or '0')
+if now == 0 then
+    now = math.floor(server_now_us() / 1000)
+end
 
 -- Get current bucket state
 -- Format: "tokens:last_refill_time"
@@ -206,45 +1468,87 @@ else
 end
 
 -- Calculate tokens to add based on time elapsed
-local elapsed = now - last_refill
+local elapsed = math.max(0, now - last_refill) / 1000
 local tokens_to_add = elapsed * refill_rate
 
 -- Refill tokens (capped at capacity)
 current_tokens = math.min(current_tokens + tokens_to_add, capacity)
 
--- Check if we have enough tokens
-if current_tokens >= tokens_to_consume then
-    -- Consume tokens
-    current_tokens = current_tokens - tokens_to_consume
-    
-    -- Save new state
-    local new_bucket = string.format("%.6f:%d", current_tokens, now)
-    redis.call('SETEX', key, ttl, new_bucket)
-    
-    return 1  -- Allowed
-else
-    -- Not enough tokens - update last refill time anyway
+local allowed = 0
+if force or current_tokens - tokens_to_consume >= floor then
+    -- Consume tokens (a negative amount refunds them)
+    current_tokens = math.min(current_tokens - tokens_to_consume, capacity)
+    allowed = 1
+end
+
+-- Save new state; on denial this still records the refill.
+-- Consuming zero tokens is a peek and leaves the bucket untouched.
+if tokens_to_consume ~= 0 then
     local new_bucket = string.format("%.6f:%d", current_tokens, now)
-    redis.call('SETEX', key, ttl, new_bucket)
-    
-    return 0  -- Denied
+    redis.call('PSETEX', key, ttl, new_bucket)
 end
+
+return {allowed, string.format("%.6f", current_tokens)}
 `)
 
-	result, err := script.Run(
-		r.ctx,
-		r.client,
-		[]string{key},
-		tokens,
-		capacity,
-		refillRate,
-		nowUnix,
-		ttl,
-	).Int()
+var concurrencyAcquireScript = redis.NewScript(serverTimeLua + `
+-- Concurrency Limiter
+-- KEYS[1]: lease key (sorted set scored by lease expiry, unix ms)
+-- ARGV[1]: lease id
+-- ARGV[2]: maximum number of leases
+-- ARGV[3]: lease ttl in ms
+-- Returns {acquired, leases}
 
-	if err != nil {
-		return false, err
-	}
+local key = KEYS[1]
+local id = ARGV[1]
+local limit = tonumber(ARGV[2])
+local ttl = tonumber(ARGV[3])
+local now = math.floor(server_now_us() / 1000)
 
-	return result == 1, nil
-}
+-- Drop leases whose holder neither renewed nor released them
+redis.call('ZREMRANGEBYSCORE', key, '-inf', now)
+local count = redis.call('ZCARD', key)
+
+if count >= limit then
+    return {0, count}
+end
+
+redis.call('ZADD', key, now + ttl, id)
+-- The set lives as long as its longest lease
+local longest = redis.call('ZRANGE', key, -1, -1, 'WITHSCORES')
+redis.call('PEXPIRE', key, tonumber(longest[2]) - now)
+return {1, count + 1}
+`)
+
+var concurrencyRenewScript = redis.NewScript(serverTimeLua + `
+-- Concurrency Limiter lease renewal
+-- KEYS[1]: lease key (sorted set scored by lease expiry, unix ms)
+-- ARGV[1]: lease id
+-- ARGV[2]: lease ttl in ms
+-- Returns 1 if the lease was renewed, 0 if it is gone
+
+local key = KEYS[1]
+local id = ARGV[1]
+local ttl = tonumber(ARGV[2])
+local now = math.floor(server_now_us() / 1000)
+
+local expires = redis.call('ZSCORE', key, id)
+if not expires or tonumber(expires) <= now then
+    return 0
+end
+
+redis.call('ZADD', key, now + ttl, id)
+-- The set lives as long as its longest lease
+local longest = redis.call('ZRANGE', key, -1, -1, 'WITHSCORES')
+redis.call('PEXPIRE', key, tonumber(longest[2]) - now)
+return 1
+`)
+
+var concurrencyCountScript = redis.NewScript(serverTimeLua + `
+-- Concurrency Limiter lease count
+-- KEYS[1]: lease key (sorted set scored by lease expiry, unix ms)
+-- Returns the number of unexpired leases
+
+local now = math.floor(server_now_us() / 1000)
+return redis.call('ZCOUNT', KEYS[1], '(' .. string.format('%.0f', now), '+inf')
+`)
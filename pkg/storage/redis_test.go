@@ -73,3 +73,18 @@ func TestConcurrentAccessRedis(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, currVal, int64(10000))
 }
+
+func TestRedisStorage_Keys(t *testing.T) {
+	store := NewRedisStorage("127.0.0.1:6379")
+	ctx := context.Background()
+	store.client.FlushAll(ctx)
+
+	assert.NoError(t, store.Set("ban:alice", "1", time.Minute))
+	assert.NoError(t, store.Set("ban:bob", "1", time.Minute))
+	assert.NoError(t, store.Set("ban*", "1", time.Minute))
+	assert.NoError(t, store.Set("other", "1", time.Minute))
+
+	keys, err := store.Keys("ban:")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"ban:alice", "ban:bob"}, keys)
+}
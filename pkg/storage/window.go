@@ -0,0 +1,83 @@
+// Package storage provides interfaces and implementations
+// for rate limiter data storage.
+package storage
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+// ErrServerTimeWindow is returned by the scripts of a RedisMemory using
+// server time for windows that are not a whole number of microseconds, the
+// resolution of the Redis clock.
+var ErrServerTimeWindow = errors.New("storage: server time needs windows of whole microseconds")
+
+// WindowStart returns the start of the window of length window that contains
+// now. Windows are aligned to the Unix epoch.
+func WindowStart(now time.Time, window time.Duration) time.Time {
+	ns := now.UnixNano()
+	return time.Unix(0, ns-ns%int64(window))
+}
+
+// WindowKey returns the key of the window of length window that starts at
+// start: key followed by the start's Unix time in seconds, or in ms or ns for
+// windows that are not a whole number of seconds or ms. The scripts of a
+// RedisMemory using server time derive the same keys.
+func WindowKey(key string, start time.Time, window time.Duration) string {
+	switch windowUnit(window) {
+	case time.Second:
+		return key + ":" + strconv.FormatInt(start.Unix(), 10)
+	case time.Millisecond:
+		return key + ":" + strconv.FormatInt(start.UnixMilli(), 10)
+	default:
+		return key + ":" + strconv.FormatInt(start.UnixNano(), 10)
+	}
+}
+
+// windowUnit returns the unit WindowKey writes the start of windows of
+// length window in.
+func windowUnit(window time.Duration) time.Duration {
+	switch {
+	case window%time.Second == 0:
+		return time.Second
+	case window%time.Millisecond == 0:
+		return time.Millisecond
+	default:
+		return time.Nanosecond
+	}
+}
+
+// serverTimeWindow returns the length of window and the unit WindowKey writes
+// its start in, in µs as the server time scripts take them: the unit is 0
+// for ns.
+func serverTimeWindow(window time.Duration) (int64, int64, error) {
+	if window < time.Microsecond || window%time.Microsecond != 0 {
+		return 0, 0, ErrServerTimeWindow
+	}
+	return window.Microseconds(), windowUnit(window).Microseconds(), nil
+}
+
+// WindowChange describes a change of window length in progress, for the
+// scripts of a RedisMemory using server time: windows of length Previous are
+// used until Since, when the last of them ends, and windows of the new length
+// from then on. The first of those follows the last window of length
+// Previous. The zero WindowChange is no change.
+type WindowChange struct {
+	Previous time.Duration
+	Since    time.Time
+}
+
+// args returns the length of c.Previous, the unit WindowKey writes its start
+// in and c.Since, in µs as the server time scripts take them, or zeros for
+// no change.
+func (c WindowChange) args() (int64, int64, int64, error) {
+	if c.Previous == 0 {
+		return 0, 0, 0, nil
+	}
+	windowUs, unitUs, err := serverTimeWindow(c.Previous)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return windowUs, unitUs, c.Since.UnixMicro(), nil
+}
@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWindowKey(t *testing.T) {
+	now := time.Unix(1_700_000_042, 123_456_789)
+	tests := []struct {
+		window time.Duration
+		want   string
+	}{
+		{time.Minute, "user:1700000040"},
+		{10 * time.Second, "user:1700000040"},
+		{100 * time.Millisecond, "user:1700000042100"},
+		{1500 * time.Microsecond, "user:1700000042122500000"},
+	}
+	for _, tt := range tests {
+		start := WindowStart(now, tt.window)
+		assert.False(t, start.After(now), tt.window)
+		assert.True(t, start.Add(tt.window).After(now), tt.window)
+		assert.Equal(t, tt.want, WindowKey("user", start, tt.window), tt.window)
+	}
+}
+
+func TestServerTimeWindow(t *testing.T) {
+	window, unit, err := serverTimeWindow(1500 * time.Microsecond)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1500), window)
+	assert.Equal(t, int64(0), unit)
+
+	window, unit, err = serverTimeWindow(time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(60_000_000), window)
+	assert.Equal(t, int64(1_000_000), unit)
+
+	// The Redis clock cannot locate windows finer than a microsecond.
+	for _, w := range []time.Duration{0, 500, 1500} {
+		_, _, err = serverTimeWindow(w)
+		assert.ErrorIs(t, err, ErrServerTimeWindow, w)
+	}
+}
+
+func TestWindowChangeArgs(t *testing.T) {
+	window, unit, since, err := WindowChange{}.args()
+	assert.NoError(t, err)
+	assert.Equal(t, [3]int64{0, 0, 0}, [3]int64{window, unit, since})
+
+	window, unit, since, err = WindowChange{Previous: time.Minute, Since: time.UnixMilli(1_700_000_000_500)}.args()
+	assert.NoError(t, err)
+	assert.Equal(t, [3]int64{60_000_000, 1_000_000, 1_700_000_000_500_000}, [3]int64{window, unit, since})
+
+	_, _, _, err = WindowChange{Previous: 1500, Since: time.Unix(1_700_000_000, 0)}.args()
+	assert.ErrorIs(t, err, ErrServerTimeWindow)
+}